@@ -3,11 +3,18 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"main/utils/alacrepair"
+	"main/utils/dupes"
+	"main/utils/naming"
+	"main/utils/pathsafe"
+	"main/utils/previewcheck"
+	"main/utils/snapshot"
 	"net"
 	"net/http"
 	"net/url"
@@ -24,12 +31,31 @@ import (
 	"time"
 
 	"main/utils/ampapi"
+	"main/utils/artcache"
+	"main/utils/artwork"
+	"main/utils/artworkset"
+	"main/utils/audit"
+	"main/utils/cuesheet"
+	"main/utils/export"
+	"main/utils/flacmeta"
+	"main/utils/id3v2"
+	"main/utils/integrity"
+	"main/utils/library"
+	"main/utils/linkfile"
+	"main/utils/loudness"
 	"main/utils/lyrics"
+	"main/utils/mp4meta"
+	"main/utils/multiformat"
+	"main/utils/oggopus"
 	"main/utils/playlistdedupe"
+	"main/utils/quality"
+	"main/utils/reorganize"
+	"main/utils/retag"
 	"main/utils/runv2"
 	"main/utils/runv3"
 	"main/utils/structs"
 	"main/utils/task"
+	"main/utils/trackindex"
 
 	"github.com/AlecAivazis/survey/v2"
 	"github.com/fatih/color"
@@ -81,6 +107,7 @@ var knownMetadataTagIDsByContainer = map[string][]string{
 		"lyrics",
 		"cover",
 		"performer",
+		"loudness",
 	},
 	"flac": {
 		"title",
@@ -116,7 +143,6 @@ var knownMetadataTagIDsByContainer = map[string][]string{
 }
 
 var (
-	forbiddenNames                 = regexp.MustCompile(`[/\\<>:"|?*]`)
 	customMetadataTagKeyRe         = regexp.MustCompile(`^[A-Z0-9_:-]{1,64}$`)
 	sampleFmtBitDepthRe            = regexp.MustCompile(`^[su](\d+)`)
 	featuredTitleBracketSuffixRe   = regexp.MustCompile(`(?i)\s*[\(\[]\s*(?:feat(?:\.|uring)?|ft\.?)\s+([^\)\]]+?)\s*[\)\]]\s*$`)
@@ -124,7 +150,12 @@ var (
 	artistFeatSeparatorRe          = regexp.MustCompile(`(?i)\s+(?:feat(?:\.|uring)?|ft\.?)\s+`)
 	prefetchKeyURI                 = "skd://itunes.apple.com/P000000000/s1/e1"
 	dl_atmos                       bool
+	dl_ac3                         bool
+	quality_policy                 string
+	dl_formats                     string
+	from_queue                     string
 	dl_aac                         bool
+	dl_alac                        bool
 	dl_select                      bool
 	dl_song                        bool
 	dl_preview                     bool
@@ -134,9 +165,19 @@ var (
 	artist_select                  bool
 	debug_mode                     bool
 	select_tracks                  string
+	albumFolderOverride            string
+	urlArtistName                  string
+	urlArtistID                    string
+	nameTemplates                  = make(map[string]*naming.Template)
+	nameProfile                    pathsafe.Profile
 	abortRetries                   bool
 	alac_max                       *int
 	atmos_max                      *int
+	qualityPolicy                  *quality.Policy
+	downloadFormats                []multiformat.Format
+	activeFormat                   string
+	formatReport                   *multiformat.Report
+	ac3_max                        *int
 	mv_max                         *int
 	mv_audio_type                  *string
 	aac_type                       *string
@@ -147,9 +188,32 @@ var (
 	alacAtAvailable                bool
 	alacAtWarnOnce                 sync.Once
 	ffprobeWarnOnce                sync.Once
-	metaflacOnce                   sync.Once
-	metaflacPath                   string
-	metaflacWarnOnce               sync.Once
+	jpegtranOnce                   sync.Once
+	jpegtranPath                   string
+	coverWebpWarnOnce              sync.Once
+	coverProgressiveWarnOnce       sync.Once
+	coverMasterMu                  sync.Mutex
+	coverMasters                   = make(map[string][]byte)
+	coverMasterOrder               []string
+	coverMasterCalls               = make(map[string]*masterCall)
+	aacVariantRoots                []string
+	policyMastersMu                sync.Mutex
+	policyMasters                  = make(map[string]*m3u8.MasterPlaylist)
+	embedCoverMu                   sync.Mutex
+	embedCoverDir                  string
+	embedCoverPaths                = make(map[string]string)
+	artworkProfiles                []artworkset.Profile
+	artCache                       *artcache.Cache
+	linkMode                       = linkfile.Copy
+	trackIndexMu                   sync.Mutex
+	trackIndexes                   = make(map[string]*trackindex.Index)
+	loudnessMu                     sync.Mutex
+	checksumMu                     sync.Mutex
+	loudnessAlbums                 = make(map[string][]*loudnessTrack)
+	artistArtworkMu                sync.Mutex
+	artistArtworkCache             = make(map[string]*ampapi.ArtistRespData)
+	lyricsMu                       sync.Mutex
+	lyricsCache                    = make(map[string]*lyricsResult)
 	knownMetadataTagSetByContainer = map[string]map[string]bool{
 		"m4a":  buildKnownMetadataTagSet(knownMetadataTagIDsByContainer["m4a"]),
 		"flac": buildKnownMetadataTagSet(knownMetadataTagIDsByContainer["flac"]),
@@ -163,6 +227,7 @@ var (
 		"hires":    true,
 		"aac":      true,
 		"atmos":    true,
+		"ac3":      true,
 	}
 	metadataTagsEnabledM4a  = map[string]bool{}
 	metadataTagsEnabledFlac = map[string]bool{}
@@ -185,7 +250,53 @@ func loadConfig() error {
 	if strings.TrimSpace(Config.AlacRepairMode) == "" {
 		Config.AlacRepairMode = "all"
 	}
-	return nil
+	if Config.PreviewCheckThreshold <= 0 {
+		Config.PreviewCheckThreshold = previewcheck.DefaultThreshold
+	}
+	if Config.Ac3Max <= 0 {
+		Config.Ac3Max = 640
+	}
+	if strings.TrimSpace(Config.Ac3SaveFolder) == "" {
+		Config.Ac3SaveFolder = filepath.Join(filepath.Dir(Config.AtmosSaveFolder), "ac3")
+	}
+	artworkProfiles, err = artworkset.Resolve(Config.ArtworkProfiles)
+	if err != nil {
+		return err
+	}
+	linkMode, err = linkfile.ParseMode(Config.LinkMode)
+	if err != nil {
+		return err
+	}
+	nameProfile, err = pathsafe.Resolve(Config.FilenameProfile, Config.FilenameNormalization)
+	if err != nil {
+		return err
+	}
+	for _, variant := range aacVariants {
+		if root := aacVariantRoot(variant); root != "" {
+			aacVariantRoots = append(aacVariantRoots, root)
+		}
+	}
+	for variant := range Config.AacVariantFolders {
+		if !contains(aacVariants, variant) {
+			return fmt.Errorf("aac-variant-folders: unknown AAC type %q (use aac, aac-lc, aac-binaural or aac-downmix)", variant)
+		}
+	}
+	nameProfile = nameProfile.WithRoots(saveRoots()...)
+	Config.AlbumImage = strings.ToLower(strings.TrimSpace(Config.AlbumImage))
+	if Config.AlbumImage != "" && Config.AlbumImage != "flac" && Config.AlbumImage != "wav" {
+		return fmt.Errorf("album-image must be flac or wav, got %q", Config.AlbumImage)
+	}
+	if strings.TrimSpace(Config.CoverCacheFolder) != "" {
+		cacheMode := linkMode
+		if Config.CoverCacheHardlink {
+			cacheMode = linkfile.Hardlink
+		}
+		artCache, err = artcache.New(Config.CoverCacheFolder, cacheMode)
+		if err != nil {
+			return err
+		}
+	}
+	return initNameTemplates()
 }
 
 func normalizeMetadataContainer(container string) string {
@@ -348,6 +459,9 @@ func resolveActiveMetadataSourceFormat() string {
 	if dl_atmos {
 		return "atmos"
 	}
+	if dl_ac3 {
+		return "ac3"
+	}
 	if dl_aac {
 		return "aac"
 	}
@@ -706,17 +820,199 @@ func checkArtist(artistUrl string, token string, relationship string) ([]string,
 	return args, nil
 }
 
-func writeCover(sanAlbumFolder, name string, url string) (string, error) {
+const coverUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36"
+
+func resolveCoverFormat() string {
+	format := artwork.NormalizeFormat(Config.CoverFormat)
+	if format == "webp" {
+		if _, err := resolveFFmpegPath(); err != nil {
+			coverWebpWarnOnce.Do(func() {
+				fmt.Println("ffmpeg unavailable; saving covers as jpg instead of webp.")
+			})
+			return "jpg"
+		}
+	}
+	return format
+}
+
+func resolveJpegtranPath() string {
+	jpegtranOnce.Do(func() {
+		path, err := exec.LookPath("jpegtran")
+		if err != nil {
+			jpegtranPath = ""
+			return
+		}
+		jpegtranPath = path
+	})
+	return jpegtranPath
+}
+
+func coverRenderOptions(size, format string) artwork.Options {
+	w, h, err := artwork.ParseSize(size)
+	if err != nil {
+		w, h = 0, 0
+	}
+	opts := artwork.Options{
+		Width:       w,
+		Height:      h,
+		Format:      format,
+		JPEGQuality: Config.CoverJPEGQuality,
+		Progressive: Config.CoverProgressive,
+		StripEXIF:   Config.CoverStripEXIF,
+	}
+	// ffmpeg encodes WebP covers and decodes WebP masters that need resizing.
+	opts.FFmpegPath, _ = resolveFFmpegPath()
+	if opts.Progressive {
+		opts.JpegtranPath = resolveJpegtranPath()
+		if opts.JpegtranPath == "" {
+			coverProgressiveWarnOnce.Do(func() {
+				fmt.Println("jpegtran unavailable; saving baseline JPEG covers.")
+			})
+		}
+	}
+	return opts
+}
+
+// coverFetchSize returns the larger of cover-size and embed-cover-size so a
+// single master can serve both the cover file and the embedded picture.
+func coverFetchSize() string {
+	size := Config.CoverSize
+	cw, ch, err := artwork.ParseSize(Config.CoverSize)
+	if err != nil {
+		cw, ch = 0, 0
+	}
+	ew, eh, err := artwork.ParseSize(Config.EmbedCoverSize)
+	if err == nil && ew*eh > cw*ch {
+		size = Config.EmbedCoverSize
+	}
+	return size
+}
+
+func downloadCoverBytes(url string) ([]byte, int, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("User-Agent", coverUserAgent)
+	do, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer do.Body.Close()
+	if do.StatusCode != http.StatusOK {
+		return nil, do.StatusCode, errors.New(do.Status)
+	}
+	data, err := io.ReadAll(do.Body)
+	if err != nil {
+		return nil, do.StatusCode, err
+	}
+	return data, do.StatusCode, nil
+}
+
+func fetchCoverMaster(url string) ([]byte, error) {
+	return fetchArtworkMaster(url, coverFetchSize())
+}
+
+func fetchArtworkMaster(url, size string) ([]byte, error) {
+	format := resolveCoverFormat()
+	key := format + "|" + size + "|" + url
+
+	// Concurrent requests for the same master share one download.
+	coverMasterMu.Lock()
+	if data, ok := coverMasters[key]; ok {
+		coverMasterMu.Unlock()
+		return data, nil
+	}
+	if pending, ok := coverMasterCalls[key]; ok {
+		coverMasterMu.Unlock()
+		pending.wg.Wait()
+		return pending.data, pending.err
+	}
+	pending := &masterCall{}
+	pending.wg.Add(1)
+	coverMasterCalls[key] = pending
+	coverMasterMu.Unlock()
+
+	pending.data, pending.err = downloadArtworkMaster(url, size, format)
+	pending.wg.Done()
+
+	// Albums are processed one at a time, so only a handful of masters are
+	// ever useful at once; the oldest one makes room for a new one.
+	coverMasterMu.Lock()
+	defer coverMasterMu.Unlock()
+	delete(coverMasterCalls, key)
+	if pending.err != nil {
+		return nil, pending.err
+	}
+	if _, ok := coverMasters[key]; !ok {
+		if len(coverMasterOrder) >= 8 {
+			delete(coverMasters, coverMasterOrder[0])
+			coverMasterOrder = coverMasterOrder[1:]
+		}
+		coverMasterOrder = append(coverMasterOrder, key)
+	}
+	coverMasters[key] = pending.data
+	return pending.data, nil
+}
+
+// masterCall is an artwork master download other callers can wait for.
+type masterCall struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+}
+
+func downloadArtworkMaster(url, size, format string) ([]byte, error) {
 	originalUrl := url
 	var ext string
-	var covPath string
-	if Config.CoverFormat == "original" {
+	if format == "original" {
 		ext = strings.Split(url, "/")[len(strings.Split(url, "/"))-2]
 		ext = ext[strings.LastIndex(ext, ".")+1:]
-		covPath = filepath.Join(sanAlbumFolder, name+"."+ext)
-	} else {
-		covPath = filepath.Join(sanAlbumFolder, name+"."+Config.CoverFormat)
 	}
+	if format == "png" || format == "webp" {
+		re := regexp.MustCompile(`\{w\}x\{h\}`)
+		parts := re.Split(url, 2)
+		if len(parts) == 2 {
+			url = parts[0] + "{w}x{h}" + strings.Replace(parts[1], ".jpg", ".png", 1)
+		}
+	}
+	url = strings.Replace(url, "{w}x{h}", size, 1)
+	if format == "original" {
+		url = strings.Replace(url, "is1-ssl.mzstatic.com/image/thumb", "a5.mzstatic.com/us/r1000/0", 1)
+		url = url[:strings.LastIndex(url, "/")]
+	}
+	data, status, err := downloadCoverBytes(url)
+	if err != nil && status != 0 && format == "original" {
+		fmt.Println("Failed to get cover, falling back to " + ext + " url.")
+		splitByDot := strings.Split(originalUrl, ".")
+		last := splitByDot[len(splitByDot)-1]
+		fallback := originalUrl[:len(originalUrl)-len(last)] + ext
+		fallback = strings.Replace(fallback, "{w}x{h}", size, 1)
+		fmt.Println("Fallback URL:", fallback)
+		data, _, err = downloadCoverBytes(fallback)
+		if err != nil {
+			fmt.Println("Failed to get cover from fallback url.")
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func writeCover(sanAlbumFolder, name string, url string) (string, error) {
+	return writeArtworkImage(sanAlbumFolder, name, url, "")
+}
+
+// writeArtworkImage saves url under name in sanAlbumFolder. An empty size
+// uses cover-size; other artwork (banners, backgrounds) passes its own.
+func writeArtworkImage(sanAlbumFolder, name, url, size string) (string, error) {
+	format := resolveCoverFormat()
+	fetchSize, renderSize := coverFetchSize(), Config.CoverSize
+	if size != "" {
+		fetchSize, renderSize = size, size
+	}
+	covPath := coverFilePath(sanAlbumFolder, name, url)
 	exists, err := fileExists(covPath)
 	if err != nil {
 		fmt.Println("Failed to check if cover exists.")
@@ -725,64 +1021,124 @@ func writeCover(sanAlbumFolder, name string, url string) (string, error) {
 	if exists {
 		_ = os.Remove(covPath)
 	}
-	if Config.CoverFormat == "png" {
-		re := regexp.MustCompile(`\{w\}x\{h\}`)
-		parts := re.Split(url, 2)
-		url = parts[0] + "{w}x{h}" + strings.Replace(parts[1], ".jpg", ".png", 1)
-	}
-	url = strings.Replace(url, "{w}x{h}", Config.CoverSize, 1)
-	if Config.CoverFormat == "original" {
-		url = strings.Replace(url, "is1-ssl.mzstatic.com/image/thumb", "a5.mzstatic.com/us/r1000/0", 1)
-		url = url[:strings.LastIndex(url, "/")]
+	if artCache != nil {
+		cached, err := artCache.Get(artworkCacheKey(url, renderSize, format), filepath.Ext(covPath), func() ([]byte, error) {
+			return renderArtwork(url, fetchSize, renderSize, format)
+		})
+		if err != nil {
+			return "", err
+		}
+		if err := artCache.Place(cached, covPath); err != nil {
+			return "", err
+		}
+		return covPath, nil
 	}
-	req, err := http.NewRequest("GET", url, nil)
+	data, err := renderArtwork(url, fetchSize, renderSize, format)
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
-	do, err := http.DefaultClient.Do(req)
-	if err != nil {
+	if err := os.WriteFile(covPath, data, 0644); err != nil {
 		return "", err
 	}
-	defer do.Body.Close()
-	if do.StatusCode != http.StatusOK {
-		if Config.CoverFormat == "original" {
-			fmt.Println("Failed to get cover, falling back to " + ext + " url.")
-			splitByDot := strings.Split(originalUrl, ".")
-			last := splitByDot[len(splitByDot)-1]
-			fallback := originalUrl[:len(originalUrl)-len(last)] + ext
-			fallback = strings.Replace(fallback, "{w}x{h}", Config.CoverSize, 1)
-			fmt.Println("Fallback URL:", fallback)
-			req, err = http.NewRequest("GET", fallback, nil)
-			if err != nil {
-				fmt.Println("Failed to create request for fallback url.")
-				return "", err
-			}
-			req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
-			do, err = http.DefaultClient.Do(req)
-			if err != nil {
-				fmt.Println("Failed to get cover from fallback url.")
-				return "", err
-			}
-			defer do.Body.Close()
-			if do.StatusCode != http.StatusOK {
-				fmt.Println(fallback)
-				return "", errors.New(do.Status)
-			}
-		} else {
-			return "", errors.New(do.Status)
+	return covPath, nil
+}
+
+func renderArtwork(url, fetchSize, renderSize, format string) ([]byte, error) {
+	master, err := fetchArtworkMaster(url, fetchSize)
+	if err != nil {
+		return nil, err
+	}
+	opts := coverRenderOptions(renderSize, format)
+	if format == "original" {
+		opts.Width, opts.Height = 0, 0
+	}
+	data, _, err := artwork.Render(master, opts)
+	if err != nil {
+		if format != "original" {
+			return nil, err
+		}
+		data = master
+	}
+	return data, nil
+}
+
+func artworkCacheKey(url, size, format string) string {
+	return artcache.Key(
+		url,
+		size,
+		format,
+		strconv.Itoa(Config.CoverJPEGQuality),
+		strconv.FormatBool(Config.CoverProgressive),
+		strconv.FormatBool(Config.CoverStripEXIF),
+	)
+}
+
+// embedCoverPath returns the image to embed into a track. With the artwork
+// cache enabled the cached rendition is embedded directly; otherwise the
+// saved cover file is reused when no separate embed size is configured and
+// its format can be embedded as is.
+func embedCoverPath(dir, url string) (string, error) {
+	format := resolveCoverFormat()
+	if artCache == nil && strings.TrimSpace(Config.EmbedCoverSize) == "" && format != "webp" {
+		return ensureCoverFile(dir, albumCoverNames()[0], url)
+	}
+	return renderEmbedCover(url)
+}
+
+func renderEmbedCover(url string) (string, error) {
+	size := strings.TrimSpace(Config.EmbedCoverSize)
+	if size == "" {
+		size = Config.CoverSize
+	}
+	format := "jpg"
+	if resolveCoverFormat() == "png" {
+		format = "png"
+	}
+	render := func() ([]byte, error) {
+		master, err := fetchCoverMaster(url)
+		if err != nil {
+			return nil, err
 		}
+		data, _, err := artwork.Render(master, coverRenderOptions(size, format))
+		return data, err
+	}
+	if artCache != nil {
+		return artCache.Get(artworkCacheKey(url, size, format), format, render)
+	}
+	key := size + "|" + url
+
+	embedCoverMu.Lock()
+	defer embedCoverMu.Unlock()
+	if path, ok := embedCoverPaths[key]; ok {
+		return path, nil
 	}
-	f, err := os.Create(covPath)
+	data, err := render()
 	if err != nil {
 		return "", err
 	}
-	defer f.Close()
-	_, err = io.Copy(f, do.Body)
-	if err != nil {
+	if embedCoverDir == "" {
+		dir, err := os.MkdirTemp("", "amd-cover-")
+		if err != nil {
+			return "", err
+		}
+		embedCoverDir = dir
+	}
+	path := filepath.Join(embedCoverDir, fmt.Sprintf("embed_%d.%s", len(embedCoverPaths)+1, format))
+	if err := os.WriteFile(path, data, 0644); err != nil {
 		return "", err
 	}
-	return covPath, nil
+	embedCoverPaths[key] = path
+	return path, nil
+}
+
+func cleanupEmbedCovers() {
+	embedCoverMu.Lock()
+	defer embedCoverMu.Unlock()
+	if embedCoverDir != "" {
+		_ = os.RemoveAll(embedCoverDir)
+		embedCoverDir = ""
+	}
+	embedCoverPaths = make(map[string]string)
 }
 
 func writeLyrics(sanAlbumFolder, filename string, lrc string) error {
@@ -939,24 +1295,61 @@ func releaseFolderLabel(releaseType string) string {
 	}
 }
 
-func sanitizeFolderName(name string) string {
-	name = strings.TrimSpace(name)
-	if strings.HasSuffix(name, ".") {
-		name = strings.ReplaceAll(name, ".", "")
-	}
-	return strings.TrimSpace(name)
+// joinFolder joins the folder name below dir, made safe for the
+// filename-profile. An empty name joins to dir itself.
+func joinFolder(dir, name string) string {
+	return filepath.Join(dir, nameProfile.Folder(dir, name))
 }
 
 func currentRootFolder() string {
 	if dl_atmos {
 		return Config.AtmosSaveFolder
 	}
+	if dl_ac3 {
+		return Config.Ac3SaveFolder
+	}
 	if dl_aac {
+		if root := aacVariantRoot(Config.AacType); root != "" {
+			return root
+		}
 		return Config.AacSaveFolder
 	}
 	return Config.AlacSaveFolder
 }
 
+var aacVariants = []string{"aac", "aac-lc", "aac-binaural", "aac-downmix"}
+
+// aacVariantRoot is the save folder aac-variant-folders sets for an AAC
+// type, or "" when its downloads go to aac-save-folder.
+func aacVariantRoot(variant string) string {
+	return strings.TrimSpace(Config.AacVariantFolders[variant])
+}
+
+// checkAacFormatRoots makes sure the AAC formats of a job are saved in
+// different folders, so they don't write the same file names.
+func checkAacFormatRoots(formats []multiformat.Format) error {
+	owner := make(map[string]string)
+	for _, f := range formats {
+		if f.AacType == "" {
+			continue
+		}
+		root := aacVariantRoot(f.AacType)
+		if root == "" {
+			root = Config.AacSaveFolder
+		}
+		if other, ok := owner[filepath.Clean(root)]; ok {
+			return fmt.Errorf("--formats lists %s and %s, which would share %s; set a folder for one of them in aac-variant-folders", other, f.Name, root)
+		}
+		owner[filepath.Clean(root)] = f.Name
+	}
+	return nil
+}
+
+// isAacRoot reports whether root holds AAC downloads.
+func isAacRoot(root string) bool {
+	return root == Config.AacSaveFolder || contains(aacVariantRoots, root)
+}
+
 func fallbackAacSaveDir(original string) string {
 	targetRoot := strings.TrimSpace(Config.AacSaveFolder)
 	if targetRoot == "" {
@@ -978,16 +1371,248 @@ func fallbackAacSaveDir(original string) string {
 	return filepath.Join(targetRoot, filepath.Base(originalClean))
 }
 
+// namePlaceholders lists the placeholders of the name templates. Any of
+// them may be used in any template; the ones a name has no value for
+// render empty.
+var namePlaceholders = map[string]bool{
+	"ReleaseDate": true, "ReleaseYear": true, "ArtistName": true, "AlbumName": true,
+	"UPC": true, "RecordLabel": true, "Copyright": true, "AlbumId": true,
+	"Quality": true, "Codec": true, "Tag": true, "BitDepth": true, "SampleRate": true,
+	"ReleaseType": true, "Compilation": true, "Explicit": true, "Clean": true,
+	"AppleDigitalMaster": true, "Genre": true, "TrackTotal": true, "DiscTotal": true,
+	"UrlArtistName": true, "ArtistId": true, "PlaylistName": true, "PlaylistId": true,
+	"SongId": true, "SongNumer": true, "SongNumber": true, "SongName": true,
+	"DiscNumber": true, "TrackNumber": true,
+}
+
+// nameReleaseTypes are the keys of album-folder-formats and
+// song-file-formats.
+var nameReleaseTypes = map[string]bool{
+	"album": true, "ep": true, "single": true, "compilation": true, "mixtape": true,
+}
+
+// initNameTemplates parses every name template of the config, so mistakes
+// are reported at startup rather than halfway through a download.
+func initNameTemplates() error {
+	nameTemplates = make(map[string]*naming.Template)
+	check := func(key, src string) error {
+		if _, ok := nameTemplates[src]; ok {
+			return nil
+		}
+		known := namePlaceholders
+		if Config.AllowUnknownPlaceholders {
+			known = nil
+		}
+		t, err := naming.Parse(src, known)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		// Configs written before templates were checked can keep their
+		// unknown placeholders, which render empty.
+		for _, name := range t.Unknown(namePlaceholders) {
+			fmt.Printf("Warning: %s: unknown placeholder {%s} renders empty\n", key, name)
+		}
+		nameTemplates[src] = t
+		return nil
+	}
+	for _, f := range [][2]string{
+		{"album-folder-format", Config.AlbumFolderFormat},
+		{"playlist-folder-format", Config.PlaylistFolderFormat},
+		{"artist-folder-format", Config.ArtistFolderFormat},
+		{"song-file-format", Config.SongFileFormat},
+	} {
+		if err := check(f[0], f[1]); err != nil {
+			return err
+		}
+	}
+	for _, set := range []struct {
+		key     string
+		formats map[string]string
+	}{
+		{"album-folder-formats", Config.AlbumFolderFormats},
+		{"song-file-formats", Config.SongFileFormats},
+	} {
+		kinds := make([]string, 0, len(set.formats))
+		for kind := range set.formats {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			if !nameReleaseTypes[kind] {
+				return fmt.Errorf("%s: unknown release type %q (use album, ep, single, compilation or mixtape)", set.key, kind)
+			}
+			if err := check(set.key+"."+kind, set.formats[kind]); err != nil {
+				return err
+			}
+		}
+	}
+	for _, profile := range Config.ConvertProfiles {
+		if err := check("convert-profiles."+profile.Name+".file-format", profile.FileFormat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderName fills in a name template. Templates are parsed by
+// initNameTemplates; one that was not is parsed here without checking the
+// placeholder names.
+func renderName(format string, v naming.Vars) string {
+	t, ok := nameTemplates[format]
+	if !ok {
+		var err error
+		if t, err = naming.Parse(format, nil); err != nil {
+			return format
+		}
+	}
+	return t.Render(v)
+}
+
+func formatUses(format string, names ...string) bool {
+	if t, ok := nameTemplates[format]; ok {
+		return t.Uses(names...)
+	}
+	t, err := naming.Parse(format, nil)
+	return err == nil && t.Uses(names...)
+}
+
+// albumFolderFormat returns the album folder template of a release type.
+func albumFolderFormat(releaseType string) string {
+	if format := Config.AlbumFolderFormats[releaseType]; format != "" {
+		return format
+	}
+	return Config.AlbumFolderFormat
+}
+
+// songFileFormat returns the song file template of a release type.
+func songFileFormat(releaseType string) string {
+	if format := Config.SongFileFormats[releaseType]; format != "" {
+		return format
+	}
+	return Config.SongFileFormat
+}
+
+// albumFormatsUse reports whether any album folder template refers to names.
+func albumFormatsUse(names ...string) bool {
+	if formatUses(Config.AlbumFolderFormat, names...) {
+		return true
+	}
+	for _, format := range Config.AlbumFolderFormats {
+		if formatUses(format, names...) {
+			return true
+		}
+	}
+	return false
+}
+
+// songFormatsUse reports whether any song file template refers to names.
+func songFormatsUse(names ...string) bool {
+	if formatUses(Config.SongFileFormat, names...) {
+		return true
+	}
+	for _, format := range Config.SongFileFormats {
+		if formatUses(format, names...) {
+			return true
+		}
+	}
+	return false
+}
+
+func nameFlag(set bool) string {
+	if set {
+		return "true"
+	}
+	return ""
+}
+
+// nameTagString joins the configured choices for the {Tag} placeholder.
+func nameTagString(master bool, contentRating string) string {
+	stringsToJoin := []string{}
+	if master && Config.AppleMasterChoice != "" {
+		stringsToJoin = append(stringsToJoin, Config.AppleMasterChoice)
+	}
+	if contentRating == "explicit" && Config.ExplicitChoice != "" {
+		stringsToJoin = append(stringsToJoin, Config.ExplicitChoice)
+	}
+	if contentRating == "clean" && Config.CleanChoice != "" {
+		stringsToJoin = append(stringsToJoin, Config.CleanChoice)
+	}
+	return strings.Join(stringsToJoin, " ")
+}
+
+// setRatingVars sets {Tag}, {Explicit}, {Clean} and {AppleDigitalMaster}.
+func setRatingVars(v naming.Vars, master bool, contentRating string) {
+	v["Tag"] = nameTagString(master, contentRating)
+	v["Explicit"] = nameFlag(contentRating == "explicit")
+	v["Clean"] = nameFlag(contentRating == "clean")
+	v["AppleDigitalMaster"] = nameFlag(master)
+}
+
+// setQualityVars sets {Quality}, and {BitDepth} and {SampleRate} (in kHz)
+// when quality is a lossless label such as "24B-96kHz".
+func setQualityVars(v naming.Vars, quality string) {
+	v["Quality"] = quality
+	depth, rate := integrity.ParseQuality(quality)
+	if depth > 0 {
+		v["BitDepth"] = strconv.Itoa(depth)
+		v["SampleRate"] = strconv.FormatFloat(float64(rate)/1000, 'f', -1, 64)
+	}
+}
+
+// albumNameVars returns the album placeholders of data.
+func albumNameVars(data *ampapi.AlbumRespData, artist, albumID, quality, codec string) naming.Vars {
+	attrs := data.Attributes
+	releaseYear := ""
+	if len(attrs.ReleaseDate) >= 4 {
+		releaseYear = attrs.ReleaseDate[:4]
+	}
+	genre := ""
+	if len(attrs.GenreNames) > 0 {
+		genre = attrs.GenreNames[0]
+	}
+	discTotal := ""
+	if tracks := data.Relationships.Tracks.Data; len(tracks) > 0 {
+		discTotal = strconv.Itoa(tracks[len(tracks)-1].Attributes.DiscNumber)
+	}
+	trackTotal := ""
+	if attrs.TrackCount > 0 {
+		trackTotal = strconv.Itoa(attrs.TrackCount)
+	}
+	v := naming.Vars{
+		"ReleaseDate": attrs.ReleaseDate,
+		"ReleaseYear": releaseYear,
+		"ArtistName":  LimitString(artist),
+		"AlbumName":   LimitString(attrs.Name),
+		"UPC":         attrs.Upc,
+		"RecordLabel": attrs.RecordLabel,
+		"Copyright":   attrs.Copyright,
+		"AlbumId":     albumID,
+		"Codec":       codec,
+		"Genre":       genre,
+		"TrackTotal":  trackTotal,
+		"DiscTotal":   discTotal,
+		"Compilation": nameFlag(attrs.IsCompilation),
+		"ReleaseType": detectMetadataReleaseType(attrs.Name, attrs.TrackCount, attrs.IsSingle, attrs.IsCompilation),
+	}
+	setRatingVars(v, attrs.IsAppleDigitalMaster || attrs.IsMasteredForItunes, attrs.ContentRating)
+	setQualityVars(v, quality)
+	return v
+}
+
 func buildArtistFolderName(artistName, artistID string) string {
 	if Config.ArtistFolderFormat == "" {
 		return ""
 	}
-	folder := strings.NewReplacer(
-		"{UrlArtistName}", LimitString(artistName),
-		"{ArtistName}", LimitString(artistName),
-		"{ArtistId}", artistID,
-	).Replace(Config.ArtistFolderFormat)
-	return sanitizeFolderName(folder)
+	v := naming.Vars{
+		"UrlArtistName": LimitString(artistName),
+		"ArtistName":    LimitString(artistName),
+		"ArtistId":      artistID,
+	}
+	if urlArtistName != "" {
+		v["UrlArtistName"] = LimitString(urlArtistName)
+		v["ArtistId"] = urlArtistID
+	}
+	return strings.TrimSpace(renderName(Config.ArtistFolderFormat, v))
 }
 
 func stopSignalPath() string {
@@ -1056,12 +1681,13 @@ func waitForWrapperReady(addr string, attempts int, delay time.Duration) bool {
 }
 
 func coverFilePath(folder, name, url string) string {
-	if Config.CoverFormat == "original" {
+	format := resolveCoverFormat()
+	if format == "original" {
 		ext := strings.Split(url, "/")[len(strings.Split(url, "/"))-2]
 		ext = ext[strings.LastIndex(ext, ".")+1:]
 		return filepath.Join(folder, name+"."+ext)
 	}
-	return filepath.Join(folder, name+"."+Config.CoverFormat)
+	return filepath.Join(folder, name+"."+format)
 }
 
 func relativeToRoot(dir, root string) (string, bool) {
@@ -1081,8 +1707,35 @@ func relativeToRoot(dir, root string) (string, bool) {
 	return rel, true
 }
 
+// saveRoots lists the save folder of every download mode, those of AAC
+// variants downloaded next to another one and the quality-policy roots,
+// each once.
+func saveRoots() []string {
+	roots := []string{Config.AlacSaveFolder, Config.AtmosSaveFolder, Config.Ac3SaveFolder, Config.AacSaveFolder}
+	roots = append(roots, aacVariantRoots...)
+	kinds := make([]string, 0, len(Config.QualityPolicyRoots))
+	for kind := range Config.QualityPolicyRoots {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		roots = append(roots, Config.QualityPolicyRoots[kind])
+	}
+
+	out := roots[:0]
+	seen := make(map[string]bool)
+	for _, root := range roots {
+		if strings.TrimSpace(root) == "" || seen[filepath.Clean(root)] {
+			continue
+		}
+		seen[filepath.Clean(root)] = true
+		out = append(out, root)
+	}
+	return out
+}
+
 func siblingDirsForPath(dir string) []string {
-	roots := []string{Config.AlacSaveFolder, Config.AtmosSaveFolder, Config.AacSaveFolder}
+	roots := saveRoots()
 	var rel string
 	var base string
 	for _, root := range roots {
@@ -1112,25 +1765,106 @@ func siblingDirsForPath(dir string) []string {
 	return out
 }
 
-func copyFile(src, dst string) error {
-	in, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer in.Close()
+// linkOrCopyFile places src at dst according to link-mode, falling back
+// to a copy when a link cannot be made.
+func linkOrCopyFile(src, dst string) error {
+	_, err := linkfile.Place(src, dst, linkMode)
+	return err
+}
 
-	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
-		return err
+func saveRootForPath(path string) string {
+	for _, root := range saveRoots() {
+		if root == "" {
+			continue
+		}
+		if _, ok := relativeToRoot(path, root); ok {
+			return root
+		}
 	}
-	out, err := os.Create(dst)
-	if err != nil {
-		return err
+	return ""
+}
+
+func trackIndexForPath(path string) *trackindex.Index {
+	root := saveRootForPath(path)
+	if root == "" {
+		return nil
 	}
-	defer out.Close()
-	if _, err := io.Copy(out, in); err != nil {
-		return err
+	trackIndexMu.Lock()
+	defer trackIndexMu.Unlock()
+	idx, ok := trackIndexes[root]
+	if !ok {
+		idx = trackindex.Load(root)
+		trackIndexes[root] = idx
 	}
-	return nil
+	return idx
+}
+
+func flushTrackIndexes() {
+	trackIndexMu.Lock()
+	defer trackIndexMu.Unlock()
+	for _, idx := range trackIndexes {
+		if err := idx.Flush(); err != nil {
+			fmt.Println("Failed to update track index:", err)
+		}
+	}
+}
+
+// recordTrackPath remembers where a track carrying album metadata was saved
+// so playlist and station downloads can link to it later.
+func recordTrackPath(track *task.Track, paths ...string) {
+	if !Config.LinkPlaylistTracks {
+		return
+	}
+	if track.PreType != "albums" && !Config.UseSongInfoForPlaylist {
+		return
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if ok, err := fileExists(path); err != nil || !ok {
+			continue
+		}
+		idx := trackIndexForPath(path)
+		if idx == nil {
+			return
+		}
+		if err := idx.Record(trackindex.Key(track.ID, track.Codec), path); err != nil {
+			fmt.Println("Failed to update track index:", err)
+		}
+		return
+	}
+}
+
+// linkIndexedTrack places an already downloaded copy of a playlist or
+// station track at trackPath. Only used when playlist tracks carry album
+// metadata, otherwise the files differ in their tags.
+func linkIndexedTrack(track *task.Track, trackPath string) (string, bool) {
+	if !Config.LinkPlaylistTracks || !Config.UseSongInfoForPlaylist {
+		return "", false
+	}
+	if track.PreType != "playlists" && track.PreType != "stations" {
+		return "", false
+	}
+	idx := trackIndexForPath(trackPath)
+	if idx == nil {
+		return "", false
+	}
+	existing, ok := idx.Lookup(trackindex.Key(track.ID, track.Codec))
+	if !ok {
+		return "", false
+	}
+	dst := strings.TrimSuffix(trackPath, filepath.Ext(trackPath)) + filepath.Ext(existing)
+	if existing == dst {
+		return "", false
+	}
+	used, err := linkfile.Place(existing, dst, linkMode)
+	if err != nil {
+		fmt.Println("Failed to link existing track:", err)
+		return "", false
+	}
+	fmt.Printf("Track reused from %s (%s).\n", existing, used)
+	return dst, true
 }
 
 func findExistingSiblingFile(dir, filename string) (string, bool) {
@@ -1150,6 +1884,10 @@ func findExistingSiblingFile(dir, filename string) (string, bool) {
 }
 
 func ensureCoverFile(dir, name, url string) (string, error) {
+	return ensureArtworkFile(dir, name, url, "")
+}
+
+func ensureArtworkFile(dir, name, url, size string) (string, error) {
 	target := coverFilePath(dir, name, url)
 	exists, err := fileExists(target)
 	if err == nil && exists {
@@ -1158,3520 +1896,7562 @@ func ensureCoverFile(dir, name, url string) (string, error) {
 	for _, sibling := range siblingDirsForPath(dir) {
 		candidate := coverFilePath(sibling, name, url)
 		if ok, err := fileExists(candidate); err == nil && ok {
-			if err := copyFile(candidate, target); err == nil {
+			if err := linkOrCopyFile(candidate, target); err == nil {
 				return target, nil
 			}
 		}
 	}
-	return writeCover(dir, name, url)
+	return writeArtworkImage(dir, name, url, size)
 }
 
-func downloadAnimatedArtworkSquare(folder string, videoURL string) {
-	if videoURL == "" {
-		return
-	}
-	motionvideoUrlSquare, err := extractVideo(videoURL)
-	if err != nil {
-		fmt.Println("no motion video square.\n", err)
-		return
-	}
-	exists, err := fileExists(filepath.Join(folder, "square_animated_artwork.mp4"))
-	if err != nil {
-		fmt.Println("Failed to check if animated artwork square exists.")
-		return
-	}
-	if exists {
-		fmt.Println("Animated artwork square already exists locally.")
-		return
-	}
-	fmt.Println("Animation Artwork Square Downloading...")
-	cmd := exec.Command("ffmpeg", "-loglevel", "quiet", "-y", "-i", motionvideoUrlSquare, "-c", "copy", filepath.Join(folder, "square_animated_artwork.mp4"))
-	if err := cmd.Run(); err != nil {
-		fmt.Printf("animated artwork square dl err: %v\n", err)
+func downloadAnimatedArtworkSquare(folder, kind, videoURL string) {
+	path, fresh := saveMotionSet(folder, kind, videoURL, "square")
+	if !fresh {
 		return
 	}
-	fmt.Println("Animation Artwork Square Downloaded")
-
 	if Config.EmbyAnimatedArtwork {
-		cmd3 := exec.Command("ffmpeg", "-i", filepath.Join(folder, "square_animated_artwork.mp4"), "-vf", "scale=440:-1", "-r", "24", "-f", "gif", filepath.Join(folder, "folder.jpg"))
+		cmd3 := exec.Command("ffmpeg", "-i", path, "-vf", "scale=440:-1", "-r", "24", "-f", "gif", filepath.Join(folder, "folder.jpg"))
 		if err := cmd3.Run(); err != nil {
 			fmt.Printf("animated artwork square to gif err: %v\n", err)
 		}
 	}
 }
 
-func handleCoversOnlyAlbum(albumFolderPath string, artistFolder string, coverURL string, artistCoverURL string, animatedSquareURL string) {
-	if Config.SaveArtistCover && artistCoverURL != "" {
-		if _, err := ensureCoverFile(artistFolder, "folder", artistCoverURL); err != nil {
-			fmt.Println("Failed to write artist cover.")
-		}
-	}
-	if _, err := ensureCoverFile(albumFolderPath, "cover", coverURL); err != nil {
-		fmt.Println("Failed to write cover.")
-	}
-	if Config.SaveAnimatedArtwork && dl_atmos {
-		downloadAnimatedArtworkSquare(albumFolderPath, animatedSquareURL)
-	}
+func downloadAnimatedArtworkTall(folder, kind, videoURL string) {
+	saveMotionSet(folder, kind, videoURL, "tall")
 }
 
-func hasAtmosVariant(m3u8Url string) (bool, error) {
-	resp, err := http.Get(m3u8Url)
-	if err != nil {
-		return false, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return false, errors.New(resp.Status)
-	}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return false, err
+// saveMotionSet downloads the motion artwork of kind under the first file
+// name the artwork profiles give it and links the other names to it. It
+// returns the downloaded path and whether it was written now.
+func saveMotionSet(folder, kind, videoURL, label string) (string, bool) {
+	names := artworkset.FileNames(artworkProfiles, kind)
+	if len(names) == 0 {
+		return "", false
 	}
-	from, listType, err := m3u8.DecodeFrom(strings.NewReader(string(body)), true)
-	if err != nil || listType != m3u8.MASTER {
-		return false, errors.New("m3u8 not of master type")
+	path := filepath.Join(folder, names[0])
+	fresh := downloadMotionArtwork(folder, videoURL, names[0], label)
+	if ok, err := fileExists(path); err != nil || !ok {
+		return "", false
 	}
-	master := from.(*m3u8.MasterPlaylist)
-	for _, variant := range master.Variants {
-		if variant.Codecs == "ec-3" && strings.Contains(strings.ToLower(variant.Audio), "atmos") {
-			return true, nil
+	for _, name := range names[1:] {
+		if ok, err := fileExists(filepath.Join(folder, name)); err == nil && !ok {
+			if err := linkOrCopyFile(path, filepath.Join(folder, name)); err != nil {
+				fmt.Printf("Failed to write animated artwork %s: %v\n", name, err)
+			}
 		}
 	}
-	return false, nil
-}
-
-func defaultConvertFormats() []string {
-	return []string{"lossless", "hires", "aac"}
+	return path, fresh
 }
 
-func isHiResQuality(quality string) bool {
-	parts := strings.Split(quality, "-")
-	if len(parts) < 2 {
+// downloadMotionArtwork fetches an editorial video into folder and reports
+// whether a new file was written.
+func downloadMotionArtwork(folder, videoURL, filename, label string) bool {
+	if videoURL == "" {
 		return false
 	}
-	last := parts[len(parts)-1]
-	last = strings.TrimSpace(strings.TrimSuffix(last, "kHz"))
-	if last == "" {
+	motionvideoUrl, err := extractVideo(videoURL)
+	if err != nil {
+		fmt.Printf("no motion video %s.\n %v\n", label, err)
 		return false
 	}
-	value, err := strconv.ParseFloat(last, 64)
+	exists, err := fileExists(filepath.Join(folder, filename))
 	if err != nil {
+		fmt.Printf("Failed to check if animated artwork %s exists.\n", label)
 		return false
 	}
-	return value > 48
+	if exists {
+		fmt.Printf("Animated artwork %s already exists locally.\n", label)
+		return false
+	}
+	title := strings.ToUpper(label[:1]) + label[1:]
+	fmt.Printf("Animation Artwork %s Downloading...\n", title)
+	cmd := exec.Command("ffmpeg", "-loglevel", "quiet", "-y", "-i", motionvideoUrl, "-c", "copy", filepath.Join(folder, filename))
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("animated artwork %s dl err: %v\n", label, err)
+		return false
+	}
+	fmt.Printf("Animation Artwork %s Downloaded\n", title)
+	return true
 }
 
-func formatKeyForTrack(track *task.Track) string {
-	codec := strings.ToUpper(track.Codec)
-	switch codec {
-	case "ATMOS":
-		return "atmos"
-	case "AAC":
-		return "aac"
-	}
-	if codec == "ALAC" {
-		if isHiResQuality(track.Quality) {
-			return "hires"
-		}
-		return "lossless"
+func albumCoverNames() []string {
+	names := artworkset.FileNames(artworkProfiles, artworkset.AlbumCover)
+	if len(names) == 0 {
+		names = []string{"cover"}
 	}
-	return "lossless"
+	return names
 }
 
-func shouldConvertTrack(track *task.Track) bool {
-	formats := Config.ConvertFormats
-	if len(formats) == 0 {
-		formats = defaultConvertFormats()
+func saveCoverSet(dir, kind, url string) error {
+	if url == "" {
+		return nil
 	}
-	formatKey := formatKeyForTrack(track)
-	for _, entry := range formats {
-		if strings.EqualFold(entry, formatKey) {
-			return true
+	var firstErr error
+	for _, name := range artworkset.FileNames(artworkProfiles, kind) {
+		if _, err := ensureCoverFile(dir, name, url); err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
-	return false
+	return firstErr
 }
 
-func shouldEmitHistory() bool {
-	return !dl_lyrics_only && !dl_covers_only
+func saveAlbumCovers(dir, url string) error {
+	return saveCoverSet(dir, artworkset.AlbumCover, url)
 }
 
-func albumIDForTrack(track *task.Track) string {
-	if track.PreType == "albums" && track.PreID != "" {
-		return track.PreID
+// saveMotionArtwork saves the square and tall motion artwork of an album,
+// or of a playlist or station when playlist is set.
+func saveMotionArtwork(folder string, playlist bool, squareURL, tallURL string) {
+	squareKind, tallKind := artworkset.AlbumMotionSquare, artworkset.AlbumMotionTall
+	if playlist {
+		squareKind, tallKind = artworkset.PlaylistMotionSq, artworkset.PlaylistMotionTall
 	}
-	if len(track.Resp.Relationships.Albums.Data) > 0 {
-		return track.Resp.Relationships.Albums.Data[0].ID
+	if Config.SaveAnimatedArtwork {
+		downloadAnimatedArtworkSquare(folder, squareKind, squareURL)
+	}
+	if Config.SaveMotionTallArtwork {
+		downloadAnimatedArtworkTall(folder, tallKind, tallURL)
 	}
-	return ""
 }
 
-func albumNameForTrack(track *task.Track) string {
-	if track.AlbumData.ID != "" {
-		return track.AlbumData.Attributes.Name
+func artworkImageSize(img ampapi.ArtworkImage) string {
+	if img.Width > 0 && img.Height > 0 {
+		return fmt.Sprintf("%dx%d", img.Width, img.Height)
 	}
-	if track.Resp.Attributes.AlbumName != "" {
-		return track.Resp.Attributes.AlbumName
-	}
-	if len(track.Resp.Relationships.Albums.Data) > 0 {
-		return track.Resp.Relationships.Albums.Data[0].Attributes.Name
-	}
-	return "Unknown Album"
+	return Config.CoverSize
 }
 
-func albumArtistForTrack(track *task.Track) string {
-	if track.AlbumData.ID != "" {
-		return track.AlbumData.Attributes.ArtistName
-	}
-	if len(track.Resp.Relationships.Albums.Data) > 0 {
-		return track.Resp.Relationships.Albums.Data[0].Attributes.ArtistName
+func getArtistArtwork(artistID, storefront, language, token string) *ampapi.ArtistRespData {
+	artistArtworkMu.Lock()
+	cached, ok := artistArtworkCache[artistID]
+	artistArtworkMu.Unlock()
+	if ok {
+		return cached
 	}
-	if track.Resp.Attributes.ArtistName != "" {
-		return track.Resp.Attributes.ArtistName
+	var data *ampapi.ArtistRespData
+	resp, err := ampapi.GetArtistResp(storefront, artistID, language, token)
+	if err != nil {
+		fmt.Println("Failed to get artist artwork:", err)
+	} else if len(resp.Data) > 0 {
+		data = &resp.Data[0]
 	}
-	return "Unknown Artist"
+	artistArtworkMu.Lock()
+	artistArtworkCache[artistID] = data
+	artistArtworkMu.Unlock()
+	return data
 }
 
-func releaseTypeForTrack(track *task.Track) string {
-	if track.AlbumData.ID != "" {
-		return detectReleaseType(track.AlbumData.Attributes.Name, track.AlbumData.Attributes.TrackCount, track.AlbumData.Attributes.IsSingle)
+func saveArtistArtwork(artistFolder, artistID, artistCoverURL, storefront, language, token string) {
+	if artistFolder == "" {
+		return
 	}
-	if len(track.Resp.Relationships.Albums.Data) > 0 {
-		album := track.Resp.Relationships.Albums.Data[0].Attributes
-		return detectReleaseType(album.Name, album.TrackCount, album.IsSingle)
+	if Config.SaveArtistCover && artistCoverURL != "" {
+		if err := saveCoverSet(artistFolder, artworkset.ArtistPoster, artistCoverURL); err != nil {
+			fmt.Println("Failed to write artist cover.")
+		}
 	}
-	return "Albums"
-}
-
-func metadataReleaseTypeForTrack(track *task.Track) string {
-	if track == nil {
-		return ""
+	if !Config.SaveArtistBanner || artistID == "" {
+		return
 	}
-	if track.AlbumData.ID != "" {
-		return detectMetadataReleaseType(
-			track.AlbumData.Attributes.Name,
-			track.AlbumData.Attributes.TrackCount,
-			track.AlbumData.Attributes.IsSingle,
-			track.AlbumData.Attributes.IsCompilation,
-		)
+	artist := getArtistArtwork(artistID, storefront, language, token)
+	if artist == nil {
+		return
 	}
-	if len(track.Resp.Relationships.Albums.Data) > 0 {
-		album := track.Resp.Relationships.Albums.Data[0].Attributes
-		return detectMetadataReleaseType(
-			album.Name,
-			album.TrackCount,
-			album.IsSingle,
-			album.IsCompilation,
-		)
+	editorial := artist.Attributes.EditorialArtwork
+	if editorial.BannerUber.URL != "" {
+		for _, name := range artworkset.FileNames(artworkProfiles, artworkset.ArtistBanner) {
+			if _, err := ensureArtworkFile(artistFolder, name, editorial.BannerUber.URL, artworkImageSize(editorial.BannerUber)); err != nil {
+				fmt.Println("Failed to write artist banner.")
+			}
+		}
+	}
+	background := editorial.CenteredFullscreenBackground
+	if background.URL == "" {
+		background = editorial.SuperHeroTall
+	}
+	if background.URL != "" {
+		for _, name := range artworkset.FileNames(artworkProfiles, artworkset.ArtistBackground) {
+			if _, err := ensureArtworkFile(artistFolder, name, background.URL, artworkImageSize(background)); err != nil {
+				fmt.Println("Failed to write artist background.")
+			}
+		}
 	}
-	return detectMetadataReleaseType(track.Resp.Attributes.AlbumName, 0, false, false)
 }
 
-func emitHistoryEntry(track *task.Track) {
-	if !shouldEmitHistory() {
+// savePlaylistArtwork writes the artwork of a playlist into its folder
+// under rootFolder. Its tracks are saved in their album folders, so the
+// folder also gets a .m3u8 of files, the tracks saved for it, for media
+// servers to import the playlist with its artwork.
+func savePlaylistArtwork(rootFolder string, data ampapi.PlaylistRespData, codec string, files []string) {
+	playlistFolder := renderName(Config.PlaylistFolderFormat, naming.Vars{
+		"ArtistName":   LimitString(data.Attributes.ArtistName),
+		"PlaylistName": LimitString(data.Attributes.Name),
+		"PlaylistId":   data.ID,
+		"Codec":        codec,
+	})
+	playlistFolder = nameProfile.Folder(rootFolder, playlistFolder)
+	if playlistFolder == "" {
 		return
 	}
-	entry := map[string]any{
-		"_history_entry": "download",
-		"artist":         albumArtistForTrack(track),
-		"album":          albumNameForTrack(track),
-		"release_type":   releaseTypeForTrack(track),
-		"album_id":       albumIDForTrack(track),
-		"track_num":      track.Resp.Attributes.TrackNumber,
-		"track_name":     track.Resp.Attributes.Name,
-		"storefront":     track.Storefront,
+	folder := filepath.Join(rootFolder, playlistFolder)
+	if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+		fmt.Println("Failed to create playlist artwork folder:", err)
+		return
 	}
-	if track.Resp.Attributes.TrackNumber == 0 {
-		entry["track_num"] = track.TaskNum
+	if err := saveCoverSet(folder, artworkset.PlaylistCover, data.Attributes.Artwork.URL); err != nil {
+		fmt.Println("Failed to write playlist cover.")
 	}
-	payload, err := json.Marshal(entry)
-	if err != nil {
-		fmt.Println("Failed to emit history:", err)
-		return
+	squareVideo := data.Attributes.EditorialVideo.MotionDetailSquare.Video
+	if squareVideo == "" {
+		squareVideo = data.Attributes.EditorialVideo.MotionSquare.Video
+	}
+	tallVideo := data.Attributes.EditorialVideo.MotionDetailTall.Video
+	if tallVideo == "" {
+		tallVideo = data.Attributes.EditorialVideo.MotionTall.Video
+	}
+	saveMotionArtwork(folder, true, squareVideo, tallVideo)
+	if len(files) > 0 {
+		listPath := filepath.Join(folder, nameProfile.File(folder, playlistFolder)+".m3u8")
+		if err := writePlaylistFile(listPath, files); err != nil {
+			fmt.Println("Failed to write playlist file:", err)
+		}
 	}
-	fmt.Printf("HISTORY:%s\n", string(payload))
 }
 
-func emitUnavailableEntry(track *task.Track, reason string) {
-	if !shouldEmitHistory() {
-		return
+// writePlaylistFile writes an extended M3U of files, with paths relative to
+// it. Entries of an earlier run whose files are still there come first, so
+// a retry that skips finished tracks keeps them.
+func writePlaylistFile(path string, files []string) error {
+	dir := filepath.Dir(path)
+	var entries []string
+	seen := make(map[string]bool)
+	add := func(rel string) {
+		if rel != "" && !seen[rel] {
+			seen[rel] = true
+			entries = append(entries, rel)
+		}
 	}
-	requestedFormat := resolveActiveMetadataSourceFormat()
-	entry := map[string]any{
-		"_history_entry":   "unavailable",
-		"reason":           strings.TrimSpace(reason),
-		"requested_format": requestedFormat,
-		"artist":           albumArtistForTrack(track),
-		"album":            albumNameForTrack(track),
-		"release_type":     releaseTypeForTrack(track),
-		"album_id":         albumIDForTrack(track),
-		"track_num":        track.Resp.Attributes.TrackNumber,
-		"track_name":       track.Resp.Attributes.Name,
-		"storefront":       track.Storefront,
+	if old, err := os.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(old), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if ok, _ := fileExists(filepath.Join(dir, filepath.FromSlash(line))); ok {
+				add(line)
+			}
+		}
 	}
-	if track.Resp.Attributes.TrackNumber == 0 {
-		entry["track_num"] = track.TaskNum
+	for _, file := range files {
+		if rel, err := filepath.Rel(dir, file); err == nil {
+			add(filepath.ToSlash(rel))
+		}
 	}
-	payload, err := json.Marshal(entry)
-	if err != nil {
-		fmt.Println("Failed to emit unavailable entry:", err)
-		return
+	return os.WriteFile(path, []byte("#EXTM3U\n"+strings.Join(entries, "\n")+"\n"), 0644)
+}
+
+func handleCoversOnlyAlbum(albumFolderPath string, coverURL string, animatedSquareURL string, animatedTallURL string) {
+	if err := saveAlbumCovers(albumFolderPath, coverURL); err != nil {
+		fmt.Println("Failed to write cover.")
 	}
-	fmt.Printf("HISTORY:%s\n", string(payload))
+	saveMotionArtwork(albumFolderPath, false, animatedSquareURL, animatedTallURL)
 }
 
-func emitRepairEntry(track *task.Track, sourcePath string, repairMode string, repairReason string, bitDepthBefore int, bitDepthAfter int) {
-	if !shouldEmitHistory() {
-		return
+func hasAtmosVariant(m3u8Url string) (bool, error) {
+	return hasVariant(m3u8Url, func(variant *m3u8.Variant) bool {
+		return variant.Codecs == "ec-3" && strings.Contains(strings.ToLower(variant.Audio), "atmos")
+	})
+}
+
+func hasAc3Variant(m3u8Url string) (bool, error) {
+	return hasVariant(m3u8Url, func(variant *m3u8.Variant) bool {
+		return variant.Codecs == "ac-3"
+	})
+}
+
+// dolbyVariantCheck returns the display name, unavailable reason prefix and
+// variant check of the current Dolby download mode.
+func dolbyVariantCheck() (string, string, func(string) (bool, error)) {
+	if dl_ac3 {
+		return "Dolby Audio", "ac3", hasAc3Variant
 	}
-	requestedFormat := resolveActiveMetadataSourceFormat()
-	entry := map[string]any{
-		"_history_entry":   "repair",
-		"reason":           strings.TrimSpace(repairReason),
-		"repair_mode":      strings.TrimSpace(repairMode),
-		"requested_format": requestedFormat,
-		"artist":           albumArtistForTrack(track),
-		"album":            albumNameForTrack(track),
-		"release_type":     releaseTypeForTrack(track),
-		"album_id":         albumIDForTrack(track),
-		"track_num":        track.Resp.Attributes.TrackNumber,
-		"track_name":       track.Resp.Attributes.Name,
-		"storefront":       track.Storefront,
-		"file_path":        strings.TrimSpace(sourcePath),
+	return "Atmos", "atmos", hasAtmosVariant
+}
+
+func hasVariant(m3u8Url string, match func(*m3u8.Variant) bool) (bool, error) {
+	master, err := fetchMasterPlaylist(m3u8Url)
+	if err != nil {
+		return false, err
 	}
-	if bitDepthBefore > 0 {
-		entry["bit_depth_before"] = bitDepthBefore
+	for _, variant := range master.Variants {
+		if match(variant) {
+			return true, nil
+		}
 	}
-	if bitDepthAfter > 0 {
-		entry["bit_depth_after"] = bitDepthAfter
+	return false, nil
+}
+
+func fetchMasterPlaylist(m3u8Url string) (*m3u8.MasterPlaylist, error) {
+	resp, err := http.Get(m3u8Url)
+	if err != nil {
+		return nil, err
 	}
-	if bitDepthBefore > 0 && bitDepthAfter > 0 {
-		entry["bit_depth_reduced"] = bitDepthAfter < bitDepthBefore
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
 	}
-	if track.Resp.Attributes.TrackNumber == 0 {
-		entry["track_num"] = track.TaskNum
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
 	}
-	payload, err := json.Marshal(entry)
+	from, listType, err := m3u8.DecodeFrom(strings.NewReader(string(body)), true)
+	if err != nil || listType != m3u8.MASTER {
+		return nil, errors.New("m3u8 not of master type")
+	}
+	return from.(*m3u8.MasterPlaylist), nil
+}
+
+// masterVariants lists the audio variants of a master playlist, e.g.
+// "audio-alac-stereo-96000-24", sorted and without repeats.
+func masterVariants(b string) ([]string, error) {
+	master, err := fetchMasterPlaylist(b)
 	if err != nil {
-		fmt.Println("Failed to emit repair entry:", err)
-		return
+		return nil, err
 	}
-	fmt.Printf("HISTORY:%s\n", string(payload))
+	var out []string
+	for _, variant := range master.Variants {
+		name := variant.Audio
+		if name == "" {
+			name = variant.Codecs
+		}
+		if name != "" && !contains(out, name) {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
 }
 
-func getLyricsWithFallback(track *task.Track, token string, mediaUserToken string) (string, error) {
-	lrcStr, err := lyrics.Get(track.Storefront, track.ID, Config.LrcType, Config.Language, Config.LrcFormat, token, mediaUserToken)
-	if err == nil && lrcStr != "" {
-		return lrcStr, nil
+// initQualityPolicy parses --quality / quality-policy and fills in the
+// step defaults: limits from alac-max, atmos-max and ac3-max, roots from
+// quality-policy-roots or the mode's save folder. The first step sets the
+// download mode used for album folders. --alac, --atmos, --ac3 and --aac
+// on the command line override a quality-policy from the config.
+func initQualityPolicy() error {
+	spec := strings.TrimSpace(quality_policy)
+	if spec == "" {
+		return nil
 	}
-	if Config.Language != "" {
-		fallback, fallbackErr := lyrics.Get(track.Storefront, track.ID, Config.LrcType, "", Config.LrcFormat, token, mediaUserToken)
-		if fallbackErr == nil && fallback != "" {
-			return fallback, nil
+	if dl_alac || dl_atmos || dl_ac3 || dl_aac {
+		if pflag.CommandLine.Changed("quality") {
+			return errors.New("--quality cannot be combined with --alac, --atmos, --ac3 or --aac")
 		}
-		if fallbackErr != nil {
-			if err != nil {
-				return "", fmt.Errorf("%v; fallback failed: %w", err, fallbackErr)
+		return nil
+	}
+	policy, err := quality.Parse(spec)
+	if err != nil {
+		return err
+	}
+	for i := range policy.Steps {
+		step := &policy.Steps[i]
+		step.Root = strings.TrimSpace(Config.QualityPolicyRoots[string(step.Kind)])
+		if step.Kind == quality.AAC && Config.AacType != "" {
+			step.Kind = quality.Kind(Config.AacType)
+		}
+		switch step.Kind {
+		case quality.Atmos:
+			if step.Max == 0 {
+				step.Max = Config.AtmosMax
+			}
+			if step.Root == "" {
+				step.Root = Config.AtmosSaveFolder
+			}
+		case quality.AC3:
+			if step.Max == 0 {
+				step.Max = Config.Ac3Max
+			}
+			if step.Root == "" {
+				step.Root = Config.Ac3SaveFolder
+			}
+		case quality.HiRes, quality.Lossless:
+			if step.Max == 0 {
+				step.Max = Config.AlacMax
+			}
+			if step.Root == "" {
+				step.Root = Config.AlacSaveFolder
+			}
+		default:
+			if step.Root == "" {
+				step.Root = Config.AacSaveFolder
 			}
-			return "", fallbackErr
 		}
 	}
-	if err != nil {
-		return "", err
+	dl_atmos, dl_ac3, dl_aac = stepModes(policy.Steps[0].Kind)
+	qualityPolicy = policy
+	fmt.Println("Quality policy:", policy)
+	return nil
+}
+
+// stepModes returns the dl_atmos, dl_ac3 and dl_aac values that download
+// the variants of a policy step.
+func stepModes(kind quality.Kind) (atmos, ac3, aac bool) {
+	switch kind {
+	case quality.Atmos:
+		return true, false, false
+	case quality.AC3:
+		return false, true, false
+	case quality.HiRes, quality.Lossless:
+		return false, false, false
 	}
-	return "", errors.New("no lyrics found")
+	return false, false, true
 }
 
-func resolveAlbumQuality(storefront, trackID, language, token string, codec string, audioTraits []string) (string, string) {
-	quality := ""
-	resolvedCodec := codec
-	if !strings.Contains(Config.AlbumFolderFormat, "Quality") {
-		return quality, resolvedCodec
+// policyMaster fetches a master playlist for the quality policy once per
+// run, so the availability check, the policy decision and the variant
+// lookup of a track share one request.
+func policyMaster(masterUrl string) (*m3u8.MasterPlaylist, error) {
+	policyMastersMu.Lock()
+	master, ok := policyMasters[masterUrl]
+	policyMastersMu.Unlock()
+	if ok {
+		return master, nil
 	}
-	if trackID == "" {
-		return quality, resolvedCodec
+	master, err := fetchMasterPlaylist(masterUrl)
+	if err != nil {
+		return nil, err
 	}
+	policyMastersMu.Lock()
+	policyMasters[masterUrl] = master
+	policyMastersMu.Unlock()
+	return master, nil
+}
 
-	if dl_atmos {
-		return fmt.Sprintf("%dKbps", Config.AtmosMax-2000), resolvedCodec
-	}
-	if dl_aac && Config.AacType == "aac-lc" {
-		return "256Kbps", resolvedCodec
+func evaluateQualityPolicy(masterUrl string) (*quality.Decision, error) {
+	var variants []quality.Variant
+	if masterUrl != "" {
+		master, err := policyMaster(masterUrl)
+		if err != nil {
+			return nil, err
+		}
+		base, _ := url.Parse(masterUrl)
+		variants = quality.FromMaster(master, base)
 	}
+	return qualityPolicy.Evaluate(variants)
+}
 
-	manifest1, err := ampapi.GetSongResp(storefront, trackID, language, token)
+// applyQualityPolicy evaluates the quality policy for track and points it
+// at the chosen variant, codec and save root. It returns nil when nothing
+// in the policy can be downloaded.
+func applyQualityPolicy(track *task.Track) *quality.Decision {
+	decision, err := evaluateQualityPolicy(track.M3u8)
+	if decision == nil {
+		fmt.Println("Quality policy check failed:", err)
+		emitUnavailableEntry(track, "quality_policy_check_failed")
+		markAbortRetries(err)
+		return nil
+	}
+	track.QualityLog = strings.Join(decision.Reasons, "; ")
+	fmt.Println("Quality policy:", track.QualityLog)
 	if err != nil {
-		fmt.Println("Failed to get manifest.\n", err)
-		return quality, resolvedCodec
+		fmt.Println("No quality in the policy is available for this track.")
+		emitUnavailableEntry(track, "quality_policy_unmatched")
+		return nil
 	}
-	if manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls == "" {
-		resolvedCodec = "AAC"
-		return "256Kbps", resolvedCodec
+	track.Codec = decision.Codec()
+	if decision.Variant != nil {
+		track.MediaM3u8 = decision.Variant.URI
+		track.MediaQuality = decision.Variant.Quality()
 	}
+	if err := policyTrackFolder(track, decision); err != nil {
+		fmt.Println("Failed to create folder for", decision.Step.Kind, "download:", err)
+		return nil
+	}
+	return decision
+}
 
-	needCheck := false
-	if Config.GetM3u8Mode == "all" {
-		needCheck = true
-	} else if Config.GetM3u8Mode == "hires" && contains(audioTraits, "hi-res-lossless") {
-		needCheck = true
+// policyTrackFolder points a track that fell back to a later policy step
+// at the album folder that step would have planned: its root, its
+// " (Dolby Atmos)" suffix and its {Codec} and {Quality}.
+func policyTrackFolder(track *task.Track, decision *quality.Decision) error {
+	if decision.Step.Kind == qualityPolicy.Steps[0].Kind {
+		return moveTrackToRoot(track, decision.Step.Root)
 	}
-	if needCheck {
-		EnhancedHls_m3u8, err := checkM3u8(trackID, "album")
-		if err != nil {
-			markAbortRetries(err)
-		}
-		if strings.HasSuffix(EnhancedHls_m3u8, ".m3u8") {
-			manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls = EnhancedHls_m3u8
+	if track.AlbumData.ID == "" || albumFolderOverride != "" {
+		if err := moveTrackToRoot(track, decision.Step.Root); err != nil {
+			return err
 		}
+		return moveTrackToDir(track, stripModeSuffix(track.SaveDir, decision.Step.Kind))
 	}
-	_, quality, err = extractMedia(manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls, true)
-	if err != nil {
-		fmt.Println("Failed to extract quality from manifest.\n", err)
+	root := decision.Step.Root
+	if root == "" {
+		root = currentRootFolder()
 	}
-	return quality, resolvedCodec
+	quality := ""
+	if albumFormatsUse("Quality", "BitDepth", "SampleRate") {
+		quality = decision.Quality()
+	}
+	var dir string
+	atmos, ac3, aac := stepModes(decision.Step.Kind)
+	withModes(atmos, ac3, aac, func() {
+		_, _, dir = albumFolderPaths(root, &track.AlbumData, track.AlbumData.ID, quality, decision.Codec())
+	})
+	return moveTrackToDir(track, dir)
 }
 
-// START: New functions for search functionality
-
-// SearchResultItem is a unified struct to hold search results for display.
-type SearchResultItem struct {
-	Type   string
-	Name   string
-	Detail string
-	URL    string
-	ID     string
+// withModes runs fn in the download mode given by atmos, ac3 and aac and
+// restores the current mode afterwards.
+func withModes(atmos, ac3, aac bool, fn func()) {
+	saved := [3]bool{dl_atmos, dl_ac3, dl_aac}
+	defer func() { dl_atmos, dl_ac3, dl_aac = saved[0], saved[1], saved[2] }()
+	dl_atmos, dl_ac3, dl_aac = atmos, ac3, aac
+	fn()
 }
 
-// QualityOption holds information about a downloadable quality.
-type QualityOption struct {
-	ID          string
-	Description string
+// withRootMode runs fn in the download mode of the files under the save
+// root root, since their folder names and tags depend on it.
+func withRootMode(root string, fn func()) {
+	atmos, ac3, aac := rootModes(root)
+	withModes(atmos, ac3, aac, fn)
 }
 
-type PreviewTrack struct {
-	Num        int    `json:"num"`
-	Name       string `json:"name"`
-	Artist     string `json:"artist,omitempty"`
-	Album      string `json:"album,omitempty"`
-	ID         string `json:"id,omitempty"`
-	ISRC       string `json:"isrc,omitempty"`
-	DurationMS int    `json:"duration_ms,omitempty"`
+// rootModes tells the download mode a save root holds: a mode's save
+// folder, an AAC variant root or a quality-policy root.
+func rootModes(root string) (atmos, ac3, aac bool) {
+	switch {
+	case root == Config.AtmosSaveFolder:
+		return true, false, false
+	case root == Config.Ac3SaveFolder:
+		return false, true, false
+	case isAacRoot(root):
+		return false, false, true
+	}
+	for kind, r := range Config.QualityPolicyRoots {
+		if strings.TrimSpace(r) != "" && filepath.Clean(r) == filepath.Clean(root) {
+			return stepModes(quality.Kind(kind))
+		}
+	}
+	return false, false, false
 }
 
-type PreviewPayload struct {
-	Kind               string         `json:"kind,omitempty"`
-	Artist             string         `json:"artist,omitempty"`
-	Title              string         `json:"title,omitempty"`
-	ReleaseType        string         `json:"release_type,omitempty"`
-	TrackCount         int            `json:"track_count,omitempty"`
-	OriginalTrackCount int            `json:"original_track_count,omitempty"`
-	DuplicatesRemoved  int            `json:"duplicates_removed,omitempty"`
-	Tracks             []PreviewTrack `json:"tracks,omitempty"`
-	Preselected        []int          `json:"preselected,omitempty"`
+// stripModeSuffix drops the " (Dolby Atmos)" or " (Dolby Audio)" suffix
+// from the album folder of dir unless kind is that mode.
+func stripModeSuffix(dir string, kind quality.Kind) string {
+	name := filepath.Base(dir)
+	if kind != quality.Atmos {
+		name = strings.TrimSuffix(name, " (Dolby Atmos)")
+	}
+	if kind != quality.AC3 {
+		name = strings.TrimSuffix(name, " (Dolby Audio)")
+	}
+	return filepath.Join(filepath.Dir(dir), name)
 }
 
-func dedupePlaylistTrackData(tracks []ampapi.TrackRespData) playlistdedupe.Result {
-	return playlistdedupe.DedupeTracks(tracks, playlistdedupe.Options{
-		Enabled:             !no_playlist_dedupe,
-		DurationToleranceMS: playlistDedupeToleranceMS,
-	})
+// moveTrackToRoot re-roots the track folder under root, keeping its path
+// relative to the save folder the album was planned in, and brings the
+// cover along so it can still be embedded.
+func moveTrackToRoot(track *task.Track, root string) error {
+	if root == "" {
+		return nil
+	}
+	dir := track.SaveDir
+	from := currentRootFolder()
+	if _, ok := relativeToRoot(dir, from); !ok {
+		from = saveRootForPath(dir)
+	}
+	if rel, ok := relativeToRoot(dir, from); ok && from != "" {
+		return moveTrackToDir(track, filepath.Join(root, rel))
+	}
+	return moveTrackToDir(track, filepath.Join(root, filepath.Base(dir)))
 }
 
-// setDlFlags configures the global download flags based on the user's quality selection.
-func setDlFlags(quality string) {
-	dl_atmos = false
-	dl_aac = false
-
-	switch quality {
-	case "atmos":
-		dl_atmos = true
-		fmt.Println("Quality set to: Dolby Atmos")
-	case "aac":
-		dl_aac = true
-		*aac_type = "aac"
-		fmt.Println("Quality set to: High-Quality (AAC)")
-	case "alac":
-		fmt.Println("Quality set to: Lossless (ALAC)")
+// moveTrackToDir points the track at dir and brings the cover along.
+func moveTrackToDir(track *task.Track, dir string) error {
+	if filepath.Clean(track.SaveDir) == filepath.Clean(dir) {
+		return nil
+	}
+	track.SaveDir = dir
+	if err := os.MkdirAll(track.SaveDir, os.ModePerm); err != nil {
+		return err
 	}
+	if track.CoverPath != "" {
+		target := filepath.Join(track.SaveDir, filepath.Base(track.CoverPath))
+		if err := linkOrCopyFile(track.CoverPath, target); err != nil {
+			track.CoverPath = ""
+		} else {
+			track.CoverPath = target
+		}
+	}
+	return nil
 }
 
-// promptForQuality asks the user to select a download quality for the chosen media.
-func promptForQuality(item SearchResultItem, token string) (string, error) {
-	if item.Type == "Artist" {
-		fmt.Println("Artist selected. Proceeding to list all albums/videos.")
-		return "default", nil
+// trackMediaPlaylist returns the media playlist to download: the variant
+// the quality policy picked, or extractMedia's choice for the download
+// mode. A policy variant is picked again from a replaced master playlist
+// as long as it keeps the same codec.
+func trackMediaPlaylist(track *task.Track) (string, error) {
+	if qualityPolicy == nil {
+		mediaUrl, quality, err := extractMedia(track.M3u8, false)
+		track.MediaQuality = quality
+		return mediaUrl, err
 	}
+	if track.MediaM3u8 == "" {
+		decision, err := evaluateQualityPolicy(track.M3u8)
+		if err != nil {
+			return "", err
+		}
+		if decision.Variant == nil || decision.Codec() != track.Codec {
+			return "", errors.New("playlist does not offer the variant chosen by the quality policy")
+		}
+		track.MediaM3u8 = decision.Variant.URI
+		track.MediaQuality = decision.Variant.Quality()
+	}
+	return track.MediaM3u8, nil
+}
 
-	fmt.Printf("\nFetching available qualities for: %s\n", item.Name)
-
-	qualities := []QualityOption{
-		{ID: "alac", Description: "Lossless (ALAC)"},
-		{ID: "aac", Description: "High-Quality (AAC)"},
-		{ID: "atmos", Description: "Dolby Atmos"},
+// initDownloadFormats parses --formats. The first format becomes the
+// download mode for jobs that run a single format, like stations and
+// music videos. Mode flags on the command line override download-formats
+// from the config.
+func initDownloadFormats() error {
+	if strings.TrimSpace(dl_formats) == "" {
+		return nil
 	}
-	qualityOptions := []string{}
-	for _, q := range qualities {
-		qualityOptions = append(qualityOptions, q.Description)
+	if dl_alac || dl_atmos || dl_ac3 || dl_aac || qualityPolicy != nil {
+		if !pflag.CommandLine.Changed("formats") && (dl_alac || dl_atmos || dl_ac3 || dl_aac || pflag.CommandLine.Changed("quality")) {
+			return nil
+		}
+		return errors.New("--formats cannot be combined with --alac, --atmos, --ac3, --aac or --quality")
 	}
-
-	prompt := &survey.Select{
-		Message:  "Select a quality to download:",
-		Options:  qualityOptions,
-		PageSize: 5,
+	if dl_lyrics_only || dl_covers_only {
+		return errors.New("--formats cannot be used with --lyrics-only or --covers-only")
 	}
-
-	selectedIndex := 0
-	err := survey.AskOne(prompt, &selectedIndex)
+	formats, err := multiformat.Parse(dl_formats)
 	if err != nil {
-		// This can happen if the user presses Ctrl+C
-		return "", nil
+		return err
+	}
+	if err := checkAacFormatRoots(formats); err != nil {
+		return err
 	}
+	downloadFormats = formats
+	applyDownloadFormat(formats[0])
+	activeFormat = ""
+	return nil
+}
 
-	return qualities[selectedIndex].ID, nil
+func applyDownloadFormat(f multiformat.Format) {
+	dl_atmos, dl_ac3, dl_aac = f.Atmos, f.AC3, f.AacType != ""
+	if f.AacType != "" {
+		Config.AacType = f.AacType
+	}
+	activeFormat = f.Name
 }
 
-// handleSearch manages the entire interactive search process.
-func handleSearch(searchType string, queryParts []string, token string) (string, error) {
-	query := strings.Join(queryParts, " ")
-	validTypes := map[string]bool{"album": true, "song": true, "artist": true}
-	if !validTypes[searchType] {
-		return "", fmt.Errorf("invalid search type: %s. Use 'album', 'song', or 'artist'", searchType)
+// okKey keeps the finished tracks of every format of a multi-format job
+// apart, so a retry only repeats what failed in that format.
+func okKey(id string) string {
+	if activeFormat == "" {
+		return id
 	}
+	return id + "@" + activeFormat
+}
 
-	fmt.Printf("Searching for %ss: \"%s\" in storefront \"%s\"\n", searchType, query, Config.Storefront)
-
-	offset := 0
-	limit := 15 // Increased limit for better navigation
-
-	apiSearchType := searchType + "s"
-
-	for {
-		searchResp, err := ampapi.Search(Config.Storefront, query, apiSearchType, Config.Language, token, limit, offset)
-		if err != nil {
-			return "", fmt.Errorf("error fetching search results: %w", err)
-		}
-
-		var items []SearchResultItem
-		var displayOptions []string
-		hasNext := false
-
-		// Special options for navigation
-		const prevPageOpt = "⬅️  Previous Page"
-		const nextPageOpt = "➡️  Next Page"
-
-		// Add previous page option if applicable
-		if offset > 0 {
-			displayOptions = append(displayOptions, prevPageOpt)
+// forEachFormat runs rip once per --formats entry, or once in the current
+// mode without --formats. tracks are reset to their fetched state before
+// each format; catalog data fetched along the way is kept. A table of the
+// per-format availability of every track is printed at the end.
+func forEachFormat(tracks []task.Track, rip func() error) error {
+	if len(downloadFormats) == 0 {
+		return rip()
+	}
+	atmos, ac3, aac, aacType := dl_atmos, dl_ac3, dl_aac, Config.AacType
+	defer func() {
+		dl_atmos, dl_ac3, dl_aac, Config.AacType = atmos, ac3, aac, aacType
+		activeFormat = ""
+		formatReport = nil
+	}()
+	fetched := append([]task.Track(nil), tracks...)
+	formatReport = multiformat.NewReport(downloadFormats)
+	for i, f := range downloadFormats {
+		if checkStopAndWarn() {
+			break
 		}
-
-		switch searchType {
-		case "album":
-			if searchResp.Results.Albums != nil {
-				for _, item := range searchResp.Results.Albums.Data {
-					year := ""
-					if len(item.Attributes.ReleaseDate) >= 4 {
-						year = item.Attributes.ReleaseDate[:4]
-					}
-					trackInfo := fmt.Sprintf("%d tracks", item.Attributes.TrackCount)
-					detail := fmt.Sprintf("%s (%s, %s)", item.Attributes.ArtistName, year, trackInfo)
-					displayOptions = append(displayOptions, fmt.Sprintf("%s - %s", item.Attributes.Name, detail))
-					items = append(items, SearchResultItem{Type: "Album", URL: item.Attributes.URL, ID: item.ID})
-				}
-				hasNext = searchResp.Results.Albums.Next != ""
-			}
-		case "song":
-			if searchResp.Results.Songs != nil {
-				for _, item := range searchResp.Results.Songs.Data {
-					detail := fmt.Sprintf("%s (%s)", item.Attributes.ArtistName, item.Attributes.AlbumName)
-					displayOptions = append(displayOptions, fmt.Sprintf("%s - %s", item.Attributes.Name, detail))
-					items = append(items, SearchResultItem{Type: "Song", URL: item.Attributes.URL, ID: item.ID})
-				}
-				hasNext = searchResp.Results.Songs.Next != ""
-			}
-		case "artist":
-			if searchResp.Results.Artists != nil {
-				for _, item := range searchResp.Results.Artists.Data {
-					detail := ""
-					if len(item.Attributes.GenreNames) > 0 {
-						detail = strings.Join(item.Attributes.GenreNames, ", ")
-					}
-					displayOptions = append(displayOptions, fmt.Sprintf("%s (%s)", item.Attributes.Name, detail))
-					items = append(items, SearchResultItem{Type: "Artist", URL: item.Attributes.URL, ID: item.ID})
-				}
-				hasNext = searchResp.Results.Artists.Next != ""
+		if i > 0 {
+			for j := range tracks {
+				albumData, discTotal := tracks[j].AlbumData, tracks[j].DiscTotal
+				tracks[j] = fetched[j]
+				tracks[j].AlbumData, tracks[j].DiscTotal = albumData, discTotal
 			}
 		}
-
-		if len(items) == 0 && offset == 0 {
-			fmt.Println("No results found.")
-			return "", nil
-		}
-
-		// Add next page option if applicable
-		if hasNext {
-			displayOptions = append(displayOptions, nextPageOpt)
-		}
-
-		prompt := &survey.Select{
-			Message:  "Use arrow keys to navigate, Enter to select:",
-			Options:  displayOptions,
-			PageSize: limit, // Show a full page of results
+		applyDownloadFormat(f)
+		fmt.Printf("Format %d of %d: %s\n", i+1, len(downloadFormats), f.Name)
+		if err := rip(); err != nil {
+			fmt.Printf("Failed to download %s: %v\n", f.Name, err)
 		}
+	}
+	printFormatReport(formatReport)
+	return nil
+}
 
-		selectedIndex := 0
-		err = survey.AskOne(prompt, &selectedIndex)
-		if err != nil {
-			// User pressed Ctrl+C
-			return "", nil
-		}
+func printFormatReport(report *multiformat.Report) {
+	if report.Empty() {
+		return
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader(report.Header())
+	table.SetRowLine(false)
+	table.AppendBulk(report.Rows())
+	table.Render()
+	summary := report.Summary()
+	for _, f := range downloadFormats {
+		counts := summary[f.Name]
+		fmt.Printf("%s: %d ok, %d unavailable, %d failed\n", f.Name, counts[multiformat.StatusOK], counts[multiformat.StatusUnavailable], counts[multiformat.StatusError])
+	}
+}
 
-		selectedOption := displayOptions[selectedIndex]
+func recordFormatStatus(track *task.Track, status string) {
+	if formatReport == nil {
+		return
+	}
+	name := track.Resp.Attributes.Name
+	if name == "" {
+		name = track.ID
+	}
+	formatReport.Set(track.ID, fmt.Sprintf("%02d. %s", track.TaskNum, name), activeFormat, status)
+}
 
-		// Handle pagination
-		if selectedOption == nextPageOpt {
-			offset += limit
-			continue
-		}
-		if selectedOption == prevPageOpt {
-			offset -= limit
-			continue
-		}
+// ripTrackForFormat is ripTrack that also records the outcome in the
+// multi-format report.
+func ripTrackForFormat(track *task.Track, token string, mediaUserToken string) bool {
+	failed := counter.Error
+	ok := ripTrack(track, token, mediaUserToken)
+	switch {
+	case ok:
+		recordFormatStatus(track, multiformat.StatusOK)
+	case counter.Error > failed:
+		recordFormatStatus(track, multiformat.StatusError)
+	default:
+		recordFormatStatus(track, multiformat.StatusUnavailable)
+	}
+	return ok
+}
 
-		// Adjust index to match the `items` slice if "Previous Page" was an option
-		itemIndex := selectedIndex
-		if offset > 0 {
-			itemIndex--
-		}
+func defaultConvertFormats() []string {
+	return []string{"lossless", "hires", "aac"}
+}
 
-		selectedItem := items[itemIndex]
+func isHiResQuality(quality string) bool {
+	parts := strings.Split(quality, "-")
+	if len(parts) < 2 {
+		return false
+	}
+	last := parts[len(parts)-1]
+	last = strings.TrimSpace(strings.TrimSuffix(last, "kHz"))
+	if last == "" {
+		return false
+	}
+	value, err := strconv.ParseFloat(last, 64)
+	if err != nil {
+		return false
+	}
+	return value > 48
+}
 
-		// Automatically set single song download flag
-		if selectedItem.Type == "Song" {
-			dl_song = true
+func formatKeyForTrack(track *task.Track) string {
+	codec := strings.ToUpper(track.Codec)
+	switch codec {
+	case "ATMOS":
+		return "atmos"
+	case "AC3":
+		return "ac3"
+	case "AAC":
+		return "aac"
+	}
+	if codec == "ALAC" {
+		if isHiResQuality(track.Quality) {
+			return "hires"
 		}
+		return "lossless"
+	}
+	return "lossless"
+}
 
-		quality, err := promptForQuality(selectedItem, token)
-		if err != nil {
-			return "", fmt.Errorf("could not process quality selection: %w", err)
-		}
-		if quality == "" { // User cancelled quality selection
-			fmt.Println("Selection cancelled.")
-			return "", nil
+func shouldConvertTrack(track *task.Track) bool {
+	formats := Config.ConvertFormats
+	if len(formats) == 0 {
+		formats = defaultConvertFormats()
+	}
+	formatKey := formatKeyForTrack(track)
+	for _, entry := range formats {
+		if strings.EqualFold(entry, formatKey) {
+			return true
 		}
+	}
+	return false
+}
 
-		if quality != "default" {
-			setDlFlags(quality)
-		}
+func shouldEmitHistory() bool {
+	return !dl_lyrics_only && !dl_covers_only
+}
 
-		return selectedItem.URL, nil
+func albumIDForTrack(track *task.Track) string {
+	if track.PreType == "albums" && track.PreID != "" {
+		return track.PreID
+	}
+	if len(track.Resp.Relationships.Albums.Data) > 0 {
+		return track.Resp.Relationships.Albums.Data[0].ID
 	}
+	return ""
 }
 
-func buildPreviewPayload(rawUrl string, token string) (*PreviewPayload, error) {
-	parsed, err := url.Parse(rawUrl)
-	if err != nil {
-		return nil, err
+func albumNameForTrack(track *task.Track) string {
+	if track.AlbumData.ID != "" {
+		return track.AlbumData.Attributes.Name
 	}
-	preselectID := parsed.Query().Get("i")
+	if track.Resp.Attributes.AlbumName != "" {
+		return track.Resp.Attributes.AlbumName
+	}
+	if len(track.Resp.Relationships.Albums.Data) > 0 {
+		return track.Resp.Relationships.Albums.Data[0].Attributes.Name
+	}
+	return "Unknown Album"
+}
 
-	if storefront, albumId := checkUrl(rawUrl); albumId != "" {
-		album, err := ampapi.GetAlbumResp(storefront, albumId, Config.Language, token)
-		if err != nil {
-			return nil, err
-		}
-		meta := album.Data[0]
-		tracks := make([]PreviewTrack, 0, len(meta.Relationships.Tracks.Data))
-		preselected := []int{}
-		for i, track := range meta.Relationships.Tracks.Data {
-			tracks = append(tracks, PreviewTrack{
-				Num:        i + 1,
-				Name:       track.Attributes.Name,
-				Artist:     track.Attributes.ArtistName,
-				Album:      meta.Attributes.Name,
-				ID:         track.ID,
-				ISRC:       track.Attributes.Isrc,
-				DurationMS: track.Attributes.DurationInMillis,
-			})
-			if preselectID != "" && track.ID == preselectID {
-				preselected = []int{i + 1}
-			}
-		}
-		return &PreviewPayload{
-			Kind:        "Album",
-			Artist:      meta.Attributes.ArtistName,
-			Title:       meta.Attributes.Name,
-			ReleaseType: detectReleaseType(meta.Attributes.Name, meta.Attributes.TrackCount, meta.Attributes.IsSingle),
-			TrackCount:  meta.Attributes.TrackCount,
-			Tracks:      tracks,
-			Preselected: preselected,
-		}, nil
+func albumArtistForTrack(track *task.Track) string {
+	if track.AlbumData.ID != "" {
+		return track.AlbumData.Attributes.ArtistName
+	}
+	if len(track.Resp.Relationships.Albums.Data) > 0 {
+		return track.Resp.Relationships.Albums.Data[0].Attributes.ArtistName
+	}
+	if track.Resp.Attributes.ArtistName != "" {
+		return track.Resp.Attributes.ArtistName
 	}
+	return "Unknown Artist"
+}
 
-	if storefront, playlistId := checkUrlPlaylist(rawUrl); playlistId != "" {
-		playlist, err := ampapi.GetPlaylistResp(storefront, playlistId, Config.Language, token)
-		if err != nil {
-			return nil, err
-		}
-		meta := playlist.Data[0]
-		originalTrackCount := len(meta.Relationships.Tracks.Data)
-		dedupeResult := dedupePlaylistTrackData(meta.Relationships.Tracks.Data)
-		tracks := make([]PreviewTrack, 0, len(dedupeResult.Tracks))
-		for i, track := range dedupeResult.Tracks {
-			tracks = append(tracks, PreviewTrack{
-				Num:        i + 1,
-				Name:       track.Attributes.Name,
-				Artist:     track.Attributes.ArtistName,
-				Album:      track.Attributes.AlbumName,
-				ID:         track.ID,
-				ISRC:       track.Attributes.Isrc,
-				DurationMS: track.Attributes.DurationInMillis,
-			})
-		}
-		artistName := meta.Attributes.ArtistName
-		if artistName == "" {
-			artistName = "Apple Music"
-		}
-		payload := &PreviewPayload{
-			Kind:        "Playlist",
-			Artist:      artistName,
-			Title:       meta.Attributes.Name,
-			ReleaseType: "Playlists",
-			TrackCount:  len(tracks),
-			Tracks:      tracks,
-		}
-		if dedupeResult.RemovedCount > 0 {
-			payload.OriginalTrackCount = originalTrackCount
-			payload.DuplicatesRemoved = dedupeResult.RemovedCount
-		}
-		return payload, nil
+func releaseTypeForTrack(track *task.Track) string {
+	if track.AlbumData.ID != "" {
+		return detectReleaseType(track.AlbumData.Attributes.Name, track.AlbumData.Attributes.TrackCount, track.AlbumData.Attributes.IsSingle)
 	}
-
-	if storefront, songId := checkUrlSong(rawUrl); songId != "" {
-		song, err := ampapi.GetSongResp(storefront, songId, Config.Language, token)
-		if err != nil {
-			return nil, err
-		}
-		data := song.Data[0]
-		releaseType := "Singles"
-		if len(data.Relationships.Albums.Data) > 0 {
-			album := data.Relationships.Albums.Data[0].Attributes
-			releaseType = detectReleaseType(album.Name, album.TrackCount, album.IsSingle)
-		}
-		return &PreviewPayload{
-			Kind:        "Song",
-			Artist:      data.Attributes.ArtistName,
-			Title:       data.Attributes.Name,
-			ReleaseType: releaseType,
-			TrackCount:  1,
-			Tracks: []PreviewTrack{
-				{
-					Num:        1,
-					Name:       data.Attributes.Name,
-					Artist:     data.Attributes.ArtistName,
-					Album:      data.Attributes.AlbumName,
-					ID:         data.ID,
-					ISRC:       data.Attributes.Isrc,
-					DurationMS: data.Attributes.DurationInMillis,
-				},
-			},
-			Preselected: []int{1},
-		}, nil
+	if len(track.Resp.Relationships.Albums.Data) > 0 {
+		album := track.Resp.Relationships.Albums.Data[0].Attributes
+		return detectReleaseType(album.Name, album.TrackCount, album.IsSingle)
 	}
-
-	return nil, errors.New("unsupported url")
+	return "Albums"
 }
 
-// END: New functions for search functionality
-
-// CONVERSION FEATURE: Determine if source codec is lossy (rough heuristic by extension/codec name).
-func isLossySource(ext string, codec string) bool {
-	ext = strings.ToLower(ext)
-	if ext == ".m4a" && (codec == "AAC" || strings.Contains(codec, "AAC") || strings.Contains(codec, "ATMOS")) {
-		return true
+func metadataReleaseTypeForTrack(track *task.Track) string {
+	if track == nil {
+		return ""
 	}
-	if ext == ".mp3" || ext == ".opus" || ext == ".ogg" {
-		return true
+	if track.AlbumData.ID != "" {
+		return detectMetadataReleaseType(
+			track.AlbumData.Attributes.Name,
+			track.AlbumData.Attributes.TrackCount,
+			track.AlbumData.Attributes.IsSingle,
+			track.AlbumData.Attributes.IsCompilation,
+		)
 	}
-	return false
+	if len(track.Resp.Relationships.Albums.Data) > 0 {
+		album := track.Resp.Relationships.Albums.Data[0].Attributes
+		return detectMetadataReleaseType(
+			album.Name,
+			album.TrackCount,
+			album.IsSingle,
+			album.IsCompilation,
+		)
+	}
+	return detectMetadataReleaseType(track.Resp.Attributes.AlbumName, 0, false, false)
 }
 
-func normalizeAlacRepairMode(mode string) string {
-	mode = strings.ToLower(strings.TrimSpace(mode))
-	switch mode {
-	case "all", "corrupt-only", "off":
-		return mode
-	case "":
-		return "all"
-	default:
-		return "all"
+func emitHistoryEntry(track *task.Track) {
+	if !shouldEmitHistory() {
+		return
+	}
+	entry := map[string]any{
+		"_history_entry": "download",
+		"artist":         albumArtistForTrack(track),
+		"album":          albumNameForTrack(track),
+		"release_type":   releaseTypeForTrack(track),
+		"album_id":       albumIDForTrack(track),
+		"track_num":      track.Resp.Attributes.TrackNumber,
+		"track_name":     track.Resp.Attributes.Name,
+		"storefront":     track.Storefront,
+	}
+	if track.Resp.Attributes.TrackNumber == 0 {
+		entry["track_num"] = track.TaskNum
+	}
+	if track.QualityLog != "" {
+		entry["quality"] = track.QualityLog
+	}
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Println("Failed to emit history:", err)
+		return
 	}
+	fmt.Printf("HISTORY:%s\n", string(payload))
 }
 
-func resolveFFmpegPath() (string, error) {
-	path := strings.TrimSpace(Config.FFmpegPath)
-	if path == "" {
-		path = "ffmpeg"
+func emitUnavailableEntry(track *task.Track, reason string) {
+	if !shouldEmitHistory() {
+		return
 	}
-	return exec.LookPath(path)
+	requestedFormat := resolveActiveMetadataSourceFormat()
+	entry := map[string]any{
+		"_history_entry":   "unavailable",
+		"reason":           strings.TrimSpace(reason),
+		"requested_format": requestedFormat,
+		"artist":           albumArtistForTrack(track),
+		"album":            albumNameForTrack(track),
+		"release_type":     releaseTypeForTrack(track),
+		"album_id":         albumIDForTrack(track),
+		"track_num":        track.Resp.Attributes.TrackNumber,
+		"track_name":       track.Resp.Attributes.Name,
+		"storefront":       track.Storefront,
+	}
+	if track.Resp.Attributes.TrackNumber == 0 {
+		entry["track_num"] = track.TaskNum
+	}
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Println("Failed to emit unavailable entry:", err)
+		return
+	}
+	fmt.Printf("HISTORY:%s\n", string(payload))
 }
 
-func resolveFFprobePath(ffmpegPath string) string {
-	if ffmpegPath != "" && ffmpegPath != "ffmpeg" {
-		candidate := filepath.Join(filepath.Dir(ffmpegPath), "ffprobe")
-		if _, err := exec.LookPath(candidate); err == nil {
-			return candidate
-		}
+func emitRepairEntry(track *task.Track, sourcePath string, repairMode string, repairReason string, bitDepthBefore int, bitDepthAfter int) {
+	if !shouldEmitHistory() {
+		return
 	}
-	if _, err := exec.LookPath("ffprobe"); err == nil {
-		return "ffprobe"
+	requestedFormat := resolveActiveMetadataSourceFormat()
+	entry := map[string]any{
+		"_history_entry":   "repair",
+		"reason":           strings.TrimSpace(repairReason),
+		"repair_mode":      strings.TrimSpace(repairMode),
+		"requested_format": requestedFormat,
+		"artist":           albumArtistForTrack(track),
+		"album":            albumNameForTrack(track),
+		"release_type":     releaseTypeForTrack(track),
+		"album_id":         albumIDForTrack(track),
+		"track_num":        track.Resp.Attributes.TrackNumber,
+		"track_name":       track.Resp.Attributes.Name,
+		"storefront":       track.Storefront,
+		"file_path":        strings.TrimSpace(sourcePath),
 	}
-	return ""
+	if bitDepthBefore > 0 {
+		entry["bit_depth_before"] = bitDepthBefore
+	}
+	if bitDepthAfter > 0 {
+		entry["bit_depth_after"] = bitDepthAfter
+	}
+	if bitDepthBefore > 0 && bitDepthAfter > 0 {
+		entry["bit_depth_reduced"] = bitDepthAfter < bitDepthBefore
+	}
+	if track.Resp.Attributes.TrackNumber == 0 {
+		entry["track_num"] = track.TaskNum
+	}
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Println("Failed to emit repair entry:", err)
+		return
+	}
+	fmt.Printf("HISTORY:%s\n", string(payload))
 }
 
-func sampleFormatBitDepth(sampleFmt string) int {
-	match := sampleFmtBitDepthRe.FindStringSubmatch(strings.TrimSpace(sampleFmt))
-	if len(match) != 2 {
-		return 0
+type lyricsResult struct {
+	done chan struct{}
+	lrc  string
+	err  error
+}
+
+// getLyricsWithFallback fetches the lyrics of a track once per job, so
+// every format of a multi-format job and repeated playlist entries share
+// a single request, including ones made at the same time.
+func getLyricsWithFallback(track *task.Track, token string, mediaUserToken string) (string, error) {
+	key := track.Storefront + "/" + track.ID + "/" + Config.LrcType + "/" + Config.LrcFormat
+	lyricsMu.Lock()
+	cached, ok := lyricsCache[key]
+	if !ok {
+		cached = &lyricsResult{done: make(chan struct{})}
+		lyricsCache[key] = cached
 	}
-	bitDepth, err := strconv.Atoi(match[1])
-	if err != nil || bitDepth <= 0 {
-		return 0
+	lyricsMu.Unlock()
+	if ok {
+		<-cached.done
+		return cached.lrc, cached.err
 	}
-	return bitDepth
+	cached.lrc, cached.err = fetchLyricsWithFallback(track, token, mediaUserToken)
+	close(cached.done)
+	return cached.lrc, cached.err
 }
 
-func probeAudioBitDepth(ffprobePath, inPath string) int {
-	if ffprobePath == "" || inPath == "" {
-		return 0
+func fetchLyricsWithFallback(track *task.Track, token string, mediaUserToken string) (string, error) {
+	lrcStr, err := lyrics.Get(track.Storefront, track.ID, Config.LrcType, Config.Language, Config.LrcFormat, token, mediaUserToken)
+	if err == nil && lrcStr != "" {
+		return lrcStr, nil
+	}
+	if Config.Language != "" {
+		fallback, fallbackErr := lyrics.Get(track.Storefront, track.ID, Config.LrcType, "", Config.LrcFormat, token, mediaUserToken)
+		if fallbackErr == nil && fallback != "" {
+			return fallback, nil
+		}
+		if fallbackErr != nil {
+			if err != nil {
+				return "", fmt.Errorf("%v; fallback failed: %w", err, fallbackErr)
+			}
+			return "", fallbackErr
+		}
 	}
-	cmd := exec.Command(
-		ffprobePath,
-		"-v",
-		"error",
-		"-select_streams",
-		"a:0",
-		"-show_entries",
-		"stream=bits_per_raw_sample,bits_per_sample,sample_fmt",
-		"-of",
-		"default=nw=1",
-		inPath,
-	)
-	out, err := cmd.Output()
 	if err != nil {
-		return 0
+		return "", err
 	}
-	values := map[string]string{}
-	scanner := bufio.NewScanner(bytes.NewReader(out))
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
-		}
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			continue
-		}
-		key := strings.ToLower(strings.TrimSpace(parts[0]))
-		value := strings.TrimSpace(parts[1])
-		if key == "" || value == "" {
-			continue
-		}
-		values[key] = value
+	return "", errors.New("no lyrics found")
+}
+
+func resolveAlbumQuality(storefront, trackID, language, token string, codec string, audioTraits []string) (string, string) {
+	quality := ""
+	resolvedCodec := codec
+	if !albumFormatsUse("Quality", "BitDepth", "SampleRate") {
+		return quality, resolvedCodec
 	}
-	if raw := strings.TrimSpace(values["bits_per_raw_sample"]); raw != "" {
-		if bitDepth, err := strconv.Atoi(raw); err == nil && bitDepth > 0 {
-			return bitDepth
-		}
+	if trackID == "" {
+		return quality, resolvedCodec
 	}
-	if raw := strings.TrimSpace(values["bits_per_sample"]); raw != "" {
-		if bitDepth, err := strconv.Atoi(raw); err == nil && bitDepth > 0 {
-			return bitDepth
-		}
+
+	if dl_atmos {
+		return fmt.Sprintf("%dKbps", Config.AtmosMax-2000), resolvedCodec
 	}
-	if sampleFmt := strings.TrimSpace(values["sample_fmt"]); sampleFmt != "" {
-		return sampleFormatBitDepth(sampleFmt)
+	if dl_aac && Config.AacType == "aac-lc" {
+		return "256Kbps", resolvedCodec
 	}
-	return 0
-}
 
-func warnBitDepthReduction(label string, bitDepthBefore, bitDepthAfter int) bool {
-	if bitDepthBefore <= 0 || bitDepthAfter <= 0 || bitDepthAfter >= bitDepthBefore {
-		return false
+	manifest1, err := ampapi.GetSongResp(storefront, trackID, language, token)
+	if err != nil {
+		fmt.Println("Failed to get manifest.\n", err)
+		return quality, resolvedCodec
 	}
-	fmt.Printf("⚠ %s reduced bit depth during repair: %d-bit -> %d-bit\n", label, bitDepthBefore, bitDepthAfter)
-	return true
-}
-
-func canUseAlacAt(ffmpegPath string) bool {
-	alacAtOnce.Do(func() {
-		if runtime.GOOS != "darwin" {
-			alacAtAvailable = false
-			return
-		}
-		if ffmpegPath == "" {
-			alacAtAvailable = false
-			return
+	if manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls == "" {
+		if dl_ac3 {
+			return quality, resolvedCodec
 		}
-		cmd := exec.Command(ffmpegPath, "-hide_banner", "-decoders")
-		out, err := cmd.Output()
+		resolvedCodec = "AAC"
+		return "256Kbps", resolvedCodec
+	}
+
+	needCheck := false
+	if Config.GetM3u8Mode == "all" {
+		needCheck = true
+	} else if Config.GetM3u8Mode == "hires" && contains(audioTraits, "hi-res-lossless") {
+		needCheck = true
+	}
+	if needCheck {
+		EnhancedHls_m3u8, err := checkM3u8(trackID, "album")
 		if err != nil {
-			alacAtAvailable = false
-			return
+			markAbortRetries(err)
 		}
-		scanner := bufio.NewScanner(bytes.NewReader(out))
-		for scanner.Scan() {
-			line := scanner.Text()
-			if strings.Contains(line, " alac_at") || strings.Contains(line, "\talac_at") {
-				alacAtAvailable = true
-				return
-			}
+		if strings.HasSuffix(EnhancedHls_m3u8, ".m3u8") {
+			manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls = EnhancedHls_m3u8
 		}
-		alacAtAvailable = false
-	})
-	return alacAtAvailable
+	}
+	_, quality, err = extractMedia(manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls, true)
+	if err != nil {
+		fmt.Println("Failed to extract quality from manifest.\n", err)
+	}
+	return quality, resolvedCodec
 }
 
-func warnAlacAtFallback() {
-	alacAtWarnOnce.Do(func() {
-		if runtime.GOOS != "darwin" {
-			fmt.Println("ALAC decode: alac_at is macOS-only; falling back to ffmpeg's native ALAC decoder.")
-			return
-		}
-		fmt.Println("ALAC decode: ffmpeg does not list alac_at; falling back to native ALAC decoder.")
-	})
-}
+// START: New functions for search functionality
 
-func warnFfprobeMissing() {
-	ffprobeWarnOnce.Do(func() {
-		fmt.Println("ffprobe unavailable; skipping FLAC metadata extraction from source tags.")
-	})
+// SearchResultItem is a unified struct to hold search results for display.
+type SearchResultItem struct {
+	Type   string
+	Name   string
+	Detail string
+	URL    string
+	ID     string
 }
 
-func resolveMetaflacPath() string {
-	metaflacOnce.Do(func() {
-		path, err := exec.LookPath("metaflac")
-		if err != nil {
-			metaflacPath = ""
-			return
-		}
-		metaflacPath = path
-	})
-	return metaflacPath
+// QualityOption holds information about a downloadable quality.
+type QualityOption struct {
+	ID          string
+	Description string
 }
 
-func warnMetaflacMissing() {
-	metaflacWarnOnce.Do(func() {
-		fmt.Println("metaflac unavailable; skipping FLAC tag normalization.")
-	})
+type PreviewTrack struct {
+	Num        int    `json:"num"`
+	Name       string `json:"name"`
+	Artist     string `json:"artist,omitempty"`
+	Album      string `json:"album,omitempty"`
+	ID         string `json:"id,omitempty"`
+	ISRC       string `json:"isrc,omitempty"`
+	DurationMS int    `json:"duration_ms,omitempty"`
 }
 
-func flacGetTag(metaPath, filePath, key string) string {
-	cmd := exec.Command(metaPath, "--show-tag", key, filePath)
-	out, err := cmd.Output()
-	if err != nil {
-		return ""
-	}
-	scanner := bufio.NewScanner(bytes.NewReader(out))
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
-		}
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			continue
-		}
-		return strings.TrimSpace(parts[1])
-	}
-	return ""
+type PreviewPayload struct {
+	Kind               string         `json:"kind,omitempty"`
+	Artist             string         `json:"artist,omitempty"`
+	Title              string         `json:"title,omitempty"`
+	ReleaseType        string         `json:"release_type,omitempty"`
+	TrackCount         int            `json:"track_count,omitempty"`
+	OriginalTrackCount int            `json:"original_track_count,omitempty"`
+	DuplicatesRemoved  int            `json:"duplicates_removed,omitempty"`
+	Tracks             []PreviewTrack `json:"tracks,omitempty"`
+	Preselected        []int          `json:"preselected,omitempty"`
 }
 
-func runMetaflac(metaPath string, args ...string) {
-	if metaPath == "" {
-		return
-	}
-	cmd := exec.Command(metaPath, args...)
-	_ = cmd.Run()
+func dedupePlaylistTrackData(tracks []ampapi.TrackRespData) playlistdedupe.Result {
+	return playlistdedupe.DedupeTracks(tracks, playlistdedupe.Options{
+		Enabled:             !no_playlist_dedupe,
+		DurationToleranceMS: playlistDedupeToleranceMS,
+	})
 }
 
-func postprocessFlacTags(filePath string) {
-	metaPath := resolveMetaflacPath()
-	if metaPath == "" {
-		warnMetaflacMissing()
-		return
-	}
+// setDlFlags configures the global download flags based on the user's quality selection.
+func setDlFlags(quality string) {
+	dl_atmos = false
+	dl_ac3 = false
+	dl_aac = false
 
-	trackNumber := flacGetTag(metaPath, filePath, "TRACKNUMBER")
-	if strings.Contains(trackNumber, "/") {
-		parts := strings.SplitN(trackNumber, "/", 2)
-		tnum := strings.TrimSpace(parts[0])
-		ttot := strings.TrimSpace(parts[1])
-		if tnum != "" && ttot != "" {
-			runMetaflac(
-				metaPath,
-				"--remove-tag=TRACKNUMBER",
-				"--remove-tag=TRACKTOTAL",
-				"--remove-tag=TOTALTRACKS",
-				"--set-tag=TRACKNUMBER="+tnum,
-				"--set-tag=TOTALTRACKS="+ttot,
-				"--set-tag=TRACKTOTAL="+ttot,
-				filePath,
-			)
-		}
+	switch quality {
+	case "atmos":
+		dl_atmos = true
+		fmt.Println("Quality set to: Dolby Atmos")
+	case "ac3":
+		dl_ac3 = true
+		fmt.Println("Quality set to: Dolby Audio (AC-3)")
+	case "aac":
+		dl_aac = true
+		*aac_type = "aac"
+		fmt.Println("Quality set to: High-Quality (AAC)")
+	case "alac":
+		fmt.Println("Quality set to: Lossless (ALAC)")
 	}
+}
 
-	discNumber := flacGetTag(metaPath, filePath, "DISCNUMBER")
-	if strings.Contains(discNumber, "/") {
-		parts := strings.SplitN(discNumber, "/", 2)
-		dnum := strings.TrimSpace(parts[0])
-		dtot := strings.TrimSpace(parts[1])
-		if dnum != "" && dtot != "" {
-			runMetaflac(
-				metaPath,
-				"--remove-tag=DISCNUMBER",
-				"--remove-tag=DISCTOTAL",
-				"--remove-tag=TOTALDISCS",
-				"--set-tag=DISCNUMBER="+dnum,
-				"--set-tag=TOTALDISCS="+dtot,
-				"--set-tag=DISCTOTAL="+dtot,
-				filePath,
-			)
-		}
+// promptForQuality asks the user to select a download quality for the chosen media.
+func promptForQuality(item SearchResultItem, token string) (string, error) {
+	if item.Type == "Artist" {
+		fmt.Println("Artist selected. Proceeding to list all albums/videos.")
+		return "default", nil
 	}
 
-	runMetaflac(
-		metaPath,
-		"--remove-tag=major_brand",
-		"--remove-tag=MAJOR_BRAND",
-		"--remove-tag=minor_version",
-		"--remove-tag=MINOR_VERSION",
-		"--remove-tag=compatible_brands",
-		"--remove-tag=COMPATIBLE_BRANDS",
-		"--remove-tag=creation_time",
-		"--remove-tag=CREATION_TIME",
-		"--remove-tag=ENCODER",
-		"--remove-tag=encoder",
-		"--remove-tag=ENCODED_BY",
-		"--remove-tag=encoded_by",
-		filePath,
-	)
-}
+	fmt.Printf("\nFetching available qualities for: %s\n", item.Name)
 
-func readFormatTags(ffprobePath, inPath string) (map[string]string, error) {
-	cmd := exec.Command(
-		ffprobePath,
-		"-v",
-		"error",
-		"-show_entries",
-		"format_tags",
-		"-of",
-		"default=nw=1",
-		inPath,
-	)
-	out, err := cmd.Output()
-	if err != nil {
-		return nil, err
+	qualities := []QualityOption{
+		{ID: "alac", Description: "Lossless (ALAC)"},
+		{ID: "aac", Description: "High-Quality (AAC)"},
+		{ID: "atmos", Description: "Dolby Atmos"},
+		{ID: "ac3", Description: "Dolby Audio (AC-3)"},
 	}
-	tags := map[string]string{}
-	scanner := bufio.NewScanner(bytes.NewReader(out))
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
-		}
-		line = strings.TrimPrefix(line, "TAG:")
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			continue
-		}
-		key := strings.ToLower(strings.TrimSpace(parts[0]))
-		value := strings.TrimSpace(parts[1])
-		if key == "" || value == "" {
-			continue
-		}
-		tags[key] = value
+	qualityOptions := []string{}
+	for _, q := range qualities {
+		qualityOptions = append(qualityOptions, q.Description)
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+
+	prompt := &survey.Select{
+		Message:  "Select a quality to download:",
+		Options:  qualityOptions,
+		PageSize: 5,
 	}
-	return tags, nil
-}
 
-func pickFirstTag(tags map[string]string, keys ...string) string {
-	for _, key := range keys {
-		if val := tags[key]; val != "" {
-			return val
-		}
+	selectedIndex := 0
+	err := survey.AskOne(prompt, &selectedIndex)
+	if err != nil {
+		// This can happen if the user presses Ctrl+C
+		return "", nil
 	}
-	return ""
+
+	return qualities[selectedIndex].ID, nil
 }
 
-func splitTagFraction(value string) (string, string) {
-	raw := strings.TrimSpace(value)
-	if raw == "" {
-		return "", ""
-	}
-	parts := strings.SplitN(raw, "/", 2)
-	left := strings.TrimSpace(parts[0])
-	if len(parts) == 1 {
-		return left, ""
+// handleSearch manages the entire interactive search process.
+func handleSearch(searchType string, queryParts []string, token string) (string, error) {
+	query := strings.Join(queryParts, " ")
+	validTypes := map[string]bool{"album": true, "song": true, "artist": true}
+	if !validTypes[searchType] {
+		return "", fmt.Errorf("invalid search type: %s. Use 'album', 'song', or 'artist'", searchType)
 	}
-	right := strings.TrimSpace(parts[1])
-	return left, right
-}
 
-func assignFlacMetadata(metadata map[string]string, key, value string) {
-	val := strings.TrimSpace(value)
-	if key == "" || val == "" {
-		return
-	}
-	metadata[key] = val
-}
+	fmt.Printf("Searching for %ss: \"%s\" in storefront \"%s\"\n", searchType, query, Config.Storefront)
 
-func buildSelectedFlacMetadataFromTags(tags map[string]string) map[string]string {
-	metadata := map[string]string{}
+	offset := 0
+	limit := 15 // Increased limit for better navigation
 
-	if metadataTagEnabledFlac("title") {
-		assignFlacMetadata(metadata, "TITLE", pickFirstTag(tags, "title"))
-	}
-	if metadataTagEnabledFlac("title_sort") {
-		assignFlacMetadata(metadata, "TITLESORT", pickFirstTag(tags, "titlesort", "sort_name"))
-	}
-	if metadataTagEnabledFlac("artist") {
-		assignFlacMetadata(metadata, "ARTIST", pickFirstTag(tags, "artist"))
-	}
-	if metadataTagEnabledFlac("artist_sort") {
-		assignFlacMetadata(metadata, "ARTISTSORT", pickFirstTag(tags, "artistsort", "sort_artist"))
-	}
-	if metadataTagEnabledFlac("album") {
-		assignFlacMetadata(metadata, "ALBUM", pickFirstTag(tags, "album"))
-	}
-	if metadataTagEnabledFlac("album_sort") {
-		assignFlacMetadata(metadata, "ALBUMSORT", pickFirstTag(tags, "albumsort", "sort_album"))
-	}
-	if metadataTagEnabledFlac("album_artist") {
-		assignFlacMetadata(metadata, "ALBUMARTIST", pickFirstTag(tags, "albumartist", "album_artist"))
-	}
-	if metadataTagEnabledFlac("album_artist_sort") {
-		assignFlacMetadata(
-			metadata,
-			"ALBUMARTISTSORT",
-			pickFirstTag(tags, "albumartistsort", "sort_album_artist", "sort_albumartist"),
-		)
-	}
-	if metadataTagEnabledFlac("composer") {
-		assignFlacMetadata(metadata, "COMPOSER", formatComposerList(pickFirstTag(tags, "composer")))
-	}
-	if metadataTagEnabledFlac("composer_sort") {
-		assignFlacMetadata(metadata, "COMPOSERSORT", formatComposerList(pickFirstTag(tags, "composersort", "sort_composer")))
-	}
-	if metadataTagEnabledFlac("genre") {
-		assignFlacMetadata(metadata, "GENRE", pickFirstTag(tags, "genre"))
-	}
+	apiSearchType := searchType + "s"
 
-	trackRaw := pickFirstTag(tags, "tracknumber", "track", "tracknum")
-	trackNumber, trackTotal := splitTagFraction(trackRaw)
-	if metadataTagEnabledFlac("track_number") {
-		assignFlacMetadata(metadata, "TRACKNUMBER", trackNumber)
-	}
-	if metadataTagEnabledFlac("track_total") {
-		if trackTotal == "" {
-			trackTotal = pickFirstTag(tags, "tracktotal", "totaltracks", "track_total")
+	for {
+		searchResp, err := ampapi.Search(Config.Storefront, query, apiSearchType, Config.Language, token, limit, offset)
+		if err != nil {
+			return "", fmt.Errorf("error fetching search results: %w", err)
 		}
-		assignFlacMetadata(metadata, "TRACKTOTAL", trackTotal)
-	}
 
-	discRaw := pickFirstTag(tags, "discnumber", "disc", "disk")
-	discNumber, discTotal := splitTagFraction(discRaw)
-	if metadataTagEnabledFlac("disc_number") {
-		assignFlacMetadata(metadata, "DISCNUMBER", discNumber)
-	}
-	if metadataTagEnabledFlac("disc_total") {
-		if discTotal == "" {
-			discTotal = pickFirstTag(tags, "disctotal", "totaldiscs", "disc_total")
-		}
-		assignFlacMetadata(metadata, "DISCTOTAL", discTotal)
-	}
+		var items []SearchResultItem
+		var displayOptions []string
+		hasNext := false
 
-	if metadataTagEnabledFlac("release_date") {
-		assignFlacMetadata(metadata, "DATE", pickFirstTag(tags, "date", "release_date", "releasedate"))
-	}
-	if metadataTagEnabledFlac("original_date") {
-		assignFlacMetadata(
-			metadata,
-			"ORIGINALDATE",
-			pickFirstTag(tags, "originaldate", "original_date", "origdate", "tdor"),
-		)
-	}
-	if metadataTagEnabledFlac("release_type") {
-		assignFlacMetadata(metadata, "RELEASETYPE", pickFirstTag(tags, "releasetype", "release_type"))
-	}
-	if metadataTagEnabledFlac("isrc") {
-		assignFlacMetadata(metadata, "ISRC", pickFirstTag(tags, "isrc"))
-	}
-	if metadataTagEnabledFlac("upc") {
-		assignFlacMetadata(metadata, "UPC", pickFirstTag(tags, "upc"))
-	}
-	if metadataTagEnabledFlac("label") {
-		assignFlacMetadata(metadata, "LABEL", pickFirstTag(tags, "label"))
-	}
-	if metadataTagEnabledFlac("publisher") {
-		assignFlacMetadata(metadata, "PUBLISHER", pickFirstTag(tags, "publisher", "label"))
-	}
-	if metadataTagEnabledFlac("copyright") {
-		assignFlacMetadata(metadata, "COPYRIGHT", pickFirstTag(tags, "copyright"))
-	}
-	if metadataTagEnabledFlac("performer") {
-		assignFlacMetadata(metadata, "PERFORMER", pickFirstTag(tags, "performer"))
-	}
-	if metadataTagEnabledFlac("lyrics") {
-		assignFlacMetadata(metadata, "LYRICS", pickFirstTag(tags, "lyrics"))
-	}
-	if metadataTagEnabledFlac("album_version") {
-		assignFlacMetadata(metadata, "ALBUMVERSION", pickFirstTag(tags, "albumversion", "edition", "version"))
-	}
-	if metadataTagEnabledFlac("loudness") {
-		assignFlacMetadata(metadata, "REPLAYGAIN_TRACK_GAIN", pickFirstTag(tags, "replaygain_track_gain"))
-		assignFlacMetadata(metadata, "REPLAYGAIN_TRACK_PEAK", pickFirstTag(tags, "replaygain_track_peak"))
-		assignFlacMetadata(metadata, "REPLAYGAIN_ALBUM_GAIN", pickFirstTag(tags, "replaygain_album_gain"))
-		assignFlacMetadata(metadata, "REPLAYGAIN_ALBUM_PEAK", pickFirstTag(tags, "replaygain_album_peak"))
-		assignFlacMetadata(metadata, "R128_TRACK_GAIN", pickFirstTag(tags, "r128_track_gain"))
-		assignFlacMetadata(metadata, "R128_ALBUM_GAIN", pickFirstTag(tags, "r128_album_gain"))
-	}
+		// Special options for navigation
+		const prevPageOpt = "⬅️  Previous Page"
+		const nextPageOpt = "➡️  Next Page"
 
-	for key, value := range metadataCustomTagsFlac {
-		assignFlacMetadata(metadata, key, value)
-	}
+		// Add previous page option if applicable
+		if offset > 0 {
+			displayOptions = append(displayOptions, prevPageOpt)
+		}
 
-	return metadata
-}
+		switch searchType {
+		case "album":
+			if searchResp.Results.Albums != nil {
+				for _, item := range searchResp.Results.Albums.Data {
+					year := ""
+					if len(item.Attributes.ReleaseDate) >= 4 {
+						year = item.Attributes.ReleaseDate[:4]
+					}
+					trackInfo := fmt.Sprintf("%d tracks", item.Attributes.TrackCount)
+					detail := fmt.Sprintf("%s (%s, %s)", item.Attributes.ArtistName, year, trackInfo)
+					displayOptions = append(displayOptions, fmt.Sprintf("%s - %s", item.Attributes.Name, detail))
+					items = append(items, SearchResultItem{Type: "Album", URL: item.Attributes.URL, ID: item.ID})
+				}
+				hasNext = searchResp.Results.Albums.Next != ""
+			}
+		case "song":
+			if searchResp.Results.Songs != nil {
+				for _, item := range searchResp.Results.Songs.Data {
+					detail := fmt.Sprintf("%s (%s)", item.Attributes.ArtistName, item.Attributes.AlbumName)
+					displayOptions = append(displayOptions, fmt.Sprintf("%s - %s", item.Attributes.Name, detail))
+					items = append(items, SearchResultItem{Type: "Song", URL: item.Attributes.URL, ID: item.ID})
+				}
+				hasNext = searchResp.Results.Songs.Next != ""
+			}
+		case "artist":
+			if searchResp.Results.Artists != nil {
+				for _, item := range searchResp.Results.Artists.Data {
+					detail := ""
+					if len(item.Attributes.GenreNames) > 0 {
+						detail = strings.Join(item.Attributes.GenreNames, ", ")
+					}
+					displayOptions = append(displayOptions, fmt.Sprintf("%s (%s)", item.Attributes.Name, detail))
+					items = append(items, SearchResultItem{Type: "Artist", URL: item.Attributes.URL, ID: item.ID})
+				}
+				hasNext = searchResp.Results.Artists.Next != ""
+			}
+		}
 
-func applyAtmosPrefixToSelectedFlacMetadata(metadata map[string]string, track *task.Track) {
-	if !shouldUseAtmosMetadataPrefix(track) {
-		return
-	}
-	if value, ok := metadata["TITLE"]; ok {
-		assignFlacMetadata(metadata, "TITLE", withAtmosMetadataPrefix(value, true))
-	}
-	if value, ok := metadata["TITLESORT"]; ok {
-		assignFlacMetadata(metadata, "TITLESORT", withAtmosMetadataPrefix(value, true))
-	}
-	if value, ok := metadata["ALBUM"]; ok {
-		assignFlacMetadata(metadata, "ALBUM", withAtmosMetadataPrefix(value, true))
-	}
-	if value, ok := metadata["ALBUMSORT"]; ok {
-		assignFlacMetadata(metadata, "ALBUMSORT", withAtmosMetadataPrefix(value, true))
-	}
-}
+		if len(items) == 0 && offset == 0 {
+			fmt.Println("No results found.")
+			return "", nil
+		}
 
-func buildSelectedFlacMetadata(ffprobePath, inPath string, track *task.Track) map[string]string {
-	tags := map[string]string{}
+		// Add next page option if applicable
+		if hasNext {
+			displayOptions = append(displayOptions, nextPageOpt)
+		}
 
-	if ffprobePath == "" {
-		warnFfprobeMissing()
-	} else {
-		found, err := readFormatTags(ffprobePath, inPath)
-		if err != nil {
-			warnFfprobeMissing()
-		} else {
-			tags = found
+		prompt := &survey.Select{
+			Message:  "Use arrow keys to navigate, Enter to select:",
+			Options:  displayOptions,
+			PageSize: limit, // Show a full page of results
 		}
-	}
 
-	metadata := buildSelectedFlacMetadataFromTags(tags)
-	if metadataTagEnabledFlac("release_type") {
-		if _, exists := metadata["RELEASETYPE"]; !exists {
-			assignFlacMetadata(metadata, "RELEASETYPE", metadataReleaseTypeForTrack(track))
+		selectedIndex := 0
+		err = survey.AskOne(prompt, &selectedIndex)
+		if err != nil {
+			// User pressed Ctrl+C
+			return "", nil
 		}
-	}
-	applyAtmosPrefixToSelectedFlacMetadata(metadata, track)
-	return metadata
-}
 
-func selectAlacDecoder(ffmpegPath string) string {
-	if canUseAlacAt(ffmpegPath) {
-		return "alac_at"
-	}
-	warnAlacAtFallback()
-	return "alac"
-}
+		selectedOption := displayOptions[selectedIndex]
 
-func validateAlacFile(ffmpegPath, inPath string) (bool, string) {
-	cmd := exec.Command(
-		ffmpegPath,
-		"-v",
-		"error",
-		"-xerror",
-		"-err_detect",
-		"explode",
-		"-i",
-		inPath,
-		"-f",
-		"null",
-		"-",
-	)
-	out, err := cmd.CombinedOutput()
-	if err == nil {
-		return true, ""
-	}
-	msg := strings.TrimSpace(string(out))
-	if msg == "" {
-		return false, err.Error()
-	}
-	lines := strings.Split(msg, "\n")
-	return false, strings.TrimSpace(lines[0])
-}
+		// Handle pagination
+		if selectedOption == nextPageOpt {
+			offset += limit
+			continue
+		}
+		if selectedOption == prevPageOpt {
+			offset -= limit
+			continue
+		}
 
-func decideAlacRepair(ffmpegPath, srcPath, mode string) (bool, string, string) {
-	normalized := normalizeAlacRepairMode(mode)
-	switch normalized {
-	case "off":
-		return false, "", ""
-	case "all":
-		return true, "forced", ""
-	default:
-		ok, msg := validateAlacFile(ffmpegPath, srcPath)
-		if ok {
-			return false, "", ""
+		// Adjust index to match the `items` slice if "Previous Page" was an option
+		itemIndex := selectedIndex
+		if offset > 0 {
+			itemIndex--
 		}
-		return true, "corrupt_detected", msg
-	}
-}
 
-func replaceFile(tmpPath, destPath string) error {
-	if err := os.Rename(tmpPath, destPath); err == nil {
-		return nil
-	}
-	if err := os.Remove(destPath); err != nil {
-		return err
+		selectedItem := items[itemIndex]
+
+		// Automatically set single song download flag
+		if selectedItem.Type == "Song" {
+			dl_song = true
+		}
+
+		quality, err := promptForQuality(selectedItem, token)
+		if err != nil {
+			return "", fmt.Errorf("could not process quality selection: %w", err)
+		}
+		if quality == "" { // User cancelled quality selection
+			fmt.Println("Selection cancelled.")
+			return "", nil
+		}
+
+		if quality != "default" {
+			setDlFlags(quality)
+		}
+
+		return selectedItem.URL, nil
 	}
-	return os.Rename(tmpPath, destPath)
 }
 
-func repairAlacInPlace(ffmpegPath, decoder, inPath string) error {
-	dir := filepath.Dir(inPath)
-	ext := filepath.Ext(inPath)
-	if ext == "" {
-		ext = ".m4a"
-	}
-	tmpFile, err := os.CreateTemp(dir, ".alac-repair-*"+ext)
+func buildPreviewPayload(rawUrl string, token string) (*PreviewPayload, error) {
+	parsed, err := url.Parse(rawUrl)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	tmpPath := tmpFile.Name()
-	_ = tmpFile.Close()
+	preselectID := parsed.Query().Get("i")
 
-	args := []string{"-y"}
-	if decoder != "" {
-		args = append(args, "-c:a", decoder)
-	}
-	args = append(args,
-		"-i", inPath,
-		"-map", "0",
-		"-c", "copy",
-		"-c:a", "alac",
-		"-map_metadata", "0",
-		"-map_chapters", "0",
-		tmpPath,
-	)
-	cmd := exec.Command(ffmpegPath, args...)
-	if err := cmd.Run(); err != nil {
-		_ = os.Remove(tmpPath)
-		return err
-	}
-	if err := replaceFile(tmpPath, inPath); err != nil {
-		_ = os.Remove(tmpPath)
-		return err
+	if storefront, albumId := checkUrl(rawUrl); albumId != "" {
+		album, err := ampapi.GetAlbumResp(storefront, albumId, Config.Language, token)
+		if err != nil {
+			return nil, err
+		}
+		meta := album.Data[0]
+		tracks := make([]PreviewTrack, 0, len(meta.Relationships.Tracks.Data))
+		preselected := []int{}
+		for i, track := range meta.Relationships.Tracks.Data {
+			tracks = append(tracks, PreviewTrack{
+				Num:        i + 1,
+				Name:       track.Attributes.Name,
+				Artist:     track.Attributes.ArtistName,
+				Album:      meta.Attributes.Name,
+				ID:         track.ID,
+				ISRC:       track.Attributes.Isrc,
+				DurationMS: track.Attributes.DurationInMillis,
+			})
+			if preselectID != "" && track.ID == preselectID {
+				preselected = []int{i + 1}
+			}
+		}
+		return &PreviewPayload{
+			Kind:        "Album",
+			Artist:      meta.Attributes.ArtistName,
+			Title:       meta.Attributes.Name,
+			ReleaseType: detectReleaseType(meta.Attributes.Name, meta.Attributes.TrackCount, meta.Attributes.IsSingle),
+			TrackCount:  meta.Attributes.TrackCount,
+			Tracks:      tracks,
+			Preselected: preselected,
+		}, nil
 	}
-	return nil
-}
 
-func runAlacRepair(ffmpegPath, decoder, srcPath, label, reason, validationMsg string) error {
-	if label == "" {
-		label = "ALAC"
+	if storefront, playlistId := checkUrlPlaylist(rawUrl); playlistId != "" {
+		playlist, err := ampapi.GetPlaylistResp(storefront, playlistId, Config.Language, token)
+		if err != nil {
+			return nil, err
+		}
+		meta := playlist.Data[0]
+		originalTrackCount := len(meta.Relationships.Tracks.Data)
+		dedupeResult := dedupePlaylistTrackData(meta.Relationships.Tracks.Data)
+		tracks := make([]PreviewTrack, 0, len(dedupeResult.Tracks))
+		for i, track := range dedupeResult.Tracks {
+			tracks = append(tracks, PreviewTrack{
+				Num:        i + 1,
+				Name:       track.Attributes.Name,
+				Artist:     track.Attributes.ArtistName,
+				Album:      track.Attributes.AlbumName,
+				ID:         track.ID,
+				ISRC:       track.Attributes.Isrc,
+				DurationMS: track.Attributes.DurationInMillis,
+			})
+		}
+		artistName := meta.Attributes.ArtistName
+		if artistName == "" {
+			artistName = "Apple Music"
+		}
+		payload := &PreviewPayload{
+			Kind:        "Playlist",
+			Artist:      artistName,
+			Title:       meta.Attributes.Name,
+			ReleaseType: "Playlists",
+			TrackCount:  len(tracks),
+			Tracks:      tracks,
+		}
+		if dedupeResult.RemovedCount > 0 {
+			payload.OriginalTrackCount = originalTrackCount
+			payload.DuplicatesRemoved = dedupeResult.RemovedCount
+		}
+		return payload, nil
 	}
-	if reason == "corrupt_detected" {
-		if validationMsg != "" {
-			fmt.Printf("%s validation failed; repairing (%s)\n", label, validationMsg)
-		} else {
-			fmt.Printf("%s validation failed; repairing.\n", label)
+
+	if storefront, songId := checkUrlSong(rawUrl); songId != "" {
+		song, err := ampapi.GetSongResp(storefront, songId, Config.Language, token)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		fmt.Printf("Repairing %s...\n", label)
+		data := song.Data[0]
+		releaseType := "Singles"
+		if len(data.Relationships.Albums.Data) > 0 {
+			album := data.Relationships.Albums.Data[0].Attributes
+			releaseType = detectReleaseType(album.Name, album.TrackCount, album.IsSingle)
+		}
+		return &PreviewPayload{
+			Kind:        "Song",
+			Artist:      data.Attributes.ArtistName,
+			Title:       data.Attributes.Name,
+			ReleaseType: releaseType,
+			TrackCount:  1,
+			Tracks: []PreviewTrack{
+				{
+					Num:        1,
+					Name:       data.Attributes.Name,
+					Artist:     data.Attributes.ArtistName,
+					Album:      data.Attributes.AlbumName,
+					ID:         data.ID,
+					ISRC:       data.Attributes.Isrc,
+					DurationMS: data.Attributes.DurationInMillis,
+				},
+			},
+			Preselected: []int{1},
+		}, nil
 	}
-	if decoder == "" {
-		decoder = selectAlacDecoder(ffmpegPath)
+
+	return nil, errors.New("unsupported url")
+}
+
+// END: New functions for search functionality
+
+// CONVERSION FEATURE: Determine if source codec is lossy (rough heuristic by extension/codec name).
+func isLossySource(ext string, codec string) bool {
+	ext = strings.ToLower(ext)
+	if ext == ".m4a" && (codec == "AAC" || strings.Contains(codec, "AAC") || strings.Contains(codec, "ATMOS") || codec == "AC3") {
+		return true
 	}
-	if err := repairAlacInPlace(ffmpegPath, decoder, srcPath); err != nil {
-		fmt.Printf("%s repair failed: %v\n", label, err)
-		return err
+	if ext == ".mp3" || ext == ".opus" || ext == ".ogg" {
+		return true
 	}
-	fmt.Printf("%s repair complete.\n", label)
-	return nil
+	return false
 }
 
-func repairAlacIfNeeded(ffmpegPath, srcPath, mode, label string) (bool, string) {
-	shouldRepair, reason, validationMsg := decideAlacRepair(ffmpegPath, srcPath, mode)
-	if !shouldRepair {
-		return false, ""
-	}
-	decoder := selectAlacDecoder(ffmpegPath)
-	if err := runAlacRepair(ffmpegPath, decoder, srcPath, label, reason, validationMsg); err != nil {
-		return false, ""
+func normalizeAlacRepairMode(mode string) string {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "all", "corrupt-only", "off":
+		return mode
+	case "":
+		return "all"
+	default:
+		return "all"
 	}
-	return true, reason
 }
 
-// CONVERSION FEATURE: Build ffmpeg arguments for desired target.
-func buildFFmpegArgs(inPath, outPath, targetFmt, extraArgs string, decoder string) ([]string, error) {
-	args := []string{"-y"}
-	if decoder != "" {
-		args = append(args, "-c:a", decoder)
+func resolveFFmpegPath() (string, error) {
+	path := strings.TrimSpace(Config.FFmpegPath)
+	if path == "" {
+		path = "ffmpeg"
 	}
-	args = append(args, "-i", inPath, "-vn")
-	switch targetFmt {
-	case "flac":
-		args = append(args, "-c:a", "flac")
-	case "mp3":
-		// VBR quality 2 ~ high quality
-		args = append(args, "-c:a", "libmp3lame", "-qscale:a", "2")
-	case "opus":
-		// Medium/high quality
-		args = append(args, "-c:a", "libopus", "-b:a", "192k", "-vbr", "on")
-	case "wav":
-		args = append(args, "-c:a", "pcm_s16le")
-	case "copy":
-		// Just container copy (probably pointless for same container)
-		args = append(args, "-c", "copy")
-	default:
-		return nil, fmt.Errorf("unsupported convert-format: %s", targetFmt)
+	return exec.LookPath(path)
+}
+
+func resolveFFprobePath(ffmpegPath string) string {
+	if ffmpegPath != "" && ffmpegPath != "ffmpeg" {
+		candidate := filepath.Join(filepath.Dir(ffmpegPath), "ffprobe")
+		if _, err := exec.LookPath(candidate); err == nil {
+			return candidate
+		}
 	}
-	if extraArgs != "" {
-		// naive split; for complex quoting you could enhance
-		args = append(args, strings.Fields(extraArgs)...)
+	if _, err := exec.LookPath("ffprobe"); err == nil {
+		return "ffprobe"
 	}
-	args = append(args, outPath)
-	return args, nil
+	return ""
 }
 
-func buildAlacToFlacArgs(inPath, outPath, decoder, extraArgs string, metadata map[string]string) []string {
-	args := []string{"-y"}
-	if decoder != "" {
-		args = append(args, "-c:a", decoder)
+func sampleFormatBitDepth(sampleFmt string) int {
+	match := sampleFmtBitDepthRe.FindStringSubmatch(strings.TrimSpace(sampleFmt))
+	if len(match) != 2 {
+		return 0
 	}
-	args = append(args,
-		"-i", inPath,
-		"-map", "0:a:0",
-		"-vn", "-sn", "-dn",
-		"-c:a", "flac",
-		"-compression_level", "8",
-		"-map_chapters", "0",
-		"-map_metadata", "0",
+	bitDepth, err := strconv.Atoi(match[1])
+	if err != nil || bitDepth <= 0 {
+		return 0
+	}
+	return bitDepth
+}
+
+func probeAudioBitDepth(ffprobePath, inPath string) int {
+	if ffprobePath == "" || inPath == "" {
+		return 0
+	}
+	cmd := exec.Command(
+		ffprobePath,
+		"-v",
+		"error",
+		"-select_streams",
+		"a:0",
+		"-show_entries",
+		"stream=bits_per_raw_sample,bits_per_sample,sample_fmt",
+		"-of",
+		"default=nw=1",
+		inPath,
 	)
-	if len(metadata) > 0 {
-		keys := make([]string, 0, len(metadata))
-		for key := range metadata {
-			keys = append(keys, key)
+	out, err := cmd.Output()
+	if err != nil {
+		return 0
+	}
+	values := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
 		}
-		sort.Strings(keys)
-		for _, key := range keys {
-			if val := strings.TrimSpace(metadata[key]); val != "" {
-				args = append(args, "-metadata", fmt.Sprintf("%s=%s", key, val))
-			}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+		if key == "" || value == "" {
+			continue
+		}
+		values[key] = value
+	}
+	if raw := strings.TrimSpace(values["bits_per_raw_sample"]); raw != "" {
+		if bitDepth, err := strconv.Atoi(raw); err == nil && bitDepth > 0 {
+			return bitDepth
 		}
 	}
-	if extraArgs != "" {
-		args = append(args, strings.Fields(extraArgs)...)
+	if raw := strings.TrimSpace(values["bits_per_sample"]); raw != "" {
+		if bitDepth, err := strconv.Atoi(raw); err == nil && bitDepth > 0 {
+			return bitDepth
+		}
 	}
-	args = append(args, outPath)
-	return args
+	if sampleFmt := strings.TrimSpace(values["sample_fmt"]); sampleFmt != "" {
+		return sampleFormatBitDepth(sampleFmt)
+	}
+	return 0
 }
 
-// CONVERSION FEATURE: Perform conversion if enabled.
-func convertIfNeeded(track *task.Track, lrc string) {
-	srcPath := track.SavePath
-	if srcPath == "" {
-		return
+func warnBitDepthReduction(label string, bitDepthBefore, bitDepthAfter int) bool {
+	if bitDepthBefore <= 0 || bitDepthAfter <= 0 || bitDepthAfter >= bitDepthBefore {
+		return false
 	}
-	ext := strings.ToLower(filepath.Ext(srcPath))
-	isAlac := strings.EqualFold(track.Codec, "ALAC")
-	repairMode := normalizeAlacRepairMode(Config.AlacRepairMode)
+	fmt.Printf("⚠ %s reduced bit depth during repair: %d-bit -> %d-bit\n", label, bitDepthBefore, bitDepthAfter)
+	return true
+}
 
-	if !Config.ConvertAfterDownload {
-		if !isAlac {
+func canUseAlacAt(ffmpegPath string) bool {
+	alacAtOnce.Do(func() {
+		if runtime.GOOS != "darwin" {
+			alacAtAvailable = false
 			return
 		}
-		ffmpegPath, err := resolveFFmpegPath()
+		if ffmpegPath == "" {
+			alacAtAvailable = false
+			return
+		}
+		cmd := exec.Command(ffmpegPath, "-hide_banner", "-decoders")
+		out, err := cmd.Output()
 		if err != nil {
-			fmt.Printf("ffmpeg not found at '%s'; skipping ALAC repair.\n", Config.FFmpegPath)
+			alacAtAvailable = false
 			return
 		}
-		ffprobePath := resolveFFprobePath(ffmpegPath)
-		sourceBitDepth := probeAudioBitDepth(ffprobePath, srcPath)
-		repaired, repairReason := repairAlacIfNeeded(ffmpegPath, srcPath, repairMode, "ALAC")
-		if repaired {
-			repairedBitDepth := probeAudioBitDepth(ffprobePath, srcPath)
-			warnBitDepthReduction("ALAC repair", sourceBitDepth, repairedBitDepth)
-			emitRepairEntry(track, srcPath, repairMode, repairReason, sourceBitDepth, repairedBitDepth)
-			if err := writeMP4Tags(track, lrc); err != nil {
-				fmt.Println("⚠ Failed to restore MP4 tags after ALAC repair:", err)
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.Contains(line, " alac_at") || strings.Contains(line, "\talac_at") {
+				alacAtAvailable = true
+				return
 			}
 		}
-		return
-	}
+		alacAtAvailable = false
+	})
+	return alacAtAvailable
+}
 
-	if Config.ConvertFormat == "" {
+func warnAlacAtFallback() {
+	alacAtWarnOnce.Do(func() {
+		if runtime.GOOS != "darwin" {
+			fmt.Println("ALAC decode: alac_at is macOS-only; falling back to ffmpeg's native ALAC decoder.")
+			return
+		}
+		fmt.Println("ALAC decode: ffmpeg does not list alac_at; falling back to native ALAC decoder.")
+	})
+}
+
+func warnFfprobeMissing() {
+	ffprobeWarnOnce.Do(func() {
+		fmt.Println("ffprobe unavailable; skipping FLAC metadata extraction from source tags.")
+	})
+}
+
+// flacStrippedTags are container leftovers ffmpeg copies from the MP4
+// source into the Vorbis comment.
+var flacStrippedTags = []string{
+	"major_brand",
+	"minor_version",
+	"compatible_brands",
+	"creation_time",
+	"encoder",
+	"encoded_by",
+}
+
+// splitFlacNumberTag rewrites "3/12" style values into a number tag and
+// both common total tags.
+func splitFlacNumberTag(vc *flacmeta.VorbisComment, numberKey string, totalKeys ...string) {
+	value := vc.First(numberKey)
+	if !strings.Contains(value, "/") {
 		return
 	}
-	if !shouldConvertTrack(track) {
-		fmt.Printf("Conversion skipped (format %s not selected)\n", formatKeyForTrack(track))
+	parts := strings.SplitN(value, "/", 2)
+	num := strings.TrimSpace(parts[0])
+	total := strings.TrimSpace(parts[1])
+	if num == "" || total == "" {
 		return
 	}
-	targetFmt := strings.ToLower(Config.ConvertFormat)
+	vc.Set(numberKey, num)
+	for _, key := range totalKeys {
+		vc.Set(key, total)
+	}
+}
 
-	// Map extension for output
-	if targetFmt == "copy" {
-		fmt.Println("Convert (copy) requested; skipping because it produces no new format.")
+// postprocessFlacTags normalizes the tags of a converted FLAC file and
+// embeds the cover and lyrics, which ffmpeg drops during conversion.
+func postprocessFlacTags(filePath string, track *task.Track, lrc string) {
+	f, err := flacmeta.Open(filePath)
+	if err != nil {
+		fmt.Println("Failed to read FLAC metadata:", err)
 		return
 	}
+	splitFlacNumberTag(f.Comment, "TRACKNUMBER", "TOTALTRACKS", "TRACKTOTAL")
+	splitFlacNumberTag(f.Comment, "DISCNUMBER", "TOTALDISCS", "DISCTOTAL")
+	f.Comment.Remove(flacStrippedTags...)
 
-	if Config.ConvertSkipIfSourceMatch {
-		if ext == "."+targetFmt {
-			fmt.Printf("Conversion skipped (already %s)\n", targetFmt)
-			return
-		}
+	if lrc != "" && f.Comment.First("LYRICS") == "" {
+		f.Comment.Set("LYRICS", lrc)
 	}
+	if pic := coverPictureForTrack(track); pic != nil {
+		f.SetCover(pic)
+	}
+	if err := f.Save(); err != nil {
+		fmt.Println("Failed to write FLAC metadata:", err)
+	}
+}
 
-	outBase := strings.TrimSuffix(srcPath, ext)
-	outPath := outBase + "." + targetFmt
-
-	// Handle lossy -> lossless cases: optionally skip or warn
-	if (targetFmt == "flac" || targetFmt == "wav") && isLossySource(ext, track.Codec) {
-		if Config.ConvertSkipLossyToLossless {
-			fmt.Println("Skipping conversion: source appears lossy and target is lossless; configured to skip.")
-			return
-		}
-		if Config.ConvertWarnLossyToLossless {
-			fmt.Println("Warning: Converting lossy source to lossless container will not improve quality.")
+// coverPictureForTrack loads the embed cover of track as a FLAC picture
+// block, which also carries the MIME type and size needed by Opus and ID3.
+func coverPictureForTrack(track *task.Track) *flacmeta.Picture {
+	if track == nil || track.CoverPath == "" || !Config.EmbedCover || !metadataTagEnabled("cover") {
+		return nil
+	}
+	data, err := os.ReadFile(track.CoverPath)
+	if err == nil {
+		var pic *flacmeta.Picture
+		pic, err = flacmeta.NewPicture(data, flacmeta.PictureFrontCover)
+		if err == nil {
+			return pic
 		}
 	}
+	fmt.Println("Failed to read cover for embedding:", err)
+	return nil
+}
 
-	ffmpegPath, err := resolveFFmpegPath()
+func readFormatTags(ffprobePath, inPath string) (map[string]string, error) {
+	cmd := exec.Command(
+		ffprobePath,
+		"-v",
+		"error",
+		"-show_entries",
+		"format_tags",
+		"-of",
+		"default=nw=1",
+		inPath,
+	)
+	out, err := cmd.Output()
 	if err != nil {
-		fmt.Printf("ffmpeg not found at '%s'; skipping conversion.\n", Config.FFmpegPath)
-		return
+		return nil, err
 	}
-	ffprobePath := resolveFFprobePath(ffmpegPath)
-
-	alacDecoder := ""
-	alacNeedsRepair := false
-	alacRepairReason := ""
-	alacRepairMessage := ""
-	sourceBitDepth := 0
-	if isAlac {
-		alacNeedsRepair, alacRepairReason, alacRepairMessage = decideAlacRepair(ffmpegPath, srcPath, repairMode)
-		if alacNeedsRepair {
-			sourceBitDepth = probeAudioBitDepth(ffprobePath, srcPath)
-			alacDecoder = selectAlacDecoder(ffmpegPath)
+	tags := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		line = strings.TrimPrefix(line, "TAG:")
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
 		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+		if key == "" || value == "" {
+			continue
+		}
+		tags[key] = value
 	}
-
-	if targetFmt == "flac" && isAlac {
-		flacMetadata := buildSelectedFlacMetadata(ffprobePath, srcPath, track)
-		args := buildAlacToFlacArgs(srcPath, outPath, alacDecoder, Config.ConvertExtraArgs, flacMetadata)
-		fmt.Printf("Converting -> %s ...\n", targetFmt)
-		cmd := exec.Command(ffmpegPath, args...)
-		cmd.Stdout = nil
-		cmd.Stderr = nil
-		start := time.Now()
-		if err := cmd.Run(); err != nil {
-			fmt.Println("Conversion failed:", err)
-			return
-		}
-		fmt.Printf("Conversion completed in %s: %s\n", time.Since(start).Truncate(time.Millisecond), filepath.Base(outPath))
-		postprocessFlacTags(outPath)
-		outputBitDepth := 0
-		if alacNeedsRepair {
-			outputBitDepth = probeAudioBitDepth(ffprobePath, outPath)
-		}
-		if Config.ConvertKeepOriginal {
-			if alacNeedsRepair && runAlacRepair(ffmpegPath, alacDecoder, srcPath, "original ALAC", alacRepairReason, alacRepairMessage) == nil {
-				repairedBitDepth := probeAudioBitDepth(ffprobePath, srcPath)
-				warnBitDepthReduction("ALAC repair", sourceBitDepth, repairedBitDepth)
-				emitRepairEntry(track, srcPath, repairMode, alacRepairReason, sourceBitDepth, repairedBitDepth)
-				if err := writeMP4Tags(track, lrc); err != nil {
-					fmt.Println("⚠ Failed to restore MP4 tags after original ALAC repair:", err)
-				}
-			}
-		}
-		if !Config.ConvertKeepOriginal {
-			if alacNeedsRepair {
-				warnBitDepthReduction("ALAC->FLAC repair path", sourceBitDepth, outputBitDepth)
-				emitRepairEntry(track, outPath, repairMode, alacRepairReason, sourceBitDepth, outputBitDepth)
-			}
-			if err := os.Remove(srcPath); err != nil {
-				fmt.Println("Failed to remove original after conversion:", err)
-			} else {
-				track.SavePath = outPath
-				track.SaveName = filepath.Base(outPath)
-				fmt.Println("Original removed.")
-			}
-		} else {
-			track.SavePath = outPath
-			track.SaveName = filepath.Base(outPath)
-		}
-		return
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
+	return tags, nil
+}
 
-	args, err := buildFFmpegArgs(srcPath, outPath, targetFmt, Config.ConvertExtraArgs, alacDecoder)
-	if err != nil {
-		fmt.Println("Conversion config error:", err)
-		return
+func pickFirstTag(tags map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if val := tags[key]; val != "" {
+			return val
+		}
 	}
+	return ""
+}
 
-	fmt.Printf("Converting -> %s ...\n", targetFmt)
-	cmd := exec.Command(ffmpegPath, args...)
-	cmd.Stdout = nil
-	cmd.Stderr = nil
-	start := time.Now()
-	if err := cmd.Run(); err != nil {
-		fmt.Println("Conversion failed:", err)
-		// leave original
-		return
+func splitTagFraction(value string) (string, string) {
+	raw := strings.TrimSpace(value)
+	if raw == "" {
+		return "", ""
 	}
-	fmt.Printf("Conversion completed in %s: %s\n", time.Since(start).Truncate(time.Millisecond), filepath.Base(outPath))
-	if Config.ConvertKeepOriginal && isAlac {
-		if alacNeedsRepair && runAlacRepair(ffmpegPath, alacDecoder, srcPath, "original ALAC", alacRepairReason, alacRepairMessage) == nil {
-			repairedBitDepth := probeAudioBitDepth(ffprobePath, srcPath)
-			warnBitDepthReduction("ALAC repair", sourceBitDepth, repairedBitDepth)
-			emitRepairEntry(track, srcPath, repairMode, alacRepairReason, sourceBitDepth, repairedBitDepth)
-			if err := writeMP4Tags(track, lrc); err != nil {
-				fmt.Println("⚠ Failed to restore MP4 tags after original ALAC repair:", err)
-			}
-		}
+	parts := strings.SplitN(raw, "/", 2)
+	left := strings.TrimSpace(parts[0])
+	if len(parts) == 1 {
+		return left, ""
 	}
+	right := strings.TrimSpace(parts[1])
+	return left, right
+}
 
-	if !Config.ConvertKeepOriginal {
-		if isAlac && alacNeedsRepair {
-			emitRepairEntry(track, outPath, repairMode, alacRepairReason, 0, 0)
-		}
-		if err := os.Remove(srcPath); err != nil {
-			fmt.Println("Failed to remove original after conversion:", err)
-		} else {
-			track.SavePath = outPath
-			track.SaveName = filepath.Base(outPath)
-			fmt.Println("Original removed.")
-		}
-	} else {
-		// Keep both but point track to new file (optional decision)
-		track.SavePath = outPath
-		track.SaveName = filepath.Base(outPath)
+func assignFlacMetadata(metadata map[string]string, key, value string) {
+	val := strings.TrimSpace(value)
+	if key == "" || val == "" {
+		return
 	}
+	metadata[key] = val
 }
 
-func buildSongName(track *task.Track, quality string) string {
-	title, _ := metadataTitleAndArtistsFromTrack(track)
-	if title == "" {
-		title = track.Resp.Attributes.Name
+func buildSelectedFlacMetadataFromTags(tags map[string]string) map[string]string {
+	metadata := map[string]string{}
+
+	if metadataTagEnabledFlac("title") {
+		assignFlacMetadata(metadata, "TITLE", pickFirstTag(tags, "title"))
 	}
-	stringsToJoin := []string{}
-	if track.Resp.Attributes.IsAppleDigitalMaster {
-		if Config.AppleMasterChoice != "" {
-			stringsToJoin = append(stringsToJoin, Config.AppleMasterChoice)
-		}
+	if metadataTagEnabledFlac("title_sort") {
+		assignFlacMetadata(metadata, "TITLESORT", pickFirstTag(tags, "titlesort", "sort_name"))
 	}
-	if track.Resp.Attributes.ContentRating == "explicit" {
-		if Config.ExplicitChoice != "" {
-			stringsToJoin = append(stringsToJoin, Config.ExplicitChoice)
-		}
+	if metadataTagEnabledFlac("artist") {
+		assignFlacMetadata(metadata, "ARTIST", pickFirstTag(tags, "artist"))
 	}
-	if track.Resp.Attributes.ContentRating == "clean" {
-		if Config.CleanChoice != "" {
-			stringsToJoin = append(stringsToJoin, Config.CleanChoice)
-		}
+	if metadataTagEnabledFlac("artist_sort") {
+		assignFlacMetadata(metadata, "ARTISTSORT", pickFirstTag(tags, "artistsort", "sort_artist"))
 	}
-	tagString := strings.Join(stringsToJoin, " ")
-	trackNumber := track.Resp.Attributes.TrackNumber
-	if trackNumber == 0 {
-		trackNumber = track.TaskNum
+	if metadataTagEnabledFlac("album") {
+		assignFlacMetadata(metadata, "ALBUM", pickFirstTag(tags, "album"))
 	}
-	return strings.NewReplacer(
-		"{SongId}", track.ID,
-		"{SongNumer}", fmt.Sprintf("%02d", trackNumber),
-		"{SongName}", LimitString(title),
-		"{DiscNumber}", fmt.Sprintf("%0d", track.Resp.Attributes.DiscNumber),
-		"{TrackNumber}", fmt.Sprintf("%0d", trackNumber),
-		"{Quality}", quality,
-		"{Tag}", tagString,
-		"{Codec}", track.Codec,
-	).Replace(Config.SongFileFormat)
-}
-
-func withAtmosMetadataPrefix(value string, apply bool) string {
-	clean := strings.TrimSpace(value)
-	if clean == "" {
-		return ""
+	if metadataTagEnabledFlac("album_sort") {
+		assignFlacMetadata(metadata, "ALBUMSORT", pickFirstTag(tags, "albumsort", "sort_album"))
 	}
-	if !apply {
-		return clean
+	if metadataTagEnabledFlac("album_artist") {
+		assignFlacMetadata(metadata, "ALBUMARTIST", pickFirstTag(tags, "albumartist", "album_artist"))
 	}
-	if strings.HasPrefix(clean, atmosMetadataPrefix) {
-		return clean
+	if metadataTagEnabledFlac("album_artist_sort") {
+		assignFlacMetadata(
+			metadata,
+			"ALBUMARTISTSORT",
+			pickFirstTag(tags, "albumartistsort", "sort_album_artist", "sort_albumartist"),
+		)
 	}
-	return atmosMetadataPrefix + clean
-}
-
-func metadataAtmosPrefixEnabled() bool {
-	if Config.MetadataAtmosPrefix == nil {
-		return true
+	if metadataTagEnabledFlac("composer") {
+		assignFlacMetadata(metadata, "COMPOSER", formatComposerList(pickFirstTag(tags, "composer")))
 	}
-	return *Config.MetadataAtmosPrefix
-}
-
-func shouldUseAtmosMetadataPrefix(track *task.Track) bool {
-	if !metadataAtmosPrefixEnabled() {
-		return false
+	if metadataTagEnabledFlac("composer_sort") {
+		assignFlacMetadata(metadata, "COMPOSERSORT", formatComposerList(pickFirstTag(tags, "composersort", "sort_composer")))
 	}
-	if resolveActiveMetadataSourceFormat() == "atmos" {
-		return true
+	if metadataTagEnabledFlac("genre") {
+		assignFlacMetadata(metadata, "GENRE", pickFirstTag(tags, "genre"))
 	}
-	return track != nil && strings.EqualFold(track.Codec, "ATMOS")
-}
 
-func normalizedArtistNames(names []string) []string {
-	seen := map[string]struct{}{}
-	out := []string{}
-	for _, raw := range names {
-		name := strings.TrimSpace(raw)
-		if name == "" {
-			continue
-		}
-		if _, ok := seen[name]; ok {
-			continue
+	trackRaw := pickFirstTag(tags, "tracknumber", "track", "tracknum")
+	trackNumber, trackTotal := splitTagFraction(trackRaw)
+	if metadataTagEnabledFlac("track_number") {
+		assignFlacMetadata(metadata, "TRACKNUMBER", trackNumber)
+	}
+	if metadataTagEnabledFlac("track_total") {
+		if trackTotal == "" {
+			trackTotal = pickFirstTag(tags, "tracktotal", "totaltracks", "track_total")
 		}
-		seen[name] = struct{}{}
-		out = append(out, name)
+		assignFlacMetadata(metadata, "TRACKTOTAL", trackTotal)
 	}
-	return out
-}
 
-func splitArtistTokens(raw string, delimiters []string) []string {
-	parts := []string{raw}
-	for _, delimiter := range delimiters {
-		next := make([]string, 0, len(parts))
-		for _, part := range parts {
-			if strings.Contains(part, delimiter) {
-				next = append(next, strings.Split(part, delimiter)...)
-			} else {
-				next = append(next, part)
-			}
+	discRaw := pickFirstTag(tags, "discnumber", "disc", "disk")
+	discNumber, discTotal := splitTagFraction(discRaw)
+	if metadataTagEnabledFlac("disc_number") {
+		assignFlacMetadata(metadata, "DISCNUMBER", discNumber)
+	}
+	if metadataTagEnabledFlac("disc_total") {
+		if discTotal == "" {
+			discTotal = pickFirstTag(tags, "disctotal", "totaldiscs", "disc_total")
 		}
-		parts = next
+		assignFlacMetadata(metadata, "DISCTOTAL", discTotal)
 	}
-	return parts
-}
 
-func normalizeArtistsFromField(value string) []string {
-	raw := strings.TrimSpace(value)
-	if raw == "" {
-		return nil
+	if metadataTagEnabledFlac("release_date") {
+		assignFlacMetadata(metadata, "DATE", pickFirstTag(tags, "date", "release_date", "releasedate"))
 	}
-	raw = artistFeatSeparatorRe.ReplaceAllString(raw, "; ")
-	parts := splitArtistTokens(raw, []string{
-		"; ",
-		";",
-		" / ",
-		" x ",
-		" X ",
-		" × ",
-	})
-	return normalizedArtistNames(parts)
-}
-
-func parseFeaturedArtists(value string) []string {
-	raw := strings.TrimSpace(value)
-	if raw == "" {
-		return nil
+	if metadataTagEnabledFlac("original_date") {
+		assignFlacMetadata(
+			metadata,
+			"ORIGINALDATE",
+			pickFirstTag(tags, "originaldate", "original_date", "origdate", "tdor"),
+		)
 	}
-	parts := splitArtistTokens(raw, []string{
-		"; ",
-		";",
-		" / ",
-		" x ",
-		" X ",
-		" × ",
-		" and ",
-		" And ",
-		" with ",
+	if metadataTagEnabledFlac("release_type") {
+		assignFlacMetadata(metadata, "RELEASETYPE", pickFirstTag(tags, "releasetype", "release_type"))
+	}
+	if metadataTagEnabledFlac("isrc") {
+		assignFlacMetadata(metadata, "ISRC", pickFirstTag(tags, "isrc"))
+	}
+	if metadataTagEnabledFlac("upc") {
+		assignFlacMetadata(metadata, "UPC", pickFirstTag(tags, "upc"))
+	}
+	if metadataTagEnabledFlac("label") {
+		assignFlacMetadata(metadata, "LABEL", pickFirstTag(tags, "label"))
+	}
+	if metadataTagEnabledFlac("publisher") {
+		assignFlacMetadata(metadata, "PUBLISHER", pickFirstTag(tags, "publisher", "label"))
+	}
+	if metadataTagEnabledFlac("copyright") {
+		assignFlacMetadata(metadata, "COPYRIGHT", pickFirstTag(tags, "copyright"))
+	}
+	if metadataTagEnabledFlac("performer") {
+		assignFlacMetadata(metadata, "PERFORMER", pickFirstTag(tags, "performer"))
+	}
+	if metadataTagEnabledFlac("lyrics") {
+		assignFlacMetadata(metadata, "LYRICS", pickFirstTag(tags, "lyrics"))
+	}
+	if metadataTagEnabledFlac("album_version") {
+		assignFlacMetadata(metadata, "ALBUMVERSION", pickFirstTag(tags, "albumversion", "edition", "version"))
+	}
+	if metadataTagEnabledFlac("loudness") {
+		assignFlacMetadata(metadata, "REPLAYGAIN_TRACK_GAIN", pickFirstTag(tags, "replaygain_track_gain"))
+		assignFlacMetadata(metadata, "REPLAYGAIN_TRACK_PEAK", pickFirstTag(tags, "replaygain_track_peak"))
+		assignFlacMetadata(metadata, "REPLAYGAIN_ALBUM_GAIN", pickFirstTag(tags, "replaygain_album_gain"))
+		assignFlacMetadata(metadata, "REPLAYGAIN_ALBUM_PEAK", pickFirstTag(tags, "replaygain_album_peak"))
+		assignFlacMetadata(metadata, "R128_TRACK_GAIN", pickFirstTag(tags, "r128_track_gain"))
+		assignFlacMetadata(metadata, "R128_ALBUM_GAIN", pickFirstTag(tags, "r128_album_gain"))
+	}
+
+	for key, value := range metadataCustomTagsFlac {
+		assignFlacMetadata(metadata, key, value)
+	}
+
+	return metadata
+}
+
+func applyAtmosPrefixToSelectedFlacMetadata(metadata map[string]string, track *task.Track) {
+	if !shouldUseAtmosMetadataPrefix(track) {
+		return
+	}
+	if value, ok := metadata["TITLE"]; ok {
+		assignFlacMetadata(metadata, "TITLE", withAtmosMetadataPrefix(value, true))
+	}
+	if value, ok := metadata["TITLESORT"]; ok {
+		assignFlacMetadata(metadata, "TITLESORT", withAtmosMetadataPrefix(value, true))
+	}
+	if value, ok := metadata["ALBUM"]; ok {
+		assignFlacMetadata(metadata, "ALBUM", withAtmosMetadataPrefix(value, true))
+	}
+	if value, ok := metadata["ALBUMSORT"]; ok {
+		assignFlacMetadata(metadata, "ALBUMSORT", withAtmosMetadataPrefix(value, true))
+	}
+}
+
+func buildSelectedFlacMetadata(ffprobePath, inPath string, track *task.Track) map[string]string {
+	tags := map[string]string{}
+
+	if ffprobePath == "" {
+		warnFfprobeMissing()
+	} else {
+		found, err := readFormatTags(ffprobePath, inPath)
+		if err != nil {
+			warnFfprobeMissing()
+		} else {
+			tags = found
+		}
+	}
+
+	metadata := buildSelectedFlacMetadataFromTags(tags)
+	if metadataTagEnabledFlac("release_type") {
+		if _, exists := metadata["RELEASETYPE"]; !exists {
+			assignFlacMetadata(metadata, "RELEASETYPE", metadataReleaseTypeForTrack(track))
+		}
+	}
+	applyAtmosPrefixToSelectedFlacMetadata(metadata, track)
+	return metadata
+}
+
+func selectAlacDecoder(ffmpegPath string) string {
+	if canUseAlacAt(ffmpegPath) {
+		return "alac_at"
+	}
+	warnAlacAtFallback()
+	return "alac"
+}
+
+func validateAlacFile(ffmpegPath, inPath string) (bool, string) {
+	if _, err := integrity.Decode(ffmpegPath, inPath); err != nil {
+		return false, err.Error()
+	}
+	return true, ""
+}
+
+func decideAlacRepair(ffmpegPath, srcPath, mode string) (bool, string, string) {
+	normalized := normalizeAlacRepairMode(mode)
+	switch normalized {
+	case "off":
+		return false, "", ""
+	case "all":
+		return true, "forced", ""
+	default:
+		ok, msg := validateAlacFile(ffmpegPath, srcPath)
+		if ok {
+			return false, "", ""
+		}
+		return true, "corrupt_detected", msg
+	}
+}
+
+func replaceFile(tmpPath, destPath string) error {
+	if err := os.Rename(tmpPath, destPath); err == nil {
+		return nil
+	}
+	if err := os.Remove(destPath); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, destPath)
+}
+
+func repairAlacInPlace(ffmpegPath, decoder, inPath string) error {
+	dir := filepath.Dir(inPath)
+	ext := filepath.Ext(inPath)
+	if ext == "" {
+		ext = ".m4a"
+	}
+	tmpFile, err := os.CreateTemp(dir, ".alac-repair-*"+ext)
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	_ = tmpFile.Close()
+
+	args := []string{"-y"}
+	if decoder != "" {
+		args = append(args, "-c:a", decoder)
+	}
+	args = append(args,
+		"-i", inPath,
+		"-map", "0",
+		"-c", "copy",
+		"-c:a", "alac",
+		"-map_metadata", "0",
+		"-map_chapters", "0",
+		tmpPath,
+	)
+	cmd := exec.Command(ffmpegPath, args...)
+	if err := cmd.Run(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := replaceFile(tmpPath, inPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+func runAlacRepair(ffmpegPath, decoder, srcPath, label, reason, validationMsg string) error {
+	if label == "" {
+		label = "ALAC"
+	}
+	if reason == "corrupt_detected" {
+		if validationMsg != "" {
+			fmt.Printf("%s validation failed; repairing (%s)\n", label, validationMsg)
+		} else {
+			fmt.Printf("%s validation failed; repairing.\n", label)
+		}
+	} else {
+		fmt.Printf("Repairing %s...\n", label)
+	}
+	if decoder == "" {
+		decoder = selectAlacDecoder(ffmpegPath)
+	}
+	if err := repairAlacInPlace(ffmpegPath, decoder, srcPath); err != nil {
+		fmt.Printf("%s repair failed: %v\n", label, err)
+		return err
+	}
+	fmt.Printf("%s repair complete.\n", label)
+	return nil
+}
+
+func repairAlacIfNeeded(ffmpegPath, srcPath, mode, label string) (bool, string) {
+	shouldRepair, reason, validationMsg := decideAlacRepair(ffmpegPath, srcPath, mode)
+	if !shouldRepair {
+		return false, ""
+	}
+	decoder := selectAlacDecoder(ffmpegPath)
+	if err := runAlacRepair(ffmpegPath, decoder, srcPath, label, reason, validationMsg); err != nil {
+		return false, ""
+	}
+	return true, reason
+}
+
+// CONVERSION FEATURE: Build ffmpeg arguments for desired target.
+func buildFFmpegArgs(inPath, outPath, targetFmt, extraArgs string, decoder string) ([]string, error) {
+	args := []string{"-y"}
+	if decoder != "" {
+		args = append(args, "-c:a", decoder)
+	}
+	args = append(args, "-i", inPath, "-vn")
+	switch targetFmt {
+	case "flac":
+		args = append(args, "-c:a", "flac")
+	case "mp3":
+		// VBR quality 2 ~ high quality
+		args = append(args, "-c:a", "libmp3lame", "-qscale:a", "2")
+	case "opus":
+		// Medium/high quality
+		args = append(args, "-c:a", "libopus", "-b:a", "192k", "-vbr", "on")
+	case "wav":
+		args = append(args, "-c:a", "pcm_s16le")
+	case "copy":
+		// Just container copy (probably pointless for same container)
+		args = append(args, "-c", "copy")
+	default:
+		return nil, fmt.Errorf("unsupported convert-format: %s", targetFmt)
+	}
+	if extraArgs != "" {
+		// naive split; for complex quoting you could enhance
+		args = append(args, strings.Fields(extraArgs)...)
+	}
+	args = append(args, outPath)
+	return args, nil
+}
+
+func buildAlacToFlacArgs(inPath, outPath, decoder, extraArgs string, metadata map[string]string) []string {
+	args := []string{"-y"}
+	if decoder != "" {
+		args = append(args, "-c:a", decoder)
+	}
+	args = append(args,
+		"-i", inPath,
+		"-map", "0:a:0",
+		"-vn", "-sn", "-dn",
+		"-c:a", "flac",
+		"-compression_level", "8",
+		"-map_chapters", "0",
+		"-map_metadata", "0",
+	)
+	if len(metadata) > 0 {
+		keys := make([]string, 0, len(metadata))
+		for key := range metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if val := strings.TrimSpace(metadata[key]); val != "" {
+				args = append(args, "-metadata", fmt.Sprintf("%s=%s", key, val))
+			}
+		}
+	}
+	if extraArgs != "" {
+		args = append(args, strings.Fields(extraArgs)...)
+	}
+	args = append(args, outPath)
+	return args
+}
+
+// withGaplessTrim cuts an MP4 source to its valid samples so the encoder
+// priming and padding recorded in its edit list or iTunSMPB do not end up
+// as silence in the converted file. An audio filter already in the args,
+// such as one from the extra args, runs after the trim.
+func withGaplessTrim(args []string, inPath string) []string {
+	if !strings.EqualFold(filepath.Ext(inPath), ".m4a") {
+		return args
+	}
+	g, err := mp4meta.ReadGapless(inPath)
+	if err != nil {
+		return args
+	}
+	filter := g.TrimFilter()
+	if filter == "" {
+		return args
+	}
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] != "-i" || args[i+1] != inPath {
+			continue
+		}
+		out := append([]string{}, args...)
+		// ffmpeg applies the last audio filter given.
+		for j := len(out) - 2; j >= i+2; j-- {
+			if out[j] == "-af" || out[j] == "-filter:a" {
+				out[j+1] = filter + "," + out[j+1]
+				return out
+			}
+		}
+		out = append(out[:i+2:i+2], "-af", filter)
+		return append(out, args[i+2:]...)
+	}
+	return args
+}
+
+// repairOriginalAlac re-encodes a corrupt ALAC download in place and
+// restores its tags.
+func repairOriginalAlac(track *task.Track, lrc, ffmpegPath, repairMode string) {
+	srcPath := track.SavePath
+	ffprobePath := resolveFFprobePath(ffmpegPath)
+	sourceBitDepth := probeAudioBitDepth(ffprobePath, srcPath)
+	repaired, repairReason := repairAlacIfNeeded(ffmpegPath, srcPath, repairMode, "ALAC")
+	if repaired {
+		repairedBitDepth := probeAudioBitDepth(ffprobePath, srcPath)
+		warnBitDepthReduction("ALAC repair", sourceBitDepth, repairedBitDepth)
+		emitRepairEntry(track, srcPath, repairMode, repairReason, sourceBitDepth, repairedBitDepth)
+		if err := writeMP4Tags(track, lrc); err != nil {
+			fmt.Println("⚠ Failed to restore MP4 tags after ALAC repair:", err)
+		}
+	}
+}
+
+// CONVERSION FEATURE: Perform conversion if enabled. Returns the files
+// written by the conversion.
+func convertIfNeeded(track *task.Track, lrc string) []string {
+	srcPath := track.SavePath
+	if srcPath == "" {
+		return nil
+	}
+	ext := strings.ToLower(filepath.Ext(srcPath))
+	isAlac := strings.EqualFold(track.Codec, "ALAC")
+	repairMode := normalizeAlacRepairMode(Config.AlacRepairMode)
+
+	if !Config.ConvertAfterDownload {
+		if !isAlac {
+			return nil
+		}
+		ffmpegPath, err := resolveFFmpegPath()
+		if err != nil {
+			fmt.Printf("ffmpeg not found at '%s'; skipping ALAC repair.\n", Config.FFmpegPath)
+			return nil
+		}
+		repairOriginalAlac(track, lrc, ffmpegPath, repairMode)
+		return nil
+	}
+
+	if len(Config.ConvertProfiles) > 0 {
+		return convertWithProfiles(track, lrc)
+	}
+
+	if Config.ConvertFormat == "" {
+		return nil
+	}
+	if !shouldConvertTrack(track) {
+		fmt.Printf("Conversion skipped (format %s not selected)\n", formatKeyForTrack(track))
+		return nil
+	}
+	targetFmt := strings.ToLower(Config.ConvertFormat)
+
+	// Map extension for output
+	if targetFmt == "copy" {
+		fmt.Println("Convert (copy) requested; skipping because it produces no new format.")
+		return nil
+	}
+
+	if Config.ConvertSkipIfSourceMatch {
+		if ext == "."+targetFmt {
+			fmt.Printf("Conversion skipped (already %s)\n", targetFmt)
+			return nil
+		}
+	}
+
+	outBase := strings.TrimSuffix(srcPath, ext)
+	outPath := outBase + "." + targetFmt
+
+	// Handle lossy -> lossless cases: optionally skip or warn
+	if (targetFmt == "flac" || targetFmt == "wav") && isLossySource(ext, track.Codec) {
+		if Config.ConvertSkipLossyToLossless {
+			fmt.Println("Skipping conversion: source appears lossy and target is lossless; configured to skip.")
+			return nil
+		}
+		if Config.ConvertWarnLossyToLossless {
+			fmt.Println("Warning: Converting lossy source to lossless container will not improve quality.")
+		}
+	}
+
+	ffmpegPath, err := resolveFFmpegPath()
+	if err != nil {
+		fmt.Printf("ffmpeg not found at '%s'; skipping conversion.\n", Config.FFmpegPath)
+		return nil
+	}
+	ffprobePath := resolveFFprobePath(ffmpegPath)
+
+	if isDolbyContainer(targetFmt) {
+		if !isDolbyTrack(track) {
+			fmt.Printf("Conversion skipped (%s needs an atmos or ac3 source)\n", targetFmt)
+			return nil
+		}
+		if targetFmt == "ec3" && strings.EqualFold(track.Codec, "AC3") {
+			outPath = outBase + ".ac3"
+		}
+		var vorbis map[string]string
+		if targetFmt == "mka" {
+			vorbis = buildSelectedFlacMetadata(ffprobePath, srcPath, track)
+		}
+		fmt.Printf("Remuxing -> %s ...\n", targetFmt)
+		if err := remuxDolby(targetFmt, ffmpegPath, srcPath, outPath, profileTags(track, lrc, vorbis)); err != nil {
+			fmt.Println("Remux failed:", err)
+			return nil
+		}
+		if !Config.ConvertKeepOriginal {
+			if err := os.Remove(srcPath); err != nil {
+				fmt.Println("Failed to remove original after conversion:", err)
+				return []string{outPath}
+			}
+			fmt.Println("Original removed.")
+		}
+		track.SavePath = outPath
+		track.SaveName = filepath.Base(outPath)
+		return []string{outPath}
+	}
+
+	alacDecoder := ""
+	alacNeedsRepair := false
+	alacRepairReason := ""
+	alacRepairMessage := ""
+	sourceBitDepth := 0
+	if isAlac {
+		alacNeedsRepair, alacRepairReason, alacRepairMessage = decideAlacRepair(ffmpegPath, srcPath, repairMode)
+		if alacNeedsRepair {
+			sourceBitDepth = probeAudioBitDepth(ffprobePath, srcPath)
+			alacDecoder = selectAlacDecoder(ffmpegPath)
+		}
+	}
+
+	if targetFmt == "flac" && isAlac {
+		flacMetadata := buildSelectedFlacMetadata(ffprobePath, srcPath, track)
+		args := withGaplessTrim(buildAlacToFlacArgs(srcPath, outPath, alacDecoder, Config.ConvertExtraArgs, flacMetadata), srcPath)
+		fmt.Printf("Converting -> %s ...\n", targetFmt)
+		cmd := exec.Command(ffmpegPath, args...)
+		cmd.Stdout = nil
+		cmd.Stderr = nil
+		start := time.Now()
+		if err := cmd.Run(); err != nil {
+			fmt.Println("Conversion failed:", err)
+			return nil
+		}
+		fmt.Printf("Conversion completed in %s: %s\n", time.Since(start).Truncate(time.Millisecond), filepath.Base(outPath))
+		postprocessFlacTags(outPath, track, lrc)
+		outputBitDepth := 0
+		if alacNeedsRepair {
+			outputBitDepth = probeAudioBitDepth(ffprobePath, outPath)
+		}
+		if Config.ConvertKeepOriginal {
+			if alacNeedsRepair && runAlacRepair(ffmpegPath, alacDecoder, srcPath, "original ALAC", alacRepairReason, alacRepairMessage) == nil {
+				repairedBitDepth := probeAudioBitDepth(ffprobePath, srcPath)
+				warnBitDepthReduction("ALAC repair", sourceBitDepth, repairedBitDepth)
+				emitRepairEntry(track, srcPath, repairMode, alacRepairReason, sourceBitDepth, repairedBitDepth)
+				if err := writeMP4Tags(track, lrc); err != nil {
+					fmt.Println("⚠ Failed to restore MP4 tags after original ALAC repair:", err)
+				}
+			}
+		}
+		if !Config.ConvertKeepOriginal {
+			if alacNeedsRepair {
+				warnBitDepthReduction("ALAC->FLAC repair path", sourceBitDepth, outputBitDepth)
+				emitRepairEntry(track, outPath, repairMode, alacRepairReason, sourceBitDepth, outputBitDepth)
+			}
+			if err := os.Remove(srcPath); err != nil {
+				fmt.Println("Failed to remove original after conversion:", err)
+			} else {
+				track.SavePath = outPath
+				track.SaveName = filepath.Base(outPath)
+				fmt.Println("Original removed.")
+			}
+		} else {
+			track.SavePath = outPath
+			track.SaveName = filepath.Base(outPath)
+		}
+		return []string{outPath}
+	}
+
+	args, err := buildFFmpegArgs(srcPath, outPath, targetFmt, Config.ConvertExtraArgs, alacDecoder)
+	if err != nil {
+		fmt.Println("Conversion config error:", err)
+		return nil
+	}
+	args = withGaplessTrim(args, srcPath)
+
+	fmt.Printf("Converting -> %s ...\n", targetFmt)
+	cmd := exec.Command(ffmpegPath, args...)
+	cmd.Stdout = nil
+	cmd.Stderr = nil
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		fmt.Println("Conversion failed:", err)
+		// leave original
+		return nil
+	}
+	fmt.Printf("Conversion completed in %s: %s\n", time.Since(start).Truncate(time.Millisecond), filepath.Base(outPath))
+	if Config.ConvertKeepOriginal && isAlac {
+		if alacNeedsRepair && runAlacRepair(ffmpegPath, alacDecoder, srcPath, "original ALAC", alacRepairReason, alacRepairMessage) == nil {
+			repairedBitDepth := probeAudioBitDepth(ffprobePath, srcPath)
+			warnBitDepthReduction("ALAC repair", sourceBitDepth, repairedBitDepth)
+			emitRepairEntry(track, srcPath, repairMode, alacRepairReason, sourceBitDepth, repairedBitDepth)
+			if err := writeMP4Tags(track, lrc); err != nil {
+				fmt.Println("⚠ Failed to restore MP4 tags after original ALAC repair:", err)
+			}
+		}
+	}
+
+	if !Config.ConvertKeepOriginal {
+		if isAlac && alacNeedsRepair {
+			emitRepairEntry(track, outPath, repairMode, alacRepairReason, 0, 0)
+		}
+		if err := os.Remove(srcPath); err != nil {
+			fmt.Println("Failed to remove original after conversion:", err)
+		} else {
+			track.SavePath = outPath
+			track.SaveName = filepath.Base(outPath)
+			fmt.Println("Original removed.")
+		}
+	} else {
+		// Keep both but point track to new file (optional decision)
+		track.SavePath = outPath
+		track.SaveName = filepath.Base(outPath)
+	}
+	return []string{outPath}
+}
+
+// convertWithProfiles fans a downloaded track out to every convert profile
+// whose formats match it. A corrupt ALAC source is repaired once up front
+// so each profile encodes from a clean file. Returns the converted files.
+func convertWithProfiles(track *task.Track, lrc string) []string {
+	srcPath := track.SavePath
+	ffmpegPath, err := resolveFFmpegPath()
+	if err != nil {
+		fmt.Printf("ffmpeg not found at '%s'; skipping conversion.\n", Config.FFmpegPath)
+		return nil
+	}
+	ffprobePath := resolveFFprobePath(ffmpegPath)
+	if strings.EqualFold(track.Codec, "ALAC") {
+		repairOriginalAlac(track, lrc, ffmpegPath, normalizeAlacRepairMode(Config.AlacRepairMode))
+	}
+
+	formatKey := formatKeyForTrack(track)
+	ext := strings.ToLower(filepath.Ext(srcPath))
+	sampleRate := probeAudioSampleRate(ffprobePath, srcPath)
+	bitDepth := probeAudioBitDepth(ffprobePath, srcPath)
+	var vorbis map[string]string
+
+	matched := 0
+	var outputs []string
+	for _, profile := range Config.ConvertProfiles {
+		if !convertProfileMatches(profile, formatKey) {
+			continue
+		}
+		matched++
+		codec := strings.ToLower(profile.Codec)
+		label := profile.Name
+		if label == "" {
+			label = codec
+		}
+		if isDolbyContainer(codec) && !isDolbyTrack(track) {
+			fmt.Printf("Profile %s skipped (%s needs an atmos or ac3 source)\n", label, codec)
+			continue
+		}
+		if (codec == "flac" || codec == "alac" || codec == "wav") && isLossySource(ext, track.Codec) {
+			if Config.ConvertSkipLossyToLossless {
+				fmt.Printf("Skipping profile %s: source appears lossy and target is lossless.\n", label)
+				continue
+			}
+			if Config.ConvertWarnLossyToLossless {
+				fmt.Println("Warning: Converting lossy source to lossless container will not improve quality.")
+			}
+		}
+		outPath, err := convertProfileOutputPath(profile, track, srcPath)
+		if err != nil {
+			fmt.Printf("Profile %s: %v\n", label, err)
+			continue
+		}
+		if outPath == srcPath {
+			fmt.Printf("Profile %s skipped (output would overwrite the source)\n", label)
+			continue
+		}
+		if isDolbyContainer(codec) {
+			if vorbis == nil && codec == "mka" {
+				vorbis = buildSelectedFlacMetadata(ffprobePath, srcPath, track)
+			}
+			fmt.Printf("Remuxing -> %s (%s) ...\n", codec, label)
+			start := time.Now()
+			if err := remuxDolby(codec, ffmpegPath, srcPath, outPath, profileTags(track, lrc, vorbis)); err != nil {
+				fmt.Printf("Remux (%s) failed: %v\n", label, err)
+				continue
+			}
+			fmt.Printf("Remux completed in %s: %s\n", time.Since(start).Truncate(time.Millisecond), outPath)
+			outputs = append(outputs, outPath)
+			continue
+		}
+		args, err := buildProfileFFmpegArgs(profile, srcPath, outPath, sampleRate, bitDepth)
+		if err != nil {
+			fmt.Println("Conversion config error:", err)
+			continue
+		}
+		args = withGaplessTrim(args, srcPath)
+		if err := os.MkdirAll(filepath.Dir(outPath), os.ModePerm); err != nil {
+			fmt.Printf("Profile %s: %v\n", label, err)
+			continue
+		}
+		fmt.Printf("Converting -> %s (%s) ...\n", codec, label)
+		start := time.Now()
+		if err := exec.Command(ffmpegPath, args...).Run(); err != nil {
+			fmt.Printf("Conversion (%s) failed: %v\n", label, err)
+			continue
+		}
+		if vorbis == nil && codec != "alac" && codec != "aac" && codec != "wav" {
+			vorbis = buildSelectedFlacMetadata(ffprobePath, srcPath, track)
+		}
+		if err := writeProfileTags(codec, outPath, track, lrc, vorbis); err != nil {
+			fmt.Printf("Failed to write %s tags: %v\n", label, err)
+		}
+		fmt.Printf("Conversion completed in %s: %s\n", time.Since(start).Truncate(time.Millisecond), outPath)
+		outputs = append(outputs, outPath)
+	}
+	if matched == 0 {
+		fmt.Printf("Conversion skipped (format %s not selected)\n", formatKey)
+		return nil
+	}
+	if Config.ConvertKeepOriginal || len(outputs) != matched {
+		return outputs
+	}
+	if err := os.Remove(srcPath); err != nil {
+		fmt.Println("Failed to remove original after conversion:", err)
+		return outputs
+	}
+	track.SavePath = outputs[0]
+	track.SaveName = filepath.Base(outputs[0])
+	fmt.Println("Original removed.")
+	return outputs
+}
+
+func convertProfileMatches(profile structs.ConvertProfile, formatKey string) bool {
+	formats := profile.Formats
+	if len(formats) == 0 {
+		formats = Config.ConvertFormats
+	}
+	if len(formats) == 0 {
+		formats = defaultConvertFormats()
+	}
+	for _, entry := range formats {
+		if strings.EqualFold(entry, formatKey) {
+			return true
+		}
+	}
+	return false
+}
+
+func convertProfileExt(codec string) (string, error) {
+	switch codec {
+	case "flac", "opus", "mp3", "wav":
+		return "." + codec, nil
+	case "alac", "aac":
+		return ".m4a", nil
+	case "ec3", "mka", "mp4":
+		return "." + codec, nil
+	}
+	return "", fmt.Errorf("unsupported codec: %s", codec)
+}
+
+// convertProfileOutputPath mirrors the source layout below the profile's
+// save-folder, or writes next to the source when none is set.
+func convertProfileOutputPath(profile structs.ConvertProfile, track *task.Track, srcPath string) (string, error) {
+	ext, err := convertProfileExt(strings.ToLower(profile.Codec))
+	if err != nil {
+		return "", err
+	}
+	if ext == ".ec3" && strings.EqualFold(track.Codec, "AC3") {
+		ext = ".ac3"
+	}
+	name := strings.TrimSuffix(filepath.Base(srcPath), filepath.Ext(srcPath))
+	if profile.FileFormat != "" {
+		name = buildSongNameFromFormat(track, track.Quality, profile.FileFormat)
+	}
+	dir := filepath.Dir(srcPath)
+	if profile.SaveFolder != "" {
+		rel := ""
+		if root := saveRootForPath(srcPath); root != "" {
+			rel, _ = relativeToRoot(dir, root)
+		}
+		dir = filepath.Join(profile.SaveFolder, rel)
+	}
+	return filepath.Join(dir, nameProfile.File(dir, name)+ext), nil
+}
+
+func buildProfileFFmpegArgs(profile structs.ConvertProfile, inPath, outPath string, sampleRate, bitDepth int) ([]string, error) {
+	codec := strings.ToLower(profile.Codec)
+	args := []string{
+		"-y",
+		"-i", inPath,
+		"-map", "0:a:0",
+		"-vn", "-sn", "-dn",
+		"-map_metadata", "-1",
+	}
+	targetRate := 0
+	if profile.MaxSampleRate > 0 && sampleRate > profile.MaxSampleRate {
+		targetRate = profile.MaxSampleRate
+	}
+	targetDepth := 0
+	if profile.MaxBitDepth > 0 && bitDepth > profile.MaxBitDepth {
+		targetDepth = profile.MaxBitDepth
+	}
+
+	switch codec {
+	case "flac":
+		level := profile.Quality
+		if level == "" {
+			level = "8"
+		}
+		args = append(args, "-c:a", "flac", "-compression_level", level)
+		switch targetDepth {
+		case 16:
+			args = append(args, "-sample_fmt", "s16")
+		case 24:
+			args = append(args, "-sample_fmt", "s32", "-bits_per_raw_sample", "24")
+		}
+	case "alac":
+		args = append(args, "-c:a", "alac")
+		switch targetDepth {
+		case 16:
+			args = append(args, "-sample_fmt", "s16p")
+		case 24:
+			args = append(args, "-sample_fmt", "s32p")
+		}
+	case "wav":
+		if targetDepth == 16 || (targetDepth == 0 && bitDepth <= 16) {
+			args = append(args, "-c:a", "pcm_s16le")
+		} else {
+			args = append(args, "-c:a", "pcm_s24le")
+		}
+	case "aac":
+		bitrate := profile.Bitrate
+		if bitrate == "" {
+			bitrate = "256k"
+		}
+		args = append(args, "-c:a", "aac", "-b:a", bitrate)
+	case "opus":
+		bitrate := profile.Bitrate
+		if bitrate == "" {
+			bitrate = "160k"
+		}
+		// Opus always runs at 48 kHz.
+		targetRate = 48000
+		args = append(args, "-c:a", "libopus", "-b:a", bitrate, "-vbr", "on")
+	case "mp3":
+		args = append(args, "-c:a", "libmp3lame")
+		if profile.Bitrate != "" {
+			args = append(args, "-b:a", profile.Bitrate)
+		} else {
+			quality := profile.Quality
+			if quality == "" {
+				quality = "2"
+			}
+			args = append(args, "-qscale:a", quality)
+		}
+		if targetRate == 0 && sampleRate > 48000 {
+			targetRate = 48000
+		}
+		// Tags are written afterwards as ID3v2.4.
+		args = append(args, "-id3v2_version", "0", "-write_id3v1", "0")
+	default:
+		return nil, fmt.Errorf("unsupported codec: %s", profile.Codec)
+	}
+	if targetRate > 0 {
+		args = append(args, "-ar", strconv.Itoa(targetRate))
+	}
+	if profile.ExtraArgs != "" {
+		args = append(args, strings.Fields(profile.ExtraArgs)...)
+	}
+	return append(args, outPath), nil
+}
+
+// convertedTags carries what gets written into a converted file. vorbis
+// feeds Vorbis comments and ID3 frames; mp4 writes MP4 targets.
+type convertedTags struct {
+	vorbis map[string]string
+	lyrics string
+	cover  *flacmeta.Picture
+	mp4    func(path string) error
+}
+
+// writeProfileTags maps the track's tags, cover and lyrics into the
+// container of a converted file. Vorbis and ID3 targets use the
+// metadata-tags-flac selection, MP4 targets the m4a one.
+func writeProfileTags(codec, path string, track *task.Track, lrc string, vorbis map[string]string) error {
+	return writeConvertedTags(codec, path, profileTags(track, lrc, vorbis))
+}
+
+func profileTags(track *task.Track, lrc string, vorbis map[string]string) convertedTags {
+	return convertedTags{
+		vorbis: vorbis,
+		lyrics: lrc,
+		cover:  coverPictureForTrack(track),
+		mp4: func(path string) error {
+			return writeMP4TagsTo(track, lrc, path)
+		},
+	}
+}
+
+// isDolbyContainer reports whether codec names a container the AC-3/E-AC-3
+// stream is copied into rather than a codec to encode to.
+func isDolbyContainer(codec string) bool {
+	return codec == "ec3" || codec == "mka" || codec == "mp4"
+}
+
+func isDolbyTrack(track *task.Track) bool {
+	key := formatKeyForTrack(track)
+	return key == "atmos" || key == "ac3"
+}
+
+// remuxDolby copies the Dolby stream of srcPath into a raw .ec3/.ac3 file,
+// Matroska with tags and an attached cover, or an MP4 with dec3 and chnl
+// boxes checked by mp4meta. Atmos objects survive because nothing is
+// decoded.
+func remuxDolby(container, ffmpegPath, srcPath, outPath string, tags convertedTags) error {
+	if err := os.MkdirAll(filepath.Dir(outPath), os.ModePerm); err != nil {
+		return err
+	}
+	switch container {
+	case "mp4":
+		if _, err := linkfile.Place(srcPath, outPath, linkfile.Copy); err != nil {
+			return err
+		}
+		cfg, err := mp4meta.PrepareDolby(outPath)
+		if err != nil {
+			os.Remove(outPath)
+			return err
+		}
+		layout := cfg.Layout()
+		if cfg.JOC {
+			layout = fmt.Sprintf("%s + Atmos objects (complexity %d)", layout, cfg.Complexity)
+		}
+		fmt.Printf("Channel layout: %s, %d kbps\n", layout, cfg.DataRate)
+		if tags.mp4 == nil {
+			return nil
+		}
+		return tags.mp4(outPath)
+	case "ec3":
+		return exec.Command(ffmpegPath, "-y", "-i", srcPath, "-map", "0:a:0", "-c:a", "copy", outPath).Run()
+	case "mka":
+		args := []string{"-y", "-i", srcPath, "-map", "0:a:0", "-c:a", "copy", "-map_metadata", "-1"}
+		keys := make([]string, 0, len(tags.vorbis))
+		for key := range tags.vorbis {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			args = append(args, "-metadata", key+"="+strings.TrimSpace(tags.vorbis[key]))
+		}
+		if tags.lyrics != "" && tags.vorbis["LYRICS"] == "" {
+			args = append(args, "-metadata", "LYRICS="+tags.lyrics)
+		}
+		if tags.cover != nil {
+			name := "cover.jpg"
+			if tags.cover.MIME == "image/png" {
+				name = "cover.png"
+			}
+			coverPath := filepath.Join(filepath.Dir(outPath), "."+filepath.Base(outPath)+"."+name)
+			if err := os.WriteFile(coverPath, tags.cover.Data, 0644); err != nil {
+				return err
+			}
+			defer os.Remove(coverPath)
+			args = append(args, "-attach", coverPath,
+				"-metadata:s:t:0", "mimetype="+tags.cover.MIME,
+				"-metadata:s:t:0", "filename="+name)
+		}
+		return exec.Command(ffmpegPath, append(args, outPath)...).Run()
+	}
+	return fmt.Errorf("unsupported container: %s", container)
+}
+
+func writeConvertedTags(codec, path string, tags convertedTags) error {
+	switch codec {
+	case "alac", "aac":
+		if tags.mp4 == nil {
+			return nil
+		}
+		return tags.mp4(path)
+	case "flac":
+		f, err := flacmeta.Open(path)
+		if err != nil {
+			return err
+		}
+		applyVorbisTags(f.Comment, tags.vorbis, tags.lyrics)
+		if tags.cover != nil {
+			f.SetCover(tags.cover)
+		}
+		return f.Save()
+	case "opus":
+		vc, err := oggopus.ReadTags(path)
+		if err != nil {
+			return err
+		}
+		applyVorbisTags(vc, tags.vorbis, tags.lyrics)
+		if tags.cover != nil {
+			vc.Set("METADATA_BLOCK_PICTURE", base64.StdEncoding.EncodeToString(tags.cover.Encode()))
+		}
+		return oggopus.WriteTags(path, vc)
+	case "mp3":
+		tag := id3v2.FromVorbis(tags.vorbis)
+		lyricsText := tags.lyrics
+		if lyricsText == "" {
+			lyricsText = tags.vorbis["LYRICS"]
+		}
+		if lyricsText != "" {
+			synced, plain := id3v2.ParseLRC(lyricsText)
+			tag.AddLyrics("XXX", plain)
+			tag.AddSyncedLyrics("XXX", synced)
+		}
+		if tags.cover != nil {
+			tag.AddPicture(tags.cover.MIME, id3v2.PictureFrontCover, "", tags.cover.Data)
+		}
+		return id3v2.WriteFile(path, tag)
+	}
+	return nil
+}
+
+func applyVorbisTags(vc *flacmeta.VorbisComment, metadata map[string]string, lrc string) {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	vc.Fields = nil
+	for _, key := range keys {
+		vc.Set(key, strings.TrimSpace(metadata[key]))
+	}
+	splitFlacNumberTag(vc, "TRACKNUMBER", "TOTALTRACKS", "TRACKTOTAL")
+	splitFlacNumberTag(vc, "DISCNUMBER", "TOTALDISCS", "DISCTOTAL")
+	if lrc != "" && vc.First("LYRICS") == "" {
+		vc.Set("LYRICS", lrc)
+	}
+}
+
+// probeAudioCodec returns the codec name ffprobe reports for the first
+// audio stream, e.g. "alac" or "eac3".
+func probeAudioCodec(ffprobePath, inPath string) string {
+	if ffprobePath == "" || inPath == "" {
+		return ""
+	}
+	out, err := exec.Command(
+		ffprobePath,
+		"-v", "error",
+		"-select_streams", "a:0",
+		"-show_entries", "stream=codec_name",
+		"-of", "default=nw=1:nk=1",
+		inPath,
+	).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// probeDuration returns the container duration ffprobe reports, or 0.
+func probeDuration(ffprobePath, inPath string) time.Duration {
+	if ffprobePath == "" || inPath == "" {
+		return 0
+	}
+	out, err := exec.Command(
+		ffprobePath,
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=nw=1:nk=1",
+		inPath,
+	).Output()
+	if err != nil {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func probeAudioSampleRate(ffprobePath, inPath string) int {
+	if ffprobePath == "" || inPath == "" {
+		return 0
+	}
+	out, err := exec.Command(
+		ffprobePath,
+		"-v", "error",
+		"-select_streams", "a:0",
+		"-show_entries", "stream=sample_rate",
+		"-of", "default=nw=1:nk=1",
+		inPath,
+	).Output()
+	if err != nil {
+		return 0
+	}
+	rate, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return 0
+	}
+	return rate
+}
+
+func buildSongName(track *task.Track, quality string) string {
+	return buildSongNameFromFormat(track, quality, songFileFormat(metadataReleaseTypeForTrack(track)))
+}
+
+func buildSongNameFromFormat(track *task.Track, quality, format string) string {
+	title, _ := metadataTitleAndArtistsFromTrack(track)
+	if title == "" {
+		title = track.Resp.Attributes.Name
+	}
+	trackNumber := track.Resp.Attributes.TrackNumber
+	if trackNumber == 0 {
+		trackNumber = track.TaskNum
+	}
+	v := naming.Vars{}
+	if track.AlbumData.ID != "" {
+		v = albumNameVars(&track.AlbumData, track.AlbumData.Attributes.ArtistName, track.AlbumData.ID, "", "")
+	} else {
+		v["AlbumName"] = LimitString(track.Resp.Attributes.AlbumName)
+		v["ReleaseType"] = metadataReleaseTypeForTrack(track)
+	}
+	if track.DiscTotal > 0 {
+		v["DiscTotal"] = strconv.Itoa(track.DiscTotal)
+	}
+	if len(track.Resp.Attributes.GenreNames) > 0 {
+		v["Genre"] = track.Resp.Attributes.GenreNames[0]
+	}
+	if track.PreType == "playlists" {
+		v["PlaylistName"] = LimitString(track.PlaylistData.Attributes.Name)
+		v["PlaylistId"] = track.PlaylistData.ID
+	}
+	v["ArtistName"] = LimitString(track.Resp.Attributes.ArtistName)
+	v["SongId"] = track.ID
+	v["SongNumer"] = fmt.Sprintf("%02d", trackNumber)
+	v["SongNumber"] = fmt.Sprintf("%02d", trackNumber)
+	v["SongName"] = LimitString(title)
+	v["DiscNumber"] = fmt.Sprintf("%0d", track.Resp.Attributes.DiscNumber)
+	v["TrackNumber"] = fmt.Sprintf("%0d", trackNumber)
+	v["Codec"] = track.Codec
+	setRatingVars(v, track.Resp.Attributes.IsAppleDigitalMaster, track.Resp.Attributes.ContentRating)
+	setQualityVars(v, quality)
+	return renderName(format, v)
+}
+
+func withAtmosMetadataPrefix(value string, apply bool) string {
+	clean := strings.TrimSpace(value)
+	if clean == "" {
+		return ""
+	}
+	if !apply {
+		return clean
+	}
+	if strings.HasPrefix(clean, atmosMetadataPrefix) {
+		return clean
+	}
+	return atmosMetadataPrefix + clean
+}
+
+func metadataAtmosPrefixEnabled() bool {
+	if Config.MetadataAtmosPrefix == nil {
+		return true
+	}
+	return *Config.MetadataAtmosPrefix
+}
+
+func shouldUseAtmosMetadataPrefix(track *task.Track) bool {
+	if !metadataAtmosPrefixEnabled() {
+		return false
+	}
+	if resolveActiveMetadataSourceFormat() == "atmos" {
+		return true
+	}
+	return track != nil && strings.EqualFold(track.Codec, "ATMOS")
+}
+
+func normalizedArtistNames(names []string) []string {
+	seen := map[string]struct{}{}
+	out := []string{}
+	for _, raw := range names {
+		name := strings.TrimSpace(raw)
+		if name == "" {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		out = append(out, name)
+	}
+	return out
+}
+
+func splitArtistTokens(raw string, delimiters []string) []string {
+	parts := []string{raw}
+	for _, delimiter := range delimiters {
+		next := make([]string, 0, len(parts))
+		for _, part := range parts {
+			if strings.Contains(part, delimiter) {
+				next = append(next, strings.Split(part, delimiter)...)
+			} else {
+				next = append(next, part)
+			}
+		}
+		parts = next
+	}
+	return parts
+}
+
+func normalizeArtistsFromField(value string) []string {
+	raw := strings.TrimSpace(value)
+	if raw == "" {
+		return nil
+	}
+	raw = artistFeatSeparatorRe.ReplaceAllString(raw, "; ")
+	parts := splitArtistTokens(raw, []string{
+		"; ",
+		";",
+		" / ",
+		" x ",
+		" X ",
+		" × ",
+	})
+	return normalizedArtistNames(parts)
+}
+
+func parseFeaturedArtists(value string) []string {
+	raw := strings.TrimSpace(value)
+	if raw == "" {
+		return nil
+	}
+	parts := splitArtistTokens(raw, []string{
+		"; ",
+		";",
+		" / ",
+		" x ",
+		" X ",
+		" × ",
+		" and ",
+		" And ",
+		" with ",
 		" With ",
 		", ",
 		",",
 	})
-	return normalizedArtistNames(parts)
+	return normalizedArtistNames(parts)
+}
+
+func stripFeaturedArtistsFromTitle(title string) (string, []string) {
+	cleaned := strings.TrimSpace(title)
+	if cleaned == "" {
+		return "", nil
+	}
+	featured := []string{}
+
+	for {
+		if matches := featuredTitleBracketSuffixRe.FindStringSubmatch(cleaned); len(matches) == 2 {
+			featured = append(featured, parseFeaturedArtists(matches[1])...)
+			cleaned = strings.TrimSpace(strings.TrimSuffix(cleaned, matches[0]))
+			continue
+		}
+		if matches := featuredTitleInlineSuffixRe.FindStringSubmatch(cleaned); len(matches) == 2 {
+			featured = append(featured, parseFeaturedArtists(matches[1])...)
+			cleaned = strings.TrimSpace(strings.TrimSuffix(cleaned, matches[0]))
+			cleaned = strings.TrimSpace(strings.TrimRight(cleaned, "-–—"))
+			continue
+		}
+		break
+	}
+
+	cleaned = strings.TrimSpace(cleaned)
+	if cleaned == "" {
+		cleaned = strings.TrimSpace(title)
+	}
+	return cleaned, normalizedArtistNames(featured)
+}
+
+func metadataTitleAndArtistsFromTrack(track *task.Track) (string, []string) {
+	if track == nil {
+		return "", nil
+	}
+	cleanTitle, featuredArtists := stripFeaturedArtistsFromTitle(track.Resp.Attributes.Name)
+	artistNames := artistNamesFromTrack(track)
+	if len(featuredArtists) > 0 {
+		artistNames = normalizedArtistNames(append(artistNames, featuredArtists...))
+	}
+	return cleanTitle, artistNames
+}
+
+func formatArtistList(names []string) string {
+	normalized := normalizedArtistNames(names)
+	if len(normalized) == 0 {
+		return ""
+	}
+	return strings.Join(normalized, ", ")
+}
+
+func shouldSplitComposerConjunction(raw string) bool {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		return false
+	}
+	if strings.Contains(trimmed, ";") || strings.Contains(trimmed, " / ") || strings.Contains(trimmed, " x ") || strings.Contains(trimmed, " X ") || strings.Contains(trimmed, " × ") {
+		return true
+	}
+	if shouldSplitStandaloneComposerAmpersand(trimmed) {
+		return true
+	}
+	return strings.Count(trimmed, ",") >= 2
+}
+
+func shouldSplitStandaloneComposerAmpersand(raw string) bool {
+	if strings.Count(raw, " & ") != 1 {
+		return false
+	}
+	if strings.Contains(raw, ",") || strings.Contains(raw, ";") || strings.Contains(raw, " / ") || strings.Contains(raw, " x ") || strings.Contains(raw, " X ") || strings.Contains(raw, " × ") {
+		return false
+	}
+	parts := strings.SplitN(raw, " & ", 2)
+	left := strings.TrimSpace(parts[0])
+	right := strings.TrimSpace(parts[1])
+	if left == "" || right == "" {
+		return false
+	}
+	leftWords := strings.Fields(left)
+	rightWords := strings.Fields(right)
+	if len(leftWords) == 0 || len(rightWords) == 0 {
+		return false
+	}
+	if len(leftWords) == 1 && len(rightWords) == 1 {
+		if !looksLikeComposerAbbreviation(leftWords[0]) && !looksLikeComposerAbbreviation(rightWords[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+func looksLikeComposerAbbreviation(token string) bool {
+	trimmed := strings.TrimSpace(token)
+	if trimmed == "" {
+		return false
+	}
+	if len(trimmed) <= 3 {
+		hasLetter := false
+		for _, r := range trimmed {
+			if (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') {
+				hasLetter = true
+			}
+		}
+		if hasLetter && strings.ToUpper(trimmed) == trimmed {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeComposersFromField(value string) []string {
+	raw := strings.TrimSpace(value)
+	if raw == "" {
+		return nil
+	}
+	parts := splitArtistTokens(raw, []string{
+		"; ",
+		";",
+		" / ",
+		" x ",
+		" X ",
+		" × ",
+		", ",
+		",",
+	})
+	expanded := make([]string, 0, len(parts))
+	splitConjunction := shouldSplitComposerConjunction(raw)
+	for _, part := range parts {
+		token := strings.TrimSpace(part)
+		if token == "" {
+			continue
+		}
+		if splitConjunction {
+			for _, subPart := range splitArtistTokens(token, []string{" & ", " and ", " And "}) {
+				subToken := strings.TrimSpace(subPart)
+				if subToken != "" {
+					expanded = append(expanded, subToken)
+				}
+			}
+			continue
+		}
+		expanded = append(expanded, token)
+	}
+	return normalizedArtistNames(expanded)
+}
+
+func formatComposerList(value string) string {
+	return formatArtistList(normalizeComposersFromField(value))
+}
+
+func primaryArtist(names []string) string {
+	normalized := normalizedArtistNames(names)
+	if len(normalized) == 0 {
+		return ""
+	}
+	return normalized[0]
+}
+
+func artistNamesFromTrack(track *task.Track) []string {
+	names := []string{}
+	if track != nil {
+		for _, artist := range track.Resp.Relationships.Artists.Data {
+			names = append(names, artist.Attributes.Name)
+		}
+		if len(names) > 0 {
+			return normalizedArtistNames(names)
+		}
+		if track.Resp.Attributes.ArtistName != "" {
+			return normalizeArtistsFromField(track.Resp.Attributes.ArtistName)
+		}
+	}
+	return nil
+}
+
+func artistNamesFromAlbumData(album *ampapi.AlbumRespData) []string {
+	if album == nil {
+		return nil
+	}
+	names := []string{}
+	for _, artist := range album.Relationships.Artists.Data {
+		names = append(names, artist.Attributes.Name)
+	}
+	if len(names) > 0 {
+		return normalizedArtistNames(names)
+	}
+	if album.Attributes.ArtistName != "" {
+		return normalizeArtistsFromField(album.Attributes.ArtistName)
+	}
+	return nil
+}
+
+func artistNamesFromMusicVideoData(video *ampapi.MusicVideoRespData) []string {
+	if video == nil {
+		return nil
+	}
+	names := []string{}
+	for _, artist := range video.Relationships.Artists.Data {
+		names = append(names, artist.Attributes.Name)
+	}
+	if len(names) > 0 {
+		return normalizedArtistNames(names)
+	}
+	if video.Attributes.ArtistName != "" {
+		return normalizeArtistsFromField(video.Attributes.ArtistName)
+	}
+	return nil
+}
+
+func albumArtistNamesFromTrack(track *task.Track) []string {
+	if track == nil {
+		return nil
+	}
+	if track.AlbumData.ID != "" {
+		if names := artistNamesFromAlbumData(&track.AlbumData); len(names) > 0 {
+			return names
+		}
+	}
+	if len(track.Resp.Relationships.Albums.Data) > 0 {
+		albumRel := track.Resp.Relationships.Albums.Data[0]
+		if albumRel.Attributes.ArtistName != "" {
+			return normalizeArtistsFromField(albumRel.Attributes.ArtistName)
+		}
+	}
+	if track.Resp.Attributes.ArtistName != "" {
+		return normalizeArtistsFromField(track.Resp.Attributes.ArtistName)
+	}
+	return nil
+}
+
+func trackSupportsCurrentFormat(track *task.Track) bool {
+	if track == nil {
+		return false
+	}
+	if qualityPolicy != nil {
+		_, err := evaluateQualityPolicy(track.M3u8)
+		return err == nil
+	}
+	if dl_atmos || dl_ac3 {
+		if track.WebM3u8 == "" {
+			return false
+		}
+		label, _, check := dolbyVariantCheck()
+		available, err := check(track.WebM3u8)
+		if err != nil {
+			fmt.Println(label, "availability check failed:", err)
+			return false
+		}
+		return available
+	}
+	if dl_aac {
+		return true
+	}
+	traits := track.Resp.Attributes.AudioTraits
+	if Config.GetM3u8Mode == "hires" {
+		return contains(traits, "hi-res-lossless")
+	}
+	if len(traits) == 0 {
+		return true
+	}
+	return contains(traits, "lossless") || contains(traits, "hi-res-lossless")
+}
+
+func anySelectedTrackSupportsFormat(tracks []task.Track, selected []int) bool {
+	if len(tracks) == 0 || len(selected) == 0 {
+		return false
+	}
+	for _, idx := range selected {
+		if idx <= 0 || idx > len(tracks) {
+			continue
+		}
+		if trackSupportsCurrentFormat(&tracks[idx-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func ripTrack(track *task.Track, token string, mediaUserToken string) bool {
+	if checkStopAndWarn() {
+		return false
+	}
+	// A redownload after a preview mismatch starts again from here.
+	planned := *track
+	var err error
+	counter.Total++
+	fmt.Printf("Track %d of %d: %s\n", track.TaskNum, track.TaskTotal, track.Type)
+
+	//提前获取到的播放列表下track所在的专辑信息
+	if track.PreType == "playlists" && Config.UseSongInfoForPlaylist {
+		if track.AlbumData.ID == "" {
+			track.GetAlbumData(token)
+		}
+	}
+
+	//mv dl dev
+	if track.Type == "music-videos" {
+		if len(mediaUserToken) <= 50 {
+			fmt.Println("meida-user-token is not set, skip MV dl")
+			counter.Success++
+			return true
+		}
+		if _, err := exec.LookPath("mp4decrypt"); err != nil {
+			fmt.Println("mp4decrypt is not found, skip MV dl")
+			counter.Success++
+			return true
+		}
+		err := mvDownloader(track.ID, track.SaveDir, token, track.Storefront, mediaUserToken, track)
+		if err != nil {
+			fmt.Println("\u26A0 Failed to dl MV:", err)
+			counter.Error++
+			return false
+		}
+		counter.Success++
+		return true
+	}
+
+	if qualityPolicy == nil && (dl_atmos || dl_ac3) {
+		label, reason, check := dolbyVariantCheck()
+		if track.WebM3u8 == "" {
+			fmt.Println(label, "not available for this track.")
+			emitUnavailableEntry(track, reason+"_unavailable")
+			counter.Unavailable++
+			return false
+		}
+		available, err := check(track.WebM3u8)
+		if err != nil {
+			fmt.Println(label, "availability check failed:", err)
+			emitUnavailableEntry(track, reason+"_availability_check_failed")
+			counter.Unavailable++
+			markAbortRetries(err)
+			return false
+		}
+		if !available {
+			fmt.Println(label, "not available for this track.")
+			emitUnavailableEntry(track, reason+"_unavailable")
+			counter.Unavailable++
+			return false
+		}
+	}
+
+	needDlAacLc := false
+	usingLosslessFallback := false
+	if qualityPolicy == nil && dl_aac && Config.AacType == "aac-lc" {
+		needDlAacLc = true
+	}
+	if qualityPolicy == nil && track.WebM3u8 == "" && !needDlAacLc {
+		if dl_atmos || dl_ac3 {
+			_, reason, _ := dolbyVariantCheck()
+			fmt.Println("Unavailable")
+			emitUnavailableEntry(track, reason+"_unavailable")
+			counter.Unavailable++
+			return false
+		}
+		fmt.Println("Lossless/Hi-Res not available for this track. Falling back to AAC.")
+		emitUnavailableEntry(track, "lossless_unavailable")
+		usingLosslessFallback = true
+		needDlAacLc = true
+	}
+	if needDlAacLc {
+		track.Codec = "AAC"
+	}
+	if usingLosslessFallback {
+		track.SaveDir = fallbackAacSaveDir(track.SaveDir)
+		track.CoverPath = ""
+		if err := os.MkdirAll(track.SaveDir, os.ModePerm); err != nil {
+			fmt.Println("Failed to create AAC fallback folder:", err)
+			counter.Error++
+			return false
+		}
+	}
+
+	needCheck := false
+	if Config.GetM3u8Mode == "all" {
+		needCheck = true
+	} else if Config.GetM3u8Mode == "hires" && contains(track.Resp.Attributes.AudioTraits, "hi-res-lossless") {
+		needCheck = true
+	}
+	if needCheck && !needDlAacLc {
+		EnhancedHls_m3u8, err := checkM3u8(track.ID, "song")
+		if err != nil {
+			markAbortRetries(err)
+		}
+		if strings.HasSuffix(EnhancedHls_m3u8, ".m3u8") {
+			track.DeviceM3u8 = EnhancedHls_m3u8
+			track.M3u8 = EnhancedHls_m3u8
+		}
+	}
+
+	var decision *quality.Decision
+	if qualityPolicy != nil {
+		decision = applyQualityPolicy(track)
+		if decision == nil {
+			counter.Unavailable++
+			return false
+		}
+		needDlAacLc = decision.Variant == nil
+	}
+
+	var Quality string
+	if songFormatsUse("Quality", "BitDepth", "SampleRate") {
+		if decision != nil {
+			Quality = decision.Quality()
+		} else if dl_atmos {
+			Quality = fmt.Sprintf("%dKbps", Config.AtmosMax-2000)
+		} else if needDlAacLc {
+			Quality = "256Kbps"
+		} else {
+			_, Quality, err = extractMedia(track.M3u8, true)
+			if err != nil {
+				fmt.Println("Failed to extract quality from manifest.\n", err)
+				counter.Error++
+				return false
+			}
+		}
+	}
+	track.Quality = Quality
+
+	songName := buildSongName(track, Quality)
+	fmt.Println(songName)
+	baseName := nameProfile.File(track.SaveDir, songName)
+	track.SaveName = baseName + ".m4a"
+	trackPath := filepath.Join(track.SaveDir, track.SaveName)
+	lrcFilename := fmt.Sprintf("%s.%s", baseName, Config.LrcFormat)
+
+	// Determine possible post-conversion target file (so we can skip re-download)
+	var convertedPath string
+	considerConverted := false
+	if Config.ConvertAfterDownload &&
+		Config.ConvertFormat != "" &&
+		strings.ToLower(Config.ConvertFormat) != "copy" &&
+		!Config.ConvertKeepOriginal {
+		convertedPath = strings.TrimSuffix(trackPath, filepath.Ext(trackPath)) + "." + strings.ToLower(Config.ConvertFormat)
+		considerConverted = true
+	}
+
+	// Existence check now considers converted output (if original was deleted)
+	existsOriginal, err := fileExists(trackPath)
+	if err != nil {
+		fmt.Println("Failed to check if track exists.")
+	}
+	if existsOriginal {
+		fmt.Println("Track already exists locally.")
+		track.SavePath = trackPath
+		recordTrackPath(track, trackPath)
+		queueAlbumLoudness(track, nil, trackPath, convertedPath)
+		counter.Success++
+		okDict[okKey(track.PreID)] = append(okDict[okKey(track.PreID)], track.TaskNum)
+		emitHistoryEntry(track)
+		return true
+	}
+	if considerConverted {
+		existsConverted, err2 := fileExists(convertedPath)
+		if err2 == nil && existsConverted {
+			fmt.Println("Converted track already exists locally.")
+			track.SavePath = convertedPath
+			recordTrackPath(track, convertedPath)
+			queueAlbumLoudness(track, nil, convertedPath)
+			counter.Success++
+			okDict[okKey(track.PreID)] = append(okDict[okKey(track.PreID)], track.TaskNum)
+			emitHistoryEntry(track)
+			return true
+		}
+	}
+	if linkedPath, ok := linkIndexedTrack(track, trackPath); ok {
+		track.SavePath = linkedPath
+		counter.Success++
+		okDict[okKey(track.PreID)] = append(okDict[okKey(track.PreID)], track.TaskNum)
+		emitHistoryEntry(track)
+		return true
+	}
+
+	if needDlAacLc {
+		if len(mediaUserToken) <= 50 {
+			if usingLosslessFallback {
+				fmt.Println("Lossless fallback to AAC requires a valid media-user-token. Skipping this track.")
+				counter.Unavailable++
+				return false
+			}
+			fmt.Println("Invalid media-user-token")
+			counter.Error++
+			return false
+		}
+		_, err := runv3.Run(track.ID, trackPath, token, mediaUserToken, false, "")
+		if err != nil {
+			fmt.Println("Failed to dl aac-lc:", err)
+			if err.Error() == "Unavailable" {
+				counter.Unavailable++
+				return false
+			}
+			if usingLosslessFallback {
+				counter.Unavailable++
+				return false
+			}
+			counter.Error++
+			return false
+		}
+	} else {
+		trackM3u8Url, err := trackMediaPlaylist(track)
+		if err != nil {
+			fmt.Println("\u26A0 Failed to extract info from manifest:", err)
+			counter.Unavailable++
+			return false
+		}
+		if Config.GetM3u8FromDevice {
+			hasPrefetch, err := mediaPlaylistHasPrefetchKey(trackM3u8Url)
+			if err != nil {
+				fmt.Println("⚠️ Failed to inspect media playlist for prefetch key:", err)
+			} else if hasPrefetch {
+				fmt.Println("⚠️ Prefetch-only key detected; requesting device m3u8...")
+				deviceM3u8, _ := checkM3u8(track.ID, "song")
+				if strings.HasSuffix(deviceM3u8, ".m3u8") {
+					track.DeviceM3u8 = deviceM3u8
+					track.M3u8 = deviceM3u8
+					track.MediaM3u8 = ""
+					track.MediaQuality = ""
+					trackM3u8Url, err = trackMediaPlaylist(track)
+					if err != nil {
+						fmt.Println("\u26A0 Failed to extract info from device manifest:", err)
+						counter.Unavailable++
+						return false
+					}
+				} else {
+					fmt.Println("⚠️ Device m3u8 unavailable; continuing with web playlist.")
+				}
+			}
+		}
+		//边下载边解密
+		err = runv2.Run(track.ID, trackM3u8Url, trackPath, Config)
+		if err != nil && shouldRetryWrapper(err) {
+			fmt.Println("Decryptor connection dropped; waiting for wrapper to restart...")
+			if waitForWrapperReady(Config.DecryptM3u8Port, 5, time.Second) {
+				err = runv2.Run(track.ID, trackM3u8Url, trackPath, Config)
+			}
+		}
+		if err != nil {
+			fmt.Println("Failed to run v2:", err)
+			markAbortRetries(err)
+			counter.Error++
+			return false
+		}
+	}
+	if Config.VerifyDownloads {
+		if err := verifyDownload(track, trackPath); err != nil {
+			fmt.Println("\u26A0 Verification failed:", err)
+			os.Remove(trackPath)
+			counter.Error++
+			return false
+		}
+	}
+	if mode := normalizePreviewCheckMode(Config.PreviewCheck); mode != "off" {
+		if res, mismatch := previewMismatch(track, trackPath); mismatch {
+			fmt.Printf("\u26A0 Track does not match its preview (score %.2f)\n", res.Score)
+			if mode == "redownload" && !track.PreviewRetry {
+				os.Remove(trackPath)
+				counter.Total--
+				fmt.Println("Downloading the track again...")
+				// Folder, codec and playlists were moved on by the quality
+				// policy and fallbacks; start over from the planned ones.
+				albumData := track.AlbumData
+				*track = planned
+				track.AlbumData = albumData
+				track.PreviewRetry = true
+				return ripTrack(track, token, mediaUserToken)
+			}
+			emitPreviewMismatchEntry(track, trackPath, res)
+		}
+	}
+
+	// Lyrics after audio (reuse from siblings when possible)
+	var lrc string
+	embedLyrics := Config.EmbedLrc && metadataTagEnabled("lyrics")
+	if embedLyrics || Config.SaveLrcFile {
+		existingPath, ok := findExistingSiblingFile(track.SaveDir, lrcFilename)
+		if ok {
+			content, err := os.ReadFile(existingPath)
+			if err == nil {
+				targetPath := filepath.Join(track.SaveDir, lrcFilename)
+				if Config.SaveLrcFile && existingPath != targetPath {
+					if err := linkOrCopyFile(existingPath, targetPath); err != nil {
+						fmt.Println("Failed to copy lyrics:", err)
+					}
+				}
+				if embedLyrics {
+					lrc = string(content)
+				}
+			}
+		} else {
+			lrcStr, err := getLyricsWithFallback(track, token, mediaUserToken)
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				if Config.SaveLrcFile {
+					err := writeLyrics(track.SaveDir, lrcFilename, lrcStr)
+					if err != nil {
+						fmt.Printf("Failed to write lyrics")
+					}
+				}
+				if embedLyrics {
+					lrc = lrcStr
+				}
+			}
+		}
+	}
+
+	// Embed cover after lyrics to keep order: audio -> lyrics -> covers
+	if Config.EmbedCover && metadataTagEnabled("cover") && track.CoverPath == "" {
+		coverURL := track.Resp.Attributes.Artwork.URL
+		if track.CoverURL != "" {
+			coverURL = track.CoverURL
+		}
+		coverPath, err := embedCoverPath(track.SaveDir, coverURL)
+		if err != nil {
+			fmt.Println("Failed to write cover.")
+		} else {
+			track.CoverPath = coverPath
+		}
+	}
+
+	track.SavePath = trackPath
+	err = writeMP4Tags(track, lrc)
+	if err != nil {
+		fmt.Println("\u26A0 Failed to write tags in media:", err)
+		counter.Unavailable++
+		return false
+	}
+
+	// CONVERSION FEATURE hook
+	outputs := convertIfNeeded(track, lrc)
+	recordTrackPath(track, trackPath, convertedPath)
+	if Config.LoudnessAnalysis {
+		analyzeTrackLoudness(track, append([]string{trackPath}, outputs...))
+	}
+	refreshChecksums(append([]string{trackPath}, outputs...)...)
+
+	counter.Success++
+	okDict[okKey(track.PreID)] = append(okDict[okKey(track.PreID)], track.TaskNum)
+	emitHistoryEntry(track)
+	return true
+}
+
+func normalizePreviewCheckMode(mode string) string {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "flag", "redownload":
+		return mode
+	default:
+		return "off"
+	}
+}
+
+// previewMismatch cross-correlates a fresh download with the catalog
+// preview. It reports a mismatch only when the check could run; tracks
+// without a preview or without ffmpeg pass.
+func previewMismatch(track *task.Track, path string) (previewcheck.Result, bool) {
+	previews := track.Resp.Attributes.Previews
+	if len(previews) == 0 || previews[0].URL == "" {
+		return previewcheck.Result{}, false
+	}
+	ffmpegPath, err := resolveFFmpegPath()
+	if err != nil {
+		fmt.Printf("ffmpeg not found at '%s'; skipping preview check.\n", Config.FFmpegPath)
+		return previewcheck.Result{}, false
+	}
+	res, err := previewcheck.Check(ffmpegPath, previews[0].URL, path)
+	if err != nil {
+		fmt.Println("Preview check skipped:", err)
+		return previewcheck.Result{}, false
+	}
+	return res, res.Score < Config.PreviewCheckThreshold
+}
+
+func emitPreviewMismatchEntry(track *task.Track, path string, res previewcheck.Result) {
+	if !shouldEmitHistory() {
+		return
+	}
+	entry := map[string]any{
+		"_history_entry": "preview_mismatch",
+		"artist":         albumArtistForTrack(track),
+		"album":          albumNameForTrack(track),
+		"album_id":       albumIDForTrack(track),
+		"track_num":      track.Resp.Attributes.TrackNumber,
+		"track_name":     track.Resp.Attributes.Name,
+		"storefront":     track.Storefront,
+		"file_path":      path,
+		"score":          res.Score,
+		"offset_ms":      res.Offset.Milliseconds(),
+	}
+	if track.Resp.Attributes.TrackNumber == 0 {
+		entry["track_num"] = track.TaskNum
+	}
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Println("Failed to emit preview entry:", err)
+		return
+	}
+	fmt.Printf("HISTORY:%s\n", string(payload))
+}
+
+// verifyDownload decodes a fresh download in full and compares it with the
+// catalog duration and, for ALAC, the sample rate and bit depth of the
+// chosen variant.
+func verifyDownload(track *task.Track, path string) error {
+	ffmpegPath, err := resolveFFmpegPath()
+	if err != nil {
+		fmt.Printf("ffmpeg not found at '%s'; skipping verification.\n", Config.FFmpegPath)
+		return nil
+	}
+	decoded, err := integrity.Decode(ffmpegPath, path)
+	if err != nil {
+		return fmt.Errorf("decode failed: %v", err)
+	}
+	want := integrity.Audio{Duration: time.Duration(track.Resp.Attributes.DurationInMillis) * time.Millisecond}
+	got := integrity.Audio{Duration: decoded}
+	if track.Codec == "ALAC" {
+		ffprobePath := resolveFFprobePath(ffmpegPath)
+		want.BitDepth, want.SampleRate = integrity.ParseQuality(track.MediaQuality)
+		got.BitDepth = probeAudioBitDepth(ffprobePath, path)
+		got.SampleRate = probeAudioSampleRate(ffprobePath, path)
+	}
+	if problems := want.Problems(got); len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// refreshChecksums brings the SHA256SUMS entries of paths up to date after
+// the app wrote or removed them. Files are added to a manifest only with
+// checksum-manifest enabled, but listed ones are always kept current so
+// that verify does not flag the app's own changes.
+func refreshChecksums(paths ...string) {
+	checksumMu.Lock()
+	defer checksumMu.Unlock()
+	manifests := make(map[string]*integrity.Manifest)
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		dir, name := filepath.Dir(path), filepath.Base(path)
+		m, ok := manifests[dir]
+		if !ok {
+			var err error
+			if m, err = integrity.LoadManifest(dir); err != nil {
+				fmt.Println("Failed to read checksum manifest:", err)
+			}
+			manifests[dir] = m
+		}
+		if m == nil || (!Config.ChecksumManifest && m.Sum(name) == "") {
+			continue
+		}
+		if exists, _ := fileExists(path); !exists {
+			m.Remove(name)
+		} else if err := m.Add(name); err != nil {
+			fmt.Println("Failed to hash file:", err)
+		}
+	}
+	for _, m := range manifests {
+		if m == nil {
+			continue
+		}
+		if err := m.Save(); err != nil {
+			fmt.Println("Failed to write checksum manifest:", err)
+		}
+	}
+}
+
+// moveChecksum carries the manifest entry of a moved file to the manifest
+// of its new folder.
+func moveChecksum(from, to string) {
+	checksumMu.Lock()
+	defer checksumMu.Unlock()
+	src, err := integrity.LoadManifest(filepath.Dir(from))
+	if err != nil {
+		return
+	}
+	sum := src.Sum(filepath.Base(from))
+	if sum == "" {
+		return
+	}
+	dst := src
+	if filepath.Dir(from) != filepath.Dir(to) {
+		if dst, err = integrity.LoadManifest(filepath.Dir(to)); err != nil {
+			fmt.Println("Failed to read checksum manifest:", err)
+			return
+		}
+	}
+	src.Remove(filepath.Base(from))
+	dst.Set(filepath.Base(to), sum)
+	if err := dst.Save(); err != nil {
+		fmt.Println("Failed to write checksum manifest:", err)
+		return
+	}
+	if dst != src {
+		if err := src.Save(); err != nil {
+			fmt.Println("Failed to write checksum manifest:", err)
+		}
+	}
+}
+
+// loudnessTrack is one album track waiting for the album gain pass. result
+// is nil for tracks that were already on disk and have not been measured.
+type loudnessTrack struct {
+	id     string
+	files  []string
+	result *loudness.Result
+}
+
+// analyzeTrackLoudness measures a finished track, writes its track gain to
+// every file produced for it and keeps the result for the album pass.
+func analyzeTrackLoudness(track *task.Track, files []string) {
+	files = existingFiles(files)
+	if len(files) == 0 {
+		return
+	}
+	ffmpegPath, err := resolveFFmpegPath()
+	if err != nil {
+		fmt.Printf("ffmpeg not found at '%s'; skipping loudness analysis.\n", Config.FFmpegPath)
+		return
+	}
+	result, err := loudness.Analyze(ffmpegPath, files[0])
+	if err != nil {
+		fmt.Println("Loudness analysis failed:", err)
+		return
+	}
+	if !result.Valid() {
+		fmt.Println("Track is silent; skipping loudness tags.")
+		return
+	}
+	fmt.Printf("Loudness: %.1f LUFS, LRA %.1f LU, true peak %.1f dBTP\n", result.Integrated, result.Range, result.TruePeak)
+	writeLoudnessTags(files, result, nil)
+	queueAlbumLoudness(track, result, files...)
+}
+
+func queueAlbumLoudness(track *task.Track, result *loudness.Result, files ...string) {
+	if !Config.LoudnessAnalysis || track.PreType != "albums" {
+		return
+	}
+	files = existingFiles(files)
+	if len(files) == 0 {
+		return
+	}
+	loudnessMu.Lock()
+	defer loudnessMu.Unlock()
+	entry := &loudnessTrack{id: track.ID, files: files, result: result}
+	tracks := loudnessAlbums[track.PreID]
+	for i := range tracks {
+		if tracks[i].id == track.ID {
+			tracks[i] = entry
+			return
+		}
+	}
+	loudnessAlbums[track.PreID] = append(tracks, entry)
+}
+
+// finishAlbumLoudness adds album gain to every track of an album once all
+// of its tracks are on disk. Tracks that were already present are measured
+// here; nothing is done when no track was downloaded in this run.
+func finishAlbumLoudness(albumID string, expected int) {
+	loudnessMu.Lock()
+	tracks := loudnessAlbums[albumID]
+	delete(loudnessAlbums, albumID)
+	loudnessMu.Unlock()
+
+	fresh := false
+	for _, t := range tracks {
+		if t.result != nil {
+			fresh = true
+		}
+	}
+	if !fresh {
+		return
+	}
+	if len(tracks) < expected {
+		fmt.Printf("Album gain skipped: only %d of %d tracks are available.\n", len(tracks), expected)
+		return
+	}
+	ffmpegPath, err := resolveFFmpegPath()
+	if err != nil {
+		return
+	}
+	results := make([]*loudness.Result, 0, len(tracks))
+	for _, t := range tracks {
+		if t.result == nil {
+			if t.result, err = loudness.Analyze(ffmpegPath, t.files[0]); err != nil {
+				fmt.Printf("Album gain skipped: %s: %v\n", filepath.Base(t.files[0]), err)
+				return
+			}
+		}
+		results = append(results, t.result)
+	}
+	album := loudness.Album(results)
+	if !album.Valid() {
+		return
+	}
+	fmt.Printf("Album loudness: %.1f LUFS, LRA %.1f LU, true peak %.1f dBTP\n", album.Integrated, album.Range, album.TruePeak)
+	for _, t := range tracks {
+		if t.result.Valid() {
+			writeLoudnessTags(t.files, t.result, album)
+			refreshChecksums(t.files...)
+		}
+	}
+}
+
+// writeLoudnessTags writes ReplayGain tags to FLAC and Ogg files, R128 gains
+// to Opus and SoundCheck plus ReplayGain atoms to m4a. album may be nil.
+func writeLoudnessTags(files []string, track, album *loudness.Result) {
+	for _, path := range files {
+		var err error
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".m4a":
+			if metadataTagEnabled("loudness") {
+				err = writeMP4Loudness(path, track, album)
+			}
+		case ".flac":
+			if metadataTagEnabledFlac("loudness") {
+				var f *flacmeta.File
+				if err = linkfile.Unshare(path); err == nil {
+					f, err = flacmeta.Open(path)
+				}
+				if err == nil {
+					setVorbisTags(f.Comment, loudness.ReplayGainTags(track, album))
+					err = f.Save()
+				}
+			}
+		case ".opus", ".ogg":
+			if metadataTagEnabledFlac("loudness") {
+				var vc *flacmeta.VorbisComment
+				if err = linkfile.Unshare(path); err == nil {
+					vc, err = oggopus.ReadTags(path)
+				}
+				if err == nil {
+					setVorbisTags(vc, loudness.ReplayGainTags(track, album))
+					setVorbisTags(vc, loudness.R128Tags(track, album))
+					err = oggopus.WriteTags(path, vc)
+				}
+			}
+		}
+		if err != nil {
+			fmt.Printf("Failed to write loudness tags to %s: %v\n", filepath.Base(path), err)
+		}
+	}
+}
+
+func setVorbisTags(vc *flacmeta.VorbisComment, tags map[string]string) {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		vc.Set(key, tags[key])
+	}
+}
+
+func writeMP4Loudness(path string, track, album *loudness.Result) error {
+	if err := linkfile.Unshare(path); err != nil {
+		return err
+	}
+	mp4, err := mp4tag.Open(path)
+	if err != nil {
+		return err
+	}
+	defer mp4.Close()
+	mp4.UpperCustom(false)
+	custom := map[string]string{"iTunNORM": loudness.SoundCheck(track)}
+	for key, value := range loudness.ReplayGainTags(track, album) {
+		custom[strings.ToLower(key)] = value
+	}
+	return mp4.Write(&mp4tag.MP4Tags{Custom: custom}, nil)
+}
+
+func existingFiles(paths []string) []string {
+	var out []string
+	seen := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+		if ok, err := fileExists(path); err == nil && ok {
+			out = append(out, path)
+		}
+	}
+	return out
+}
+
+func countAudioTracks(tracks []task.Track) int {
+	n := 0
+	for i := range tracks {
+		if tracks[i].Type != "music-videos" {
+			n++
+		}
+	}
+	return n
+}
+
+func ripLyricsTrack(track *task.Track, token string, mediaUserToken string) bool {
+	if checkStopAndWarn() {
+		return false
+	}
+	counter.Total++
+	fmt.Printf("Track %d of %d: %s\n", track.TaskNum, track.TaskTotal, track.Type)
+
+	if !trackSupportsCurrentFormat(track) {
+		fmt.Println("Format not available for this track; skipping lyrics.")
+		counter.Unavailable++
+		return false
+	}
+
+	if track.Type == "music-videos" {
+		fmt.Println("Skipping music video for lyrics-only.")
+		counter.Success++
+		return true
+	}
+
+	if !Config.SaveLrcFile {
+		fmt.Println("save-lrc-file is disabled; nothing to write in lyrics-only mode.")
+		counter.Success++
+		return true
+	}
+
+	songName := buildSongName(track, "")
+	fmt.Println(songName)
+	lrcFilename := fmt.Sprintf("%s.%s", nameProfile.File(track.SaveDir, songName), Config.LrcFormat)
+	targetPath := filepath.Join(track.SaveDir, lrcFilename)
+	exists, err := fileExists(targetPath)
+	if err == nil && exists {
+		fmt.Println("Lyrics already exist locally.")
+		counter.Success++
+		return true
+	}
+
+	if existingPath, ok := findExistingSiblingFile(track.SaveDir, lrcFilename); ok {
+		if err := linkOrCopyFile(existingPath, targetPath); err != nil {
+			fmt.Println("Failed to copy lyrics:", err)
+			counter.Error++
+			return false
+		}
+		fmt.Println("Lyrics copied from sibling format.")
+		counter.Success++
+		return true
+	}
+
+	lrcStr, err := getLyricsWithFallback(track, token, mediaUserToken)
+	if err != nil {
+		fmt.Println(err)
+		counter.Unavailable++
+		return false
+	}
+	if err := writeLyrics(track.SaveDir, lrcFilename, lrcStr); err != nil {
+		fmt.Println("Failed to write lyrics.")
+		counter.Error++
+		return false
+	}
+	counter.Success++
+	return true
+}
+
+func ripStation(albumId string, token string, storefront string, mediaUserToken string) error {
+	station := task.NewStation(storefront, albumId)
+	err := station.GetResp(mediaUserToken, token, Config.Language)
+	if err != nil {
+		return err
+	}
+	fmt.Println(" -", station.Type)
+	meta := station.Resp
+
+	var Codec string
+	if dl_atmos {
+		Codec = "ATMOS"
+	} else if dl_ac3 {
+		Codec = "AC3"
+	} else if dl_aac {
+		Codec = "AAC"
+	} else {
+		Codec = "ALAC"
+	}
+	station.Codec = Codec
+	var singerFoldername string
+	if Config.ArtistFolderFormat != "" {
+		singerFoldername = renderName(Config.ArtistFolderFormat, naming.Vars{
+			"ArtistName":    "Apple Music Station",
+			"UrlArtistName": "Apple Music Station",
+		})
+		singerFoldername = strings.TrimSpace(singerFoldername)
+		fmt.Println(singerFoldername)
+	}
+	singerFolder := joinFolder(currentRootFolder(), singerFoldername)
+	os.MkdirAll(singerFolder, os.ModePerm)
+	station.SaveDir = singerFolder
+
+	playlistFolder := renderName(Config.PlaylistFolderFormat, naming.Vars{
+		"ArtistName":   "Apple Music Station",
+		"PlaylistName": LimitString(station.Name),
+		"PlaylistId":   station.ID,
+		"Codec":        Codec,
+	})
+	playlistFolder = nameProfile.Folder(singerFolder, playlistFolder)
+	playlistFolderPath := filepath.Join(singerFolder, playlistFolder)
+	os.MkdirAll(playlistFolderPath, os.ModePerm)
+	station.SaveName = playlistFolder
+	fmt.Println(playlistFolder)
+
+	if Config.SaveCoverFile || Config.EmbedCover {
+		if err := saveCoverSet(playlistFolderPath, artworkset.PlaylistCover, meta.Data[0].Attributes.Artwork.URL); err != nil {
+			fmt.Println("Failed to write cover.")
+		}
+		if names := artworkset.FileNames(artworkProfiles, artworkset.PlaylistCover); len(names) > 0 {
+			station.CoverPath = coverFilePath(playlistFolderPath, names[0], meta.Data[0].Attributes.Artwork.URL)
+		}
+	}
+
+	stationSquareVideo := meta.Data[0].Attributes.EditorialVideo.MotionSquare.Video
+	if stationSquareVideo != "" || meta.Data[0].Attributes.EditorialVideo.MotionTall.Video != "" {
+		fmt.Println("Found Animation Artwork.")
+	}
+	saveMotionArtwork(playlistFolderPath, true, stationSquareVideo, meta.Data[0].Attributes.EditorialVideo.MotionTall.Video)
+	if station.Type == "stream" {
+		counter.Total++
+		if isInArray(okDict[station.ID], 1) {
+			counter.Success++
+			return nil
+		}
+		songName := renderName(Config.SongFileFormat, naming.Vars{
+			"ArtistName":   "Apple Music Station",
+			"PlaylistName": LimitString(station.Name),
+			"PlaylistId":   station.ID,
+			"SongId":       station.ID,
+			"SongNumer":    "01",
+			"SongNumber":   "01",
+			"SongName":     LimitString(station.Name),
+			"DiscNumber":   "1",
+			"TrackNumber":  "1",
+			"Quality":      "256Kbps",
+			"Codec":        "AAC",
+		})
+		fmt.Println(songName)
+		trackPath := filepath.Join(playlistFolderPath, nameProfile.File(playlistFolderPath, songName)+".m4a")
+		exists, _ := fileExists(trackPath)
+		if exists {
+			counter.Success++
+			okDict[station.ID] = append(okDict[station.ID], 1)
+
+			fmt.Println("Radio already exists locally.")
+			return nil
+		}
+		assetsUrl, serverUrl, err := ampapi.GetStationAssetsUrlAndServerUrl(station.ID, mediaUserToken, token)
+		if err != nil {
+			fmt.Println("Failed to get station assets url.", err)
+			counter.Error++
+			return err
+		}
+		trackM3U8 := strings.ReplaceAll(assetsUrl, "index.m3u8", "256/prog_index.m3u8")
+		keyAndUrls, _ := runv3.Run(station.ID, trackM3U8, token, mediaUserToken, true, serverUrl)
+		err = runv3.ExtMvData(keyAndUrls, trackPath)
+		if err != nil {
+			fmt.Println("Failed to download station stream.", err)
+			counter.Error++
+			return err
+		}
+		t := &mp4tag.MP4Tags{
+			Title:       station.Name,
+			Album:       station.Name,
+			Artist:      "Apple Music Station",
+			AlbumArtist: "Apple Music Station",
+			TrackNumber: 1,
+			TrackTotal:  1,
+			DiscNumber:  1,
+			DiscTotal:   1,
+		}
+		if Config.EmbedCover {
+			coverPath, err := embedCoverPath(playlistFolderPath, meta.Data[0].Attributes.Artwork.URL)
+			if err != nil {
+				fmt.Println("Failed to write cover.")
+			} else {
+				addMP4Cover(t, coverPath)
+			}
+		}
+		if err := writeMP4File(trackPath, t); err != nil {
+			fmt.Printf("Embed failed: %v\n", err)
+		}
+		counter.Success++
+		okDict[station.ID] = append(okDict[station.ID], 1)
+		return nil
+	}
+
+	for i := range station.Tracks {
+		station.Tracks[i].CoverURL = meta.Data[0].Attributes.Artwork.URL
+		station.Tracks[i].SaveDir = playlistFolderPath
+		station.Tracks[i].Codec = Codec
+	}
+
+	trackTotal := len(station.Tracks)
+	arr := make([]int, trackTotal)
+	for i := 0; i < trackTotal; i++ {
+		arr[i] = i + 1
+	}
+	var selected []int
+
+	if true {
+		selected = arr
+	}
+	for i := range station.Tracks {
+		i++
+		if isInArray(selected, i) {
+			ripTrack(&station.Tracks[i-1], token, mediaUserToken)
+		}
+	}
+	return nil
+}
+
+func ripAlbum(albumId string, token string, storefront string, mediaUserToken string, urlArg_i string) error {
+	if checkStopAndWarn() {
+		return nil
+	}
+	album := task.NewAlbum(storefront, albumId)
+	err := album.GetResp(token, Config.Language)
+	if err != nil {
+		fmt.Println("Failed to get album response.")
+		return err
+	}
+	meta := album.Resp
+	if debug_mode {
+		fmt.Println(meta.Data[0].Attributes.ArtistName)
+		fmt.Println(meta.Data[0].Attributes.Name)
+
+		for trackNum, track := range meta.Data[0].Relationships.Tracks.Data {
+			trackNum++
+			fmt.Printf("\nTrack %d of %d:\n", trackNum, len(meta.Data[0].Relationships.Tracks.Data))
+			fmt.Printf("%02d. %s\n", trackNum, track.Attributes.Name)
+
+			manifest, err := ampapi.GetSongResp(storefront, track.ID, album.Language, token)
+			if err != nil {
+				fmt.Printf("Failed to get manifest for track %d: %v\n", trackNum, err)
+				continue
+			}
+
+			var m3u8Url string
+			if manifest.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls != "" {
+				m3u8Url = manifest.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls
+			}
+			needCheck := false
+			if Config.GetM3u8Mode == "all" {
+				needCheck = true
+			} else if Config.GetM3u8Mode == "hires" && contains(track.Attributes.AudioTraits, "hi-res-lossless") {
+				needCheck = true
+			}
+			if needCheck {
+				fullM3u8Url, err := checkM3u8(track.ID, "song")
+				if err != nil {
+					markAbortRetries(err)
+				}
+				if err == nil && strings.HasSuffix(fullM3u8Url, ".m3u8") {
+					m3u8Url = fullM3u8Url
+				} else {
+					fmt.Println("Failed to get best quality m3u8 from device m3u8 port, will use m3u8 from Web API")
+				}
+			}
+
+			_, _, err = extractMedia(m3u8Url, true)
+			if err != nil {
+				fmt.Printf("Failed to extract quality info for track %d: %v\n", trackNum, err)
+				continue
+			}
+		}
+		return nil
+	}
+
+	trackTotal := len(meta.Data[0].Relationships.Tracks.Data)
+	arr := make([]int, trackTotal)
+	for i := 0; i < trackTotal; i++ {
+		arr[i] = i + 1
+	}
+
+	var selected []int
+	if select_tracks != "" {
+		selected, err = parseTrackSelection(select_tracks, trackTotal)
+		if err != nil {
+			fmt.Println("Invalid --select-tracks:", err)
+			return err
+		}
+	} else if !dl_select {
+		selected = arr
+	} else {
+		selected = album.ShowSelect()
+	}
+
+	if (dl_covers_only || dl_lyrics_only) && !anySelectedTrackSupportsFormat(album.Tracks, selected) {
+		fmt.Println("No selected tracks available for this format; skipping.")
+		return nil
+	}
+	return forEachFormat(album.Tracks, func() error {
+		return ripAlbumFormat(album, albumId, selected, token, storefront, mediaUserToken, urlArg_i)
+	})
+}
+
+// ripAlbumFormat downloads the selected tracks of a fetched album in the
+// current download mode.
+func ripAlbumFormat(album *task.Album, albumId string, selected []int, token, storefront, mediaUserToken, urlArg_i string) error {
+	meta := album.Resp
+	codec := "ALAC"
+	if dl_atmos {
+		codec = "ATMOS"
+	} else if dl_ac3 {
+		codec = "AC3"
+	} else if dl_aac {
+		codec = "AAC"
+	}
+	album.Codec = codec
+
+	artistID := ""
+	if len(meta.Data[0].Relationships.Artists.Data) > 0 {
+		artistID = meta.Data[0].Relationships.Artists.Data[0].ID
+	}
+
+	quality, resolvedCodec := resolveAlbumQuality(
+		storefront,
+		meta.Data[0].Relationships.Tracks.Data[0].ID,
+		album.Language,
+		token,
+		codec,
+		meta.Data[0].Relationships.Tracks.Data[0].Attributes.AudioTraits,
+	)
+	codec = resolvedCodec
+	album.Codec = codec
+
+	singerFolder, albumFolderName, albumFolderPath := albumFolderPaths(currentRootFolder(), &meta.Data[0], albumId, quality, codec)
+	if albumFolderOverride != "" {
+		albumFolderName, albumFolderPath = filepath.Base(albumFolderOverride), albumFolderOverride
+	}
+	os.MkdirAll(singerFolder, os.ModePerm)
+	album.SaveDir = singerFolder
+	os.MkdirAll(albumFolderPath, os.ModePerm)
+	album.SaveName = albumFolderName
+	fmt.Println(albumFolderName)
+
+	artistCoverURL := ""
+	if len(meta.Data[0].Relationships.Artists.Data) > 0 {
+		artistCoverURL = meta.Data[0].Relationships.Artists.Data[0].Attributes.Artwork.Url
+	}
+	squareVideo := meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video
+	if squareVideo == "" {
+		squareVideo = meta.Data[0].Attributes.EditorialVideo.MotionSquare.Video
+	}
+	tallVideo := meta.Data[0].Attributes.EditorialVideo.MotionDetailTall.Video
+	if tallVideo == "" {
+		tallVideo = meta.Data[0].Attributes.EditorialVideo.MotionTall.Video
+	}
+
+	if dl_covers_only {
+		saveArtistArtwork(singerFolder, artistID, artistCoverURL, storefront, album.Language, token)
+		handleCoversOnlyAlbum(albumFolderPath, meta.Data[0].Attributes.Artwork.URL, squareVideo, tallVideo)
+		return nil
+	}
+
+	for i := range album.Tracks {
+		album.Tracks[i].SaveDir = albumFolderPath
+		album.Tracks[i].Codec = codec
+		if qualityPolicy != nil && album.Tracks[i].AlbumData.ID == "" {
+			album.Tracks[i].AlbumData = meta.Data[0]
+		}
+	}
+
+	if dl_song {
+		if urlArg_i != "" {
+			for i := range album.Tracks {
+				if urlArg_i == album.Tracks[i].ID {
+					if dl_lyrics_only {
+						ripLyricsTrack(&album.Tracks[i], token, mediaUserToken)
+					} else {
+						ripTrackForFormat(&album.Tracks[i], token, mediaUserToken)
+					}
+					return nil
+				}
+			}
+		}
+		return nil
+	}
+
+	imagePath := ""
+	if Config.AlbumImage != "" && !dl_lyrics_only {
+		imagePath = filepath.Join(albumFolderPath, nameProfile.File(albumFolderPath, albumFolderName)+"."+Config.AlbumImage)
+		if exists, _ := fileExists(imagePath); exists && Config.AlbumImageRemoveTracks {
+			// The tracks in the image were removed; only new or missing
+			// tracks are downloaded.
+			skipAlbumImageTracks(album, albumId, imagePath, selected)
+		}
+	}
+
+	anySuccess := false
+	for i := range album.Tracks {
+		if checkStopAndWarn() {
+			return nil
+		}
+		index := i + 1
+		if isInArray(okDict[okKey(albumId)], index) {
+			counter.Total++
+			counter.Success++
+			recordFormatStatus(&album.Tracks[i], multiformat.StatusOK)
+			continue
+		}
+		if !isInArray(selected, index) {
+			continue
+		}
+		var success bool
+		if dl_lyrics_only {
+			success = ripLyricsTrack(&album.Tracks[i], token, mediaUserToken)
+		} else {
+			success = ripTrackForFormat(&album.Tracks[i], token, mediaUserToken)
+		}
+		if success {
+			anySuccess = true
+		}
+	}
+
+	if anySuccess && !dl_lyrics_only {
+		if Config.LoudnessAnalysis {
+			finishAlbumLoudness(albumId, countAudioTracks(album.Tracks))
+		}
+		if Config.AlbumSnapshot {
+			saveAlbumSnapshot(album, albumFolderPath)
+		}
+		if imagePath != "" {
+			writeAlbumImage(album, &meta.Data[0], imagePath)
+		}
+		if Config.SaveCoverFile {
+			if err := saveAlbumCovers(albumFolderPath, meta.Data[0].Attributes.Artwork.URL); err != nil {
+				fmt.Println("Failed to write cover.")
+			}
+		}
+		saveArtistArtwork(singerFolder, artistID, artistCoverURL, storefront, album.Language, token)
+		saveMotionArtwork(albumFolderPath, false, squareVideo, tallVideo)
+	}
+
+	return nil
+
+}
+
+// albumFolderPaths returns the artist folder, the album folder name and the
+// album folder path of a release saved below root in the current download
+// mode, following artist-folder-format and album-folder-format.
+func albumFolderPaths(root string, data *ampapi.AlbumRespData, albumId, quality, codec string) (string, string, string) {
+	primaryAlbumArtist := primaryArtist(artistNamesFromAlbumData(data))
+	if primaryAlbumArtist == "" {
+		primaryAlbumArtist = data.Attributes.ArtistName
+	}
+	artistID := ""
+	if len(data.Relationships.Artists.Data) > 0 {
+		artistID = data.Relationships.Artists.Data[0].ID
+	}
+	singerFolderName := buildArtistFolderName(primaryAlbumArtist, artistID)
+	singerFolder := joinFolder(root, singerFolderName)
+
+	releaseType := detectReleaseType(data.Attributes.Name, data.Attributes.TrackCount, data.Attributes.IsSingle)
+	releaseFolder := releaseFolderLabel(releaseType)
+
+	v := albumNameVars(data, primaryAlbumArtist, albumId, quality, codec)
+	v["ArtistId"] = artistID
+	albumFolderName := renderName(albumFolderFormat(v["ReleaseType"]), v)
+	albumFolderName = strings.TrimSpace(albumFolderName)
+	if dl_atmos && !strings.Contains(strings.ToLower(albumFolderName), "dolby atmos") {
+		albumFolderName = fmt.Sprintf("%s (Dolby Atmos)", albumFolderName)
+	}
+	if dl_ac3 && !strings.Contains(strings.ToLower(albumFolderName), "dolby audio") {
+		albumFolderName = fmt.Sprintf("%s (Dolby Audio)", albumFolderName)
+	}
+	releasePath := filepath.Join(singerFolder, releaseFolder)
+	albumFolderName = nameProfile.Folder(releasePath, albumFolderName)
+	return singerFolder, albumFolderName, filepath.Join(releasePath, albumFolderName)
+}
+
+// writeAlbumImage joins the decoded tracks of an album into one FLAC or WAV
+// file and writes a matching .cue sheet. FLAC images also carry the sheet
+// as a CUESHEET block and per-track CUE_TRACKnn_* tags. An existing image
+// that lacks some of the downloaded tracks is rebuilt when every track
+// file is still there, or else extended when the new tracks follow its
+// own; tracks that fit neither are reported and stay as separate files.
+func writeAlbumImage(album *task.Album, data *ampapi.AlbumRespData, imagePath string) {
+	cuePath := strings.TrimSuffix(imagePath, filepath.Ext(imagePath)) + ".cue"
+	var tracks []*task.Track
+	for i := range album.Tracks {
+		if album.Tracks[i].Type != "music-videos" {
+			tracks = append(tracks, &album.Tracks[i])
+		}
+	}
+	if len(tracks) == 0 || len(tracks) > cuesheet.MaxTracks {
+		fmt.Printf("Album image skipped: a cue sheet cannot hold %d tracks.\n", len(tracks))
+		return
+	}
+
+	exists, _ := fileExists(imagePath)
+	var inImage []cuesheet.Track
+	var added []*task.Track
+	if exists {
+		cue, err := os.ReadFile(cuePath)
+		if err != nil {
+			fmt.Println("Album image exists but its cue sheet cannot be read:", err)
+			return
+		}
+		inImage = cuesheet.Parse(string(cue))
+		for _, track := range tracks {
+			if track.SavePath != "" && !inAlbumImage(inImage, track) {
+				added = append(added, track)
+			}
+		}
+		if len(added) == 0 {
+			fmt.Println("Album image already exists locally.")
+			return
+		}
+	}
+	ffmpegPath, err := resolveFFmpegPath()
+	if err != nil {
+		fmt.Printf("ffmpeg not found at '%s'; skipping album image.\n", Config.FFmpegPath)
+		return
+	}
+
+	sheet := &cuesheet.Sheet{
+		Catalog:   data.Attributes.Upc,
+		Title:     data.Attributes.Name,
+		Performer: data.Attributes.ArtistName,
+		Date:      data.Attributes.ReleaseDate,
+		File:      filepath.Base(imagePath),
+	}
+	if len(data.Attributes.GenreNames) > 0 {
+		sheet.Genre = data.Attributes.GenreNames[0]
+	}
+	parts, err := albumImageParts(sheet, tracks)
+	if err != nil && exists {
+		parts, err = albumImageExtension(sheet, imagePath, inImage, tracks, added)
+		if err != nil {
+			var nums []string
+			for _, track := range added {
+				nums = append(nums, strconv.Itoa(track.TaskNum))
+			}
+			fmt.Printf("Album image not updated: %v; tracks %s stay as separate files.\n", err, strings.Join(nums, ", "))
+			return
+		}
+	}
+	if err != nil {
+		fmt.Println("Album image skipped:", err)
+		return
+	}
+
+	args := []string{"-y"}
+	var filter strings.Builder
+	var sources []string
+	for i, part := range parts {
+		args = append(args, "-i", part.src)
+		if !part.image {
+			sources = append(sources, part.src)
+		}
+		trim := part.trim
+		if trim == "" {
+			trim = "anull"
+		}
+		fmt.Fprintf(&filter, "[%d:a:0]%s[a%d];", i, trim, i)
+	}
+	for i := range parts {
+		fmt.Fprintf(&filter, "[a%d]", i)
+	}
+	fmt.Fprintf(&filter, "concat=n=%d:v=0:a=1[out]", len(parts))
+	args = append(args, "-filter_complex", filter.String(), "-map", "[out]")
+	if Config.AlbumImage == "flac" {
+		args = append(args, "-c:a", "flac", "-compression_level", "8", "-f", "flac")
+	} else if probeAudioBitDepth(resolveFFprobePath(ffmpegPath), parts[0].src) > 16 {
+		args = append(args, "-c:a", "pcm_s24le", "-f", "wav")
+	} else {
+		args = append(args, "-c:a", "pcm_s16le", "-f", "wav")
+	}
+	tmp := imagePath + ".part"
+	args = append(args, tmp)
+
+	switch {
+	case !exists:
+		fmt.Printf("Writing album image (%d tracks) ...\n", len(sheet.Tracks))
+	case parts[0].image:
+		fmt.Printf("Extending album image with %d tracks ...\n", len(added))
+	default:
+		fmt.Printf("Rebuilding album image with %d new tracks ...\n", len(added))
+	}
+	start := time.Now()
+	if out, err := exec.Command(ffmpegPath, args...).CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		fmt.Printf("Album image failed: %v\n%s\n", err, strings.TrimSpace(string(out)))
+		return
+	}
+	if Config.AlbumImage == "flac" {
+		if err := tagAlbumImage(tmp, sheet, data, tracks); err != nil {
+			fmt.Println("Failed to tag album image:", err)
+		}
+	}
+	if err := os.Rename(tmp, imagePath); err != nil {
+		os.Remove(tmp)
+		fmt.Println("Album image failed:", err)
+		return
+	}
+	if err := os.WriteFile(cuePath, []byte(sheet.String()), 0644); err != nil {
+		fmt.Println("Failed to write cue sheet:", err)
+	}
+	fmt.Printf("Album image completed in %s: %s\n", time.Since(start).Truncate(time.Millisecond), filepath.Base(imagePath))
+	refreshChecksums(imagePath, cuePath)
+
+	if !Config.AlbumImageRemoveTracks {
+		return
+	}
+	// Only the files folded into the image go; conversions stay.
+	removed := existingFiles(sources)
+	for _, path := range removed {
+		if err := os.Remove(path); err != nil {
+			fmt.Println("Failed to remove track after album image:", err)
+		}
+	}
+	refreshChecksums(removed...)
+}
+
+// albumImagePart is one input of an album image: a track file with the
+// filter that trims it, or the existing image being extended.
+type albumImagePart struct {
+	src   string
+	trim  string
+	image bool
+}
+
+// albumImageParts fills sheet with tracks and returns their files, which
+// must all be downloaded and share one sample rate.
+func albumImageParts(sheet *cuesheet.Sheet, tracks []*task.Track) ([]albumImagePart, error) {
+	var parts []albumImagePart
+	for _, track := range tracks {
+		src, samples, rate, trim, err := albumImageSource(track)
+		if err != nil {
+			return nil, fmt.Errorf("track %d: %v", track.TaskNum, err)
+		}
+		if sheet.SampleRate == 0 {
+			sheet.SampleRate = rate
+		} else if rate != sheet.SampleRate {
+			return nil, errors.New("tracks have different sample rates")
+		}
+		sheet.Tracks = append(sheet.Tracks, cuesheet.Track{
+			Title:     track.Resp.Attributes.Name,
+			Performer: track.Resp.Attributes.ArtistName,
+			ISRC:      track.Resp.Attributes.Isrc,
+			Offset:    sheet.TotalSamples,
+		})
+		sheet.TotalSamples += samples
+		parts = append(parts, albumImagePart{src: src, trim: trim})
+	}
+	return parts, nil
+}
+
+// albumImageExtension fills sheet with the tracks of the FLAC image at
+// imagePath, at the exact offsets of its CUESHEET block, followed by the
+// added tracks, and returns the image and their files. The added tracks
+// must come after every track of the image in album order.
+func albumImageExtension(sheet *cuesheet.Sheet, imagePath string, inImage []cuesheet.Track, tracks, added []*task.Track) ([]albumImagePart, error) {
+	if Config.AlbumImage != "flac" {
+		return nil, errors.New("only FLAC images can be extended")
+	}
+	last := -1
+	for i, track := range tracks {
+		if inAlbumImage(inImage, track) {
+			last = i
+		}
+	}
+	for _, track := range tracks[:last+1] {
+		for _, a := range added {
+			if a == track {
+				return nil, errors.New("the new tracks do not follow the tracks of the image")
+			}
+		}
+	}
+	f, err := flacmeta.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.StreamInfo()
+	if err != nil {
+		return nil, err
+	}
+	block := f.Block(flacmeta.BlockCueSheet)
+	if block == nil {
+		return nil, errors.New("the image has no CUESHEET block")
+	}
+	offsets, total, err := cuesheet.FlacOffsets(block.Data)
+	if err != nil {
+		return nil, err
+	}
+	if len(offsets) != len(inImage) || len(inImage)+len(added) > cuesheet.MaxTracks {
+		return nil, errors.New("the cue sheet does not match the image")
+	}
+
+	sheet.SampleRate, sheet.TotalSamples, sheet.Tracks = info.SampleRate, total, nil
+	for i, t := range inImage {
+		t.Offset = offsets[i]
+		sheet.Tracks = append(sheet.Tracks, t)
+	}
+	parts := []albumImagePart{{src: imagePath, image: true}}
+	for _, track := range added {
+		src, samples, rate, trim, err := albumImageSource(track)
+		if err != nil {
+			return nil, fmt.Errorf("track %d: %v", track.TaskNum, err)
+		}
+		if rate != sheet.SampleRate {
+			return nil, fmt.Errorf("track %d has a different sample rate than the image", track.TaskNum)
+		}
+		sheet.Tracks = append(sheet.Tracks, cuesheet.Track{
+			Title:     track.Resp.Attributes.Name,
+			Performer: track.Resp.Attributes.ArtistName,
+			ISRC:      track.Resp.Attributes.Isrc,
+			Offset:    sheet.TotalSamples,
+		})
+		sheet.TotalSamples += samples
+		parts = append(parts, albumImagePart{src: src, trim: trim})
+	}
+	return parts, nil
+}
+
+// albumImageTracks lists the tracks of the album images in dir, as their
+// cue sheets record them.
+func albumImageTracks(dir string) []cuesheet.Track {
+	sheets, _ := filepath.Glob(filepath.Join(dir, "*.cue"))
+	var tracks []cuesheet.Track
+	for _, path := range sheets {
+		if data, err := os.ReadFile(path); err == nil {
+			tracks = append(tracks, cuesheet.Parse(string(data))...)
+		}
+	}
+	return tracks
+}
+
+// isAlbumImage reports whether path is an album image, a file with a cue
+// sheet of the same name next to it.
+func isAlbumImage(path string) bool {
+	ok, _ := fileExists(strings.TrimSuffix(path, filepath.Ext(path)) + ".cue")
+	return ok
+}
+
+// inAlbumImage reports whether track is one of the tracks of an image.
+func inAlbumImage(image []cuesheet.Track, track *task.Track) bool {
+	t := cuesheet.Track{Title: track.Resp.Attributes.Name, Performer: track.Resp.Attributes.ArtistName, ISRC: track.Resp.Attributes.Isrc}
+	for _, done := range image {
+		if done.Same(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipAlbumImageTracks marks the selected tracks that are already in the
+// existing image at imagePath as done, going by the image's cue sheet.
+func skipAlbumImageTracks(album *task.Album, albumId, imagePath string, selected []int) {
+	data, err := os.ReadFile(strings.TrimSuffix(imagePath, filepath.Ext(imagePath)) + ".cue")
+	if err != nil {
+		fmt.Println("Album image exists but its cue sheet cannot be read:", err)
+		return
+	}
+	inImage := cuesheet.Parse(string(data))
+	skipped := 0
+	for i := range album.Tracks {
+		track := &album.Tracks[i]
+		if track.Type == "music-videos" || !isInArray(selected, i+1) {
+			continue
+		}
+		if inAlbumImage(inImage, track) {
+			okDict[okKey(albumId)] = append(okDict[okKey(albumId)], i+1)
+			skipped++
+		}
+	}
+	fmt.Printf("Album image already exists locally with %d of the selected tracks.\n", skipped)
+}
+
+// albumImageSource picks the lossless file of a downloaded track, the saved
+// file or an ALAC or FLAC copy next to it, and returns its decoded sample
+// count, sample rate and the trim filter that drops the encoder priming and
+// padding of MP4 sources.
+func albumImageSource(track *task.Track) (string, uint64, int, string, error) {
+	if track.SavePath == "" {
+		return "", 0, 0, "", errors.New("not downloaded")
+	}
+	stem := strings.TrimSuffix(track.SavePath, filepath.Ext(track.SavePath))
+	for _, path := range existingFiles([]string{track.SavePath, stem + ".flac", stem + ".m4a"}) {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".m4a":
+			g, err := mp4meta.ReadGapless(path)
+			if err != nil {
+				return "", 0, 0, "", err
+			}
+			if g.Codec != "alac" {
+				continue
+			}
+			return path, g.Valid, int(g.SampleRate), g.TrimFilter(), nil
+		case ".flac":
+			f, err := flacmeta.Open(path)
+			if err != nil {
+				return "", 0, 0, "", err
+			}
+			info, err := f.StreamInfo()
+			if err != nil {
+				return "", 0, 0, "", err
+			}
+			return path, info.TotalSamples, info.SampleRate, "", nil
+		}
+	}
+	return "", 0, 0, "", fmt.Errorf("no ALAC or FLAC file for %s", filepath.Base(track.SavePath))
+}
+
+func tagAlbumImage(path string, sheet *cuesheet.Sheet, data *ampapi.AlbumRespData, tracks []*task.Track) error {
+	f, err := flacmeta.Open(path)
+	if err != nil {
+		return err
+	}
+	f.SetBlock(flacmeta.BlockCueSheet, sheet.FlacBlock())
+	vc := f.Comment
+	vc.Fields = nil
+	set := func(key, value string) {
+		if value = strings.TrimSpace(value); value != "" {
+			vc.Set(key, value)
+		}
+	}
+	set("ALBUM", sheet.Title)
+	set("ALBUMARTIST", sheet.Performer)
+	set("ARTIST", sheet.Performer)
+	set("DATE", sheet.Date)
+	set("GENRE", sheet.Genre)
+	set("LABEL", data.Attributes.RecordLabel)
+	set("COPYRIGHT", data.Attributes.Copyright)
+	set("UPC", data.Attributes.Upc)
+	set("TOTALTRACKS", strconv.Itoa(len(sheet.Tracks)))
+	for i, t := range sheet.Tracks {
+		prefix := fmt.Sprintf("CUE_TRACK%02d_", i+1)
+		set(prefix+"TITLE", t.Title)
+		set(prefix+"PERFORMER", t.Performer)
+		set(prefix+"ISRC", t.ISRC)
+	}
+	for _, track := range tracks {
+		if pic := coverPictureForTrack(track); pic != nil {
+			f.SetCover(pic)
+			break
+		}
+	}
+	return f.Save()
+}
+
+func ripPlaylist(playlistId string, token string, storefront string, mediaUserToken string) error {
+	if checkStopAndWarn() {
+		return nil
+	}
+	playlist := task.NewPlaylist(storefront, playlistId)
+	err := playlist.GetResp(token, Config.Language)
+	if err != nil {
+		fmt.Println("Failed to get playlist response.")
+		return err
+	}
+	if len(playlist.Resp.Data) > 0 {
+		originalTrackCount := len(playlist.Resp.Data[0].Relationships.Tracks.Data)
+		dedupeResult := dedupePlaylistTrackData(playlist.Resp.Data[0].Relationships.Tracks.Data)
+		if dedupeResult.RemovedCount > 0 {
+			fmt.Printf("Playlist dedupe: %d -> %d (%d skipped)\n", originalTrackCount, len(dedupeResult.Tracks), dedupeResult.RemovedCount)
+			playlist.Resp.Data[0].Relationships.Tracks.Data = dedupeResult.Tracks
+			dedupedTracks := make([]task.Track, 0, len(dedupeResult.KeptIndexes))
+			for _, idx := range dedupeResult.KeptIndexes {
+				if idx >= 0 && idx < len(playlist.Tracks) {
+					dedupedTracks = append(dedupedTracks, playlist.Tracks[idx])
+				}
+			}
+			playlist.Tracks = dedupedTracks
+		}
+		total := len(playlist.Tracks)
+		for i := range playlist.Tracks {
+			playlist.Tracks[i].TaskNum = i + 1
+			playlist.Tracks[i].TaskTotal = total
+		}
+	}
+	meta := playlist.Resp
+	if debug_mode {
+		fmt.Println(meta.Data[0].Attributes.ArtistName)
+		fmt.Println(meta.Data[0].Attributes.Name)
+
+		for trackNum, track := range meta.Data[0].Relationships.Tracks.Data {
+			trackNum++
+			fmt.Printf("\nTrack %d of %d:\n", trackNum, len(meta.Data[0].Relationships.Tracks.Data))
+			fmt.Printf("%02d. %s\n", trackNum, track.Attributes.Name)
+
+			manifest, err := ampapi.GetSongResp(storefront, track.ID, playlist.Language, token)
+			if err != nil {
+				fmt.Printf("Failed to get manifest for track %d: %v\n", trackNum, err)
+				continue
+			}
+
+			var m3u8Url string
+			if manifest.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls != "" {
+				m3u8Url = manifest.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls
+			}
+			needCheck := false
+			if Config.GetM3u8Mode == "all" {
+				needCheck = true
+			} else if Config.GetM3u8Mode == "hires" && contains(track.Attributes.AudioTraits, "hi-res-lossless") {
+				needCheck = true
+			}
+			if needCheck {
+				fullM3u8Url, err := checkM3u8(track.ID, "song")
+				if err != nil {
+					markAbortRetries(err)
+				}
+				if err == nil && strings.HasSuffix(fullM3u8Url, ".m3u8") {
+					m3u8Url = fullM3u8Url
+				} else {
+					fmt.Println("Failed to get best quality m3u8 from device m3u8 port, will use m3u8 from Web API")
+				}
+			}
+
+			_, _, err = extractMedia(m3u8Url, true)
+			if err != nil {
+				fmt.Printf("Failed to extract quality info for track %d: %v\n", trackNum, err)
+				continue
+			}
+		}
+		return nil
+	}
+
+	trackTotal := len(meta.Data[0].Relationships.Tracks.Data)
+	arr := make([]int, trackTotal)
+	for i := 0; i < trackTotal; i++ {
+		arr[i] = i + 1
+	}
+
+	var selected []int
+	if select_tracks != "" {
+		selected, err = parseTrackSelection(select_tracks, trackTotal)
+		if err != nil {
+			fmt.Println("Invalid --select-tracks:", err)
+			return err
+		}
+	} else if !dl_select {
+		selected = arr
+	} else {
+		selected = playlist.ShowSelect()
+	}
+
+	catalog := &playlistCatalog{
+		albums:       make(map[string]*ampapi.AlbumRespData),
+		trackNumbers: make(map[string]map[string][2]int),
+		artistCovers: make(map[string]string),
+	}
+	return forEachFormat(playlist.Tracks, func() error {
+		return ripPlaylistFormat(playlist, playlistId, selected, catalog, token, storefront, mediaUserToken)
+	})
 }
 
-func stripFeaturedArtistsFromTitle(title string) (string, []string) {
-	cleaned := strings.TrimSpace(title)
-	if cleaned == "" {
-		return "", nil
+// playlistCatalog caches the album and artist data looked up for playlist
+// tracks across the formats of a job.
+type playlistCatalog struct {
+	albums       map[string]*ampapi.AlbumRespData
+	trackNumbers map[string]map[string][2]int
+	artistCovers map[string]string
+}
+
+// ripPlaylistFormat downloads the selected tracks of a fetched playlist in
+// the current download mode.
+func ripPlaylistFormat(playlist *task.Playlist, playlistId string, selected []int, catalog *playlistCatalog, token, storefront, mediaUserToken string) error {
+	meta := playlist.Resp
+	codec := "ALAC"
+	if dl_atmos {
+		codec = "ATMOS"
+	} else if dl_ac3 {
+		codec = "AC3"
+	} else if dl_aac {
+		codec = "AAC"
 	}
-	featured := []string{}
+	playlist.Codec = codec
 
-	for {
-		if matches := featuredTitleBracketSuffixRe.FindStringSubmatch(cleaned); len(matches) == 2 {
-			featured = append(featured, parseFeaturedArtists(matches[1])...)
-			cleaned = strings.TrimSpace(strings.TrimSuffix(cleaned, matches[0]))
+	type albumGroup struct {
+		albumID      string
+		albumData    *ampapi.AlbumRespData
+		albumName    string
+		artistName   string
+		artistID     string
+		releaseDate  string
+		upc          string
+		recordLabel  string
+		artistCover  string
+		trackCount   int
+		isSingle     bool
+		audioTraits  []string
+		coverURL     string
+		sampleTrack  string
+		tagString    string
+		quality      string
+		codec        string
+		folderPath   string
+		artistFolder string
+		trackIndexes []int
+		skip         bool
+	}
+
+	groups := make(map[string]*albumGroup)
+	playlistLists := make(map[string]library.Playlists)
+	var playlistFiles []string
+	albumCache := catalog.albums
+	albumTrackNumbers := catalog.trackNumbers
+	artistCoverCache := catalog.artistCovers
+	rootFolder := currentRootFolder()
+
+	for idx := range playlist.Tracks {
+		order := idx + 1
+		if !isInArray(selected, order) {
 			continue
 		}
-		if matches := featuredTitleInlineSuffixRe.FindStringSubmatch(cleaned); len(matches) == 2 {
-			featured = append(featured, parseFeaturedArtists(matches[1])...)
-			cleaned = strings.TrimSpace(strings.TrimSuffix(cleaned, matches[0]))
-			cleaned = strings.TrimSpace(strings.TrimRight(cleaned, "-–—"))
-			continue
+
+		track := &playlist.Tracks[idx]
+		albumID := ""
+		albumName := track.Resp.Attributes.AlbumName
+		releaseDate := ""
+		upc := ""
+		recordLabel := ""
+		artistCover := ""
+		trackCount := 0
+		isSingle := false
+		audioTraits := track.Resp.Attributes.AudioTraits
+
+		if len(track.Resp.Relationships.Albums.Data) > 0 {
+			albumRel := track.Resp.Relationships.Albums.Data[0]
+			albumID = albumRel.ID
+			if albumRel.Attributes.Name != "" {
+				albumName = albumRel.Attributes.Name
+			}
+			releaseDate = albumRel.Attributes.ReleaseDate
+			trackCount = albumRel.Attributes.TrackCount
+			isSingle = albumRel.Attributes.IsSingle
+			upc = albumRel.Attributes.Upc
+		}
+
+		if albumID == "" {
+			albumID = fmt.Sprintf("unknown-%s", albumName)
+		}
+
+		artistID := ""
+		if len(track.Resp.Relationships.Artists.Data) > 0 {
+			artistID = track.Resp.Relationships.Artists.Data[0].ID
+		}
+
+		var albumData *ampapi.AlbumRespData
+		shouldFetchAlbum := !strings.HasPrefix(albumID, "unknown-")
+		if shouldFetchAlbum {
+			if cached, ok := albumCache[albumID]; ok {
+				albumData = cached
+			} else {
+				resp, err := ampapi.GetAlbumResp(storefront, albumID, playlist.Language, token)
+				if err != nil {
+					fmt.Println("Failed to fetch album data for playlist item:", err)
+				} else if len(resp.Data) > 0 {
+					albumData = &resp.Data[0]
+					albumCache[albumID] = albumData
+				}
+			}
+		}
+
+		if albumData != nil {
+			if albumData.Attributes.Name != "" {
+				albumName = albumData.Attributes.Name
+			}
+			if albumData.Attributes.ReleaseDate != "" {
+				releaseDate = albumData.Attributes.ReleaseDate
+			}
+			if albumData.Attributes.Upc != "" {
+				upc = albumData.Attributes.Upc
+			}
+			if albumData.Attributes.RecordLabel != "" {
+				recordLabel = albumData.Attributes.RecordLabel
+			}
+			if albumData.Attributes.TrackCount > 0 {
+				trackCount = albumData.Attributes.TrackCount
+			}
+			isSingle = albumData.Attributes.IsSingle
+			if len(albumData.Relationships.Artists.Data) > 0 {
+				artistCover = albumData.Relationships.Artists.Data[0].Attributes.Artwork.Url
+			}
+			if len(albumData.Relationships.Artists.Data) > 0 {
+				artistID = albumData.Relationships.Artists.Data[0].ID
+			}
+			track.AlbumData = *albumData
+			if len(albumData.Relationships.Tracks.Data) > 0 {
+				track.DiscTotal = albumData.Relationships.Tracks.Data[len(albumData.Relationships.Tracks.Data)-1].Attributes.DiscNumber
+			}
+			if _, ok := albumTrackNumbers[albumID]; !ok {
+				trackMap := make(map[string][2]int)
+				for _, albumTrack := range albumData.Relationships.Tracks.Data {
+					trackMap[albumTrack.ID] = [2]int{
+						albumTrack.Attributes.TrackNumber,
+						albumTrack.Attributes.DiscNumber,
+					}
+				}
+				albumTrackNumbers[albumID] = trackMap
+			}
+		}
+		if releaseDate == "" && track.Resp.Attributes.ReleaseDate != "" {
+			releaseDate = track.Resp.Attributes.ReleaseDate
+		}
+		if artistCover == "" && artistID != "" {
+			if cached, ok := artistCoverCache[artistID]; ok {
+				artistCover = cached
+			} else {
+				resp, err := ampapi.GetArtistResp(storefront, artistID, playlist.Language, token)
+				if err == nil && len(resp.Data) > 0 {
+					artistCover = resp.Data[0].Attributes.Artwork.Url
+				}
+				artistCoverCache[artistID] = artistCover
+			}
+		}
+
+		primaryAlbumArtist := ""
+		if albumData != nil {
+			primaryAlbumArtist = primaryArtist(artistNamesFromAlbumData(albumData))
+		}
+		if primaryAlbumArtist == "" {
+			primaryAlbumArtist = primaryArtist(artistNamesFromTrack(track))
+		}
+		if primaryAlbumArtist == "" {
+			primaryAlbumArtist = track.Resp.Attributes.ArtistName
+		}
+		if trackMap, ok := albumTrackNumbers[albumID]; ok {
+			if nums, ok := trackMap[track.ID]; ok {
+				if nums[0] > 0 {
+					track.Resp.Attributes.TrackNumber = nums[0]
+				}
+				if nums[1] > 0 {
+					track.Resp.Attributes.DiscNumber = nums[1]
+				}
+			}
+		}
+
+		stringsToJoin := []string{}
+		if track.Resp.Attributes.IsAppleDigitalMaster {
+			if Config.AppleMasterChoice != "" {
+				stringsToJoin = append(stringsToJoin, Config.AppleMasterChoice)
+			}
+		}
+		if track.Resp.Attributes.ContentRating == "explicit" {
+			if Config.ExplicitChoice != "" {
+				stringsToJoin = append(stringsToJoin, Config.ExplicitChoice)
+			}
+		}
+		if track.Resp.Attributes.ContentRating == "clean" {
+			if Config.CleanChoice != "" {
+				stringsToJoin = append(stringsToJoin, Config.CleanChoice)
+			}
+		}
+		tagString := strings.Join(stringsToJoin, " ")
+
+		group, ok := groups[albumID]
+		if !ok {
+			group = &albumGroup{
+				albumID:      albumID,
+				albumData:    albumData,
+				albumName:    albumName,
+				artistName:   primaryAlbumArtist,
+				artistID:     artistID,
+				releaseDate:  releaseDate,
+				upc:          upc,
+				recordLabel:  recordLabel,
+				artistCover:  artistCover,
+				trackCount:   trackCount,
+				isSingle:     isSingle,
+				audioTraits:  audioTraits,
+				coverURL:     track.Resp.Attributes.Artwork.URL,
+				sampleTrack:  track.ID,
+				tagString:    tagString,
+				codec:        codec,
+				trackIndexes: []int{idx},
+			}
+			groups[albumID] = group
+		} else {
+			group.trackIndexes = append(group.trackIndexes, idx)
+			if group.albumName == "" && albumName != "" {
+				group.albumName = albumName
+			}
+			if group.artistName == "" && primaryAlbumArtist != "" {
+				group.artistName = primaryAlbumArtist
+			}
+			if group.releaseDate == "" && releaseDate != "" {
+				group.releaseDate = releaseDate
+			}
+			if group.upc == "" && upc != "" {
+				group.upc = upc
+			}
+			if group.recordLabel == "" && recordLabel != "" {
+				group.recordLabel = recordLabel
+			}
+			if group.artistCover == "" && artistCover != "" {
+				group.artistCover = artistCover
+			}
+			if group.trackCount == 0 && trackCount > 0 {
+				group.trackCount = trackCount
+			}
+			if group.artistID == "" && artistID != "" {
+				group.artistID = artistID
+			}
 		}
-		break
 	}
 
-	cleaned = strings.TrimSpace(cleaned)
-	if cleaned == "" {
-		cleaned = strings.TrimSpace(title)
-	}
-	return cleaned, normalizedArtistNames(featured)
-}
-
-func metadataTitleAndArtistsFromTrack(track *task.Track) (string, []string) {
-	if track == nil {
-		return "", nil
-	}
-	cleanTitle, featuredArtists := stripFeaturedArtistsFromTitle(track.Resp.Attributes.Name)
-	artistNames := artistNamesFromTrack(track)
-	if len(featuredArtists) > 0 {
-		artistNames = normalizedArtistNames(append(artistNames, featuredArtists...))
-	}
-	return cleanTitle, artistNames
-}
+	for _, group := range groups {
+		if dl_atmos || dl_ac3 || dl_covers_only || dl_lyrics_only {
+			hasSupported := false
+			for _, idx := range group.trackIndexes {
+				if idx >= 0 && idx < len(playlist.Tracks) {
+					if trackSupportsCurrentFormat(&playlist.Tracks[idx]) {
+						hasSupported = true
+						break
+					}
+				}
+			}
+			if !hasSupported {
+				fmt.Printf("No selected tracks available for this format; skipping %s.\n", group.albumName)
+				group.skip = true
+				continue
+			}
+		}
 
-func formatArtistList(names []string) string {
-	normalized := normalizedArtistNames(names)
-	if len(normalized) == 0 {
-		return ""
-	}
-	return strings.Join(normalized, ", ")
-}
+		artistFolderName := buildArtistFolderName(group.artistName, group.artistID)
+		artistFolder := joinFolder(rootFolder, artistFolderName)
+		group.artistFolder = artistFolder
+		releaseType := detectReleaseType(group.albumName, group.trackCount, group.isSingle)
+		releaseFolder := releaseFolderLabel(releaseType)
 
-func shouldSplitComposerConjunction(raw string) bool {
-	trimmed := strings.TrimSpace(raw)
-	if trimmed == "" {
-		return false
-	}
-	if strings.Contains(trimmed, ";") || strings.Contains(trimmed, " / ") || strings.Contains(trimmed, " x ") || strings.Contains(trimmed, " X ") || strings.Contains(trimmed, " × ") {
-		return true
-	}
-	if shouldSplitStandaloneComposerAmpersand(trimmed) {
-		return true
-	}
-	return strings.Count(trimmed, ",") >= 2
-}
+		quality, resolvedCodec := resolveAlbumQuality(
+			storefront,
+			group.sampleTrack,
+			playlist.Language,
+			token,
+			group.codec,
+			group.audioTraits,
+		)
+		group.codec = resolvedCodec
+		group.quality = quality
 
-func shouldSplitStandaloneComposerAmpersand(raw string) bool {
-	if strings.Count(raw, " & ") != 1 {
-		return false
-	}
-	if strings.Contains(raw, ",") || strings.Contains(raw, ";") || strings.Contains(raw, " / ") || strings.Contains(raw, " x ") || strings.Contains(raw, " X ") || strings.Contains(raw, " × ") {
-		return false
-	}
-	parts := strings.SplitN(raw, " & ", 2)
-	left := strings.TrimSpace(parts[0])
-	right := strings.TrimSpace(parts[1])
-	if left == "" || right == "" {
-		return false
-	}
-	leftWords := strings.Fields(left)
-	rightWords := strings.Fields(right)
-	if len(leftWords) == 0 || len(rightWords) == 0 {
-		return false
-	}
-	if len(leftWords) == 1 && len(rightWords) == 1 {
-		if !looksLikeComposerAbbreviation(leftWords[0]) && !looksLikeComposerAbbreviation(rightWords[0]) {
-			return false
+		albumData := group.albumData
+		if albumData == nil {
+			albumData = &ampapi.AlbumRespData{}
+			albumData.Attributes.Name = group.albumName
+			albumData.Attributes.TrackCount = group.trackCount
+			albumData.Attributes.IsSingle = group.isSingle
 		}
-	}
-	return true
-}
+		v := albumNameVars(albumData, group.artistName, group.albumID, group.quality, group.codec)
+		releaseYear := ""
+		if len(group.releaseDate) >= 4 {
+			releaseYear = group.releaseDate[:4]
+		}
+		v["ReleaseDate"] = group.releaseDate
+		v["ReleaseYear"] = releaseYear
+		v["AlbumName"] = LimitString(group.albumName)
+		v["UPC"] = group.upc
+		v["RecordLabel"] = group.recordLabel
+		v["ArtistId"] = group.artistID
+		v["Tag"] = group.tagString
+		albumFolderName := renderName(albumFolderFormat(v["ReleaseType"]), v)
+		albumFolderName = strings.TrimSpace(albumFolderName)
+		if dl_atmos && !strings.Contains(strings.ToLower(albumFolderName), "dolby atmos") {
+			albumFolderName = fmt.Sprintf("%s (Dolby Atmos)", albumFolderName)
+		}
+		if dl_ac3 && !strings.Contains(strings.ToLower(albumFolderName), "dolby audio") {
+			albumFolderName = fmt.Sprintf("%s (Dolby Audio)", albumFolderName)
+		}
+		group.folderPath = joinFolder(filepath.Join(artistFolder, releaseFolder), albumFolderName)
+		os.MkdirAll(group.folderPath, os.ModePerm)
 
-func looksLikeComposerAbbreviation(token string) bool {
-	trimmed := strings.TrimSpace(token)
-	if trimmed == "" {
-		return false
-	}
-	if len(trimmed) <= 3 {
-		hasLetter := false
-		for _, r := range trimmed {
-			if (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') {
-				hasLetter = true
+		if Config.SaveCoverFile && !dl_covers_only {
+			if err := saveAlbumCovers(group.folderPath, group.coverURL); err != nil {
+				fmt.Println("Failed to write cover.")
 			}
 		}
-		if hasLetter && strings.ToUpper(trimmed) == trimmed {
-			return true
+
+		if dl_covers_only {
+			saveArtistArtwork(artistFolder, group.artistID, group.artistCover, storefront, playlist.Language, token)
+			handleCoversOnlyAlbum(group.folderPath, group.coverURL, "", "")
 		}
 	}
-	return false
-}
 
-func normalizeComposersFromField(value string) []string {
-	raw := strings.TrimSpace(value)
-	if raw == "" {
+	if dl_covers_only {
+		if Config.SavePlaylistArtwork {
+			savePlaylistArtwork(rootFolder, meta.Data[0], codec, nil)
+		}
 		return nil
 	}
-	parts := splitArtistTokens(raw, []string{
-		"; ",
-		";",
-		" / ",
-		" x ",
-		" X ",
-		" × ",
-		", ",
-		",",
-	})
-	expanded := make([]string, 0, len(parts))
-	splitConjunction := shouldSplitComposerConjunction(raw)
-	for _, part := range parts {
-		token := strings.TrimSpace(part)
-		if token == "" {
-			continue
+
+	groupSuccess := make(map[string]bool)
+
+	for idx := range playlist.Tracks {
+		if checkStopAndWarn() {
+			return nil
 		}
-		if splitConjunction {
-			for _, subPart := range splitArtistTokens(token, []string{" & ", " and ", " And "}) {
-				subToken := strings.TrimSpace(subPart)
-				if subToken != "" {
-					expanded = append(expanded, subToken)
-				}
-			}
+		order := idx + 1
+		if !isInArray(selected, order) {
 			continue
 		}
-		expanded = append(expanded, token)
-	}
-	return normalizedArtistNames(expanded)
-}
-
-func formatComposerList(value string) string {
-	return formatArtistList(normalizeComposersFromField(value))
-}
-
-func primaryArtist(names []string) string {
-	normalized := normalizedArtistNames(names)
-	if len(normalized) == 0 {
-		return ""
-	}
-	return normalized[0]
-}
-
-func artistNamesFromTrack(track *task.Track) []string {
-	names := []string{}
-	if track != nil {
-		for _, artist := range track.Resp.Relationships.Artists.Data {
-			names = append(names, artist.Attributes.Name)
+		track := &playlist.Tracks[idx]
+		albumID := ""
+		if len(track.Resp.Relationships.Albums.Data) > 0 {
+			albumID = track.Resp.Relationships.Albums.Data[0].ID
 		}
-		if len(names) > 0 {
-			return normalizedArtistNames(names)
+		if albumID == "" {
+			albumID = fmt.Sprintf("unknown-%s", track.Resp.Attributes.AlbumName)
 		}
-		if track.Resp.Attributes.ArtistName != "" {
-			return normalizeArtistsFromField(track.Resp.Attributes.ArtistName)
+		group, ok := groups[albumID]
+		if ok {
+			if group.skip {
+				continue
+			}
+			track.SaveDir = group.folderPath
+			track.Codec = group.codec
+		} else {
+			if dl_covers_only || dl_lyrics_only {
+				continue
+			}
+			track.SaveDir = rootFolder
+			track.Codec = codec
 		}
-	}
-	return nil
-}
 
-func artistNamesFromAlbumData(album *ampapi.AlbumRespData) []string {
-	if album == nil {
-		return nil
-	}
-	names := []string{}
-	for _, artist := range album.Relationships.Artists.Data {
-		names = append(names, artist.Attributes.Name)
-	}
-	if len(names) > 0 {
-		return normalizedArtistNames(names)
-	}
-	if album.Attributes.ArtistName != "" {
-		return normalizeArtistsFromField(album.Attributes.ArtistName)
-	}
-	return nil
-}
+		if isInArray(okDict[okKey(playlistId)], order) {
+			counter.Total++
+			counter.Success++
+			recordFormatStatus(track, multiformat.StatusOK)
+			continue
+		}
 
-func artistNamesFromMusicVideoData(video *ampapi.MusicVideoRespData) []string {
-	if video == nil {
-		return nil
+		if dl_lyrics_only {
+			if ripLyricsTrack(track, token, mediaUserToken) {
+				groupSuccess[albumID] = true
+			}
+		} else {
+			if ripTrackForFormat(track, token, mediaUserToken) {
+				groupSuccess[albumID] = true
+				recordPlaylistTrack(playlistLists, playlistId, meta.Data[0].Attributes.Name, track.SavePath)
+				if track.SavePath != "" {
+					playlistFiles = append(playlistFiles, track.SavePath)
+				}
+			}
+		}
 	}
-	names := []string{}
-	for _, artist := range video.Relationships.Artists.Data {
-		names = append(names, artist.Attributes.Name)
+	for root, lists := range playlistLists {
+		if err := lists.Save(root); err != nil {
+			fmt.Println("Failed to save playlist index:", err)
+		}
 	}
-	if len(names) > 0 {
-		return normalizedArtistNames(names)
+	if Config.SavePlaylistArtwork && !dl_lyrics_only {
+		savePlaylistArtwork(rootFolder, meta.Data[0], codec, playlistFiles)
 	}
-	if video.Attributes.ArtistName != "" {
-		return normalizeArtistsFromField(video.Attributes.ArtistName)
+
+	if !dl_lyrics_only && (Config.SaveArtistCover || Config.SaveArtistBanner) {
+		for albumID, success := range groupSuccess {
+			if !success {
+				continue
+			}
+			group, ok := groups[albumID]
+			if !ok || group.artistFolder == "" {
+				continue
+			}
+			saveArtistArtwork(group.artistFolder, group.artistID, group.artistCover, storefront, playlist.Language, token)
+		}
 	}
 	return nil
 }
 
-func albumArtistNamesFromTrack(track *task.Track) []string {
-	if track == nil {
-		return nil
+// recordPlaylistTrack adds the file saved at path, and the copies next to
+// it such as a kept original or a conversion, to the playlist record of its
+// save root. lists holds the records loaded so far by root.
+func recordPlaylistTrack(lists map[string]library.Playlists, id, name, path string) {
+	root := saveRootForPath(path)
+	if path == "" || root == "" {
+		return
 	}
-	if track.AlbumData.ID != "" {
-		if names := artistNamesFromAlbumData(&track.AlbumData); len(names) > 0 {
-			return names
-		}
+	if _, ok := lists[root]; !ok {
+		lists[root] = library.LoadPlaylists(root)
 	}
-	if len(track.Resp.Relationships.Albums.Data) > 0 {
-		albumRel := track.Resp.Relationships.Albums.Data[0]
-		if albumRel.Attributes.ArtistName != "" {
-			return normalizeArtistsFromField(albumRel.Attributes.ArtistName)
+	dir, base := filepath.Split(path)
+	stem := strings.TrimSuffix(base, filepath.Ext(base))
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		if f.IsDir() || !library.IsAudio(f.Name()) || strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())) != stem {
+			continue
+		}
+		if rel, err := filepath.Rel(root, filepath.Join(dir, f.Name())); err == nil {
+			lists[root].Add(id, name, rel)
 		}
 	}
-	if track.Resp.Attributes.ArtistName != "" {
-		return normalizeArtistsFromField(track.Resp.Attributes.ArtistName)
-	}
-	return nil
 }
 
-func trackSupportsCurrentFormat(track *task.Track) bool {
-	if track == nil {
-		return false
+func buildMP4TagsForTrack(track *task.Track, lrc string) (*mp4tag.MP4Tags, error) {
+	title, titleArtists := metadataTitleAndArtistsFromTrack(track)
+	if title == "" {
+		title = track.Resp.Attributes.Name
 	}
-	if dl_atmos {
-		if track.WebM3u8 == "" {
-			return false
-		}
-		available, err := hasAtmosVariant(track.WebM3u8)
-		if err != nil {
-			fmt.Println("Atmos availability check failed:", err)
-			return false
+	useAtmosPrefix := shouldUseAtmosMetadataPrefix(track)
+	tagTitle := withAtmosMetadataPrefix(title, useAtmosPrefix)
+	albumName := withAtmosMetadataPrefix(track.Resp.Attributes.AlbumName, useAtmosPrefix)
+	composerList := formatComposerList(track.Resp.Attributes.ComposerName)
+	if composerList == "" {
+		composerList = strings.TrimSpace(track.Resp.Attributes.ComposerName)
+	}
+	trackArtistList := formatArtistList(titleArtists)
+	if trackArtistList == "" {
+		trackArtistList = formatArtistList(artistNamesFromTrack(track))
+		if trackArtistList == "" {
+			trackArtistList = track.Resp.Attributes.ArtistName
 		}
-		return available
 	}
-	if dl_aac {
-		return true
+	albumArtistName := primaryArtist(albumArtistNamesFromTrack(track))
+	if albumArtistName == "" {
+		albumArtistName = track.Resp.Attributes.ArtistName
 	}
-	traits := track.Resp.Attributes.AudioTraits
-	if Config.GetM3u8Mode == "hires" {
-		return contains(traits, "hi-res-lossless")
+	trackNumber := track.Resp.Attributes.TrackNumber
+	if trackNumber == 0 {
+		trackNumber = track.TaskNum
 	}
-	if len(traits) == 0 {
-		return true
+
+	t := &mp4tag.MP4Tags{
+		Custom: map[string]string{},
 	}
-	return contains(traits, "lossless") || contains(traits, "hi-res-lossless")
-}
 
-func anySelectedTrackSupportsFormat(tracks []task.Track, selected []int) bool {
-	if len(tracks) == 0 || len(selected) == 0 {
-		return false
+	if metadataTagEnabled("title") {
+		t.Title = tagTitle
 	}
-	for _, idx := range selected {
-		if idx <= 0 || idx > len(tracks) {
-			continue
-		}
-		if trackSupportsCurrentFormat(&tracks[idx-1]) {
-			return true
-		}
+	if metadataTagEnabled("title_sort") {
+		t.TitleSort = tagTitle
 	}
-	return false
-}
-
-func ripTrack(track *task.Track, token string, mediaUserToken string) bool {
-	if checkStopAndWarn() {
-		return false
+	if metadataTagEnabled("artist") {
+		t.Artist = trackArtistList
 	}
-	var err error
-	counter.Total++
-	fmt.Printf("Track %d of %d: %s\n", track.TaskNum, track.TaskTotal, track.Type)
-
-	//提前获取到的播放列表下track所在的专辑信息
-	if track.PreType == "playlists" && Config.UseSongInfoForPlaylist {
-		if track.AlbumData.ID == "" {
-			track.GetAlbumData(token)
-		}
+	if metadataTagEnabled("artist_sort") {
+		t.ArtistSort = trackArtistList
 	}
-
-	//mv dl dev
-	if track.Type == "music-videos" {
-		if len(mediaUserToken) <= 50 {
-			fmt.Println("meida-user-token is not set, skip MV dl")
-			counter.Success++
-			return true
-		}
-		if _, err := exec.LookPath("mp4decrypt"); err != nil {
-			fmt.Println("mp4decrypt is not found, skip MV dl")
-			counter.Success++
-			return true
-		}
-		err := mvDownloader(track.ID, track.SaveDir, token, track.Storefront, mediaUserToken, track)
-		if err != nil {
-			fmt.Println("\u26A0 Failed to dl MV:", err)
-			counter.Error++
-			return false
-		}
-		counter.Success++
-		return true
+	if metadataTagEnabled("composer") {
+		t.Composer = composerList
 	}
-
-	if dl_atmos {
-		if track.WebM3u8 == "" {
-			fmt.Println("Atmos not available for this track.")
-			emitUnavailableEntry(track, "atmos_unavailable")
-			counter.Unavailable++
-			return false
-		}
-		available, err := hasAtmosVariant(track.WebM3u8)
-		if err != nil {
-			fmt.Println("Atmos availability check failed:", err)
-			emitUnavailableEntry(track, "atmos_availability_check_failed")
-			counter.Unavailable++
-			markAbortRetries(err)
-			return false
-		}
-		if !available {
-			fmt.Println("Atmos not available for this track.")
-			emitUnavailableEntry(track, "atmos_unavailable")
-			counter.Unavailable++
-			return false
-		}
+	if metadataTagEnabled("composer_sort") {
+		t.ComposerSort = composerList
 	}
-
-	needDlAacLc := false
-	usingLosslessFallback := false
-	if dl_aac && Config.AacType == "aac-lc" {
-		needDlAacLc = true
+	if metadataTagEnabled("genre") && len(track.Resp.Attributes.GenreNames) > 0 {
+		t.CustomGenre = track.Resp.Attributes.GenreNames[0]
 	}
-	if track.WebM3u8 == "" && !needDlAacLc {
-		if dl_atmos {
-			fmt.Println("Unavailable")
-			emitUnavailableEntry(track, "atmos_unavailable")
-			counter.Unavailable++
-			return false
-		}
-		fmt.Println("Lossless/Hi-Res not available for this track. Falling back to AAC.")
-		emitUnavailableEntry(track, "lossless_unavailable")
-		usingLosslessFallback = true
-		needDlAacLc = true
+	if metadataTagEnabled("lyrics") && lrc != "" {
+		t.Lyrics = lrc
 	}
-	if needDlAacLc {
-		track.Codec = "AAC"
+	if metadataTagEnabled("track_number") {
+		t.TrackNumber = int16(trackNumber)
 	}
-	if usingLosslessFallback {
-		track.SaveDir = fallbackAacSaveDir(track.SaveDir)
-		track.CoverPath = ""
-		if err := os.MkdirAll(track.SaveDir, os.ModePerm); err != nil {
-			fmt.Println("Failed to create AAC fallback folder:", err)
-			counter.Error++
-			return false
-		}
+	if metadataTagEnabled("disc_number") {
+		t.DiscNumber = int16(track.Resp.Attributes.DiscNumber)
 	}
-
-	needCheck := false
-	if Config.GetM3u8Mode == "all" {
-		needCheck = true
-	} else if Config.GetM3u8Mode == "hires" && contains(track.Resp.Attributes.AudioTraits, "hi-res-lossless") {
-		needCheck = true
+	if metadataTagEnabled("album") {
+		t.Album = albumName
 	}
-	if needCheck && !needDlAacLc {
-		EnhancedHls_m3u8, err := checkM3u8(track.ID, "song")
-		if err != nil {
-			markAbortRetries(err)
-		}
-		if strings.HasSuffix(EnhancedHls_m3u8, ".m3u8") {
-			track.DeviceM3u8 = EnhancedHls_m3u8
-			track.M3u8 = EnhancedHls_m3u8
-		}
+	if metadataTagEnabled("album_sort") {
+		t.AlbumSort = albumName
 	}
-
-	var Quality string
-	if strings.Contains(Config.SongFileFormat, "Quality") {
-		if dl_atmos {
-			Quality = fmt.Sprintf("%dKbps", Config.AtmosMax-2000)
-		} else if needDlAacLc {
-			Quality = "256Kbps"
-		} else {
-			_, Quality, err = extractMedia(track.M3u8, true)
-			if err != nil {
-				fmt.Println("Failed to extract quality from manifest.\n", err)
-				counter.Error++
-				return false
-			}
+	if metadataTagEnabled("performer") && trackArtistList != "" {
+		t.Custom["PERFORMER"] = trackArtistList
+	}
+	if metadataTagEnabled("release_type") {
+		releaseType := metadataReleaseTypeForTrack(track)
+		if releaseType != "" {
+			t.Custom["RELEASETYPE"] = releaseType
 		}
 	}
-	track.Quality = Quality
-
-	songName := buildSongName(track, Quality)
-	fmt.Println(songName)
-	filename := fmt.Sprintf("%s.m4a", forbiddenNames.ReplaceAllString(songName, "_"))
-	track.SaveName = filename
-	trackPath := filepath.Join(track.SaveDir, track.SaveName)
-	lrcFilename := fmt.Sprintf("%s.%s", forbiddenNames.ReplaceAllString(songName, "_"), Config.LrcFormat)
-
-	// Determine possible post-conversion target file (so we can skip re-download)
-	var convertedPath string
-	considerConverted := false
-	if Config.ConvertAfterDownload &&
-		Config.ConvertFormat != "" &&
-		strings.ToLower(Config.ConvertFormat) != "copy" &&
-		!Config.ConvertKeepOriginal {
-		convertedPath = strings.TrimSuffix(trackPath, filepath.Ext(trackPath)) + "." + strings.ToLower(Config.ConvertFormat)
-		considerConverted = true
+	if metadataTagEnabled("isrc") && track.Resp.Attributes.Isrc != "" {
+		t.Custom["ISRC"] = track.Resp.Attributes.Isrc
 	}
 
-	// Existence check now considers converted output (if original was deleted)
-	existsOriginal, err := fileExists(trackPath)
-	if err != nil {
-		fmt.Println("Failed to check if track exists.")
-	}
-	if existsOriginal {
-		fmt.Println("Track already exists locally.")
-		counter.Success++
-		okDict[track.PreID] = append(okDict[track.PreID], track.TaskNum)
-		emitHistoryEntry(track)
-		return true
+	if metadataTagEnabled("itunes_album_id") && track.PreType == "albums" {
+		albumID, err := strconv.ParseUint(track.PreID, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		t.ItunesAlbumID = int32(albumID)
 	}
-	if considerConverted {
-		existsConverted, err2 := fileExists(convertedPath)
-		if err2 == nil && existsConverted {
-			fmt.Println("Converted track already exists locally.")
-			counter.Success++
-			okDict[track.PreID] = append(okDict[track.PreID], track.TaskNum)
-			emitHistoryEntry(track)
-			return true
+
+	if metadataTagEnabled("itunes_artist_id") && len(track.Resp.Relationships.Artists.Data) > 0 {
+		artistID, err := strconv.ParseUint(track.Resp.Relationships.Artists.Data[0].ID, 10, 32)
+		if err != nil {
+			return nil, err
 		}
+		t.ItunesArtistID = int32(artistID)
 	}
 
-	if needDlAacLc {
-		if len(mediaUserToken) <= 50 {
-			if usingLosslessFallback {
-				fmt.Println("Lossless fallback to AAC requires a valid media-user-token. Skipping this track.")
-				counter.Unavailable++
-				return false
-			}
-			fmt.Println("Invalid media-user-token")
-			counter.Error++
-			return false
+	if (track.PreType == "playlists" || track.PreType == "stations") && !Config.UseSongInfoForPlaylist {
+		if metadataTagEnabled("disc_number") {
+			t.DiscNumber = 1
 		}
-		_, err := runv3.Run(track.ID, trackPath, token, mediaUserToken, false, "")
-		if err != nil {
-			fmt.Println("Failed to dl aac-lc:", err)
-			if err.Error() == "Unavailable" {
-				counter.Unavailable++
-				return false
-			}
-			if usingLosslessFallback {
-				counter.Unavailable++
-				return false
-			}
-			counter.Error++
-			return false
+		if metadataTagEnabled("disc_total") {
+			t.DiscTotal = 1
+		}
+		if metadataTagEnabled("track_number") {
+			t.TrackNumber = int16(trackNumber)
+		}
+		if metadataTagEnabled("track_total") {
+			t.TrackTotal = int16(track.TaskTotal)
+		}
+		if metadataTagEnabled("album") {
+			t.Album = track.PlaylistData.Attributes.Name
+		}
+		if metadataTagEnabled("album_sort") {
+			t.AlbumSort = track.PlaylistData.Attributes.Name
+		}
+		if metadataTagEnabled("album_artist") {
+			t.AlbumArtist = albumArtistName
+		}
+		if metadataTagEnabled("album_artist_sort") {
+			t.AlbumArtistSort = albumArtistName
+		}
+	} else if (track.PreType == "playlists" || track.PreType == "stations") && Config.UseSongInfoForPlaylist {
+		if metadataTagEnabled("disc_total") {
+			t.DiscTotal = int16(track.DiscTotal)
+		}
+		if metadataTagEnabled("track_total") {
+			t.TrackTotal = int16(track.AlbumData.Attributes.TrackCount)
+		}
+		if metadataTagEnabled("album_artist") {
+			t.AlbumArtist = albumArtistName
+		}
+		if metadataTagEnabled("album_artist_sort") {
+			t.AlbumArtistSort = albumArtistName
+		}
+		if metadataTagEnabled("upc") && track.AlbumData.Attributes.Upc != "" {
+			t.Custom["UPC"] = track.AlbumData.Attributes.Upc
+		}
+		if metadataTagEnabled("label") && track.AlbumData.Attributes.RecordLabel != "" {
+			t.Custom["LABEL"] = track.AlbumData.Attributes.RecordLabel
+		}
+		if metadataTagEnabled("release_date") {
+			t.Date = track.AlbumData.Attributes.ReleaseDate
+		}
+		if metadataTagEnabled("copyright") {
+			t.Copyright = track.AlbumData.Attributes.Copyright
+		}
+		if metadataTagEnabled("publisher") {
+			t.Publisher = track.AlbumData.Attributes.RecordLabel
 		}
 	} else {
-		trackM3u8Url, _, err := extractMedia(track.M3u8, false)
-		if err != nil {
-			fmt.Println("\u26A0 Failed to extract info from manifest:", err)
-			counter.Unavailable++
-			return false
+		if metadataTagEnabled("disc_total") {
+			t.DiscTotal = int16(track.DiscTotal)
 		}
-		if Config.GetM3u8FromDevice {
-			hasPrefetch, err := mediaPlaylistHasPrefetchKey(trackM3u8Url)
-			if err != nil {
-				fmt.Println("⚠️ Failed to inspect media playlist for prefetch key:", err)
-			} else if hasPrefetch {
-				fmt.Println("⚠️ Prefetch-only key detected; requesting device m3u8...")
-				deviceM3u8, _ := checkM3u8(track.ID, "song")
-				if strings.HasSuffix(deviceM3u8, ".m3u8") {
-					track.DeviceM3u8 = deviceM3u8
-					track.M3u8 = deviceM3u8
-					trackM3u8Url, _, err = extractMedia(track.M3u8, false)
-					if err != nil {
-						fmt.Println("\u26A0 Failed to extract info from device manifest:", err)
-						counter.Unavailable++
-						return false
-					}
-				} else {
-					fmt.Println("⚠️ Device m3u8 unavailable; continuing with web playlist.")
-				}
-			}
+		if metadataTagEnabled("track_total") {
+			t.TrackTotal = int16(track.AlbumData.Attributes.TrackCount)
 		}
-		//边下载边解密
-		err = runv2.Run(track.ID, trackM3u8Url, trackPath, Config)
-		if err != nil && shouldRetryWrapper(err) {
-			fmt.Println("Decryptor connection dropped; waiting for wrapper to restart...")
-			if waitForWrapperReady(Config.DecryptM3u8Port, 5, time.Second) {
-				err = runv2.Run(track.ID, trackM3u8Url, trackPath, Config)
-			}
+		if metadataTagEnabled("album_artist") {
+			t.AlbumArtist = albumArtistName
 		}
-		if err != nil {
-			fmt.Println("Failed to run v2:", err)
-			markAbortRetries(err)
-			counter.Error++
-			return false
+		if metadataTagEnabled("album_artist_sort") {
+			t.AlbumArtistSort = albumArtistName
 		}
-	}
-
-	// Lyrics after audio (reuse from siblings when possible)
-	var lrc string
-	embedLyrics := Config.EmbedLrc && metadataTagEnabled("lyrics")
-	if embedLyrics || Config.SaveLrcFile {
-		existingPath, ok := findExistingSiblingFile(track.SaveDir, lrcFilename)
-		if ok {
-			content, err := os.ReadFile(existingPath)
-			if err == nil {
-				targetPath := filepath.Join(track.SaveDir, lrcFilename)
-				if Config.SaveLrcFile && existingPath != targetPath {
-					if err := copyFile(existingPath, targetPath); err != nil {
-						fmt.Println("Failed to copy lyrics:", err)
-					}
-				}
-				if embedLyrics {
-					lrc = string(content)
-				}
-			}
-		} else {
-			lrcStr, err := getLyricsWithFallback(track, token, mediaUserToken)
-			if err != nil {
-				fmt.Println(err)
-			} else {
-				if Config.SaveLrcFile {
-					err := writeLyrics(track.SaveDir, lrcFilename, lrcStr)
-					if err != nil {
-						fmt.Printf("Failed to write lyrics")
-					}
-				}
-				if embedLyrics {
-					lrc = lrcStr
-				}
-			}
+		if metadataTagEnabled("upc") && track.AlbumData.Attributes.Upc != "" {
+			t.Custom["UPC"] = track.AlbumData.Attributes.Upc
 		}
-	}
-
-	// Embed cover after lyrics to keep order: audio -> lyrics -> covers
-	tags := []string{
-		"tool=",
-		"artist=AppleMusic",
-	}
-	embedCover := Config.EmbedCover && metadataTagEnabled("cover")
-	if embedCover {
-		if track.CoverPath == "" {
-			coverPath, err := ensureCoverFile(track.SaveDir, "cover", track.Resp.Attributes.Artwork.URL)
-			if err != nil {
-				fmt.Println("Failed to write cover.")
-			} else {
-				track.CoverPath = coverPath
-			}
+		if metadataTagEnabled("release_date") {
+			t.Date = track.AlbumData.Attributes.ReleaseDate
 		}
-		if track.CoverPath != "" {
-			tags = append(tags, fmt.Sprintf("cover=%s", track.CoverPath))
+		if metadataTagEnabled("copyright") {
+			t.Copyright = track.AlbumData.Attributes.Copyright
+		}
+		if metadataTagEnabled("publisher") {
+			t.Publisher = track.AlbumData.Attributes.RecordLabel
+		}
+		if metadataTagEnabled("label") && track.AlbumData.Attributes.RecordLabel != "" {
+			t.Custom["LABEL"] = track.AlbumData.Attributes.RecordLabel
 		}
-	}
-	tagsString := strings.Join(tags, ":")
-	cmd := exec.Command("MP4Box", "-itags", tagsString, trackPath)
-	if err := cmd.Run(); err != nil {
-		fmt.Printf("Embed failed: %v\n", err)
-		counter.Error++
-		return false
 	}
 
-	track.SavePath = trackPath
-	err = writeMP4Tags(track, lrc)
-	if err != nil {
-		fmt.Println("\u26A0 Failed to write tags in media:", err)
-		counter.Unavailable++
-		return false
+	if metadataTagEnabled("advisory") {
+		if track.Resp.Attributes.ContentRating == "explicit" {
+			t.ItunesAdvisory = mp4tag.ItunesAdvisoryExplicit
+		} else if track.Resp.Attributes.ContentRating == "clean" {
+			t.ItunesAdvisory = mp4tag.ItunesAdvisoryClean
+		} else {
+			t.ItunesAdvisory = mp4tag.ItunesAdvisoryNone
+		}
 	}
 
-	// CONVERSION FEATURE hook
-	convertIfNeeded(track, lrc)
+	for key, value := range metadataCustomTagsM4a {
+		t.Custom[key] = value
+	}
 
-	counter.Success++
-	okDict[track.PreID] = append(okDict[track.PreID], track.TaskNum)
-	emitHistoryEntry(track)
-	return true
+	return t, nil
 }
 
-func ripLyricsTrack(track *task.Track, token string, mediaUserToken string) bool {
-	if checkStopAndWarn() {
-		return false
-	}
-	counter.Total++
-	fmt.Printf("Track %d of %d: %s\n", track.TaskNum, track.TaskTotal, track.Type)
+func writeMP4Tags(track *task.Track, lrc string) error {
+	return writeMP4TagsTo(track, lrc, track.SavePath)
+}
 
-	if !trackSupportsCurrentFormat(track) {
-		fmt.Println("Format not available for this track; skipping lyrics.")
-		counter.Unavailable++
-		return false
+func writeMP4TagsTo(track *task.Track, lrc, path string) error {
+	t, err := buildMP4TagsForTrack(track, lrc)
+	if err != nil {
+		return err
 	}
 
-	if track.Type == "music-videos" {
-		fmt.Println("Skipping music video for lyrics-only.")
-		counter.Success++
-		return true
+	if Config.EmbedCover && metadataTagEnabled("cover") && track.CoverPath != "" {
+		addMP4Cover(t, track.CoverPath)
 	}
+	return writeMP4File(path, t)
+}
 
-	if !Config.SaveLrcFile {
-		fmt.Println("save-lrc-file is disabled; nothing to write in lyrics-only mode.")
-		counter.Success++
-		return true
+// writeMP4File flattens fragmented downloads and makes sure an ilst exists
+// before handing the file to go-mp4tag. Embedded pictures are replaced when
+// t carries a cover, del names further items to remove, and files with
+// encoder priming or padding get an iTunSMPB item for gapless playback.
+func writeMP4File(path string, t *mp4tag.MP4Tags, del ...string) error {
+	if err := linkfile.Unshare(path); err != nil {
+		return err
 	}
-
-	songName := buildSongName(track, "")
-	fmt.Println(songName)
-	lrcFilename := fmt.Sprintf("%s.%s", forbiddenNames.ReplaceAllString(songName, "_"), Config.LrcFormat)
-	targetPath := filepath.Join(track.SaveDir, lrcFilename)
-	exists, err := fileExists(targetPath)
-	if err == nil && exists {
-		fmt.Println("Lyrics already exist locally.")
-		counter.Success++
-		return true
+	if err := mp4meta.Prepare(path); err != nil {
+		return err
 	}
-
-	if existingPath, ok := findExistingSiblingFile(track.SaveDir, lrcFilename); ok {
-		if err := copyFile(existingPath, targetPath); err != nil {
-			fmt.Println("Failed to copy lyrics:", err)
-			counter.Error++
-			return false
+	if g, err := mp4meta.ReadGapless(path); err == nil && (g.Priming > 0 || g.Padding > 0) {
+		if t.Custom == nil {
+			t.Custom = map[string]string{}
 		}
-		fmt.Println("Lyrics copied from sibling format.")
-		counter.Success++
-		return true
+		t.Custom["iTunSMPB"] = g.ITunSMPB()
 	}
-
-	lrcStr, err := getLyricsWithFallback(track, token, mediaUserToken)
+	mp4, err := mp4tag.Open(path)
 	if err != nil {
-		fmt.Println(err)
-		counter.Unavailable++
-		return false
+		return err
 	}
-	if err := writeLyrics(track.SaveDir, lrcFilename, lrcStr); err != nil {
-		fmt.Println("Failed to write lyrics.")
-		counter.Error++
-		return false
+	defer mp4.Close()
+	// Custom keys are already upper case; iTunSMPB and iTunNORM must keep
+	// their case for players to find them.
+	mp4.UpperCustom(false)
+	if len(t.Pictures) > 0 {
+		del = append(del, "allpictures")
 	}
-	counter.Success++
-	return true
+	return mp4.Write(t, del)
 }
 
-func ripStation(albumId string, token string, storefront string, mediaUserToken string) error {
-	station := task.NewStation(storefront, albumId)
-	err := station.GetResp(mediaUserToken, token, Config.Language)
+func addMP4Cover(t *mp4tag.MP4Tags, coverPath string) {
+	data, err := os.ReadFile(coverPath)
 	if err != nil {
-		return err
+		fmt.Println("Failed to read cover:", err)
+		return
 	}
-	fmt.Println(" -", station.Type)
-	meta := station.Resp
-
-	var Codec string
-	if dl_atmos {
-		Codec = "ATMOS"
-	} else if dl_aac {
-		Codec = "AAC"
-	} else {
-		Codec = "ALAC"
+	t.Pictures = append(t.Pictures, &mp4tag.MP4Picture{Format: mp4tag.ImageTypeAuto, Data: data})
+}
+
+// runExport mirrors a selection of the downloaded library into a folder or
+// mounted device, transcoding when asked and keeping within --max-size.
+func runExport(argv []string) {
+	fs := pflag.NewFlagSet("export", pflag.ContinueOnError)
+	dest := fs.String("to", "", "Target folder or mounted device")
+	artists := fs.StringSlice("artist", nil, "Export tracks by this artist (repeatable)")
+	playlists := fs.StringSlice("playlist", nil, "Export tracks downloaded for this playlist, by name or ID (repeatable)")
+	query := fs.String("query", "", "Library query, e.g. 'genre:jazz year>=1990'")
+	format := fs.String("format", "copy", "Output format: copy, flac, opus, mp3, wav")
+	profileName := fs.String("profile", "", "Use a convert profile instead of --format")
+	maxSize := fs.String("max-size", "", "Total size budget, e.g. 32G")
+	nameRules := fs.String("filename-profile", Config.FilenameProfile, "Naming rules of the target filesystem: legacy, posix, windows, fat32, exfat, smb or ascii")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: export --to DIR [--artist NAME] [--playlist NAME] [--query Q] [--format FMT | --profile NAME] [--max-size SIZE] [--filename-profile NAME]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(argv); err != nil {
+		return
 	}
-	station.Codec = Codec
-	var singerFoldername string
-	if Config.ArtistFolderFormat != "" {
-		singerFoldername = strings.NewReplacer(
-			"{ArtistName}", "Apple Music Station",
-			"{ArtistId}", "",
-			"{UrlArtistName}", "Apple Music Station",
-		).Replace(Config.ArtistFolderFormat)
-		if strings.HasSuffix(singerFoldername, ".") {
-			singerFoldername = strings.ReplaceAll(singerFoldername, ".", "")
-		}
-		singerFoldername = strings.TrimSpace(singerFoldername)
-		fmt.Println(singerFoldername)
+	if *dest == "" {
+		fmt.Println("Error: export requires --to.")
+		fs.Usage()
+		return
 	}
-	singerFolder := filepath.Join(Config.AlacSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
-	if dl_atmos {
-		singerFolder = filepath.Join(Config.AtmosSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
+	if len(*artists) == 0 && len(*playlists) == 0 && *query == "" {
+		fmt.Println("Error: select tracks with --artist, --playlist or --query.")
+		return
 	}
-	if dl_aac {
-		singerFolder = filepath.Join(Config.AacSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
+	q, err := library.ParseQuery(*query)
+	if err != nil {
+		fmt.Println("Invalid query:", err)
+		return
+	}
+	budget, err := export.ParseSize(*maxSize)
+	if err != nil {
+		fmt.Println("Invalid --max-size:", err)
+		return
+	}
+	destProfile, err := pathsafe.Resolve(*nameRules, Config.FilenameNormalization)
+	if err != nil {
+		fmt.Println("Invalid --filename-profile:", err)
+		return
 	}
-	os.MkdirAll(singerFolder, os.ModePerm)
-	station.SaveDir = singerFolder
-
-	playlistFolder := strings.NewReplacer(
-		"{ArtistName}", "Apple Music Station",
-		"{PlaylistName}", LimitString(station.Name),
-		"{PlaylistId}", station.ID,
-		"{Quality}", "",
-		"{Codec}", Codec,
-		"{Tag}", "",
-	).Replace(Config.PlaylistFolderFormat)
-	if strings.HasSuffix(playlistFolder, ".") {
-		playlistFolder = strings.ReplaceAll(playlistFolder, ".", "")
-	}
-	playlistFolder = strings.TrimSpace(playlistFolder)
-	playlistFolderPath := filepath.Join(singerFolder, forbiddenNames.ReplaceAllString(playlistFolder, "_"))
-	os.MkdirAll(playlistFolderPath, os.ModePerm)
-	station.SaveName = playlistFolder
-	fmt.Println(playlistFolder)
 
-	if Config.SaveCoverFile || Config.EmbedCover {
-		covPath, err := ensureCoverFile(playlistFolderPath, "cover", meta.Data[0].Attributes.Artwork.URL)
-		if err != nil {
-			fmt.Println("Failed to write cover.")
+	codec := strings.ToLower(*format)
+	settings := codec
+	var profile *structs.ConvertProfile
+	if *profileName != "" {
+		for i := range Config.ConvertProfiles {
+			if strings.EqualFold(Config.ConvertProfiles[i].Name, *profileName) {
+				profile = &Config.ConvertProfiles[i]
+			}
+		}
+		if profile == nil {
+			fmt.Printf("Unknown convert profile: %s\n", *profileName)
+			return
+		}
+		codec = strings.ToLower(profile.Codec)
+		settings = fmt.Sprintf("profile:%+v", *profile)
+	}
+	ext := ""
+	if codec != "copy" {
+		if ext, err = convertProfileExt(codec); err != nil {
+			fmt.Println(err)
+			return
 		}
-		station.CoverPath = covPath
 	}
 
-	if Config.SaveAnimatedArtwork && dl_atmos && meta.Data[0].Attributes.EditorialVideo.MotionSquare.Video != "" {
-		fmt.Println("Found Animation Artwork.")
+	entries, err := library.ScanRoots(saveRoots())
+	if err != nil {
+		fmt.Println("Failed to scan library:", err)
+		return
+	}
+	var items []export.Item
+	for i := range entries {
+		e := &entries[i]
+		if !exportSelected(e, *artists, *playlists) || !q.Match(e) {
+			continue
+		}
+		target := e.Rel
+		if ext != "" {
+			target = strings.TrimSuffix(target, filepath.Ext(target)) + ext
+		}
+		target = destProfile.Path(*dest, target)
+		items = append(items, export.Item{Source: e.Path, Size: e.Size, ModTime: e.ModTime, Target: target})
+	}
+	if len(items) == 0 {
+		fmt.Println("No tracks matched the selection.")
+	}
 
-		motionvideoUrlSquare, err := extractVideo(meta.Data[0].Attributes.EditorialVideo.MotionSquare.Video)
-		if err != nil {
-			fmt.Println("no motion video square.\n", err)
+	var ffmpegPath, ffprobePath string
+	if codec != "copy" {
+		if ffmpegPath, err = resolveFFmpegPath(); err != nil {
+			fmt.Printf("ffmpeg not found at '%s'; cannot export as %s.\n", Config.FFmpegPath, codec)
+			return
+		}
+		ffprobePath = resolveFFprobePath(ffmpegPath)
+	}
+	transcode := func(src, dst string) error {
+		if codec == "copy" {
+			_, err := linkfile.Place(src, dst, linkfile.Copy)
+			return err
+		}
+		if isDolbyContainer(codec) {
+			return remuxDolby(codec, ffmpegPath, src, dst, convertedTagsFromFile(ffprobePath, src))
+		}
+		var args []string
+		var err error
+		if profile != nil {
+			args, err = buildProfileFFmpegArgs(*profile, src, dst, probeAudioSampleRate(ffprobePath, src), probeAudioBitDepth(ffprobePath, src))
 		} else {
-			exists, err := fileExists(filepath.Join(playlistFolderPath, "square_animated_artwork.mp4"))
-			if err != nil {
-				fmt.Println("Failed to check if animated artwork square exists.")
-			}
-			if exists {
-				fmt.Println("Animated artwork square already exists locally.")
-			} else {
-				fmt.Println("Animation Artwork Square Downloading...")
-				cmd := exec.Command("ffmpeg", "-loglevel", "quiet", "-y", "-i", motionvideoUrlSquare, "-c", "copy", filepath.Join(playlistFolderPath, "square_animated_artwork.mp4"))
-				if err := cmd.Run(); err != nil {
-					fmt.Printf("animated artwork square dl err: %v\n", err)
-				} else {
-					fmt.Println("Animation Artwork Square Downloaded")
-				}
-			}
+			args, err = buildFFmpegArgs(src, dst, codec, "", "")
+		}
+		if err != nil {
+			return err
+		}
+		if err := exec.Command(ffmpegPath, withGaplessTrim(args, src)...).Run(); err != nil {
+			return err
 		}
+		return writeConvertedTags(codec, dst, convertedTagsFromFile(ffprobePath, src))
+	}
 
-		if Config.EmbyAnimatedArtwork {
-			cmd3 := exec.Command("ffmpeg", "-i", filepath.Join(playlistFolderPath, "square_animated_artwork.mp4"), "-vf", "scale=440:-1", "-r", "24", "-f", "gif", filepath.Join(playlistFolderPath, "folder.jpg"))
-			if err := cmd3.Run(); err != nil {
-				fmt.Printf("animated artwork square to gif err: %v\n", err)
-			}
+	fmt.Printf("Exporting %d tracks to %s ...\n", len(items), *dest)
+	res, err := export.Sync(items, export.Options{
+		Dest:      *dest,
+		Budget:    budget,
+		Settings:  settings,
+		Transcode: transcode,
+		Progress: func(action, target string) {
+			fmt.Printf("%s: %s\n", action, target)
+		},
+	})
+	if err != nil {
+		fmt.Println("Export failed:", err)
+	}
+	fmt.Printf("Export finished: %d exported, %d up to date, %d removed, %d over budget, %d failed (%.1f MiB)\n",
+		res.Exported, res.UpToDate, res.Removed, res.OverBudget, res.Failed, float64(res.Bytes)/(1<<20))
+}
+
+func exportSelected(e *library.Entry, artists, playlists []string) bool {
+	if len(artists) == 0 && len(playlists) == 0 {
+		return true
+	}
+	for _, artist := range artists {
+		if strings.EqualFold(e.Artist, artist) || strings.EqualFold(e.AlbumArtist, artist) {
+			return true
 		}
 	}
-	if station.Type == "stream" {
-		counter.Total++
-		if isInArray(okDict[station.ID], 1) {
-			counter.Success++
-			return nil
+	for _, playlist := range playlists {
+		if library.InPlaylist(e, playlist) {
+			return true
 		}
-		songName := strings.NewReplacer(
-			"{SongId}", station.ID,
-			"{SongNumer}", "01",
-			"{SongName}", LimitString(station.Name),
-			"{DiscNumber}", "1",
-			"{TrackNumber}", "1",
-			"{Quality}", "256Kbps",
-			"{Tag}", "",
-			"{Codec}", "AAC",
-		).Replace(Config.SongFileFormat)
-		fmt.Println(songName)
-		trackPath := filepath.Join(playlistFolderPath, fmt.Sprintf("%s.m4a", forbiddenNames.ReplaceAllString(songName, "_")))
-		exists, _ := fileExists(trackPath)
-		if exists {
-			counter.Success++
-			okDict[station.ID] = append(okDict[station.ID], 1)
+	}
+	return false
+}
 
-			fmt.Println("Radio already exists locally.")
-			return nil
+// convertedTagsFromFile reads the tags, lyrics and cover of an existing
+// download so they can be carried into an exported copy.
+func convertedTagsFromFile(ffprobePath, src string) convertedTags {
+	tags := convertedTags{vorbis: map[string]string{}}
+	if ffprobePath != "" {
+		if found, err := readFormatTags(ffprobePath, src); err == nil {
+			tags.vorbis = buildSelectedFlacMetadataFromTags(found)
 		}
-		assetsUrl, serverUrl, err := ampapi.GetStationAssetsUrlAndServerUrl(station.ID, mediaUserToken, token)
+	}
+	switch strings.ToLower(filepath.Ext(src)) {
+	case ".m4a":
+		mp4, err := mp4tag.Open(src)
 		if err != nil {
-			fmt.Println("Failed to get station assets url.", err)
-			counter.Error++
-			return err
+			break
 		}
-		trackM3U8 := strings.ReplaceAll(assetsUrl, "index.m3u8", "256/prog_index.m3u8")
-		keyAndUrls, _ := runv3.Run(station.ID, trackM3U8, token, mediaUserToken, true, serverUrl)
-		err = runv3.ExtMvData(keyAndUrls, trackPath)
+		mp4.UpperCustom(false)
+		mt, err := mp4.Read()
+		mp4.Close()
 		if err != nil {
-			fmt.Println("Failed to download station stream.", err)
-			counter.Error++
-			return err
+			break
 		}
-		tags := []string{
-			"tool=",
-			"disk=1/1",
-			"track=1",
-			"tracknum=1/1",
-			fmt.Sprintf("artist=%s", "Apple Music Station"),
-			fmt.Sprintf("performer=%s", "Apple Music Station"),
-			fmt.Sprintf("album_artist=%s", "Apple Music Station"),
-			fmt.Sprintf("album=%s", station.Name),
-			fmt.Sprintf("title=%s", station.Name),
+		// Gapless and loudness data describe the source encoding, not the
+		// exported file; writeMP4File adds a fresh iTunSMPB when needed.
+		for key := range mt.Custom {
+			if strings.EqualFold(key, "iTunSMPB") || strings.EqualFold(key, "iTunNORM") {
+				delete(mt.Custom, key)
+			}
 		}
-		if Config.EmbedCover {
-			tags = append(tags, fmt.Sprintf("cover=%s", station.CoverPath))
+		if len(mt.Pictures) > 0 {
+			tags.cover, _ = flacmeta.NewPicture(mt.Pictures[0].Data, flacmeta.PictureFrontCover)
 		}
-		tagsString := strings.Join(tags, ":")
-		cmd := exec.Command("MP4Box", "-itags", tagsString, trackPath)
-		if err := cmd.Run(); err != nil {
-			fmt.Printf("Embed failed: %v\n", err)
+		tags.mp4 = func(path string) error {
+			return writeMP4File(path, mt)
+		}
+	case ".flac":
+		f, err := flacmeta.Open(src)
+		if err != nil {
+			break
+		}
+		for _, pic := range f.Pictures {
+			if tags.cover == nil || pic.Type == flacmeta.PictureFrontCover {
+				tags.cover = pic
+			}
 		}
-		counter.Success++
-		okDict[station.ID] = append(okDict[station.ID], 1)
-		return nil
 	}
+	return tags
+}
 
-	for i := range station.Tracks {
-		station.Tracks[i].CoverPath = station.CoverPath
-		station.Tracks[i].SaveDir = playlistFolderPath
-		station.Tracks[i].Codec = Codec
+// resolveToken gets an API token, falling back to authorization-token.
+func resolveToken() (string, error) {
+	token, err := ampapi.GetToken()
+	if err == nil {
+		return token, nil
+	}
+	if Config.AuthorizationToken != "" && Config.AuthorizationToken != "your-authorization-token" {
+		return strings.Replace(Config.AuthorizationToken, "Bearer ", "", -1), nil
+	}
+	return "", err
+}
+
+// runRetag rewrites the tags of existing m4a and FLAC downloads under the
+// current metadata policy. Files are matched to the catalog by the album
+// ID or UPC in their tags, then by ISRC or track position; album data is
+// read through the API cache.
+func runRetag(argv []string) {
+	fs := pflag.NewFlagSet("retag", pflag.ContinueOnError)
+	diff := fs.Bool("diff", false, "Show the tag changes without writing them")
+	artists := fs.StringSlice("artist", nil, "Retag tracks by this artist (repeatable)")
+	playlists := fs.StringSlice("playlist", nil, "Retag tracks downloaded for this playlist, by name or ID (repeatable)")
+	query := fs.String("query", "", "Library query, e.g. 'genre:jazz year>=1990'")
+	storefront := fs.String("storefront", Config.Storefront, "Storefront used for catalog lookups")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: retag [--diff] [--artist NAME] [--playlist NAME] [--query Q] [--storefront CC]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(argv); err != nil {
+		return
+	}
+	q, err := library.ParseQuery(*query)
+	if err != nil {
+		fmt.Println("Invalid query:", err)
+		return
+	}
+	token, err := resolveToken()
+	if err != nil {
+		fmt.Println("Failed to get token.")
+		return
+	}
+	entries, err := library.ScanRoots(saveRoots())
+	if err != nil {
+		fmt.Println("Failed to scan library:", err)
+		return
 	}
 
-	trackTotal := len(station.Tracks)
-	arr := make([]int, trackTotal)
-	for i := 0; i < trackTotal; i++ {
-		arr[i] = i + 1
+	lookup := catalogLookup(*storefront, token)
+
+	var changed, current, skipped, failed int
+	for _, root := range saveRoots() {
+		withRootMode(root, func() {
+			initMetadataPolicy()
+			for i := range entries {
+				e := &entries[i]
+				if e.Root != root || !exportSelected(e, *artists, *playlists) || !q.Match(e) {
+					continue
+				}
+				var changes []retag.Change
+				switch e.Format {
+				case "m4a":
+					changes, err = retagMP4(e, lookup, !*diff)
+				case "flac":
+					changes, err = retagFLAC(e, lookup, !*diff)
+				default:
+					skipped++
+					continue
+				}
+				if err != nil {
+					fmt.Printf("%s: %v\n", e.Rel, err)
+					failed++
+					continue
+				}
+				if len(changes) == 0 {
+					current++
+					continue
+				}
+				if !*diff {
+					refreshChecksums(e.Path)
+				}
+				changed++
+				fmt.Println(e.Rel)
+				for _, c := range changes {
+					fmt.Println("  " + c.String())
+				}
+			}
+		})
 	}
-	var selected []int
+	initMetadataPolicy()
 
-	if true {
-		selected = arr
+	verb := "retagged"
+	if *diff {
+		verb = "would change"
 	}
-	for i := range station.Tracks {
-		i++
-		if isInArray(selected, i) {
-			ripTrack(&station.Tracks[i-1], token, mediaUserToken)
+	fmt.Printf("Retag finished: %d %s, %d up to date, %d failed, %d skipped (not m4a or FLAC)\n", changed, verb, current, failed, skipped)
+}
+
+// retagCodec is the codec of tracks saved below the save root of the
+// current download mode.
+func retagCodec() string {
+	switch {
+	case dl_atmos:
+		return "ATMOS"
+	case dl_ac3:
+		return "AC3"
+	case dl_aac:
+		return "AAC"
+	}
+	return "ALAC"
+}
+
+// retagManagedMP4 reports whether an m4a tag is written by the metadata
+// policy, so that retag may remove it.
+func retagManagedMP4(key string) bool {
+	if name, ok := strings.CutPrefix(key, "custom:"); ok {
+		switch name {
+		case "PERFORMER", "RELEASETYPE", "ISRC", "UPC", "LABEL":
+			return true
 		}
+		_, ok := metadataCustomTagsM4a[name]
+		return ok
 	}
-	return nil
+	return true
 }
 
-func ripAlbum(albumId string, token string, storefront string, mediaUserToken string, urlArg_i string) error {
-	if checkStopAndWarn() {
-		return nil
+// retagManagedFlac is retagManagedMP4 for Vorbis comments.
+func retagManagedFlac(key string) bool {
+	switch key {
+	case "TITLE", "TITLESORT", "ARTIST", "ARTISTSORT", "ALBUM", "ALBUMSORT", "ALBUMARTIST", "ALBUMARTISTSORT",
+		"COMPOSER", "COMPOSERSORT", "GENRE", "TRACKNUMBER", "TRACKTOTAL", "DISCNUMBER", "DISCTOTAL", "DATE",
+		"ORIGINALDATE", "RELEASETYPE", "ISRC", "UPC", "LABEL", "PUBLISHER", "COPYRIGHT", "PERFORMER", "LYRICS",
+		"ALBUMVERSION", "REPLAYGAIN_TRACK_GAIN", "REPLAYGAIN_TRACK_PEAK", "REPLAYGAIN_ALBUM_GAIN",
+		"REPLAYGAIN_ALBUM_PEAK", "R128_TRACK_GAIN", "R128_ALBUM_GAIN":
+		return true
 	}
-	album := task.NewAlbum(storefront, albumId)
-	err := album.GetResp(token, Config.Language)
-	if err != nil {
-		fmt.Println("Failed to get album response.")
-		return err
+	_, ok := metadataCustomTagsFlac[key]
+	return ok
+}
+
+// retagCover works out whether the embedded cover has to be added or
+// removed. It returns the cover to embed, if any, and the change to show.
+func retagCover(track *task.Track, hasCover bool) (string, *retag.Change) {
+	wantCover := Config.EmbedCover && metadataTagEnabled("cover")
+	switch {
+	case wantCover && !hasCover:
+		coverURL := track.Resp.Attributes.Artwork.URL
+		path, err := renderEmbedCover(coverURL)
+		if err != nil {
+			fmt.Println("Failed to render cover:", err)
+			return "", nil
+		}
+		return path, &retag.Change{Key: "cover", New: "embedded"}
+	case !wantCover && hasCover:
+		return "", &retag.Change{Key: "cover", Old: "embedded"}
 	}
-	meta := album.Resp
-	if debug_mode {
-		fmt.Println(meta.Data[0].Attributes.ArtistName)
-		fmt.Println(meta.Data[0].Attributes.Name)
+	return "", nil
+}
 
-		for trackNum, track := range meta.Data[0].Relationships.Tracks.Data {
-			trackNum++
-			fmt.Printf("\nTrack %d of %d:\n", trackNum, len(meta.Data[0].Relationships.Tracks.Data))
-			fmt.Printf("%02d. %s\n", trackNum, track.Attributes.Name)
+// retagLookup finds the catalog track a file was downloaded from, given the
+// album ID or UPC in its tags.
+type retagLookup func(albumID, upc string, ref retag.TrackRef) (*task.Track, error)
 
-			manifest, err := ampapi.GetSongResp(storefront, track.ID, album.Language, token)
-			if err != nil {
-				fmt.Printf("Failed to get manifest for track %d: %v\n", trackNum, err)
-				continue
-			}
+// albumLookup fetches a catalog album by ID, or by UPC when the ID is not
+// known.
+type albumLookup func(albumID, upc string) (*task.Album, error)
 
-			var m3u8Url string
-			if manifest.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls != "" {
-				m3u8Url = manifest.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls
-			}
-			needCheck := false
-			if Config.GetM3u8Mode == "all" {
-				needCheck = true
-			} else if Config.GetM3u8Mode == "hires" && contains(track.Attributes.AudioTraits, "hi-res-lossless") {
-				needCheck = true
-			}
-			if needCheck {
-				fullM3u8Url, err := checkM3u8(track.ID, "song")
+// catalogAlbums returns an albumLookup that fetches each album once.
+func catalogAlbums(storefront, token string) albumLookup {
+	albums := make(map[string]*task.Album)
+	upcs := make(map[string]string)
+	return func(albumID, upc string) (*task.Album, error) {
+		if albumID == "" && upc != "" {
+			id, ok := upcs[upc]
+			if !ok {
+				var err error
+				id, err = ampapi.GetAlbumIDByUpc(storefront, upc, token)
 				if err != nil {
-					markAbortRetries(err)
-				}
-				if err == nil && strings.HasSuffix(fullM3u8Url, ".m3u8") {
-					m3u8Url = fullM3u8Url
-				} else {
-					fmt.Println("Failed to get best quality m3u8 from device m3u8 port, will use m3u8 from Web API")
+					fmt.Println("Failed to look up UPC", upc+":", err)
 				}
+				upcs[upc] = id
 			}
-
-			_, _, err = extractMedia(m3u8Url, true)
-			if err != nil {
-				fmt.Printf("Failed to extract quality info for track %d: %v\n", trackNum, err)
-				continue
+			albumID = id
+		}
+		if albumID == "" {
+			return nil, errors.New("no album ID or UPC in tags")
+		}
+		album, ok := albums[albumID]
+		if !ok {
+			album = task.NewAlbum(storefront, albumID)
+			if err := album.GetResp(token, Config.Language); err != nil {
+				album = nil
 			}
+			albums[albumID] = album
 		}
-		return nil
-	}
-
-	codec := "ALAC"
-	if dl_atmos {
-		codec = "ATMOS"
-	} else if dl_aac {
-		codec = "AAC"
+		if album == nil {
+			return nil, fmt.Errorf("album %s not found", albumID)
+		}
+		return album, nil
 	}
-	album.Codec = codec
+}
 
-	trackTotal := len(meta.Data[0].Relationships.Tracks.Data)
-	arr := make([]int, trackTotal)
-	for i := 0; i < trackTotal; i++ {
-		arr[i] = i + 1
+func albumTrackRefs(album *task.Album) []retag.TrackRef {
+	refs := make([]retag.TrackRef, len(album.Tracks))
+	for i, t := range album.Tracks {
+		refs[i] = retag.TrackRef{ISRC: t.Resp.Attributes.Isrc, Disc: t.Resp.Attributes.DiscNumber, Track: t.Resp.Attributes.TrackNumber}
 	}
+	return refs
+}
 
-	var selected []int
-	if select_tracks != "" {
-		selected, err = parseTrackSelection(select_tracks, trackTotal)
+// catalogLookup returns a retagLookup that fetches each album once.
+func catalogLookup(storefront, token string) retagLookup {
+	albums := catalogAlbums(storefront, token)
+	return func(albumID, upc string, ref retag.TrackRef) (*task.Track, error) {
+		album, err := albums(albumID, upc)
 		if err != nil {
-			fmt.Println("Invalid --select-tracks:", err)
-			return err
+			return nil, err
 		}
-	} else if !dl_select {
-		selected = arr
-	} else {
-		selected = album.ShowSelect()
+		i := retag.Match(albumTrackRefs(album), ref)
+		if i < 0 {
+			return nil, fmt.Errorf("no matching track in album %s", album.ID)
+		}
+		track := album.Tracks[i]
+		return &track, nil
 	}
+}
 
-	if (dl_covers_only || dl_lyrics_only) && !anySelectedTrackSupportsFormat(album.Tracks, selected) {
-		fmt.Println("No selected tracks available for this format; skipping.")
-		return nil
+// libraryAlbumIdentity reads the catalog album ID and UPC stored in a
+// downloaded m4a or FLAC.
+func libraryAlbumIdentity(e *library.Entry) (string, string, error) {
+	switch e.Format {
+	case "m4a":
+		mp4, err := mp4tag.Open(e.Path)
+		if err != nil {
+			return "", "", err
+		}
+		mp4.UpperCustom(false)
+		tags, err := mp4.Read()
+		mp4.Close()
+		if err != nil {
+			return "", "", err
+		}
+		upc := ""
+		for key, value := range tags.Custom {
+			if strings.EqualFold(key, "UPC") {
+				upc = value
+			}
+		}
+		albumID := ""
+		if tags.ItunesAlbumID > 0 {
+			albumID = strconv.Itoa(int(tags.ItunesAlbumID))
+		}
+		return albumID, upc, nil
+	case "flac":
+		f, err := flacmeta.Open(e.Path)
+		if err != nil {
+			return "", "", err
+		}
+		return "", f.Comment.First("UPC"), nil
 	}
+	return "", "", fmt.Errorf("no catalog IDs in %s files", e.Format)
+}
 
-	primaryAlbumArtist := primaryArtist(artistNamesFromAlbumData(&meta.Data[0]))
-	if primaryAlbumArtist == "" {
-		primaryAlbumArtist = meta.Data[0].Attributes.ArtistName
+func retagMP4(e *library.Entry, lookup retagLookup, write bool) ([]retag.Change, error) {
+	mp4, err := mp4tag.Open(e.Path)
+	if err != nil {
+		return nil, err
 	}
-	artistID := ""
-	if len(meta.Data[0].Relationships.Artists.Data) > 0 {
-		artistID = meta.Data[0].Relationships.Artists.Data[0].ID
+	mp4.UpperCustom(false)
+	tags, err := mp4.Read()
+	mp4.Close()
+	if err != nil {
+		return nil, err
 	}
-	singerFolderName := buildArtistFolderName(primaryAlbumArtist, artistID)
-	rootFolder := currentRootFolder()
-	singerFolder := rootFolder
-	if singerFolderName != "" {
-		singerFolder = filepath.Join(rootFolder, forbiddenNames.ReplaceAllString(singerFolderName, "_"))
+	upc := ""
+	for key, value := range tags.Custom {
+		if strings.EqualFold(key, "UPC") {
+			upc = value
+		}
 	}
-	os.MkdirAll(singerFolder, os.ModePerm)
-	album.SaveDir = singerFolder
-
-	releaseType := detectReleaseType(meta.Data[0].Attributes.Name, meta.Data[0].Attributes.TrackCount, meta.Data[0].Attributes.IsSingle)
-	releaseFolder := releaseFolderLabel(releaseType)
+	albumID := ""
+	if tags.ItunesAlbumID > 0 {
+		albumID = strconv.Itoa(int(tags.ItunesAlbumID))
+	}
+	track, err := lookup(albumID, upc, retag.TrackRef{ISRC: e.ISRC, Disc: e.DiscNumber, Track: e.TrackNumber})
+	if err != nil {
+		return nil, err
+	}
+	track.Codec = retagCodec()
 
-	quality, resolvedCodec := resolveAlbumQuality(
-		storefront,
-		meta.Data[0].Relationships.Tracks.Data[0].ID,
-		album.Language,
-		token,
-		codec,
-		meta.Data[0].Relationships.Tracks.Data[0].Attributes.AudioTraits,
-	)
-	codec = resolvedCodec
-	album.Codec = codec
+	// Lyrics are kept from the file rather than fetched again.
+	lrc := ""
+	if metadataTagEnabled("lyrics") {
+		lrc = tags.Lyrics
+	}
+	desired, err := buildMP4TagsForTrack(track, lrc)
+	if err != nil {
+		return nil, err
+	}
+	changes := retag.Diff(retag.MP4Fields(tags), retag.MP4Fields(desired), retagManagedMP4)
+	coverPath, coverChange := retagCover(track, len(tags.Pictures) > 0)
+	if coverChange != nil {
+		changes = append(changes, *coverChange)
+	}
+	if len(changes) == 0 || !write {
+		return changes, nil
+	}
 
-	stringsToJoin := []string{}
-	if meta.Data[0].Attributes.IsAppleDigitalMaster || meta.Data[0].Attributes.IsMasteredForItunes {
-		if Config.AppleMasterChoice != "" {
-			stringsToJoin = append(stringsToJoin, Config.AppleMasterChoice)
+	var del []string
+	for _, c := range changes {
+		switch {
+		case c.Key == "cover":
+			if c.New == "" {
+				del = append(del, "allpictures")
+			}
+		case strings.HasPrefix(c.Key, "custom:"):
+			// go-mp4tag can only drop custom items all at once, so the
+			// ones retag does not manage are written back.
+			if c.New == "" && !contains(del, "allcustom") {
+				del = append(del, "allcustom")
+			}
+		case c.New == "":
+			del = append(del, c.Key)
 		}
 	}
-	if meta.Data[0].Attributes.ContentRating == "explicit" {
-		if Config.ExplicitChoice != "" {
-			stringsToJoin = append(stringsToJoin, Config.ExplicitChoice)
+	if contains(del, "allcustom") {
+		for key, value := range tags.Custom {
+			if _, ok := desired.Custom[key]; !ok && !retagManagedMP4("custom:"+strings.ToUpper(key)) {
+				desired.Custom[key] = value
+			}
 		}
 	}
-	if meta.Data[0].Attributes.ContentRating == "clean" {
-		if Config.CleanChoice != "" {
-			stringsToJoin = append(stringsToJoin, Config.CleanChoice)
-		}
+	if coverPath != "" {
+		addMP4Cover(desired, coverPath)
 	}
-	tagString := strings.Join(stringsToJoin, " ")
+	return changes, writeMP4File(e.Path, desired, del...)
+}
 
-	releaseDate := meta.Data[0].Attributes.ReleaseDate
-	releaseYear := ""
-	if len(releaseDate) >= 4 {
-		releaseYear = releaseDate[:4]
-	}
-	albumFolderName := strings.NewReplacer(
-		"{ReleaseDate}", releaseDate,
-		"{ReleaseYear}", releaseYear,
-		"{ArtistName}", LimitString(primaryAlbumArtist),
-		"{AlbumName}", LimitString(meta.Data[0].Attributes.Name),
-		"{UPC}", meta.Data[0].Attributes.Upc,
-		"{RecordLabel}", meta.Data[0].Attributes.RecordLabel,
-		"{Copyright}", meta.Data[0].Attributes.Copyright,
-		"{AlbumId}", albumId,
-		"{Quality}", quality,
-		"{Codec}", codec,
-		"{Tag}", tagString,
-	).Replace(Config.AlbumFolderFormat)
-	albumFolderName = sanitizeFolderName(albumFolderName)
-	if dl_atmos && !strings.Contains(strings.ToLower(albumFolderName), "dolby atmos") {
-		albumFolderName = fmt.Sprintf("%s (Dolby Atmos)", albumFolderName)
+func retagFLAC(e *library.Entry, lookup retagLookup, write bool) ([]retag.Change, error) {
+	f, err := flacmeta.Open(e.Path)
+	if err != nil {
+		return nil, err
+	}
+	track, err := lookup("", f.Comment.First("UPC"), retag.TrackRef{ISRC: e.ISRC, Disc: e.DiscNumber, Track: e.TrackNumber})
+	if err != nil {
+		return nil, err
+	}
+	track.Codec = retagCodec()
+	source, err := buildMP4TagsForTrack(track, "")
+	if err != nil {
+		return nil, err
 	}
-	albumFolderPath := filepath.Join(singerFolder, releaseFolder, forbiddenNames.ReplaceAllString(albumFolderName, "_"))
-	os.MkdirAll(albumFolderPath, os.ModePerm)
-	album.SaveName = albumFolderName
-	fmt.Println(albumFolderName)
 
-	artistCoverURL := ""
-	if len(meta.Data[0].Relationships.Artists.Data) > 0 {
-		artistCoverURL = meta.Data[0].Relationships.Artists.Data[0].Attributes.Artwork.Url
+	// FLAC tags are derived from the m4a tags, as after conversion. Values
+	// that do not come from the catalog are carried over from the file.
+	tags := retag.FFprobeTags(source)
+	for _, key := range []string{"LYRICS", "ORIGINALDATE", "ALBUMVERSION", "REPLAYGAIN_TRACK_GAIN", "REPLAYGAIN_TRACK_PEAK",
+		"REPLAYGAIN_ALBUM_GAIN", "REPLAYGAIN_ALBUM_PEAK", "R128_TRACK_GAIN", "R128_ALBUM_GAIN"} {
+		if value := f.Comment.First(key); value != "" {
+			tags[strings.ToLower(key)] = value
+		}
 	}
-	squareVideo := meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video
-	if squareVideo == "" {
-		squareVideo = meta.Data[0].Attributes.EditorialVideo.MotionSquare.Video
+	desired := buildSelectedFlacMetadataFromTags(tags)
+	if metadataTagEnabledFlac("release_type") {
+		if _, exists := desired["RELEASETYPE"]; !exists {
+			assignFlacMetadata(desired, "RELEASETYPE", metadataReleaseTypeForTrack(track))
+		}
 	}
+	applyAtmosPrefixToSelectedFlacMetadata(desired, track)
 
-	if dl_covers_only {
-		handleCoversOnlyAlbum(albumFolderPath, singerFolder, meta.Data[0].Attributes.Artwork.URL, artistCoverURL, squareVideo)
-		return nil
+	current := make(map[string]string)
+	for _, field := range f.Comment.Fields {
+		key := strings.ToUpper(field.Name)
+		if _, ok := current[key]; !ok {
+			current[key] = f.Comment.First(key)
+		}
+	}
+	changes := retag.Diff(current, desired, retagManagedFlac)
+	coverPath, coverChange := retagCover(track, len(f.Pictures) > 0)
+	if coverChange != nil {
+		changes = append(changes, *coverChange)
+	}
+	if len(changes) == 0 || !write {
+		return changes, nil
 	}
 
-	for i := range album.Tracks {
-		album.Tracks[i].SaveDir = albumFolderPath
-		album.Tracks[i].Codec = codec
+	for _, c := range changes {
+		switch {
+		case c.Key == "cover" && c.New == "":
+			f.Pictures = nil
+		case c.Key == "cover":
+			data, err := os.ReadFile(coverPath)
+			if err != nil {
+				return nil, err
+			}
+			pic, err := flacmeta.NewPicture(data, flacmeta.PictureFrontCover)
+			if err != nil {
+				return nil, err
+			}
+			f.SetCover(pic)
+		case c.New == "":
+			f.Comment.Remove(c.Key)
+		default:
+			f.Comment.Set(c.Key, c.New)
+		}
 	}
+	if err := linkfile.Unshare(e.Path); err != nil {
+		return nil, err
+	}
+	return changes, f.Save()
+}
 
-	if dl_song {
-		if urlArg_i != "" {
-			for i := range album.Tracks {
-				if urlArg_i == album.Tracks[i].ID {
-					if dl_lyrics_only {
-						ripLyricsTrack(&album.Tracks[i], token, mediaUserToken)
-					} else {
-						ripTrack(&album.Tracks[i], token, mediaUserToken)
+func runReorganize(argv []string) {
+	fs := pflag.NewFlagSet("reorganize", pflag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Show the moves without making them")
+	undo := fs.String("undo", "", "Move files back as recorded in this undo log")
+	logPath := fs.String("log", "", "Write the undo log to this file (default reorganize-undo-<time>.json)")
+	artists := fs.StringSlice("artist", nil, "Reorganize tracks by this artist (repeatable)")
+	query := fs.String("query", "", "Library query, e.g. 'genre:jazz year>=1990'")
+	storefront := fs.String("storefront", Config.Storefront, "Storefront used for catalog lookups")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: reorganize [--dry-run] [--log FILE] [--artist NAME] [--query Q] [--storefront CC]")
+		fmt.Fprintln(os.Stderr, "       reorganize --undo FILE")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(argv); err != nil {
+		return
+	}
+	if *undo != "" {
+		undoReorganize(*undo)
+		return
+	}
+	q, err := library.ParseQuery(*query)
+	if err != nil {
+		fmt.Println("Invalid query:", err)
+		return
+	}
+	token, err := resolveToken()
+	if err != nil {
+		fmt.Println("Failed to get token.")
+		return
+	}
+	entries, err := library.ScanRoots(saveRoots())
+	if err != nil {
+		fmt.Println("Failed to scan library:", err)
+		return
+	}
+	ffprobePath := ""
+	if ffmpegPath, err := resolveFFmpegPath(); err == nil {
+		ffprobePath = resolveFFprobePath(ffmpegPath)
+	}
+	lookup := catalogLookup(*storefront, token)
+
+	var moves []reorganize.Move
+	var failed, skipped int
+	singers := make(map[string]string)
+	sidecars := make(map[string]bool)
+	for _, root := range saveRoots() {
+		withRootMode(root, func() {
+			initMetadataPolicy()
+			albumQuality := make(map[string]string)
+			for i := range entries {
+				e := &entries[i]
+				if e.Root != root || !exportSelected(e, *artists, nil) || !q.Match(e) {
+					continue
+				}
+				if e.Format != "m4a" && e.Format != "flac" {
+					skipped++
+					continue
+				}
+				to, singerFolder, err := reorganizeTarget(e, lookup, ffprobePath, albumQuality)
+				if err != nil {
+					fmt.Printf("%s: %v\n", e.Rel, err)
+					failed++
+					continue
+				}
+				moves = append(moves, reorganize.Move{From: e.Path, To: to, Root: root})
+				singers[e.Path] = singerFolder
+				for _, m := range reorganizeSidecars(e.Path, to, root) {
+					if !sidecars[m.From] {
+						sidecars[m.From] = true
+						moves = append(moves, m)
 					}
-					return nil
 				}
 			}
-		}
-		return nil
+		})
 	}
+	initMetadataPolicy()
 
-	anySuccess := false
-	for i := range album.Tracks {
-		if checkStopAndWarn() {
-			return nil
+	moves, conflicts := reorganize.Plan(moves)
+	moves, more := reorganize.Plan(append(moves, reorganizeLeftovers(moves, singers, entries)...))
+	conflicts = append(conflicts, more...)
+	for _, c := range conflicts {
+		fmt.Printf("Skipped %s: %s\n", reorganizeRel(c.From, c.Root), c.Reason)
+	}
+
+	undoLog := &reorganize.Log{Created: time.Now()}
+	if !*dryRun && len(moves) > 0 {
+		path := *logPath
+		if path == "" {
+			path = fmt.Sprintf("reorganize-undo-%s.json", undoLog.Created.Format("20060102-150405"))
 		}
-		index := i + 1
-		if isInArray(okDict[albumId], index) {
-			counter.Total++
-			counter.Success++
-			continue
+		var err error
+		if undoLog, err = reorganize.Create(path); err != nil {
+			fmt.Println("Failed to write undo log:", err)
+			return
 		}
-		if !isInArray(selected, index) {
+		defer undoLog.Close()
+		fmt.Println("Writing undo log to", path)
+	}
+	for _, m := range moves {
+		fmt.Printf("%s -> %s\n", reorganizeRel(m.From, m.Root), reorganizeRel(m.To, m.Root))
+		if *dryRun {
 			continue
 		}
-		var success bool
-		if dl_lyrics_only {
-			success = ripLyricsTrack(&album.Tracks[i], token, mediaUserToken)
-		} else {
-			success = ripTrack(&album.Tracks[i], token, mediaUserToken)
-		}
-		if success {
-			anySuccess = true
+		if err := undoLog.Apply(m); err != nil {
+			fmt.Println("  Failed to move:", err)
+			failed++
+			continue
 		}
+		moveChecksum(m.From, m.To)
 	}
-
-	if anySuccess && !dl_lyrics_only {
-		if Config.SaveCoverFile {
-			if _, err := ensureCoverFile(albumFolderPath, "cover", meta.Data[0].Attributes.Artwork.URL); err != nil {
-				fmt.Println("Failed to write cover.")
-			}
-		}
-		if Config.SaveArtistCover && artistCoverURL != "" {
-			if _, err := ensureCoverFile(singerFolder, "folder", artistCoverURL); err != nil {
-				fmt.Println("Failed to write artist cover.")
-			}
-		}
-		if Config.SaveAnimatedArtwork && dl_atmos {
-			downloadAnimatedArtworkSquare(albumFolderPath, squareVideo)
-		}
+	if *dryRun {
+		fmt.Printf("Reorganize dry run: %d files would move, %d conflicts, %d failed, %d skipped (not m4a or FLAC)\n", len(moves), len(conflicts), failed, skipped)
+		return
 	}
-
-	return nil
-
-}
-func ripPlaylist(playlistId string, token string, storefront string, mediaUserToken string) error {
-	if checkStopAndWarn() {
-		return nil
+	for _, m := range undoLog.Moves {
+		reorganize.RemoveEmptyDirs(filepath.Dir(m.From), m.Root)
 	}
-	playlist := task.NewPlaylist(storefront, playlistId)
-	err := playlist.GetResp(token, Config.Language)
+	fmt.Printf("Reorganize finished: %d files moved, %d conflicts, %d failed, %d skipped (not m4a or FLAC)\n", len(undoLog.Moves), len(conflicts), failed, skipped)
+}
+
+func undoReorganize(path string) {
+	undoLog, err := reorganize.Load(path)
 	if err != nil {
-		fmt.Println("Failed to get playlist response.")
-		return err
+		fmt.Println("Failed to read undo log:", err)
+		return
 	}
-	if len(playlist.Resp.Data) > 0 {
-		originalTrackCount := len(playlist.Resp.Data[0].Relationships.Tracks.Data)
-		dedupeResult := dedupePlaylistTrackData(playlist.Resp.Data[0].Relationships.Tracks.Data)
-		if dedupeResult.RemovedCount > 0 {
-			fmt.Printf("Playlist dedupe: %d -> %d (%d skipped)\n", originalTrackCount, len(dedupeResult.Tracks), dedupeResult.RemovedCount)
-			playlist.Resp.Data[0].Relationships.Tracks.Data = dedupeResult.Tracks
-			dedupedTracks := make([]task.Track, 0, len(dedupeResult.KeptIndexes))
-			for _, idx := range dedupeResult.KeptIndexes {
-				if idx >= 0 && idx < len(playlist.Tracks) {
-					dedupedTracks = append(dedupedTracks, playlist.Tracks[idx])
-				}
-			}
-			playlist.Tracks = dedupedTracks
-		}
-		total := len(playlist.Tracks)
-		for i := range playlist.Tracks {
-			playlist.Tracks[i].TaskNum = i + 1
-			playlist.Tracks[i].TaskTotal = total
+	undone := undoLog.Undo(func(m reorganize.Move, err error) {
+		fmt.Printf("%s: %v\n", m.To, err)
+	})
+	for _, m := range undoLog.Moves {
+		if ok, _ := fileExists(m.To); !ok {
+			moveChecksum(m.To, m.From)
+			reorganize.RemoveEmptyDirs(filepath.Dir(m.To), m.Root)
 		}
 	}
-	meta := playlist.Resp
-	if debug_mode {
-		fmt.Println(meta.Data[0].Attributes.ArtistName)
-		fmt.Println(meta.Data[0].Attributes.Name)
-
-		for trackNum, track := range meta.Data[0].Relationships.Tracks.Data {
-			trackNum++
-			fmt.Printf("\nTrack %d of %d:\n", trackNum, len(meta.Data[0].Relationships.Tracks.Data))
-			fmt.Printf("%02d. %s\n", trackNum, track.Attributes.Name)
-
-			manifest, err := ampapi.GetSongResp(storefront, track.ID, playlist.Language, token)
-			if err != nil {
-				fmt.Printf("Failed to get manifest for track %d: %v\n", trackNum, err)
-				continue
-			}
+	fmt.Printf("Undo finished: %d of %d moves reverted\n", undone, len(undoLog.Moves))
+}
 
-			var m3u8Url string
-			if manifest.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls != "" {
-				m3u8Url = manifest.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls
-			}
-			needCheck := false
-			if Config.GetM3u8Mode == "all" {
-				needCheck = true
-			} else if Config.GetM3u8Mode == "hires" && contains(track.Attributes.AudioTraits, "hi-res-lossless") {
-				needCheck = true
-			}
-			if needCheck {
-				fullM3u8Url, err := checkM3u8(track.ID, "song")
-				if err != nil {
-					markAbortRetries(err)
-				}
-				if err == nil && strings.HasSuffix(fullM3u8Url, ".m3u8") {
-					m3u8Url = fullM3u8Url
-				} else {
-					fmt.Println("Failed to get best quality m3u8 from device m3u8 port, will use m3u8 from Web API")
-				}
-			}
+func reorganizeRel(path, root string) string {
+	if rel, ok := relativeToRoot(path, root); ok {
+		return rel
+	}
+	return path
+}
 
-			_, _, err = extractMedia(m3u8Url, true)
-			if err != nil {
-				fmt.Printf("Failed to extract quality info for track %d: %v\n", trackNum, err)
-				continue
+// reorganizeTarget returns where e belongs under the current templates and
+// the artist folder of that path. albumQuality caches the album {Quality}
+// by album ID.
+func reorganizeTarget(e *library.Entry, lookup retagLookup, ffprobePath string, albumQuality map[string]string) (string, string, error) {
+	albumID, upc, err := libraryAlbumIdentity(e)
+	if err != nil {
+		return "", "", err
+	}
+	track, err := lookup(albumID, upc, retag.TrackRef{ISRC: e.ISRC, Disc: e.DiscNumber, Track: e.TrackNumber})
+	if err != nil {
+		return "", "", err
+	}
+	track.Codec = retagCodec()
+	quality := ""
+	if albumFormatsUse("Quality", "BitDepth", "SampleRate") {
+		cached, ok := albumQuality[track.AlbumData.ID]
+		if !ok {
+			if cached, err = downloadedQuality(ffprobePath, e.Path); err != nil {
+				return "", "", err
 			}
+			albumQuality[track.AlbumData.ID] = cached
 		}
-		return nil
+		quality = cached
 	}
-
-	codec := "ALAC"
-	if dl_atmos {
-		codec = "ATMOS"
-	} else if dl_aac {
-		codec = "AAC"
+	singerFolder, _, albumFolderPath := albumFolderPaths(e.Root, &track.AlbumData, track.AlbumData.ID, quality, track.Codec)
+	songQuality := ""
+	if songFormatsUse("Quality", "BitDepth", "SampleRate") {
+		if songQuality, err = downloadedQuality(ffprobePath, e.Path); err != nil {
+			return "", "", err
+		}
 	}
-	playlist.Codec = codec
+	name := nameProfile.File(albumFolderPath, buildSongName(track, songQuality))
+	return filepath.Join(albumFolderPath, name+filepath.Ext(e.Path)), singerFolder, nil
+}
 
-	trackTotal := len(meta.Data[0].Relationships.Tracks.Data)
-	arr := make([]int, trackTotal)
-	for i := 0; i < trackTotal; i++ {
-		arr[i] = i + 1
+// downloadedQuality works out the {Quality} a file was saved with. Lossless
+// files are probed; the Dolby and AAC labels follow the download settings,
+// as ripTrack does.
+func downloadedQuality(ffprobePath, path string) (string, error) {
+	switch {
+	case dl_atmos:
+		return fmt.Sprintf("%dKbps", Config.AtmosMax-2000), nil
+	case dl_ac3:
+		return fmt.Sprintf("%d Kbps", Config.Ac3Max), nil
+	case dl_aac && Config.AacType == "aac-lc":
+		return "256Kbps", nil
+	case dl_aac:
+		return "256 Kbps", nil
 	}
+	if ffprobePath == "" {
+		return "", errors.New("ffprobe is needed to read the audio quality")
+	}
+	bitDepth := probeAudioBitDepth(ffprobePath, path)
+	sampleRate := probeAudioSampleRate(ffprobePath, path)
+	if bitDepth == 0 || sampleRate == 0 {
+		return "", errors.New("could not read the audio quality")
+	}
+	return fmt.Sprintf("%dB-%.1fkHz", bitDepth, float64(sampleRate)/1000.0), nil
+}
 
-	var selected []int
-	if select_tracks != "" {
-		selected, err = parseTrackSelection(select_tracks, trackTotal)
-		if err != nil {
-			fmt.Println("Invalid --select-tracks:", err)
-			return err
+// reorganizeSidecars returns the moves that keep lyrics files next to an
+// audio file moved from from to to.
+func reorganizeSidecars(from, to, root string) []reorganize.Move {
+	exts := []string{".lrc", ".ttml"}
+	if ext := "." + strings.ToLower(Config.LrcFormat); !contains(exts, ext) {
+		exts = append(exts, ext)
+	}
+	base := strings.TrimSuffix(from, filepath.Ext(from))
+	newBase := strings.TrimSuffix(to, filepath.Ext(to))
+	var out []reorganize.Move
+	for _, ext := range exts {
+		if ok, _ := fileExists(base + ext); ok {
+			out = append(out, reorganize.Move{From: base + ext, To: newBase + ext, Root: root})
 		}
-	} else if !dl_select {
-		selected = arr
-	} else {
-		selected = playlist.ShowSelect()
 	}
+	return out
+}
 
-	type albumGroup struct {
-		albumID      string
-		albumName    string
-		artistName   string
-		artistID     string
-		releaseDate  string
-		upc          string
-		recordLabel  string
-		artistCover  string
-		trackCount   int
-		isSingle     bool
-		audioTraits  []string
-		coverURL     string
-		sampleTrack  string
-		tagString    string
-		quality      string
-		codec        string
-		folderPath   string
-		artistFolder string
-		trackIndexes []int
-		skip         bool
+func isArtistArtwork(name string) bool {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	for _, kind := range []string{artworkset.ArtistPoster, artworkset.ArtistBanner, artworkset.ArtistBackground} {
+		if contains(artworkset.FileNames(artworkProfiles, kind), base) {
+			return true
+		}
 	}
+	return false
+}
 
-	groups := make(map[string]*albumGroup)
-	albumCache := make(map[string]*ampapi.AlbumRespData)
-	albumTrackNumbers := make(map[string]map[string][2]int)
-	artistCoverCache := make(map[string]string)
-	rootFolder := currentRootFolder()
-
-	for idx := range playlist.Tracks {
-		order := idx + 1
-		if !isInArray(selected, order) {
+// reorganizeLeftovers follows planned audio moves with the other files of
+// the folders they empty, such as covers, motion artwork and cue sheets,
+// and with the artist artwork of artist folders that move as a whole.
+// singers maps each moved audio file to its new artist folder.
+func reorganizeLeftovers(planned []reorganize.Move, singers map[string]string, entries []library.Entry) []reorganize.Move {
+	inDir := make(map[string]int)
+	for _, e := range entries {
+		inDir[filepath.Dir(e.Path)]++
+	}
+	moved := make(map[string]bool)
+	leaving := make(map[string]int)
+	targets := make(map[string]map[string]bool)
+	roots := make(map[string]string)
+	for _, m := range planned {
+		moved[m.From] = true
+		if _, ok := singers[m.From]; !ok {
 			continue
 		}
-
-		track := &playlist.Tracks[idx]
-		albumID := ""
-		albumName := track.Resp.Attributes.AlbumName
-		releaseDate := ""
-		upc := ""
-		recordLabel := ""
-		artistCover := ""
-		trackCount := 0
-		isSingle := false
-		audioTraits := track.Resp.Attributes.AudioTraits
-
-		if len(track.Resp.Relationships.Albums.Data) > 0 {
-			albumRel := track.Resp.Relationships.Albums.Data[0]
-			albumID = albumRel.ID
-			if albumRel.Attributes.Name != "" {
-				albumName = albumRel.Attributes.Name
-			}
-			releaseDate = albumRel.Attributes.ReleaseDate
-			trackCount = albumRel.Attributes.TrackCount
-			isSingle = albumRel.Attributes.IsSingle
-			upc = albumRel.Attributes.Upc
+		dir := filepath.Dir(m.From)
+		leaving[dir]++
+		if targets[dir] == nil {
+			targets[dir] = make(map[string]bool)
 		}
+		targets[dir][filepath.Dir(m.To)] = true
+		roots[dir] = m.Root
+	}
+	dirs := make([]string, 0, len(leaving))
+	for dir := range leaving {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
 
-		if albumID == "" {
-			albumID = fmt.Sprintf("unknown-%s", albumName)
+	var out []reorganize.Move
+	artistTargets := make(map[string]map[string]bool)
+	artistRoots := make(map[string]string)
+	for _, dir := range dirs {
+		root := roots[dir]
+		if leaving[dir] != inDir[dir] || len(targets[dir]) != 1 || filepath.Clean(dir) == filepath.Clean(root) {
+			continue
 		}
-
-		artistID := ""
-		if len(track.Resp.Relationships.Artists.Data) > 0 {
-			artistID = track.Resp.Relationships.Artists.Data[0].ID
+		var newDir string
+		for d := range targets[dir] {
+			newDir = d
 		}
-
-		var albumData *ampapi.AlbumRespData
-		shouldFetchAlbum := !strings.HasPrefix(albumID, "unknown-")
-		if shouldFetchAlbum {
-			if cached, ok := albumCache[albumID]; ok {
-				albumData = cached
-			} else {
-				resp, err := ampapi.GetAlbumResp(storefront, albumID, playlist.Language, token)
-				if err != nil {
-					fmt.Println("Failed to fetch album data for playlist item:", err)
-				} else if len(resp.Data) > 0 {
-					albumData = &resp.Data[0]
-					albumCache[albumID] = albumData
+		if newDir != dir {
+			files, _ := os.ReadDir(dir)
+			for _, f := range files {
+				path := filepath.Join(dir, f.Name())
+				if f.IsDir() || moved[path] || isArtistArtwork(f.Name()) || f.Name() == integrity.ManifestName {
+					continue
 				}
+				out = append(out, reorganize.Move{From: path, To: filepath.Join(newDir, f.Name()), Root: root})
 			}
 		}
-
-		if albumData != nil {
-			if albumData.Attributes.Name != "" {
-				albumName = albumData.Attributes.Name
-			}
-			if albumData.Attributes.ReleaseDate != "" {
-				releaseDate = albumData.Attributes.ReleaseDate
-			}
-			if albumData.Attributes.Upc != "" {
-				upc = albumData.Attributes.Upc
-			}
-			if albumData.Attributes.RecordLabel != "" {
-				recordLabel = albumData.Attributes.RecordLabel
-			}
-			if albumData.Attributes.TrackCount > 0 {
-				trackCount = albumData.Attributes.TrackCount
-			}
-			isSingle = albumData.Attributes.IsSingle
-			if len(albumData.Relationships.Artists.Data) > 0 {
-				artistCover = albumData.Relationships.Artists.Data[0].Attributes.Artwork.Url
-			}
-			if len(albumData.Relationships.Artists.Data) > 0 {
-				artistID = albumData.Relationships.Artists.Data[0].ID
-			}
-			track.AlbumData = *albumData
-			if len(albumData.Relationships.Tracks.Data) > 0 {
-				track.DiscTotal = albumData.Relationships.Tracks.Data[len(albumData.Relationships.Tracks.Data)-1].Attributes.DiscNumber
-			}
-			if _, ok := albumTrackNumbers[albumID]; !ok {
-				trackMap := make(map[string][2]int)
-				for _, albumTrack := range albumData.Relationships.Tracks.Data {
-					trackMap[albumTrack.ID] = [2]int{
-						albumTrack.Attributes.TrackNumber,
-						albumTrack.Attributes.DiscNumber,
+		// The artist folder is the nearest one above holding artist artwork.
+		for parent := filepath.Dir(dir); parent != filepath.Clean(root) && parent != filepath.Dir(parent); parent = filepath.Dir(parent) {
+			if reorganizeHasArtistArtwork(parent) {
+				if artistTargets[parent] == nil {
+					artistTargets[parent] = make(map[string]bool)
+				}
+				for from, singer := range singers {
+					if filepath.Dir(from) == dir {
+						artistTargets[parent][singer] = true
 					}
 				}
-				albumTrackNumbers[albumID] = trackMap
+				artistRoots[parent] = root
+				break
 			}
 		}
-		if releaseDate == "" && track.Resp.Attributes.ReleaseDate != "" {
-			releaseDate = track.Resp.Attributes.ReleaseDate
+	}
+
+	artistDirs := make([]string, 0, len(artistTargets))
+	for dir := range artistTargets {
+		artistDirs = append(artistDirs, dir)
+	}
+	sort.Strings(artistDirs)
+	for _, dir := range artistDirs {
+		if len(artistTargets[dir]) != 1 {
+			continue
 		}
-		if artistCover == "" && artistID != "" {
-			if cached, ok := artistCoverCache[artistID]; ok {
-				artistCover = cached
-			} else {
-				resp, err := ampapi.GetArtistResp(storefront, artistID, playlist.Language, token)
-				if err == nil && len(resp.Data) > 0 {
-					artistCover = resp.Data[0].Attributes.Artwork.Url
-				}
-				artistCoverCache[artistID] = artistCover
+		// Only move artwork when nothing else of the artist stays behind.
+		total, leavingTotal := 0, 0
+		prefix := dir + string(os.PathSeparator)
+		for d, n := range inDir {
+			if strings.HasPrefix(d+string(os.PathSeparator), prefix) {
+				total += n
 			}
 		}
-
-		primaryAlbumArtist := ""
-		if albumData != nil {
-			primaryAlbumArtist = primaryArtist(artistNamesFromAlbumData(albumData))
+		for from := range singers {
+			if moved[from] && strings.HasPrefix(from, prefix) {
+				leavingTotal++
+			}
 		}
-		if primaryAlbumArtist == "" {
-			primaryAlbumArtist = primaryArtist(artistNamesFromTrack(track))
+		var newDir string
+		for d := range artistTargets[dir] {
+			newDir = d
 		}
-		if primaryAlbumArtist == "" {
-			primaryAlbumArtist = track.Resp.Attributes.ArtistName
+		if total != leavingTotal || newDir == dir {
+			continue
 		}
-		if trackMap, ok := albumTrackNumbers[albumID]; ok {
-			if nums, ok := trackMap[track.ID]; ok {
-				if nums[0] > 0 {
-					track.Resp.Attributes.TrackNumber = nums[0]
-				}
-				if nums[1] > 0 {
-					track.Resp.Attributes.DiscNumber = nums[1]
-				}
+		files, _ := os.ReadDir(dir)
+		for _, f := range files {
+			if !f.IsDir() && isArtistArtwork(f.Name()) {
+				out = append(out, reorganize.Move{From: filepath.Join(dir, f.Name()), To: filepath.Join(newDir, f.Name()), Root: artistRoots[dir]})
 			}
 		}
+	}
+	return out
+}
 
-		stringsToJoin := []string{}
-		if track.Resp.Attributes.IsAppleDigitalMaster {
-			if Config.AppleMasterChoice != "" {
-				stringsToJoin = append(stringsToJoin, Config.AppleMasterChoice)
-			}
-		}
-		if track.Resp.Attributes.ContentRating == "explicit" {
-			if Config.ExplicitChoice != "" {
-				stringsToJoin = append(stringsToJoin, Config.ExplicitChoice)
-			}
-		}
-		if track.Resp.Attributes.ContentRating == "clean" {
-			if Config.CleanChoice != "" {
-				stringsToJoin = append(stringsToJoin, Config.CleanChoice)
-			}
+func reorganizeHasArtistArtwork(dir string) bool {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, f := range files {
+		if !f.IsDir() && isArtistArtwork(f.Name()) {
+			return true
 		}
-		tagString := strings.Join(stringsToJoin, " ")
+	}
+	return false
+}
 
-		group, ok := groups[albumID]
-		if !ok {
-			group = &albumGroup{
-				albumID:      albumID,
-				albumName:    albumName,
-				artistName:   primaryAlbumArtist,
-				artistID:     artistID,
-				releaseDate:  releaseDate,
-				upc:          upc,
-				recordLabel:  recordLabel,
-				artistCover:  artistCover,
-				trackCount:   trackCount,
-				isSingle:     isSingle,
-				audioTraits:  audioTraits,
-				coverURL:     track.Resp.Attributes.Artwork.URL,
-				sampleTrack:  track.ID,
-				tagString:    tagString,
-				codec:        codec,
-				trackIndexes: []int{idx},
-			}
-			groups[albumID] = group
-		} else {
-			group.trackIndexes = append(group.trackIndexes, idx)
-			if group.albumName == "" && albumName != "" {
-				group.albumName = albumName
-			}
-			if group.artistName == "" && primaryAlbumArtist != "" {
-				group.artistName = primaryAlbumArtist
-			}
-			if group.releaseDate == "" && releaseDate != "" {
-				group.releaseDate = releaseDate
-			}
-			if group.upc == "" && upc != "" {
-				group.upc = upc
-			}
-			if group.recordLabel == "" && recordLabel != "" {
-				group.recordLabel = recordLabel
-			}
-			if group.artistCover == "" && artistCover != "" {
-				group.artistCover = artistCover
-			}
-			if group.trackCount == 0 && trackCount > 0 {
-				group.trackCount = trackCount
+func runAudit(argv []string) {
+	fs := pflag.NewFlagSet("audit", pflag.ContinueOnError)
+	artists := fs.StringSlice("artist", nil, "Audit albums by this artist (repeatable)")
+	query := fs.String("query", "", "Library query, e.g. 'genre:jazz year>=1990'")
+	storefront := fs.String("storefront", Config.Storefront, "Storefront used for catalog lookups")
+	queue := fs.String("queue", "", "Append the download jobs that fix the issues to this file")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: audit [--artist NAME] [--query Q] [--storefront CC] [--queue FILE]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(argv); err != nil {
+		return
+	}
+	q, err := library.ParseQuery(*query)
+	if err != nil {
+		fmt.Println("Invalid query:", err)
+		return
+	}
+	token, err := resolveToken()
+	if err != nil {
+		fmt.Println("Failed to get token.")
+		return
+	}
+	entries, err := library.ScanRoots(saveRoots())
+	if err != nil {
+		fmt.Println("Failed to scan library:", err)
+		return
+	}
+	ffprobePath := ""
+	if ffmpegPath, err := resolveFFmpegPath(); err == nil {
+		ffprobePath = resolveFFprobePath(ffmpegPath)
+	}
+	albums := catalogAlbums(*storefront, token)
+	audioBases := make(map[string]bool)
+	for _, e := range entries {
+		audioBases[strings.TrimSuffix(e.Path, filepath.Ext(e.Path))] = true
+	}
+
+	type auditGroup struct {
+		album *task.Album
+		files []*library.Entry
+	}
+	var reports []*audit.Album
+	var unknown []string
+	checked, skipped := 0, 0
+	for _, root := range saveRoots() {
+		withRootMode(root, func() {
+			groups := make(map[string]*auditGroup)
+			var order []string
+			for i := range entries {
+				e := &entries[i]
+				if e.Root != root || !exportSelected(e, *artists, nil) || !q.Match(e) {
+					continue
+				}
+				if e.Format != "m4a" && e.Format != "flac" {
+					skipped++
+					continue
+				}
+				albumID, upc, err := libraryAlbumIdentity(e)
+				var album *task.Album
+				if err == nil {
+					album, err = albums(albumID, upc)
+				}
+				if err != nil {
+					unknown = append(unknown, fmt.Sprintf("%s: %v", e.Rel, err))
+					continue
+				}
+				g, ok := groups[album.ID]
+				if !ok {
+					g = &auditGroup{album: album}
+					groups[album.ID] = g
+					order = append(order, album.ID)
+				}
+				g.files = append(g.files, e)
 			}
-			if group.artistID == "" && artistID != "" {
-				group.artistID = artistID
+			for _, id := range order {
+				g := groups[id]
+				checked++
+				report := auditAlbum(g.album, root, g.files, ffprobePath, audioBases)
+				if len(report.Issues) > 0 {
+					reports = append(reports, report)
+				}
 			}
-		}
+		})
 	}
 
-	for _, group := range groups {
-		if dl_atmos || dl_covers_only || dl_lyrics_only {
-			hasSupported := false
-			for _, idx := range group.trackIndexes {
-				if idx >= 0 && idx < len(playlist.Tracks) {
-					if trackSupportsCurrentFormat(&playlist.Tracks[idx]) {
-						hasSupported = true
-						break
-					}
-				}
-			}
-			if !hasSupported {
-				fmt.Printf("No selected tracks available for this format; skipping %s.\n", group.albumName)
-				group.skip = true
-				continue
+	totals := make(map[string]int)
+	var jobs [][]string
+	for _, report := range reports {
+		fmt.Println(report.Name)
+		for _, issue := range report.Issues {
+			totals[issue.Kind]++
+			if issue.Track > 0 {
+				fmt.Printf("  %s: %d. %s\n", issue.Kind, issue.Track, issue.Detail)
+			} else {
+				fmt.Printf("  %s: %s\n", issue.Kind, issue.Detail)
 			}
 		}
-
-		artistFolderName := buildArtistFolderName(group.artistName, group.artistID)
-		artistFolder := rootFolder
-		if artistFolderName != "" {
-			artistFolder = filepath.Join(rootFolder, forbiddenNames.ReplaceAllString(artistFolderName, "_"))
+		jobs = append(jobs, report.Jobs()...)
+	}
+	if len(unknown) > 0 {
+		fmt.Println("Files not matched to a catalog album")
+		for _, line := range unknown {
+			fmt.Println("  " + line)
 		}
-		group.artistFolder = artistFolder
-		releaseType := detectReleaseType(group.albumName, group.trackCount, group.isSingle)
-		releaseFolder := releaseFolderLabel(releaseType)
-
-		quality, resolvedCodec := resolveAlbumQuality(
-			storefront,
-			group.sampleTrack,
-			playlist.Language,
-			token,
-			group.codec,
-			group.audioTraits,
-		)
-		group.codec = resolvedCodec
-		group.quality = quality
+		totals[audit.Orphan] += len(unknown)
+	}
 
-		releaseYear := ""
-		if len(group.releaseDate) >= 4 {
-			releaseYear = group.releaseDate[:4]
+	fmt.Printf("Audit finished: %d albums checked, %d with issues, %d files skipped (not m4a or FLAC)\n", checked, len(reports), skipped)
+	for _, kind := range audit.Kinds {
+		if totals[kind] > 0 {
+			fmt.Printf("  %s: %d\n", kind, totals[kind])
 		}
-		albumFolderName := strings.NewReplacer(
-			"{ReleaseDate}", group.releaseDate,
-			"{ReleaseYear}", releaseYear,
-			"{ArtistName}", LimitString(group.artistName),
-			"{AlbumName}", LimitString(group.albumName),
-			"{UPC}", group.upc,
-			"{RecordLabel}", group.recordLabel,
-			"{Copyright}", "",
-			"{AlbumId}", group.albumID,
-			"{Quality}", group.quality,
-			"{Codec}", group.codec,
-			"{Tag}", group.tagString,
-		).Replace(Config.AlbumFolderFormat)
-		albumFolderName = sanitizeFolderName(albumFolderName)
-		if dl_atmos && !strings.Contains(strings.ToLower(albumFolderName), "dolby atmos") {
-			albumFolderName = fmt.Sprintf("%s (Dolby Atmos)", albumFolderName)
+	}
+	if *queue != "" && len(jobs) > 0 {
+		f, err := os.OpenFile(*queue, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Println("Failed to open queue file:", err)
+			return
 		}
-		group.folderPath = filepath.Join(artistFolder, releaseFolder, forbiddenNames.ReplaceAllString(albumFolderName, "_"))
-		os.MkdirAll(group.folderPath, os.ModePerm)
-
-		if Config.SaveCoverFile && !dl_covers_only {
-			if _, err := ensureCoverFile(group.folderPath, "cover", group.coverURL); err != nil {
-				fmt.Println("Failed to write cover.")
-			}
+		defer f.Close()
+		for _, job := range jobs {
+			fmt.Fprintln(f, strings.Join(job, " "))
 		}
+		fmt.Printf("Queued %d fix jobs in %s\n", len(jobs), *queue)
+	}
+}
 
-		if dl_covers_only {
-			handleCoversOnlyAlbum(group.folderPath, artistFolder, group.coverURL, group.artistCover, "")
+// runQueueFile runs the download jobs of an audit queue file, one line of
+// arguments each, as separate runs of this program so every job starts
+// from its own flags. The file is then rewritten with the jobs that failed
+// or did not run, so the next run picks up where this one stopped.
+func runQueueFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Println("Failed to read queue file:", err)
+		return
+	}
+	var jobs, kept []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			jobs = append(jobs, line)
+		} else if line != "" {
+			kept = append(kept, line)
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Println("Failed to find the program to run queue jobs with:", err)
+		return
+	}
+	ran, failed := 0, 0
+	for i, job := range jobs {
+		if checkStopAndWarn() {
+			kept = append(kept, jobs[i:]...)
+			break
+		}
+		ran++
+		fmt.Printf("Queue job %d of %d: %s\n", i+1, len(jobs), job)
+		cmd := exec.Command(exe, strings.Fields(job)...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Println("Queue job failed:", err)
+			failed++
+			kept = append(kept, job)
 		}
 	}
+	fmt.Printf("Queue finished: %d of %d jobs run, %d failed\n", ran, len(jobs), failed)
 
-	if dl_covers_only {
-		return nil
+	var out strings.Builder
+	for _, line := range kept {
+		out.WriteString(line + "\n")
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(out.String()), 0644); err != nil {
+		fmt.Println("Failed to update queue file:", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		fmt.Println("Failed to update queue file:", err)
+		return
 	}
+	fmt.Printf("%d jobs left in %s\n", failed+len(jobs)-ran, path)
+}
 
-	groupSuccess := make(map[string]bool)
+// auditAlbum checks the files of one album, saved in the save root root
+// in the current download mode, against its catalog track list. Tracks
+// joined into an album image count as present. audioBases holds every
+// library file path without its extension, to tell orphaned lyrics files.
+func auditAlbum(album *task.Album, root string, files []*library.Entry, ffprobePath string, audioBases map[string]bool) *audit.Album {
+	data := album.Resp.Data[0]
+	report := &audit.Album{
+		ID:         album.ID,
+		Storefront: album.Storefront,
+		Name:       fmt.Sprintf("%s - %s (%s, %s)", data.Attributes.ArtistName, data.Attributes.Name, album.ID, retagCodec()),
+		Flags:      rootFlags(root),
+	}
 
-	for idx := range playlist.Tracks {
-		if checkStopAndWarn() {
-			return nil
+	refs := make([]retag.TrackRef, len(files))
+	var dirs []string
+	for i, e := range files {
+		refs[i] = retag.TrackRef{ISRC: e.ISRC, Disc: e.DiscNumber, Track: e.TrackNumber}
+		if dir := filepath.Dir(e.Path); !contains(dirs, dir) {
+			dirs = append(dirs, dir)
 		}
-		order := idx + 1
-		if !isInArray(selected, order) {
+	}
+	var imaged []cuesheet.Track
+	for _, dir := range dirs {
+		imaged = append(imaged, albumImageTracks(dir)...)
+	}
+	matches, missing := audit.Match(albumTrackRefs(album), refs)
+	for _, i := range missing {
+		track := album.Tracks[i]
+		if track.Type == "music-videos" || inAlbumImage(imaged, &track) {
 			continue
 		}
-		track := &playlist.Tracks[idx]
-		albumID := ""
-		if len(track.Resp.Relationships.Albums.Data) > 0 {
-			albumID = track.Resp.Relationships.Albums.Data[0].ID
+		report.Add(audit.MissingTrack, track.TaskNum, track.Name)
+	}
+
+	paths := make(map[int][]string)
+	for i, e := range files {
+		if matches[i] < 0 {
+			if !isAlbumImage(e.Path) {
+				report.Add(audit.Orphan, 0, e.Rel+" (no matching track)")
+			}
+			continue
 		}
-		if albumID == "" {
-			albumID = fmt.Sprintf("unknown-%s", track.Resp.Attributes.AlbumName)
+		track := album.Tracks[matches[i]]
+		paths[matches[i]] = append(paths[matches[i]], e.Path)
+		if problem := auditFormatIssue(&track, e.Path, ffprobePath); problem != "" {
+			report.Add(audit.WrongFormat, track.TaskNum, e.Rel+": "+problem)
 		}
-		group, ok := groups[albumID]
-		if ok {
-			if group.skip {
+	}
+
+	if Config.SaveLrcFile {
+		for i, track := range album.Tracks {
+			if len(paths[i]) == 0 || !track.Resp.Attributes.HasLyrics {
 				continue
 			}
-			track.SaveDir = group.folderPath
-			track.Codec = group.codec
-		} else {
-			if dl_covers_only || dl_lyrics_only {
-				continue
+			found := false
+			for _, path := range paths[i] {
+				if ok, _ := fileExists(strings.TrimSuffix(path, filepath.Ext(path)) + "." + Config.LrcFormat); ok {
+					found = true
+				}
+			}
+			if !found {
+				report.Add(audit.MissingLyrics, track.TaskNum, track.Name)
 			}
-			track.SaveDir = rootFolder
-			track.Codec = codec
 		}
-
-		if isInArray(okDict[playlistId], order) {
-			counter.Total++
-			counter.Success++
+	}
+	for _, dir := range dirs {
+		names, err := os.ReadDir(dir)
+		if err != nil {
 			continue
 		}
-
-		if dl_lyrics_only {
-			if ripLyricsTrack(track, token, mediaUserToken) {
-				groupSuccess[albumID] = true
+		hasCover := false
+		for _, f := range names {
+			ext := strings.ToLower(filepath.Ext(f.Name()))
+			base := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+			if contains(albumCoverNames(), base) {
+				hasCover = true
 			}
-		} else {
-			if ripTrack(track, token, mediaUserToken) {
-				groupSuccess[albumID] = true
+			if !f.IsDir() && (ext == ".lrc" || ext == ".ttml") && !audioBases[filepath.Join(dir, base)] {
+				report.Add(audit.Orphan, 0, filepath.Join(filepath.Base(dir), f.Name())+" (no audio file)")
 			}
 		}
+		if Config.SaveCoverFile && !hasCover {
+			report.Add(audit.MissingCover, 0, filepath.Base(dir))
+		}
 	}
+	return report
+}
 
-	if !dl_lyrics_only && Config.SaveArtistCover {
-		for albumID, success := range groupSuccess {
-			if !success {
-				continue
-			}
-			group, ok := groups[albumID]
-			if !ok || group.artistCover == "" || group.artistFolder == "" {
-				continue
-			}
-			if _, err := ensureCoverFile(group.artistFolder, "folder", group.artistCover); err != nil {
-				fmt.Println("Failed to write artist cover.")
+// rootFlags returns the command line flags of a download run that saves
+// into the save root root in the format of the files there.
+func rootFlags(root string) []string {
+	switch root {
+	case Config.AtmosSaveFolder:
+		return []string{"--atmos"}
+	case Config.Ac3SaveFolder:
+		return []string{"--ac3"}
+	case Config.AacSaveFolder:
+		// aac-save-folder holds the AAC types without a folder of their own.
+		for _, variant := range append([]string{Config.AacType}, aacVariants...) {
+			if variant != "" && aacVariantRoot(variant) == "" {
+				return []string{"--aac", "--aac-type", variant}
 			}
 		}
+		return []string{"--aac"}
+	case Config.AlacSaveFolder:
+		return []string{"--alac"}
+	}
+	for _, variant := range aacVariants {
+		if r := aacVariantRoot(variant); r != "" && filepath.Clean(r) == filepath.Clean(root) {
+			return []string{"--aac", "--aac-type", variant}
+		}
+	}
+	for kind, r := range Config.QualityPolicyRoots {
+		if strings.TrimSpace(r) != "" && filepath.Clean(r) == filepath.Clean(root) {
+			return []string{"--quality", kind}
+		}
 	}
 	return nil
 }
 
-func buildMP4TagsForTrack(track *task.Track, lrc string) (*mp4tag.MP4Tags, error) {
-	title, titleArtists := metadataTitleAndArtistsFromTrack(track)
-	if title == "" {
-		title = track.Resp.Attributes.Name
-	}
-	useAtmosPrefix := shouldUseAtmosMetadataPrefix(track)
-	tagTitle := withAtmosMetadataPrefix(title, useAtmosPrefix)
-	albumName := withAtmosMetadataPrefix(track.Resp.Attributes.AlbumName, useAtmosPrefix)
-	composerList := formatComposerList(track.Resp.Attributes.ComposerName)
-	if composerList == "" {
-		composerList = strings.TrimSpace(track.Resp.Attributes.ComposerName)
+// auditFormatIssue describes how a downloaded file differs from what the
+// current settings produce for track, or returns "" when it does not.
+func auditFormatIssue(track *task.Track, path, ffprobePath string) string {
+	track.Codec = retagCodec()
+	if Config.ConvertAfterDownload && track.Codec == "ALAC" && ffprobePath != "" {
+		track.Quality, _ = downloadedQuality(ffprobePath, path)
 	}
-	trackArtistList := formatArtistList(titleArtists)
-	if trackArtistList == "" {
-		trackArtistList = formatArtistList(artistNamesFromTrack(track))
-		if trackArtistList == "" {
-			trackArtistList = track.Resp.Attributes.ArtistName
-		}
+	ext := strings.ToLower(filepath.Ext(path))
+	exts := auditExpectedExts(track)
+	if !contains(exts, ext) {
+		return fmt.Sprintf("%s file, expected %s", ext, strings.Join(exts, " or "))
 	}
-	albumArtistName := primaryArtist(albumArtistNamesFromTrack(track))
-	if albumArtistName == "" {
-		albumArtistName = track.Resp.Attributes.ArtistName
+	// Convert profiles may write m4a files in another codec.
+	if ext != ".m4a" || ffprobePath == "" || len(Config.ConvertProfiles) > 0 {
+		return ""
 	}
-	trackNumber := track.Resp.Attributes.TrackNumber
-	if trackNumber == 0 {
-		trackNumber = track.TaskNum
+	want := map[string]string{"ALAC": "alac", "ATMOS": "eac3", "AC3": "ac3", "AAC": "aac"}[track.Codec]
+	if got := probeAudioCodec(ffprobePath, path); got != "" && got != want {
+		return fmt.Sprintf("%s audio, expected %s", got, want)
 	}
+	return ""
+}
 
-	t := &mp4tag.MP4Tags{
-		Custom: map[string]string{},
+// auditExpectedExts lists the file extensions a download of track ends up
+// with after conversion.
+func auditExpectedExts(track *task.Track) []string {
+	if !Config.ConvertAfterDownload {
+		return []string{".m4a"}
 	}
-
-	if metadataTagEnabled("title") {
-		t.Title = tagTitle
+	if len(Config.ConvertProfiles) > 0 {
+		exts := []string{".m4a"}
+		for _, profile := range Config.ConvertProfiles {
+			if !convertProfileMatches(profile, formatKeyForTrack(track)) {
+				continue
+			}
+			if ext, err := convertProfileExt(strings.ToLower(profile.Codec)); err == nil && !contains(exts, ext) {
+				exts = append(exts, ext)
+			}
+		}
+		return exts
 	}
-	if metadataTagEnabled("title_sort") {
-		t.TitleSort = tagTitle
+	format := strings.ToLower(Config.ConvertFormat)
+	if format == "" || format == "copy" || !shouldConvertTrack(track) {
+		return []string{".m4a"}
 	}
-	if metadataTagEnabled("artist") {
-		t.Artist = trackArtistList
+	if Config.ConvertKeepOriginal {
+		return []string{"." + format, ".m4a"}
 	}
-	if metadataTagEnabled("artist_sort") {
-		t.ArtistSort = trackArtistList
+	return []string{"." + format}
+}
+
+func runVerify(argv []string) {
+	fs := pflag.NewFlagSet("verify", pflag.ContinueOnError)
+	artists := fs.StringSlice("artist", nil, "Verify tracks by this artist (repeatable)")
+	query := fs.String("query", "", "Library query, e.g. 'genre:jazz year>=1990'")
+	update := fs.Bool("update", false, "Add unlisted files to the manifests and drop entries of deleted files")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: verify [--artist NAME] [--query Q] [--update]")
+		fs.PrintDefaults()
 	}
-	if metadataTagEnabled("composer") {
-		t.Composer = composerList
+	if err := fs.Parse(argv); err != nil {
+		return
 	}
-	if metadataTagEnabled("composer_sort") {
-		t.ComposerSort = composerList
+	q, err := library.ParseQuery(*query)
+	if err != nil {
+		fmt.Println("Invalid query:", err)
+		return
 	}
-	if metadataTagEnabled("genre") && len(track.Resp.Attributes.GenreNames) > 0 {
-		t.CustomGenre = track.Resp.Attributes.GenreNames[0]
+	entries, err := library.ScanRoots(saveRoots())
+	if err != nil {
+		fmt.Println("Failed to scan library:", err)
+		return
 	}
-	if metadataTagEnabled("lyrics") && lrc != "" {
-		t.Lyrics = lrc
+
+	var dirs []string
+	files := make(map[string][]*library.Entry)
+	for i := range entries {
+		e := &entries[i]
+		if !exportSelected(e, *artists, nil) || !q.Match(e) {
+			continue
+		}
+		dir := filepath.Dir(e.Path)
+		if _, ok := files[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		files[dir] = append(files[dir], e)
 	}
-	if metadataTagEnabled("track_number") {
-		t.TrackNumber = int16(trackNumber)
+	sort.Strings(dirs)
+
+	counts := make(map[string]int)
+	for _, dir := range dirs {
+		m, err := integrity.LoadManifest(dir)
+		if err != nil {
+			fmt.Printf("%s: %v\n", dir, err)
+			counts["unreadable"]++
+			continue
+		}
+		if len(m.Names()) == 0 {
+			counts["no manifest"]++
+		}
+		changed := false
+		for _, r := range m.Verify() {
+			counts[r.Status]++
+			switch r.Status {
+			case integrity.StatusMismatch:
+				fmt.Printf("CHANGED  %s\n", filepath.Join(dir, r.Name))
+			case integrity.StatusMissing:
+				fmt.Printf("MISSING  %s\n", filepath.Join(dir, r.Name))
+				if *update {
+					m.Remove(r.Name)
+					changed = true
+				}
+			}
+		}
+		for _, e := range files[dir] {
+			name := filepath.Base(e.Path)
+			if m.Sum(name) != "" {
+				continue
+			}
+			counts["unlisted"]++
+			if !*update {
+				continue
+			}
+			if err := m.Add(name); err != nil {
+				fmt.Println("Failed to hash file:", err)
+				continue
+			}
+			changed = true
+		}
+		if changed {
+			if err := m.Save(); err != nil {
+				fmt.Println("Failed to write checksum manifest:", err)
+			}
+		}
 	}
-	if metadataTagEnabled("disc_number") {
-		t.DiscNumber = int16(track.Resp.Attributes.DiscNumber)
+
+	unlisted := "not in a manifest"
+	if *update {
+		unlisted = "added to manifests"
 	}
-	if metadataTagEnabled("album") {
-		t.Album = albumName
+	fmt.Printf("Verify finished: %d ok, %d changed, %d missing, %d %s (%d folders without a manifest)\n",
+		counts[integrity.StatusOK], counts[integrity.StatusMismatch], counts[integrity.StatusMissing], counts["unlisted"], unlisted, counts["no manifest"])
+}
+
+// runDupes finds copies of the same recording within each save root and
+// optionally replaces the extra copies with hardlinks or deletes them.
+func runDupes(argv []string) {
+	fs := pflag.NewFlagSet("dupes", pflag.ContinueOnError)
+	artists := fs.StringSlice("artist", nil, "Only check tracks by this artist (repeatable)")
+	query := fs.String("query", "", "Library query, e.g. 'genre:jazz year>=1990'")
+	action := fs.String("action", "", "What to do with duplicates: hardlink or delete (default: only list them)")
+	yes := fs.Bool("yes", false, "Apply the action without asking")
+	noFingerprint := fs.Bool("no-fingerprint", false, "Only group by ISRC")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: dupes [--artist NAME] [--query Q] [--action hardlink|delete] [--yes] [--no-fingerprint]")
+		fs.PrintDefaults()
 	}
-	if metadataTagEnabled("album_sort") {
-		t.AlbumSort = albumName
+	if err := fs.Parse(argv); err != nil {
+		return
 	}
-	if metadataTagEnabled("performer") && trackArtistList != "" {
-		t.Custom["PERFORMER"] = trackArtistList
+	if *action != "" && *action != "hardlink" && *action != "delete" {
+		fmt.Println("Unknown action:", *action)
+		return
 	}
-	if metadataTagEnabled("release_type") {
-		releaseType := metadataReleaseTypeForTrack(track)
-		if releaseType != "" {
-			t.Custom["RELEASETYPE"] = releaseType
-		}
+	q, err := library.ParseQuery(*query)
+	if err != nil {
+		fmt.Println("Invalid query:", err)
+		return
 	}
-	if metadataTagEnabled("isrc") && track.Resp.Attributes.Isrc != "" {
-		t.Custom["ISRC"] = track.Resp.Attributes.Isrc
+	entries, err := library.ScanRoots(saveRoots())
+	if err != nil {
+		fmt.Println("Failed to scan library:", err)
+		return
 	}
-
-	if metadataTagEnabled("itunes_album_id") && track.PreType == "albums" {
-		albumID, err := strconv.ParseUint(track.PreID, 10, 32)
-		if err != nil {
-			return nil, err
+	var files []dupes.File
+	for i := range entries {
+		e := &entries[i]
+		if !exportSelected(e, *artists, nil) || !q.Match(e) {
+			continue
 		}
-		t.ItunesAlbumID = int32(albumID)
+		files = append(files, dupes.File{
+			Path:    e.Path,
+			Root:    e.Root,
+			ISRC:    e.ISRC,
+			Release: e.AlbumArtist + "\x00" + e.Album,
+			Size:    e.Size,
+		})
 	}
 
-	if metadataTagEnabled("itunes_artist_id") && len(track.Resp.Relationships.Artists.Data) > 0 {
-		artistID, err := strconv.ParseUint(track.Resp.Relationships.Artists.Data[0].ID, 10, 32)
-		if err != nil {
-			return nil, err
+	if !*noFingerprint {
+		fingerprintDupes(files)
+	}
+	groups := dupes.Find(files)
+	for i := range groups {
+		for j := range groups[i].Files {
+			groups[i].Files[j].Rank = libraryReleaseRank(groups[i].Files[j].Path)
 		}
-		t.ItunesArtistID = int32(artistID)
+		groups[i].Sort()
 	}
 
-	if (track.PreType == "playlists" || track.PreType == "stations") && !Config.UseSongInfoForPlaylist {
-		if metadataTagEnabled("disc_number") {
-			t.DiscNumber = 1
-		}
-		if metadataTagEnabled("disc_total") {
-			t.DiscTotal = 1
-		}
-		if metadataTagEnabled("track_number") {
-			t.TrackNumber = int16(trackNumber)
-		}
-		if metadataTagEnabled("track_total") {
-			t.TrackTotal = int16(track.TaskTotal)
-		}
-		if metadataTagEnabled("album") {
-			t.Album = track.PlaylistData.Attributes.Name
-		}
-		if metadataTagEnabled("album_sort") {
-			t.AlbumSort = track.PlaylistData.Attributes.Name
-		}
-		if metadataTagEnabled("album_artist") {
-			t.AlbumArtist = albumArtistName
+	var extra []dupes.File
+	var keepFor []string
+	var reclaim int64
+	for _, g := range groups {
+		if g.ByFingerprint {
+			fmt.Printf("\n%s (audio fingerprint)\n", filepath.Base(g.Files[0].Path))
+		} else {
+			fmt.Printf("\n%s (ISRC %s)\n", filepath.Base(g.Files[0].Path), g.ISRC)
 		}
-		if metadataTagEnabled("album_artist_sort") {
-			t.AlbumArtistSort = albumArtistName
+		keep := g.Files[0]
+		fmt.Printf("  keep     %s\n", keep.Path)
+		for _, f := range g.Files[1:] {
+			if dupes.Linked(keep.Path, f.Path) {
+				fmt.Printf("  linked   %s\n", f.Path)
+				continue
+			}
+			// A hardlink would give this copy the tags of the kept
+			// release, so copies from other releases are only listed.
+			if *action == "hardlink" && !dupes.SameRelease(keep, f) {
+				fmt.Printf("  release  %s (other release, not linked)\n", f.Path)
+				continue
+			}
+			fmt.Printf("  dup      %s\n", f.Path)
+			extra = append(extra, f)
+			keepFor = append(keepFor, keep.Path)
+			reclaim += f.Size
 		}
-	} else if (track.PreType == "playlists" || track.PreType == "stations") && Config.UseSongInfoForPlaylist {
-		if metadataTagEnabled("disc_total") {
-			t.DiscTotal = int16(track.DiscTotal)
+	}
+	fmt.Printf("\nDupes finished: %d recordings with %d duplicate files (%.1f MB)\n", len(groups), len(extra), float64(reclaim)/(1<<20))
+	if *action == "" || len(extra) == 0 {
+		return
+	}
+
+	if !*yes {
+		verb := "Replace %d duplicates with hardlinks? [y/N]: "
+		if *action == "delete" {
+			verb = "Delete %d duplicates? [y/N]: "
 		}
-		if metadataTagEnabled("track_total") {
-			t.TrackTotal = int16(track.AlbumData.Attributes.TrackCount)
+		fmt.Printf(verb, len(extra))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return
 		}
-		if metadataTagEnabled("album_artist") {
-			t.AlbumArtist = albumArtistName
+	}
+	done := 0
+	for i, f := range extra {
+		err = nil
+		switch *action {
+		case "hardlink":
+			err = dupes.Hardlink(keepFor[i], f.Path)
+			refreshChecksums(f.Path)
+		case "delete":
+			var paths []string
+			for _, m := range reorganizeSidecars(f.Path, f.Path, f.Root) {
+				paths = append(paths, m.From)
+			}
+			for _, path := range append(paths, f.Path) {
+				if rmErr := os.Remove(path); rmErr != nil {
+					err = rmErr
+				}
+			}
+			refreshChecksums(append(paths, f.Path)...)
 		}
-		if metadataTagEnabled("album_artist_sort") {
-			t.AlbumArtistSort = albumArtistName
+		if err != nil {
+			fmt.Printf("Failed to %s %s: %v\n", *action, f.Path, err)
+			continue
 		}
-		if metadataTagEnabled("upc") && track.AlbumData.Attributes.Upc != "" {
-			t.Custom["UPC"] = track.AlbumData.Attributes.Upc
+		done++
+	}
+	fmt.Printf("%d of %d duplicates handled\n", done, len(extra))
+}
+
+// fingerprintDupes fingerprints the files that cannot be grouped by ISRC
+// alone, together with the files whose duration is close to theirs.
+func fingerprintDupes(files []dupes.File) {
+	missing := false
+	for _, f := range files {
+		if f.ISRC == "" {
+			missing = true
+			break
 		}
-		if metadataTagEnabled("label") && track.AlbumData.Attributes.RecordLabel != "" {
-			t.Custom["LABEL"] = track.AlbumData.Attributes.RecordLabel
+	}
+	if !missing {
+		return
+	}
+	ffmpegPath, err := resolveFFmpegPath()
+	if err != nil {
+		fmt.Println("Skipping audio fingerprints, ffmpeg not found:", err)
+		return
+	}
+	ffprobePath := resolveFFprobePath(ffmpegPath)
+	for i := range files {
+		files[i].Duration = probeDuration(ffprobePath, files[i].Path)
+	}
+	need := dupes.NeedsFingerprint(files)
+	for i := range files {
+		if !need[i] {
+			continue
 		}
-		if metadataTagEnabled("release_date") {
-			t.Date = track.AlbumData.Attributes.ReleaseDate
+		fp, err := dupes.Decode(ffmpegPath, files[i].Path)
+		if err != nil {
+			fmt.Printf("Failed to fingerprint %s: %v\n", files[i].Path, err)
+			continue
 		}
-		if metadataTagEnabled("copyright") {
-			t.Copyright = track.AlbumData.Attributes.Copyright
+		files[i].Fingerprint = fp
+	}
+}
+
+// libraryReleaseRank ranks the release a downloaded file belongs to, using
+// its album name, track total and release type tags.
+func libraryReleaseRank(path string) int {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".m4a":
+		mp4, err := mp4tag.Open(path)
+		if err != nil {
+			return 0
 		}
-		if metadataTagEnabled("publisher") {
-			t.Publisher = track.AlbumData.Attributes.RecordLabel
+		mp4.UpperCustom(false)
+		tags, err := mp4.Read()
+		mp4.Close()
+		if err != nil {
+			return 0
 		}
-	} else {
-		if metadataTagEnabled("disc_total") {
-			t.DiscTotal = int16(track.DiscTotal)
+		single := false
+		for key, value := range tags.Custom {
+			if strings.EqualFold(key, "RELEASETYPE") {
+				single = strings.EqualFold(value, "single")
+			}
 		}
-		if metadataTagEnabled("track_total") {
-			t.TrackTotal = int16(track.AlbumData.Attributes.TrackCount)
+		return playlistdedupe.ReleaseRank(tags.Album, int(tags.TrackTotal), single)
+	case ".flac":
+		f, err := flacmeta.Open(path)
+		if err != nil {
+			return 0
 		}
-		if metadataTagEnabled("album_artist") {
-			t.AlbumArtist = albumArtistName
+		total, _ := strconv.Atoi(f.Comment.First("TRACKTOTAL"))
+		if total == 0 {
+			total, _ = strconv.Atoi(f.Comment.First("TOTALTRACKS"))
 		}
-		if metadataTagEnabled("album_artist_sort") {
-			t.AlbumArtistSort = albumArtistName
+		single := strings.EqualFold(f.Comment.First("RELEASETYPE"), "single")
+		return playlistdedupe.ReleaseRank(f.Comment.First("ALBUM"), total, single)
+	}
+	return 0
+}
+
+// albumSnapshot records the current catalog state of an album. Tracks with
+// a SavePath are marked as downloaded. Variants are read from each track's
+// master playlist when withVariants is set.
+func albumSnapshot(album *task.Album, withVariants bool) *snapshot.Album {
+	data := album.Resp.Data[0]
+	s := &snapshot.Album{
+		ID:                 album.ID,
+		Storefront:         album.Storefront,
+		Artist:             data.Attributes.ArtistName,
+		Name:               data.Attributes.Name,
+		Codec:              album.Codec,
+		TrackCount:         data.Attributes.TrackCount,
+		AppleDigitalMaster: data.Attributes.IsAppleDigitalMaster,
+		Updated:            time.Now(),
+	}
+	for _, track := range album.Tracks {
+		attrs := track.Resp.Attributes
+		t := snapshot.Track{
+			ID:          track.ID,
+			Disc:        attrs.DiscNumber,
+			Number:      attrs.TrackNumber,
+			Name:        attrs.Name,
+			ISRC:        attrs.Isrc,
+			DurationMS:  attrs.DurationInMillis,
+			AudioTraits: attrs.AudioTraits,
+			Quality:     track.MediaQuality,
+		}
+		if track.SavePath != "" {
+			t.File = filepath.Base(track.SavePath)
+		}
+		if withVariants && track.WebM3u8 != "" {
+			variants, err := masterVariants(track.WebM3u8)
+			if err != nil {
+				fmt.Printf("Failed to read variants of %s: %v\n", attrs.Name, err)
+			}
+			t.Variants = variants
 		}
-		if metadataTagEnabled("upc") && track.AlbumData.Attributes.Upc != "" {
-			t.Custom["UPC"] = track.AlbumData.Attributes.Upc
+		s.Tracks = append(s.Tracks, t)
+	}
+	return s
+}
+
+// saveAlbumSnapshot merges the tracks downloaded into dir with the folder's
+// previous snapshot.
+func saveAlbumSnapshot(album *task.Album, dir string) {
+	old, err := snapshot.Load(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Failed to read album snapshot:", err)
+	}
+	if err := snapshot.Merge(old, albumSnapshot(album, true)).Save(dir); err != nil {
+		fmt.Println("Failed to write album snapshot:", err)
+	}
+}
+
+// runCheckUpdates compares the album snapshots in the library with the
+// catalog and can download the new and changed tracks into the existing
+// album folders.
+func runCheckUpdates(argv []string) {
+	fs := pflag.NewFlagSet("check-updates", pflag.ContinueOnError)
+	artists := fs.StringSlice("artist", nil, "Check albums by this artist (repeatable)")
+	download := fs.Bool("download", false, "Download new and changed tracks into the existing album folders")
+	noVariants := fs.Bool("no-variants", false, "Do not read master playlists to compare the available variants")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: check-updates [--artist NAME] [--download] [--no-variants]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(argv); err != nil {
+		return
+	}
+	token, err := resolveToken()
+	if err != nil {
+		fmt.Println("Failed to get token.")
+		return
+	}
+	if *download {
+		initMetadataPolicy()
+	}
+
+	checked, changed, downloaded := 0, 0, 0
+	selection := select_tracks
+	for _, root := range saveRoots() {
+		withRootMode(root, func() {
+			dirs, err := snapshot.Find(root)
+			if err != nil && !os.IsNotExist(err) {
+				fmt.Printf("Failed to scan %s: %v\n", root, err)
+			}
+			for _, dir := range dirs {
+				old, err := snapshot.Load(dir)
+				if err != nil {
+					fmt.Printf("%s: %v\n", dir, err)
+					continue
+				}
+				if len(*artists) > 0 && !containsFold(*artists, old.Artist) {
+					continue
+				}
+				checked++
+				album := task.NewAlbum(old.Storefront, old.ID)
+				if err := album.GetResp(token, Config.Language); err != nil {
+					fmt.Printf("%s - %s: album %s not found: %v\n", old.Artist, old.Name, old.ID, err)
+					continue
+				}
+				cur := albumSnapshot(album, !*noVariants)
+				changes := snapshot.Diff(old, cur)
+				if len(changes) == 0 {
+					continue
+				}
+				changed++
+				fmt.Printf("%s - %s (%s, %s)\n", old.Artist, old.Name, old.ID, retagCodec())
+				for _, c := range changes {
+					if c.Position > 0 {
+						fmt.Printf("  %s: %d. %s\n", c.Kind, c.Position, c.Detail)
+					} else {
+						fmt.Printf("  %s: %s\n", c.Kind, c.Detail)
+					}
+				}
+				positions := snapshot.Downloads(changes)
+				if !*download || len(positions) == 0 {
+					continue
+				}
+				if downloadAlbumUpdates(old, cur, changes, positions, dir, token) {
+					downloaded++
+				}
+			}
+		})
+	}
+	select_tracks = selection
+
+	fmt.Printf("Check finished: %d albums checked, %d changed", checked, changed)
+	if *download {
+		fmt.Printf(", %d updated", downloaded)
+	}
+	fmt.Println()
+}
+
+// downloadAlbumUpdates downloads the tracks at positions into the album's
+// existing folder. Files of changed tracks are set aside first so the new
+// version is not skipped as already present, and put back when it could
+// not be downloaded.
+func downloadAlbumUpdates(old, cur *snapshot.Album, changes []snapshot.Change, positions []int, dir, token string) bool {
+	backups := make(map[string]string)
+	for _, c := range changes {
+		if c.Kind != snapshot.Changed || c.File == "" {
+			continue
 		}
-		if metadataTagEnabled("release_date") {
-			t.Date = track.AlbumData.Attributes.ReleaseDate
+		path := filepath.Join(dir, c.File)
+		backup := filepath.Join(dir, "."+c.File+".old")
+		if err := os.Rename(path, backup); err != nil {
+			fmt.Println("Failed to set aside old file:", err)
+			continue
 		}
-		if metadataTagEnabled("copyright") {
-			t.Copyright = track.AlbumData.Attributes.Copyright
+		backups[cur.Tracks[c.Position-1].ID] = path
+	}
+
+	// The refreshed snapshot tells which tracks were replaced.
+	snapshots := Config.AlbumSnapshot
+	Config.AlbumSnapshot = true
+	select_tracks = audit.Selection(positions)
+	albumFolderOverride = dir
+	err := ripAlbum(old.ID, token, old.Storefront, Config.MediaUserToken, "")
+	albumFolderOverride = ""
+	Config.AlbumSnapshot = snapshots
+	if err != nil {
+		fmt.Println("Failed to rip album:", err)
+	}
+
+	updated, _ := snapshot.Load(dir)
+	ok := err == nil
+	for id, path := range backups {
+		backup := filepath.Join(dir, "."+filepath.Base(path)+".old")
+		replaced := false
+		if updated != nil {
+			for _, t := range updated.Tracks {
+				if t.ID != id || t.File == "" {
+					continue
+				}
+				exists, _ := fileExists(filepath.Join(dir, t.File))
+				replaced = exists
+			}
 		}
-		if metadataTagEnabled("publisher") {
-			t.Publisher = track.AlbumData.Attributes.RecordLabel
+		if replaced {
+			os.Remove(backup)
+			refreshChecksums(path)
+			continue
 		}
-		if metadataTagEnabled("label") && track.AlbumData.Attributes.RecordLabel != "" {
-			t.Custom["LABEL"] = track.AlbumData.Attributes.RecordLabel
+		ok = false
+		if err := os.Rename(backup, path); err != nil {
+			fmt.Println("Failed to restore old file:", err)
 		}
 	}
+	return ok
+}
 
-	if metadataTagEnabled("advisory") {
-		if track.Resp.Attributes.ContentRating == "explicit" {
-			t.ItunesAdvisory = mp4tag.ItunesAdvisoryExplicit
-		} else if track.Resp.Attributes.ContentRating == "clean" {
-			t.ItunesAdvisory = mp4tag.ItunesAdvisoryClean
-		} else {
-			t.ItunesAdvisory = mp4tag.ItunesAdvisoryNone
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
 		}
 	}
+	return false
+}
 
-	for key, value := range metadataCustomTagsM4a {
-		t.Custom[key] = value
+func runAlac(argv []string) {
+	if len(argv) == 0 || argv[0] != "repair" {
+		fmt.Fprintln(os.Stderr, "Usage: alac repair [--root DIR] [--workers N] [--mode all|corrupt-only|off] [--report FILE] [--dry-run]")
+		return
 	}
-
-	return t, nil
+	runAlacRepairLibrary(argv[1:])
 }
 
-func writeMP4Tags(track *task.Track, lrc string) error {
-	t, err := buildMP4TagsForTrack(track, lrc)
+// runAlacRepairLibrary validates every ALAC file below the library roots
+// and repairs them the way downloads are repaired, keeping their tags and
+// cover art.
+func runAlacRepairLibrary(argv []string) {
+	fs := pflag.NewFlagSet("alac repair", pflag.ContinueOnError)
+	roots := fs.StringSlice("root", nil, "Library root to scan (repeatable, default: all save folders)")
+	workers := fs.Int("workers", runtime.NumCPU(), "Number of files checked at the same time")
+	mode := fs.String("mode", Config.AlacRepairMode, "Repair mode: all, corrupt-only or off (off only validates)")
+	reportPath := fs.String("report", "", "Report file (default: alac-repair-<time>.json)")
+	dryRun := fs.Bool("dry-run", false, "Validate and report without changing files")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: alac repair [--root DIR] [--workers N] [--mode all|corrupt-only|off] [--report FILE] [--dry-run]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(argv); err != nil {
+		return
+	}
+	ffmpegPath, err := resolveFFmpegPath()
 	if err != nil {
-		return err
+		fmt.Println("ALAC repair needs ffmpeg:", err)
+		return
+	}
+	ffprobePath := resolveFFprobePath(ffmpegPath)
+	if ffprobePath == "" {
+		fmt.Println("ALAC repair needs ffprobe to recognise ALAC files.")
+		return
+	}
+	if len(*roots) == 0 {
+		*roots = saveRoots()
 	}
 
-	mp4, err := mp4tag.Open(track.SavePath)
-	if err != nil {
-		return err
+	report := &alacrepair.Report{
+		Created: time.Now(),
+		Mode:    normalizeAlacRepairMode(*mode),
+		DryRun:  *dryRun,
+	}
+	if report.Mode != "off" && !*dryRun {
+		report.Decoder = selectAlacDecoder(ffmpegPath)
+	}
+	var paths []string
+	seen := make(map[string]bool)
+	for _, root := range *roots {
+		if root == "" || seen[root] {
+			continue
+		}
+		seen[root] = true
+		found, err := alacrepair.Find(root)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Failed to scan %s: %v\n", root, err)
+		}
+		report.Roots = append(report.Roots, root)
+		paths = append(paths, found...)
+	}
+
+	fmt.Printf("Checking %d m4a files with %d workers (mode %s)\n", len(paths), *workers, report.Mode)
+	check := func(path string) alacrepair.File {
+		return repairLibraryAlac(ffmpegPath, ffprobePath, report.Decoder, report.Mode, *dryRun, path)
+	}
+	report.Add(alacrepair.Run(paths, *workers, check, func(f alacrepair.File) {
+		switch f.Status {
+		case alacrepair.StatusCorrupt:
+			fmt.Printf("CORRUPT   %s (%s)\n", f.Path, f.Validation)
+		case alacrepair.StatusRepaired:
+			fmt.Printf("REPAIRED  %s\n", f.Path)
+			warnBitDepthReduction(filepath.Base(f.Path), f.BitDepthBefore, f.BitDepthAfter)
+			if f.Error != "" {
+				fmt.Printf("⚠ %s: %s\n", filepath.Base(f.Path), f.Error)
+			}
+		case alacrepair.StatusFailed:
+			fmt.Printf("FAILED    %s: %s\n", f.Path, f.Error)
+		}
+	})...)
+
+	if *reportPath == "" {
+		*reportPath = "alac-repair-" + report.Created.Format("20060102-150405") + ".json"
+	}
+	if err := report.Save(*reportPath); err != nil {
+		fmt.Println("Failed to write report:", err)
+	} else {
+		fmt.Println("Report written to", *reportPath)
+	}
+	s := report.Summary
+	fmt.Printf("ALAC repair finished: %d ok, %d corrupt, %d repaired, %d failed, %d not ALAC (%d with reduced bit depth)\n",
+		s[alacrepair.StatusOK], s[alacrepair.StatusCorrupt], s[alacrepair.StatusRepaired], s[alacrepair.StatusFailed], s[alacrepair.StatusSkipped], s["bit_depth_reduced"])
+}
+
+// repairLibraryAlac validates one file and repairs it when the mode asks
+// for it. Tags and pictures are read beforehand and written back, since
+// ffmpeg drops some of the iTunes atoms when remuxing.
+func repairLibraryAlac(ffmpegPath, ffprobePath, decoder, mode string, dryRun bool, path string) alacrepair.File {
+	res := alacrepair.File{Path: path}
+	if codec := probeAudioCodec(ffprobePath, path); codec != "alac" {
+		res.Status = alacrepair.StatusSkipped
+		res.Reason = "codec " + codec
+		if codec == "" {
+			res.Reason = "unreadable"
+		}
+		return res
+	}
+	res.BitDepthBefore = probeAudioBitDepth(ffprobePath, path)
+	ok, msg := validateAlacFile(ffmpegPath, path)
+	res.Validation = msg
+	switch {
+	case !ok && (mode == "off" || dryRun):
+		res.Status = alacrepair.StatusCorrupt
+		return res
+	case !ok:
+		res.Reason = "corrupt_detected"
+	case mode == "all" && !dryRun:
+		res.Reason = "forced"
+	default:
+		res.Status = alacrepair.StatusOK
+		return res
+	}
+
+	mp4, err := mp4tag.Open(path)
+	var tags *mp4tag.MP4Tags
+	if err == nil {
+		mp4.UpperCustom(false)
+		tags, err = mp4.Read()
+		mp4.Close()
 	}
-	defer mp4.Close()
-	err = mp4.Write(t, []string{})
 	if err != nil {
-		return err
+		res.Status = alacrepair.StatusFailed
+		res.Error = "reading tags: " + err.Error()
+		return res
 	}
-	return nil
+	if err := repairAlacInPlace(ffmpegPath, decoder, path); err != nil {
+		res.Status = alacrepair.StatusFailed
+		res.Error = err.Error()
+		return res
+	}
+	res.Status = alacrepair.StatusRepaired
+	if err := writeMP4File(path, tags); err != nil {
+		res.Error = "restoring tags: " + err.Error()
+	}
+	res.BitDepthAfter = probeAudioBitDepth(ffprobePath, path)
+	res.BitDepthReduced = res.BitDepthBefore > 0 && res.BitDepthAfter > 0 && res.BitDepthAfter < res.BitDepthBefore
+	refreshChecksums(path)
+	return res
 }
 
 func main() {
@@ -4680,19 +9460,47 @@ func main() {
 		fmt.Printf("load Config failed: %v", err)
 		return
 	}
-	token, err := ampapi.GetToken()
-	if err != nil {
-		if Config.AuthorizationToken != "" && Config.AuthorizationToken != "your-authorization-token" {
-			token = strings.Replace(Config.AuthorizationToken, "Bearer ", "", -1)
-		} else {
-			fmt.Println("Failed to get token.")
+	defer cleanupEmbedCovers()
+	defer flushTrackIndexes()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "retag":
+			runRetag(os.Args[2:])
+			return
+		case "reorganize":
+			runReorganize(os.Args[2:])
+			return
+		case "audit":
+			runAudit(os.Args[2:])
+			return
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "alac":
+			runAlac(os.Args[2:])
+			return
+		case "dupes":
+			runDupes(os.Args[2:])
+			return
+		case "check-updates":
+			runCheckUpdates(os.Args[2:])
 			return
 		}
 	}
+	token, err := resolveToken()
+	if err != nil {
+		fmt.Println("Failed to get token.")
+		return
+	}
 	var search_type string
 	pflag.StringVar(&search_type, "search", "", "Search for 'album', 'song', or 'artist'. Provide query after flags.")
 	pflag.BoolVar(&dl_preview, "preview", false, "Output JSON preview metadata and exit")
+	pflag.BoolVar(&dl_alac, "alac", false, "Download ALAC, overriding quality-policy and download-formats from the config")
 	pflag.BoolVar(&dl_atmos, "atmos", false, "Enable atmos download mode")
+	pflag.BoolVar(&dl_ac3, "ac3", false, "Enable Dolby Audio (AC-3) download mode")
 	pflag.BoolVar(&dl_aac, "aac", false, "Enable adm-aac download mode")
 	pflag.BoolVar(&dl_select, "select", false, "Enable selective download")
 	pflag.StringVar(&select_tracks, "select-tracks", "", "Select tracks by list/range (e.g., 1,2,5-7)")
@@ -4704,6 +9512,10 @@ func main() {
 	pflag.BoolVar(&debug_mode, "debug", false, "Enable debug mode to show audio quality information")
 	alac_max = pflag.Int("alac-max", Config.AlacMax, "Specify the max quality for download alac")
 	atmos_max = pflag.Int("atmos-max", Config.AtmosMax, "Specify the max quality for download atmos")
+	ac3_max = pflag.Int("ac3-max", Config.Ac3Max, "Specify the max bitrate for download ac3")
+	pflag.StringVar(&quality_policy, "quality", Config.QualityPolicy, "Quality policy with fallbacks, e.g. atmos>hires<=96k>lossless>aac")
+	pflag.StringVar(&dl_formats, "formats", Config.DownloadFormats, "Download several formats in one pass, e.g. alac,atmos,aac-binaural")
+	pflag.StringVar(&from_queue, "from-queue", "", "Run the download jobs that audit --queue wrote to this file")
 	aac_type = pflag.String("aac-type", Config.AacType, "Select AAC type, aac aac-binaural aac-downmix")
 	mv_audio_type = pflag.String("mv-audio-type", Config.MVAudioType, "Select MV audio type, atmos ac3 aac")
 	mv_max = pflag.Int("mv-max", Config.MVMax, "Specify the max quality for download MV")
@@ -4711,6 +9523,7 @@ func main() {
 	pflag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] [url1 url2 ...]\n", "[main | main.exe | go run main.go]")
 		fmt.Fprintf(os.Stderr, "Search Usage: %s --search [album|song|artist] [query]\n", "[main | main.exe | go run main.go]")
+		fmt.Fprintf(os.Stderr, "Commands: %s export|retag|reorganize|audit|verify|alac repair|dupes|check-updates --help\n", "[main | main.exe | go run main.go]")
 		fmt.Println("\nOptions:")
 		pflag.PrintDefaults()
 	}
@@ -4718,16 +9531,37 @@ func main() {
 	pflag.Parse()
 	Config.AlacMax = *alac_max
 	Config.AtmosMax = *atmos_max
+	Config.Ac3Max = *ac3_max
 	Config.AacType = *aac_type
 	Config.MVAudioType = *mv_audio_type
 	Config.MVMax = *mv_max
 	clearStopSignal()
 	initMetadataPolicy()
 
+	if from_queue != "" {
+		runQueueFile(from_queue)
+		return
+	}
 	if dl_lyrics_only && dl_covers_only {
 		fmt.Println("Error: --lyrics-only and --covers-only cannot be used together.")
 		return
 	}
+	if dl_atmos && dl_ac3 {
+		fmt.Println("Error: --atmos and --ac3 cannot be used together.")
+		return
+	}
+	if dl_alac && (dl_atmos || dl_ac3 || dl_aac) {
+		fmt.Println("Error: --alac cannot be combined with --atmos, --ac3 or --aac.")
+		return
+	}
+	if err := initQualityPolicy(); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	if err := initDownloadFormats(); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 	if select_tracks != "" {
 		dl_select = true
 	}
@@ -4783,15 +9617,11 @@ func main() {
 	}
 
 	if strings.Contains(os.Args[0], "/artist/") {
-		urlArtistName, urlArtistID, err := getUrlArtistName(os.Args[0], token)
+		urlArtistName, urlArtistID, err = getUrlArtistName(os.Args[0], token)
 		if err != nil {
 			fmt.Println("Failed to get artistname.")
 			return
 		}
-		Config.ArtistFolderFormat = strings.NewReplacer(
-			"{UrlArtistName}", LimitString(urlArtistName),
-			"{ArtistId}", urlArtistID,
-		).Replace(Config.ArtistFolderFormat)
 		albumArgs, err := checkArtist(os.Args[0], token, "albums")
 		if err != nil {
 			fmt.Println("Failed to get artist albums.")
@@ -4832,16 +9662,11 @@ func main() {
 					counter.Success++
 					continue
 				}
-				mvSaveDir := strings.NewReplacer(
-					"{ArtistName}", "",
-					"{UrlArtistName}", "",
-					"{ArtistId}", "",
-				).Replace(Config.ArtistFolderFormat)
-				if mvSaveDir != "" {
-					mvSaveDir = filepath.Join(Config.AlacSaveFolder, forbiddenNames.ReplaceAllString(mvSaveDir, "_"))
-				} else {
-					mvSaveDir = Config.AlacSaveFolder
-				}
+				mvSaveDir := renderName(Config.ArtistFolderFormat, naming.Vars{
+					"UrlArtistName": LimitString(urlArtistName),
+					"ArtistId":      urlArtistID,
+				})
+				mvSaveDir = joinFolder(Config.AlacSaveFolder, strings.TrimSpace(mvSaveDir))
 				storefront, albumId = checkUrlMv(urlRaw)
 				err := mvDownloader(albumId, mvSaveDir, token, storefront, Config.MediaUserToken, nil)
 				if err != nil {
@@ -4903,6 +9728,7 @@ func main() {
 			} else {
 				fmt.Println("Invalid type")
 			}
+			flushTrackIndexes()
 		}
 		fmt.Printf("=======  [\u2714 ] Completed: %d/%d  |  [\u26A0 ] Warnings: %d  |  [\u2716 ] Errors: %d  =======\n", counter.Success, counter.Total, counter.Unavailable+counter.NotSong, counter.Error)
 		if counter.Error == 0 {
@@ -4926,11 +9752,6 @@ func mvDownloader(adamID string, saveDir string, token string, storefront string
 		return nil
 	}
 
-	if strings.HasSuffix(saveDir, ".") {
-		saveDir = strings.ReplaceAll(saveDir, ".", "")
-	}
-	saveDir = strings.TrimSpace(saveDir)
-
 	vidPath := filepath.Join(saveDir, fmt.Sprintf("%s_vid.mp4", adamID))
 	audPath := filepath.Join(saveDir, fmt.Sprintf("%s_aud.mp4", adamID))
 	mvSaveName := fmt.Sprintf("%s (%s)", MVInfo.Data[0].Attributes.Name, adamID)
@@ -4938,7 +9759,7 @@ func mvDownloader(adamID string, saveDir string, token string, storefront string
 		mvSaveName = fmt.Sprintf("%02d. %s", track.TaskNum, MVInfo.Data[0].Attributes.Name)
 	}
 
-	mvOutPath := filepath.Join(saveDir, fmt.Sprintf("%s.mp4", forbiddenNames.ReplaceAllString(mvSaveName, "_")))
+	mvOutPath := filepath.Join(saveDir, nameProfile.File(saveDir, mvSaveName)+".mp4")
 
 	fmt.Println(MVInfo.Data[0].Attributes.Name)
 
@@ -5025,18 +9846,15 @@ func mvDownloader(adamID string, saveDir string, token string, storefront string
 		tags = append(tags, fmt.Sprintf("performer=%s", mvPrimaryArtist))
 	}
 
-	var covPath string
 	if true {
 		thumbURL := MVInfo.Data[0].Attributes.Artwork.URL
-		baseThumbName := forbiddenNames.ReplaceAllString(mvSaveName, "_") + "_thumbnail"
-		covPath, err = writeCover(saveDir, baseThumbName, thumbURL)
+		covPath, err := renderEmbedCover(thumbURL)
 		if err != nil {
 			fmt.Println("Failed to save MV thumbnail:", err)
 		} else {
 			tags = append(tags, fmt.Sprintf("cover=%s", covPath))
 		}
 	}
-	defer os.Remove(covPath)
 
 	tagsString := strings.Join(tags, ":")
 	muxCmd := exec.Command("MP4Box", "-itags", tagsString, "-quiet", "-add", vidPath, "-add", audPath, "-keep-utc", "-new", mvOutPath)
@@ -5321,19 +10139,30 @@ func extractMedia(b string, more_mode bool) (string, string, error) {
 					Quality = fmt.Sprintf("%s Kbps", split[len(split)-1])
 					break
 				}
-			} else if variant.Codecs == "ac-3" { // Add Dolby Audio support
+			}
+		} else if dl_ac3 {
+			if variant.Codecs == "ac-3" {
 				if debug_mode && !more_mode {
 					fmt.Printf("Debug: Found Dolby Audio variant - %s (Bitrate: %d Kbps)\n",
 						variant.Audio, variant.Bandwidth/1000)
 				}
-				streamUrlTemp, err := masterUrl.Parse(variant.URI)
+				split := strings.Split(variant.Audio, "-")
+				bitrate, err := strconv.Atoi(split[len(split)-1])
 				if err != nil {
 					return "", "", err
 				}
-				streamUrl = streamUrlTemp
-				split := strings.Split(variant.Audio, "-")
-				Quality = fmt.Sprintf("%s Kbps", split[len(split)-1])
-				break
+				if bitrate <= Config.Ac3Max {
+					if !debug_mode && !more_mode {
+						fmt.Printf("%s\n", variant.Audio)
+					}
+					streamUrlTemp, err := masterUrl.Parse(variant.URI)
+					if err != nil {
+						return "", "", err
+					}
+					streamUrl = streamUrlTemp
+					Quality = fmt.Sprintf("%s Kbps", split[len(split)-1])
+					break
+				}
 			}
 		} else if dl_aac {
 			if variant.Codecs == "mp4a.40.2" {
@@ -0,0 +1,120 @@
+// Package alacrepair validates and repairs the ALAC files of a library in
+// parallel and records the outcome in a JSON report.
+package alacrepair
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK       = "ok"
+	StatusCorrupt  = "corrupt"
+	StatusRepaired = "repaired"
+	StatusFailed   = "failed"
+	StatusSkipped  = "skipped"
+)
+
+// File is the outcome for one file. Corrupt files are only reported when
+// the repair mode is off or the run is a dry run.
+type File struct {
+	Path            string `json:"path"`
+	Status          string `json:"status"`
+	Reason          string `json:"reason,omitempty"`
+	Validation      string `json:"validation_error,omitempty"`
+	Error           string `json:"error,omitempty"`
+	BitDepthBefore  int    `json:"bit_depth_before,omitempty"`
+	BitDepthAfter   int    `json:"bit_depth_after,omitempty"`
+	BitDepthReduced bool   `json:"bit_depth_reduced,omitempty"`
+}
+
+// Report is the JSON report written at the end of a run.
+type Report struct {
+	Created time.Time      `json:"created"`
+	Mode    string         `json:"repair_mode"`
+	Decoder string         `json:"decoder"`
+	DryRun  bool           `json:"dry_run,omitempty"`
+	Roots   []string       `json:"roots"`
+	Summary map[string]int `json:"summary"`
+	Files   []File         `json:"files"`
+}
+
+// Add appends files to the report and counts them by status.
+func (r *Report) Add(files ...File) {
+	if r.Summary == nil {
+		r.Summary = make(map[string]int)
+	}
+	for _, f := range files {
+		r.Files = append(r.Files, f)
+		r.Summary[f.Status]++
+		if f.BitDepthReduced {
+			r.Summary["bit_depth_reduced"]++
+		}
+	}
+}
+
+func (r *Report) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Find returns the .m4a files below root in lexical order. Temporary files
+// left by an interrupted repair are skipped.
+func Find(root string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".m4a") || strings.HasPrefix(d.Name(), ".alac-repair-") {
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	sort.Strings(paths)
+	return paths, err
+}
+
+// Run calls check for every path on the given number of workers. Results
+// keep the order of paths. done, when set, is called for each result as
+// it arrives, never concurrently.
+func Run(paths []string, workers int, check func(string) File, done func(File)) []File {
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]File, len(paths))
+	jobs := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				f := check(paths[i])
+				mu.Lock()
+				results[i] = f
+				if done != nil {
+					done(f)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range paths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,50 @@
+package alacrepair
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFind(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"B/02. B.m4a", "A/01. A.M4A", "A/cover.jpg", "A/.alac-repair-123.m4a"} {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths, err := Find(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || filepath.Base(paths[0]) != "01. A.M4A" || filepath.Base(paths[1]) != "02. B.m4a" {
+		t.Fatalf("paths = %q", paths)
+	}
+}
+
+func TestRun(t *testing.T) {
+	paths := []string{"a", "b", "c", "d", "e"}
+	calls := 0
+	results := Run(paths, 3, func(path string) File {
+		status := StatusOK
+		if path == "c" {
+			status = StatusRepaired
+		}
+		return File{Path: path, Status: status, BitDepthBefore: 24, BitDepthAfter: 16, BitDepthReduced: path == "c"}
+	}, func(File) { calls++ })
+	if calls != len(paths) {
+		t.Fatalf("done called %d times", calls)
+	}
+	for i, f := range results {
+		if f.Path != paths[i] {
+			t.Fatalf("results out of order: %+v", results)
+		}
+	}
+	r := &Report{}
+	r.Add(results...)
+	if r.Summary[StatusOK] != 4 || r.Summary[StatusRepaired] != 1 || r.Summary["bit_depth_reduced"] != 1 {
+		t.Fatalf("summary = %v", r.Summary)
+	}
+}
@@ -173,6 +173,49 @@ func GetAlbumRespByHref(href string, language string, token string) (*AlbumResp,
 	return obj, nil
 }
 
+// GetAlbumIDByUpc looks up the catalog ID of the album with the given UPC.
+func GetAlbumIDByUpc(storefront string, upc string, token string) (string, error) {
+	var err error
+	if token == "" {
+		token, err = GetToken()
+		if err != nil {
+			return "", err
+		}
+	}
+	cached := new(AlbumResp)
+	if hit, _ := loadCachedJSON("album-by-upc", cached, storefront, upc); hit && len(cached.Data) > 0 {
+		return cached.Data[0].ID, nil
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/albums", storefront), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+	req.Header.Set("Origin", "https://music.apple.com")
+	query := url.Values{}
+	query.Set("filter[upc]", upc)
+	query.Set("omit[resource]", "autos")
+	req.URL.RawQuery = query.Encode()
+	do, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer do.Body.Close()
+	if do.StatusCode != http.StatusOK {
+		return "", errors.New(do.Status)
+	}
+	obj := new(AlbumResp)
+	if err := json.NewDecoder(do.Body).Decode(&obj); err != nil {
+		return "", err
+	}
+	if len(obj.Data) == 0 {
+		return "", fmt.Errorf("no album with UPC %s", upc)
+	}
+	saveCachedJSON("album-by-upc", obj, storefront, upc)
+	return obj.Data[0].ID, nil
+}
+
 type AlbumResp struct {
 	Href string          `json:"href"`
 	Next string          `json:"next"`
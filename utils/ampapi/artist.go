@@ -30,7 +30,8 @@ func GetArtistResp(storefront string, id string, language string, token string)
 	req.Header.Set("Origin", "https://music.apple.com")
 	query := url.Values{}
 	query.Set("l", language)
-	query.Set("fields[artists]", "name,artwork")
+	query.Set("fields[artists]", "name,artwork,editorialArtwork")
+	query.Set("extend", "editorialArtwork")
 	req.URL.RawQuery = query.Encode()
 	do, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -63,5 +64,17 @@ type ArtistRespData struct {
 		Artwork struct {
 			Url string `json:"url"`
 		} `json:"artwork"`
+		EditorialArtwork struct {
+			BannerUber                   ArtworkImage `json:"bannerUber"`
+			CenteredFullscreenBackground ArtworkImage `json:"centeredFullscreenBackground"`
+			SubscriptionHero             ArtworkImage `json:"subscriptionHero"`
+			SuperHeroTall                ArtworkImage `json:"superHeroTall"`
+		} `json:"editorialArtwork"`
 	} `json:"attributes"`
 }
+
+type ArtworkImage struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
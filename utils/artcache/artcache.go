@@ -0,0 +1,150 @@
+package artcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"main/utils/linkfile"
+)
+
+// Cache is a content-addressed artwork store. Entries are keyed by the
+// mzstatic asset and the rendering parameters, so the same cover requested
+// by an album, a playlist and a station resolves to one file on disk.
+type Cache struct {
+	Dir  string
+	Mode linkfile.Mode
+
+	mu       sync.Mutex
+	inflight map[string]*call
+}
+
+type call struct {
+	wg   sync.WaitGroup
+	path string
+	err  error
+}
+
+func New(dir string, mode linkfile.Mode) (*Cache, error) {
+	if strings.TrimSpace(dir) == "" {
+		return nil, errors.New("artwork cache folder is empty")
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &Cache{Dir: dir, Mode: mode, inflight: make(map[string]*call)}, nil
+}
+
+// AssetID extracts the stable part of an mzstatic artwork URL, dropping the
+// host and the trailing size/format segment. Other URLs are returned
+// without query string.
+func AssetID(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	path := u.Path
+	if !strings.Contains(u.Host, "mzstatic.com") {
+		return u.Host + path
+	}
+	for _, prefix := range []string{"/image/thumb/", "/us/r1000/0/"} {
+		if idx := strings.Index(path, prefix); idx >= 0 {
+			path = path[idx+len(prefix):]
+			break
+		}
+	}
+	if idx := strings.LastIndex(path, "/"); idx >= 0 && strings.Contains(path[idx:], "{w}x{h}") {
+		path = path[:idx]
+	}
+	return path
+}
+
+// Key builds the cache key for an artwork URL rendered with size, format
+// and any extra encoder settings.
+func Key(rawURL string, parts ...string) string {
+	h := sha256.New()
+	h.Write([]byte(AssetID(rawURL)))
+	for _, part := range parts {
+		h.Write([]byte{0})
+		h.Write([]byte(part))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *Cache) pathFor(key, ext string) string {
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return filepath.Join(c.Dir, key[:2], key+ext)
+}
+
+// Get returns the cached file for key, calling fill to produce it on a miss.
+// Concurrent requests for the same key share a single fill.
+func (c *Cache) Get(key, ext string, fill func() ([]byte, error)) (string, error) {
+	target := c.pathFor(key, ext)
+	if info, err := os.Stat(target); err == nil && info.Size() > 0 {
+		return target, nil
+	}
+
+	c.mu.Lock()
+	if existing, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		existing.wg.Wait()
+		return existing.path, existing.err
+	}
+	pending := &call{}
+	pending.wg.Add(1)
+	c.inflight[key] = pending
+	c.mu.Unlock()
+
+	pending.path, pending.err = c.store(target, fill)
+	pending.wg.Done()
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	return pending.path, pending.err
+}
+
+func (c *Cache) store(target string, fill func() ([]byte, error)) (string, error) {
+	data, err := fill()
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 0 {
+		return "", errors.New("empty artwork")
+	}
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return "", err
+	}
+	if err := os.Rename(tmpName, target); err != nil {
+		os.Remove(tmpName)
+		return "", err
+	}
+	return target, nil
+}
+
+// Place puts a cached file at dst using the cache's link mode.
+func (c *Cache) Place(cached, dst string) error {
+	_, err := linkfile.Place(cached, dst, c.Mode)
+	return err
+}
@@ -0,0 +1,91 @@
+package artcache
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"main/utils/linkfile"
+)
+
+func TestAssetIDIgnoresHostAndSize(t *testing.T) {
+	a := AssetID("https://is1-ssl.mzstatic.com/image/thumb/Music126/v4/aa/bb/cc/uuid/196589.jpg/{w}x{h}bb.jpg")
+	b := AssetID("https://is5-ssl.mzstatic.com/image/thumb/Music126/v4/aa/bb/cc/uuid/196589.jpg/{w}x{h}bb.png")
+	if a != b {
+		t.Fatalf("expected same asset id, got %q and %q", a, b)
+	}
+	if a != "Music126/v4/aa/bb/cc/uuid/196589.jpg" {
+		t.Fatalf("unexpected asset id %q", a)
+	}
+	if Key(a, "600x600", "jpg") == Key(a, "1200x1200", "jpg") {
+		t.Fatalf("expected size to change the key")
+	}
+}
+
+func TestGetCoalescesConcurrentFills(t *testing.T) {
+	cache, err := New(t.TempDir(), linkfile.Copy)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	var fills int32
+	fill := func() ([]byte, error) {
+		atomic.AddInt32(&fills, 1)
+		time.Sleep(20 * time.Millisecond)
+		return []byte("cover"), nil
+	}
+	var wg sync.WaitGroup
+	paths := make([]string, 8)
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path, err := cache.Get("abcdef", "jpg", fill)
+			if err != nil {
+				t.Errorf("get: %v", err)
+			}
+			paths[i] = path
+		}(i)
+	}
+	wg.Wait()
+	if fills != 1 {
+		t.Fatalf("expected a single fill, got %d", fills)
+	}
+	for _, path := range paths {
+		if path != paths[0] {
+			t.Fatalf("expected identical paths, got %q and %q", path, paths[0])
+		}
+	}
+	if _, err := cache.Get("abcdef", "jpg", func() ([]byte, error) {
+		t.Fatalf("unexpected fill on cache hit")
+		return nil, nil
+	}); err != nil {
+		t.Fatalf("get hit: %v", err)
+	}
+}
+
+func TestPlaceHardlinks(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := New(filepath.Join(dir, "cache"), linkfile.Hardlink)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	cached, err := cache.Get("0123ab", "jpg", func() ([]byte, error) { return []byte("cover"), nil })
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	dst := filepath.Join(dir, "album", "cover.jpg")
+	if err := cache.Place(cached, dst); err != nil {
+		t.Fatalf("place: %v", err)
+	}
+	src, _ := os.Stat(cached)
+	out, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if !os.SameFile(src, out) {
+		t.Fatalf("expected hardlink to cached file")
+	}
+}
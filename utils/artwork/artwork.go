@@ -0,0 +1,460 @@
+package artwork
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const defaultJPEGQuality = 90
+
+var ErrEncoderUnavailable = errors.New("image encoder unavailable")
+
+// Options describes how a master image is rendered into a cover file.
+// Width/Height are a bounding box; zero keeps the master dimensions and
+// images are never upscaled.
+type Options struct {
+	Width        int
+	Height       int
+	Format       string
+	JPEGQuality  int
+	Progressive  bool
+	StripEXIF    bool
+	FFmpegPath   string
+	JpegtranPath string
+}
+
+func ParseSize(value string) (int, int, error) {
+	raw := strings.ToLower(strings.TrimSpace(value))
+	if raw == "" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(raw, "x", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid size: %s", value)
+	}
+	w, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	h, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return w, h, nil
+}
+
+func NormalizeFormat(format string) string {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "jpg", "jpeg":
+		return "jpg"
+	case "png":
+		return "png"
+	case "webp":
+		return "webp"
+	case "", "original":
+		return "original"
+	default:
+		return strings.ToLower(strings.TrimSpace(format))
+	}
+}
+
+func DetectFormat(data []byte) string {
+	switch {
+	case len(data) >= 3 && data[0] == 0xFF && data[1] == 0xD8 && data[2] == 0xFF:
+		return "jpg"
+	case len(data) >= 8 && bytes.Equal(data[:8], []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case len(data) >= 12 && bytes.Equal(data[:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return "webp"
+	case len(data) >= 6 && (bytes.Equal(data[:6], []byte("GIF87a")) || bytes.Equal(data[:6], []byte("GIF89a"))):
+		return "gif"
+	case len(data) >= 4 && (bytes.Equal(data[:4], []byte("II*\x00")) || bytes.Equal(data[:4], []byte("MM\x00*"))):
+		return "tif"
+	}
+	return ""
+}
+
+// Render converts master into the target described by opts and returns the
+// encoded bytes together with the file extension that matches them.
+func Render(master []byte, opts Options) ([]byte, string, error) {
+	srcFormat := DetectFormat(master)
+	target := NormalizeFormat(opts.Format)
+	if target == "original" {
+		target = srcFormat
+	}
+	if target == "" {
+		return nil, "", errors.New("unknown image format")
+	}
+
+	if srcFormat == "webp" && (target != "webp" || opts.Width > 0 && opts.Height > 0) {
+		// image cannot decode WebP, so such masters are turned into PNG
+		// first whenever they have to be resized or transcoded.
+		decoded, err := decodeWebP(master, opts)
+		if err != nil {
+			return nil, "", err
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(decoded))
+		if err != nil {
+			return nil, "", err
+		}
+		if target != "webp" || cfg.Width > opts.Width || cfg.Height > opts.Height {
+			master, srcFormat = decoded, "png"
+		}
+	}
+
+	needsResize := false
+	if opts.Width > 0 && opts.Height > 0 && (srcFormat == "jpg" || srcFormat == "png") {
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(master))
+		if err != nil {
+			return nil, "", err
+		}
+		needsResize = cfg.Width > opts.Width || cfg.Height > opts.Height
+	}
+
+	if !needsResize && target == srcFormat {
+		out := master
+		if opts.StripEXIF {
+			switch target {
+			case "jpg":
+				out = StripJPEGMetadata(out)
+			case "png":
+				out = StripPNGMetadata(out)
+			}
+		}
+		if target == "jpg" && opts.Progressive {
+			out = progressiveJPEG(out, opts)
+		}
+		return out, target, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(master))
+	if err != nil {
+		return nil, "", err
+	}
+	if needsResize {
+		w, h := fitWithin(img.Bounds().Dx(), img.Bounds().Dy(), opts.Width, opts.Height)
+		img = Resize(img, w, h)
+	}
+
+	var buf bytes.Buffer
+	switch target {
+	case "jpg":
+		quality := opts.JPEGQuality
+		if quality <= 0 || quality > 100 {
+			quality = defaultJPEGQuality
+		}
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, "", err
+		}
+		out := buf.Bytes()
+		if opts.Progressive {
+			out = progressiveJPEG(out, opts)
+		}
+		return out, target, nil
+	case "png":
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), target, nil
+	case "webp":
+		out, err := encodeWebP(img, opts)
+		if err != nil {
+			return nil, "", err
+		}
+		return out, target, nil
+	}
+	return nil, "", fmt.Errorf("unsupported image format: %s", target)
+}
+
+func fitWithin(srcW, srcH, maxW, maxH int) (int, int) {
+	if srcW <= 0 || srcH <= 0 {
+		return maxW, maxH
+	}
+	scale := math.Min(float64(maxW)/float64(srcW), float64(maxH)/float64(srcH))
+	if scale >= 1 {
+		return srcW, srcH
+	}
+	w := int(math.Round(float64(srcW) * scale))
+	h := int(math.Round(float64(srcH) * scale))
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// Resize scales src to exactly w x h with a separable Catmull-Rom filter.
+// The kernel is widened when downscaling so every source pixel contributes.
+func Resize(src image.Image, w, h int) *image.RGBA {
+	b := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok || b.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	}
+	srcW, srcH := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+
+	tmp := make([]float64, w*srcH*4)
+	xWeights := buildWeights(srcW, w)
+	for y := 0; y < srcH; y++ {
+		row := rgba.Pix[y*rgba.Stride:]
+		for x := 0; x < w; x++ {
+			var r, g, bl, a float64
+			for _, c := range xWeights[x] {
+				p := row[c.index*4:]
+				r += float64(p[0]) * c.weight
+				g += float64(p[1]) * c.weight
+				bl += float64(p[2]) * c.weight
+				a += float64(p[3]) * c.weight
+			}
+			off := (y*w + x) * 4
+			tmp[off], tmp[off+1], tmp[off+2], tmp[off+3] = r, g, bl, a
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	yWeights := buildWeights(srcH, h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var r, g, bl, a float64
+			for _, c := range yWeights[y] {
+				off := (c.index*w + x) * 4
+				r += tmp[off] * c.weight
+				g += tmp[off+1] * c.weight
+				bl += tmp[off+2] * c.weight
+				a += tmp[off+3] * c.weight
+			}
+			alpha := clamp8(a)
+			p := dst.Pix[y*dst.Stride+x*4:]
+			p[0] = minByte(clamp8(r), alpha)
+			p[1] = minByte(clamp8(g), alpha)
+			p[2] = minByte(clamp8(bl), alpha)
+			p[3] = alpha
+		}
+	}
+	return dst
+}
+
+type contribution struct {
+	index  int
+	weight float64
+}
+
+func buildWeights(srcLen, dstLen int) [][]contribution {
+	scale := float64(srcLen) / float64(dstLen)
+	support := 2.0
+	filterScale := 1.0
+	if scale > 1 {
+		filterScale = scale
+	}
+	out := make([][]contribution, dstLen)
+	for i := 0; i < dstLen; i++ {
+		center := (float64(i)+0.5)*scale - 0.5
+		radius := support * filterScale
+		start := int(math.Floor(center - radius))
+		end := int(math.Ceil(center + radius))
+		var total float64
+		weights := make([]contribution, 0, end-start+1)
+		for j := start; j <= end; j++ {
+			weight := catmullRom((float64(j) - center) / filterScale)
+			if weight == 0 {
+				continue
+			}
+			idx := j
+			if idx < 0 {
+				idx = 0
+			} else if idx >= srcLen {
+				idx = srcLen - 1
+			}
+			weights = append(weights, contribution{index: idx, weight: weight})
+			total += weight
+		}
+		if total != 0 {
+			for k := range weights {
+				weights[k].weight /= total
+			}
+		}
+		out[i] = weights
+	}
+	return out
+}
+
+func catmullRom(x float64) float64 {
+	x = math.Abs(x)
+	switch {
+	case x < 1:
+		return (1.5*x-2.5)*x*x + 1
+	case x < 2:
+		return ((-0.5*x+2.5)*x-4)*x + 2
+	}
+	return 0
+}
+
+func clamp8(v float64) uint8 {
+	v = math.Round(v)
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+func minByte(a, b uint8) uint8 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// StripJPEGMetadata drops APPn (except JFIF/Adobe) and COM segments without
+// re-encoding the image data.
+func StripJPEGMetadata(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return data
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			pos++
+			continue
+		}
+		if marker == 0xDA {
+			return append(out, data[pos:]...)
+		}
+		if marker == 0xD9 || (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 {
+			out = append(out, data[pos:pos+2]...)
+			pos += 2
+			continue
+		}
+		length := int(data[pos+2])<<8 | int(data[pos+3])
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return data
+		}
+		segment := data[pos:end]
+		drop := marker == 0xFE
+		if marker >= 0xE1 && marker <= 0xEF && marker != 0xEE {
+			drop = true
+		}
+		if !drop {
+			out = append(out, segment...)
+		}
+		pos = end
+	}
+	return data
+}
+
+// StripPNGMetadata removes textual and EXIF chunks from a PNG stream.
+func StripPNGMetadata(data []byte) []byte {
+	if DetectFormat(data) != "png" {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:8]...)
+	pos := 8
+	for pos+12 <= len(data) {
+		length := int(uint32(data[pos])<<24 | uint32(data[pos+1])<<16 | uint32(data[pos+2])<<8 | uint32(data[pos+3]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return data
+		}
+		switch string(data[pos+4 : pos+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	return out
+}
+
+func progressiveJPEG(data []byte, opts Options) []byte {
+	if opts.JpegtranPath == "" {
+		return data
+	}
+	copyMode := "all"
+	if opts.StripEXIF {
+		copyMode = "none"
+	}
+	cmd := exec.Command(opts.JpegtranPath, "-progressive", "-optimize", "-copy", copyMode)
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.Output()
+	if err != nil || DetectFormat(out) != "jpg" {
+		return data
+	}
+	return out
+}
+
+func decodeWebP(data []byte, opts Options) ([]byte, error) {
+	if opts.FFmpegPath == "" {
+		return nil, ErrEncoderUnavailable
+	}
+	cmd := exec.Command(
+		opts.FFmpegPath,
+		"-v", "error",
+		"-f", "webp_pipe",
+		"-i", "-",
+		"-frames:v", "1",
+		"-c:v", "png",
+		"-f", "image2pipe",
+		"-",
+	)
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("webp decode: %w", err)
+	}
+	if DetectFormat(out) != "png" {
+		return nil, errors.New("webp decode produced no image")
+	}
+	return out, nil
+}
+
+func encodeWebP(img image.Image, opts Options) ([]byte, error) {
+	if opts.FFmpegPath == "" {
+		return nil, ErrEncoderUnavailable
+	}
+	var pngBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, img); err != nil {
+		return nil, err
+	}
+	quality := opts.JPEGQuality
+	if quality <= 0 || quality > 100 {
+		quality = defaultJPEGQuality
+	}
+	cmd := exec.Command(
+		opts.FFmpegPath,
+		"-v", "error",
+		"-f", "png_pipe",
+		"-i", "-",
+		"-c:v", "libwebp",
+		"-quality", strconv.Itoa(quality),
+		"-f", "webp",
+		"-",
+	)
+	cmd.Stdin = &pngBuf
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("webp encode: %w", err)
+	}
+	if DetectFormat(out) != "webp" {
+		return nil, errors.New("webp encode produced no image")
+	}
+	return out, nil
+}
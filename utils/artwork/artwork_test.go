@@ -0,0 +1,100 @@
+package artwork
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func testJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func withEXIF(data []byte) []byte {
+	app1 := []byte{0xFF, 0xE1, 0x00, 0x0A, 'E', 'x', 'i', 'f', 0, 0, 'M', 'M'}
+	out := append([]byte{}, data[:2]...)
+	out = append(out, app1...)
+	return append(out, data[2:]...)
+}
+
+func TestRenderDownscalesWithinBox(t *testing.T) {
+	master := testJPEG(t, 200, 100)
+	out, ext, err := Render(master, Options{Width: 50, Height: 50, Format: "jpg"})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if ext != "jpg" {
+		t.Fatalf("expected jpg, got %s", ext)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if cfg.Width != 50 || cfg.Height != 25 {
+		t.Fatalf("expected 50x25, got %dx%d", cfg.Width, cfg.Height)
+	}
+}
+
+func TestRenderNeverUpscales(t *testing.T) {
+	master := testJPEG(t, 40, 40)
+	out, _, err := Render(master, Options{Width: 600, Height: 600, Format: "jpg"})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if !bytes.Equal(out, master) {
+		t.Fatalf("expected master bytes to be reused")
+	}
+}
+
+func TestRenderTranscodesToPNG(t *testing.T) {
+	out, ext, err := Render(testJPEG(t, 20, 20), Options{Format: "png"})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if ext != "png" || DetectFormat(out) != "png" {
+		t.Fatalf("expected png output, got %s", DetectFormat(out))
+	}
+}
+
+func TestRenderWebPMaster(t *testing.T) {
+	master := []byte("RIFF\x0c\x00\x00\x00WEBPVP8 ")
+	out, ext, err := Render(master, Options{Format: "webp"})
+	if err != nil || ext != "webp" || !bytes.Equal(out, master) {
+		t.Fatalf("expected the master to be kept, got %s, %v", ext, err)
+	}
+	// Resizing needs ffmpeg to decode the master first.
+	if _, _, err := Render(master, Options{Width: 50, Height: 50, Format: "webp"}); err != ErrEncoderUnavailable {
+		t.Fatalf("expected ErrEncoderUnavailable, got %v", err)
+	}
+	if _, _, err := Render(master, Options{Format: "jpg"}); err != ErrEncoderUnavailable {
+		t.Fatalf("expected ErrEncoderUnavailable, got %v", err)
+	}
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	master := testJPEG(t, 16, 16)
+	tagged := withEXIF(master)
+	stripped := StripJPEGMetadata(tagged)
+	if bytes.Contains(stripped, []byte("Exif")) {
+		t.Fatalf("expected EXIF segment to be removed")
+	}
+	if !bytes.Equal(stripped, master) {
+		t.Fatalf("expected stripped image to match original stream")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Fatalf("decode stripped: %v", err)
+	}
+}
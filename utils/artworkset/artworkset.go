@@ -0,0 +1,133 @@
+package artworkset
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Artwork kinds that a profile can name files for.
+const (
+	AlbumCover         = "album-cover"
+	AlbumMotionSquare  = "album-motion-square"
+	AlbumMotionTall    = "album-motion-tall"
+	ArtistPoster       = "artist-poster"
+	ArtistBanner       = "artist-banner"
+	ArtistBackground   = "artist-background"
+	PlaylistCover      = "playlist-cover"
+	PlaylistMotionSq   = "playlist-motion-square"
+	PlaylistMotionTall = "playlist-motion-tall"
+)
+
+// Profile maps artwork kinds to the file names a media server looks for.
+// Still images are listed without extension so the configured cover format
+// applies; motion artwork is listed with its container extension.
+type Profile struct {
+	Name  string
+	Files map[string][]string
+}
+
+// None of the servers has a convention for motion artwork, so every
+// profile keeps the names Apple Music uses for it.
+var motionFiles = map[string][]string{
+	AlbumMotionSquare:  {"square_animated_artwork.mp4"},
+	AlbumMotionTall:    {"tall_animated_artwork.mp4"},
+	PlaylistMotionSq:   {"square_animated_artwork.mp4"},
+	PlaylistMotionTall: {"tall_animated_artwork.mp4"},
+}
+
+func profile(name string, files map[string][]string) Profile {
+	for kind, names := range motionFiles {
+		files[kind] = names
+	}
+	return Profile{Name: name, Files: files}
+}
+
+var profiles = map[string]Profile{
+	"default": profile("default", map[string][]string{
+		AlbumCover:       {"cover"},
+		ArtistPoster:     {"folder"},
+		ArtistBanner:     {"banner"},
+		ArtistBackground: {"backdrop"},
+		PlaylistCover:    {"cover"},
+	}),
+	"plex": profile("plex", map[string][]string{
+		AlbumCover:       {"cover"},
+		ArtistPoster:     {"artist"},
+		ArtistBanner:     {"banner"},
+		ArtistBackground: {"background"},
+		PlaylistCover:    {"poster"},
+	}),
+	"jellyfin": profile("jellyfin", map[string][]string{
+		AlbumCover:       {"folder"},
+		ArtistPoster:     {"folder"},
+		ArtistBanner:     {"banner"},
+		ArtistBackground: {"backdrop"},
+		PlaylistCover:    {"folder"},
+	}),
+	"emby": profile("emby", map[string][]string{
+		AlbumCover:       {"folder"},
+		ArtistPoster:     {"folder"},
+		ArtistBanner:     {"banner"},
+		ArtistBackground: {"backdrop"},
+		PlaylistCover:    {"folder"},
+	}),
+	"kodi": profile("kodi", map[string][]string{
+		AlbumCover:       {"cover"},
+		ArtistPoster:     {"folder"},
+		ArtistBanner:     {"banner"},
+		ArtistBackground: {"fanart"},
+		PlaylistCover:    {"folder"},
+	}),
+}
+
+func Names() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Resolve looks up the named profiles. An empty list selects the default
+// profile, which matches the file names used before profiles existed.
+func Resolve(names []string) ([]Profile, error) {
+	if len(names) == 0 {
+		return []Profile{profiles["default"]}, nil
+	}
+	out := make([]Profile, 0, len(names))
+	seen := make(map[string]bool)
+	for _, raw := range names {
+		name := strings.ToLower(strings.TrimSpace(raw))
+		if name == "" || seen[name] {
+			continue
+		}
+		profile, ok := profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown artwork profile %q (expected one of: %s)", raw, strings.Join(Names(), ", "))
+		}
+		seen[name] = true
+		out = append(out, profile)
+	}
+	if len(out) == 0 {
+		out = append(out, profiles["default"])
+	}
+	return out, nil
+}
+
+// FileNames returns the de-duplicated file names for kind across profiles.
+func FileNames(selected []Profile, kind string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, profile := range selected {
+		for _, name := range profile.Files[kind] {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	return out
+}
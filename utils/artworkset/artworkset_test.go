@@ -0,0 +1,62 @@
+package artworkset
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	got, err := Resolve(nil)
+	if err != nil || len(got) != 1 || got[0].Name != "default" {
+		t.Fatalf("Resolve(nil) = %v, %v", got, err)
+	}
+	got, err = Resolve([]string{" Plex", "jellyfin", "plex", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range got {
+		names = append(names, p.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"plex", "jellyfin"}) {
+		t.Errorf("profiles = %v", names)
+	}
+	if got, err := Resolve([]string{" ", ""}); err != nil || got[0].Name != "default" {
+		t.Errorf("blank names = %v, %v", got, err)
+	}
+	if _, err := Resolve([]string{"winamp"}); err == nil {
+		t.Error("unknown profile accepted")
+	}
+}
+
+func TestFileNames(t *testing.T) {
+	selected, err := Resolve([]string{"plex", "jellyfin", "kodi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		kind string
+		want []string
+	}{
+		{AlbumCover, []string{"cover", "folder"}},
+		{ArtistPoster, []string{"artist", "folder"}},
+		{ArtistBackground, []string{"background", "backdrop", "fanart"}},
+		{PlaylistCover, []string{"poster", "folder"}},
+		{AlbumMotionTall, []string{"tall_animated_artwork.mp4"}},
+		{PlaylistMotionSq, []string{"square_animated_artwork.mp4"}},
+		{"unknown", nil},
+	}
+	for _, tt := range tests {
+		if got := FileNames(selected, tt.kind); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FileNames(%s) = %v, want %v", tt.kind, got, tt.want)
+		}
+	}
+	for _, name := range Names() {
+		p := profiles[name]
+		for _, kind := range []string{AlbumCover, AlbumMotionSquare, AlbumMotionTall, ArtistPoster, ArtistBanner, ArtistBackground, PlaylistCover, PlaylistMotionSq, PlaylistMotionTall} {
+			if len(p.Files[kind]) == 0 {
+				t.Errorf("profile %s names no %s file", name, kind)
+			}
+		}
+	}
+}
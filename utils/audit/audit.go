@@ -0,0 +1,140 @@
+// Package audit compares the albums on disk with their catalog track lists
+// and turns what is missing into download jobs.
+package audit
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"main/utils/retag"
+)
+
+const (
+	MissingTrack  = "missing track"
+	MissingLyrics = "missing lyrics"
+	MissingCover  = "missing cover"
+	WrongFormat   = "wrong format"
+	Orphan        = "orphan file"
+)
+
+// Kinds lists the issue kinds in report order.
+var Kinds = []string{MissingTrack, MissingLyrics, MissingCover, WrongFormat, Orphan}
+
+// Match pairs files with the tracks of an album. It returns the index of
+// the track each file belongs to, -1 for files that match no track, and
+// the indexes of the tracks no file matched.
+func Match(tracks, files []retag.TrackRef) ([]int, []int) {
+	matches := make([]int, len(files))
+	found := make([]bool, len(tracks))
+	for i, f := range files {
+		matches[i] = retag.Match(tracks, f)
+		if matches[i] >= 0 {
+			found[matches[i]] = true
+		}
+	}
+	var missing []int
+	for i, ok := range found {
+		if !ok {
+			missing = append(missing, i)
+		}
+	}
+	return matches, missing
+}
+
+// Issue is one problem found in an album. Track is the 1-based position of
+// the track in the album, or 0 for problems that concern the whole album
+// or a file that matches no track.
+type Issue struct {
+	Kind   string
+	Track  int
+	Detail string
+}
+
+// Album collects the issues of one album in one save root.
+type Album struct {
+	ID         string
+	Storefront string
+	Name       string
+	// Flags select the download mode of the save root, e.g. "--atmos".
+	Flags  []string
+	Issues []Issue
+}
+
+func (a *Album) Add(kind string, track int, detail string) {
+	a.Issues = append(a.Issues, Issue{Kind: kind, Track: track, Detail: detail})
+}
+
+// Count returns the number of issues of kind.
+func (a *Album) Count(kind string) int {
+	n := 0
+	for _, issue := range a.Issues {
+		if issue.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// URL is the catalog link of the album.
+func (a *Album) URL() string {
+	return fmt.Sprintf("https://music.apple.com/%s/album/%s", a.Storefront, a.ID)
+}
+
+// Jobs returns the arguments of the download runs that fix the album.
+// Missing tracks and tracks in the wrong format are downloaded again;
+// lyrics and covers are fetched on their own. Orphan files need a decision
+// and are not queued.
+func (a *Album) Jobs() [][]string {
+	var download, lyrics []int
+	cover := false
+	for _, issue := range a.Issues {
+		switch issue.Kind {
+		case MissingTrack, WrongFormat:
+			if issue.Track > 0 {
+				download = append(download, issue.Track)
+			}
+		case MissingLyrics:
+			lyrics = append(lyrics, issue.Track)
+		case MissingCover:
+			cover = true
+		}
+	}
+	var jobs [][]string
+	job := func(extra ...string) []string {
+		args := append([]string{}, a.Flags...)
+		return append(append(args, extra...), a.URL())
+	}
+	if len(download) > 0 {
+		jobs = append(jobs, job("--select-tracks", Selection(download)))
+	}
+	if len(lyrics) > 0 {
+		jobs = append(jobs, job("--lyrics-only", "--select-tracks", Selection(lyrics)))
+	}
+	if cover {
+		jobs = append(jobs, job("--covers-only"))
+	}
+	return jobs
+}
+
+// Selection formats track positions for --select-tracks, joining runs into
+// ranges: 1,2,3,5 becomes "1-3,5".
+func Selection(tracks []int) string {
+	sorted := append([]int{}, tracks...)
+	sort.Ints(sorted)
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] <= sorted[j]+1 {
+			j++
+		}
+		if sorted[i] == sorted[j] {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
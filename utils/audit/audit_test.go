@@ -0,0 +1,55 @@
+package audit
+
+import (
+	"strings"
+	"testing"
+
+	"main/utils/retag"
+)
+
+func TestMatch(t *testing.T) {
+	tracks := []retag.TrackRef{
+		{ISRC: "USAAA0000001", Disc: 1, Track: 1},
+		{ISRC: "USAAA0000002", Disc: 1, Track: 2},
+		{ISRC: "USAAA0000003", Disc: 1, Track: 3},
+	}
+	files := []retag.TrackRef{
+		{ISRC: "USAAA0000001", Disc: 1, Track: 1},
+		{Disc: 1, Track: 3},
+		{ISRC: "GBBBB0000009", Disc: 1, Track: 9},
+	}
+	matches, missing := Match(tracks, files)
+	if matches[0] != 0 || matches[1] != 2 || matches[2] != -1 {
+		t.Fatalf("matches = %v", matches)
+	}
+	if len(missing) != 1 || missing[0] != 1 {
+		t.Fatalf("missing = %v", missing)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	a := &Album{ID: "1440857781", Storefront: "us", Flags: []string{"--atmos"}}
+	a.Add(MissingTrack, 3, "03. Song")
+	a.Add(MissingTrack, 1, "01. Intro")
+	a.Add(WrongFormat, 2, "02. Other.m4a")
+	a.Add(MissingTrack, 5, "05. End")
+	a.Add(MissingLyrics, 4, "04. Words")
+	a.Add(MissingCover, 0, "")
+	a.Add(Orphan, 0, "bonus.m4a")
+	var got []string
+	for _, job := range a.Jobs() {
+		got = append(got, strings.Join(job, " "))
+	}
+	url := "https://music.apple.com/us/album/1440857781"
+	want := []string{
+		"--atmos --select-tracks 1-3,5 " + url,
+		"--atmos --lyrics-only --select-tracks 4 " + url,
+		"--atmos --covers-only " + url,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("jobs = %q", got)
+	}
+	if a.Count(MissingTrack) != 3 || a.Count(Orphan) != 1 {
+		t.Fatal("unexpected issue counts")
+	}
+}
@@ -0,0 +1,205 @@
+// Package cuesheet writes CUE sheets for single-file album images, both as
+// text and as a FLAC CUESHEET metadata block, and reads back the tracks of
+// sheets it wrote.
+package cuesheet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxTracks is the most tracks a CUE sheet can describe.
+const MaxTracks = 99
+
+var isrcRe = regexp.MustCompile(`^[A-Z]{2}[A-Z0-9]{3}\d{7}$`)
+
+type Track struct {
+	Title     string
+	Performer string
+	ISRC      string
+	// Offset is the first sample of the track within the image.
+	Offset uint64
+}
+
+type Sheet struct {
+	Catalog    string
+	Title      string
+	Performer  string
+	Genre      string
+	Date       string
+	File       string
+	FileType   string
+	SampleRate int
+	// TotalSamples is the length of the image, used for the lead-out.
+	TotalSamples uint64
+	Tracks       []Track
+}
+
+// String renders the sheet as a .cue file. Index times are in CD frames
+// (1/75 s), rounded down from the sample offsets.
+func (s *Sheet) String() string {
+	var b strings.Builder
+	if s.Genre != "" {
+		fmt.Fprintf(&b, "REM GENRE %s\n", quote(s.Genre))
+	}
+	if s.Date != "" {
+		fmt.Fprintf(&b, "REM DATE %s\n", s.Date)
+	}
+	if catalog := Catalog(s.Catalog); catalog != "" {
+		fmt.Fprintf(&b, "CATALOG %s\n", catalog)
+	}
+	if s.Performer != "" {
+		fmt.Fprintf(&b, "PERFORMER %s\n", quote(s.Performer))
+	}
+	if s.Title != "" {
+		fmt.Fprintf(&b, "TITLE %s\n", quote(s.Title))
+	}
+	fileType := s.FileType
+	if fileType == "" {
+		fileType = "WAVE"
+	}
+	fmt.Fprintf(&b, "FILE %s %s\n", quote(s.File), fileType)
+	for i, t := range s.Tracks {
+		fmt.Fprintf(&b, "  TRACK %02d AUDIO\n", i+1)
+		if t.Title != "" {
+			fmt.Fprintf(&b, "    TITLE %s\n", quote(t.Title))
+		}
+		if t.Performer != "" {
+			fmt.Fprintf(&b, "    PERFORMER %s\n", quote(t.Performer))
+		}
+		if isrcRe.MatchString(t.ISRC) {
+			fmt.Fprintf(&b, "    ISRC %s\n", t.ISRC)
+		}
+		fmt.Fprintf(&b, "    INDEX 01 %s\n", s.timestamp(t.Offset))
+	}
+	return b.String()
+}
+
+func (s *Sheet) timestamp(offset uint64) string {
+	frames := uint64(0)
+	if s.SampleRate > 0 {
+		frames = offset * 75 / uint64(s.SampleRate)
+	}
+	return fmt.Sprintf("%02d:%02d:%02d", frames/75/60, frames/75%60, frames%75)
+}
+
+// Catalog normalises a UPC or EAN to the 13 digits a CUE CATALOG expects,
+// or returns "" when it is not a barcode.
+func Catalog(upc string) string {
+	upc = strings.TrimSpace(upc)
+	if len(upc) == 12 {
+		upc = "0" + upc
+	}
+	if len(upc) != 13 {
+		return ""
+	}
+	for _, r := range upc {
+		if r < '0' || r > '9' {
+			return ""
+		}
+	}
+	return upc
+}
+
+// Parse reads the tracks of a sheet written by String: their titles,
+// performers and ISRCs. Offsets are not read.
+func Parse(text string) []Track {
+	var tracks []Track
+	for _, line := range strings.Split(text, "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), " ")
+		value = strings.Trim(strings.TrimSpace(value), "\"")
+		if key == "TRACK" {
+			tracks = append(tracks, Track{})
+			continue
+		}
+		if len(tracks) == 0 {
+			continue
+		}
+		t := &tracks[len(tracks)-1]
+		switch key {
+		case "TITLE":
+			t.Title = value
+		case "PERFORMER":
+			t.Performer = value
+		case "ISRC":
+			t.ISRC = value
+		}
+	}
+	return tracks
+}
+
+// Same reports whether t and o describe the same recording: by ISRC when
+// both have a valid one, otherwise by title and performer as String
+// writes them.
+func (t Track) Same(o Track) bool {
+	if isrcRe.MatchString(t.ISRC) && isrcRe.MatchString(o.ISRC) {
+		return t.ISRC == o.ISRC
+	}
+	return quote(t.Title) == quote(o.Title) && quote(t.Performer) == quote(o.Performer)
+}
+
+func quote(s string) string {
+	s = strings.NewReplacer("\"", "'", "\r", " ", "\n", " ").Replace(s)
+	return "\"" + s + "\""
+}
+
+// FlacBlock encodes the sheet as the body of a FLAC CUESHEET block. Images
+// that are not CD audio use exact sample offsets and lead-out track 255.
+func (s *Sheet) FlacBlock() []byte {
+	var b bytes.Buffer
+	catalog := make([]byte, 128)
+	copy(catalog, Catalog(s.Catalog))
+	b.Write(catalog)
+	binary.Write(&b, binary.BigEndian, uint64(0)) // lead-in samples
+	b.Write(make([]byte, 259))                    // is-CD flag and reserved bits
+	b.WriteByte(byte(len(s.Tracks) + 1))
+	for i, t := range s.Tracks {
+		binary.Write(&b, binary.BigEndian, t.Offset)
+		b.WriteByte(byte(i + 1))
+		isrc := make([]byte, 12)
+		if isrcRe.MatchString(t.ISRC) {
+			copy(isrc, t.ISRC)
+		}
+		b.Write(isrc)
+		b.Write(make([]byte, 14)) // audio track, no pre-emphasis, reserved
+		b.WriteByte(1)
+		binary.Write(&b, binary.BigEndian, uint64(0)) // INDEX 01 at the track start
+		b.WriteByte(1)
+		b.Write(make([]byte, 3))
+	}
+	binary.Write(&b, binary.BigEndian, s.TotalSamples)
+	b.WriteByte(255)
+	b.Write(make([]byte, 12+14))
+	b.WriteByte(0)
+	return b.Bytes()
+}
+
+// FlacOffsets reads the track offsets and the lead-out of a CUESHEET block
+// written by FlacBlock.
+func FlacOffsets(data []byte) ([]uint64, uint64, error) {
+	if len(data) < 396 {
+		return nil, 0, errors.New("invalid CUESHEET block")
+	}
+	n := int(data[395])
+	pos := 396
+	var offsets []uint64
+	for i := 0; i < n; i++ {
+		if len(data) < pos+36 {
+			return nil, 0, errors.New("invalid CUESHEET block")
+		}
+		offset, number, indices := binary.BigEndian.Uint64(data[pos:]), data[pos+8], int(data[pos+35])
+		pos += 36 + 12*indices
+		if len(data) < pos {
+			return nil, 0, errors.New("invalid CUESHEET block")
+		}
+		if number == 255 {
+			return offsets, offset, nil
+		}
+		offsets = append(offsets, offset)
+	}
+	return nil, 0, errors.New("CUESHEET block has no lead-out")
+}
@@ -0,0 +1,102 @@
+package cuesheet
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func sample() *Sheet {
+	return &Sheet{
+		Catalog:      "602445790159",
+		Title:        `Live "In Concert"`,
+		Performer:    "Band",
+		Date:         "2022",
+		File:         "Live.flac",
+		SampleRate:   44100,
+		TotalSamples: 44100 * 200,
+		Tracks: []Track{
+			{Title: "Intro", Performer: "Band", ISRC: "USUM72212345"},
+			{Title: "Song", Performer: "Band", ISRC: "bad", Offset: 44100*65 + 44100/2},
+		},
+	}
+}
+
+func TestString(t *testing.T) {
+	want := `REM DATE 2022
+CATALOG 0602445790159
+PERFORMER "Band"
+TITLE "Live 'In Concert'"
+FILE "Live.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "Intro"
+    PERFORMER "Band"
+    ISRC USUM72212345
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Song"
+    PERFORMER "Band"
+    INDEX 01 01:05:37
+`
+	if got := sample().String(); got != want {
+		t.Fatalf("unexpected cue sheet:\n%s", got)
+	}
+}
+
+func TestFlacBlock(t *testing.T) {
+	s := sample()
+	data := s.FlacBlock()
+	// Header, two tracks with one index each, and the lead-out.
+	if want := 396 + 2*(36+12) + 36; len(data) != want {
+		t.Fatalf("block length %d, want %d", len(data), want)
+	}
+	if string(data[:13]) != "0602445790159" || data[395] != 3 {
+		t.Fatalf("unexpected header")
+	}
+	second := data[396+48:]
+	if binary.BigEndian.Uint64(second) != s.Tracks[1].Offset || second[8] != 2 || second[9] != 0 {
+		t.Fatalf("unexpected second track")
+	}
+	leadOut := data[396+96:]
+	if binary.BigEndian.Uint64(leadOut) != s.TotalSamples || leadOut[8] != 255 {
+		t.Fatalf("unexpected lead-out")
+	}
+}
+
+func TestFlacOffsets(t *testing.T) {
+	s := sample()
+	offsets, leadOut, err := FlacOffsets(s.FlacBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offsets) != 2 || offsets[0] != 0 || offsets[1] != s.Tracks[1].Offset || leadOut != s.TotalSamples {
+		t.Fatalf("offsets = %v, lead-out = %d", offsets, leadOut)
+	}
+	if _, _, err := FlacOffsets(s.FlacBlock()[:400]); err == nil {
+		t.Fatal("expected an error for a truncated block")
+	}
+}
+
+func TestParse(t *testing.T) {
+	sheet := sample()
+	tracks := Parse(sheet.String())
+	if len(tracks) != 2 {
+		t.Fatalf("tracks = %+v", tracks)
+	}
+	if tracks[0].ISRC != "USUM72212345" || tracks[1].Title != "Song" || tracks[1].ISRC != "" {
+		t.Fatalf("tracks = %+v", tracks)
+	}
+	for i, want := range sheet.Tracks {
+		if !tracks[i].Same(want) {
+			t.Errorf("track %d does not match %+v", i+1, want)
+		}
+	}
+	if tracks[0].Same(Track{Title: "Intro", Performer: "Band", ISRC: "USUM72200000"}) {
+		t.Error("different ISRC matched")
+	}
+	if !Parse(`FILE "a.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "Say 'Hi'"
+`)[0].Same(Track{Title: `Say "Hi"`}) {
+		t.Error("quoted title not matched")
+	}
+}
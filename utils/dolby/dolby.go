@@ -0,0 +1,568 @@
+// Package dolby parses AC-3 and E-AC-3 sync frames and builds the dac3,
+// dec3 and chnl boxes an MP4 sample entry carries for them.
+package dolby
+
+import (
+	"errors"
+	"fmt"
+)
+
+// E-AC-3 stream types (strmtyp).
+const (
+	StreamIndependent = 0
+	StreamDependent   = 1
+	StreamAC3Convert  = 2
+)
+
+// chan_loc flags of a dec3 substream, most significant bit first as in
+// ETSI TS 102 366 Table F.6.2.
+const (
+	LocLcRc   = 1 << 8
+	LocLrsRrs = 1 << 7
+	LocCs     = 1 << 6
+	LocTs     = 1 << 5
+	LocLsdRsd = 1 << 4
+	LocLwRw   = 1 << 3
+	LocLvhRvh = 1 << 2
+	LocCvh    = 1 << 1
+	LocLFE2   = 1 << 0
+)
+
+var (
+	sampleRates    = [3]int{48000, 44100, 32000}
+	reducedRates   = [3]int{24000, 22050, 16000}
+	blocksPerFrame = [4]int{1, 2, 3, 6}
+	acmodChannels  = [8]int{2, 1, 2, 3, 3, 4, 4, 5}
+	ac3Bitrates    = [19]int{32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 448, 512, 576, 640}
+
+	errTruncated = errors.New("truncated bitstream")
+)
+
+// Frame is the header of one AC-3 or E-AC-3 sync frame.
+type Frame struct {
+	EAC3        bool
+	StreamType  int
+	SubstreamID int
+	// Size is the frame length in bytes.
+	Size       int
+	SampleRate int
+	Fscod      int
+	Blocks     int
+	Acmod      int
+	LFE        bool
+	Bsid       int
+	Bsmod      int
+	// BitRateCode is frmsizecod/2 of an AC-3 frame.
+	BitRateCode int
+	// ChanMap is the custom channel map of a dependent substream.
+	ChanMap    int
+	HasChanMap bool
+	// JOC reports Dolby Atmos joint object coding (flag_ec3_extension_type_a).
+	JOC        bool
+	Complexity int
+}
+
+// ParseFrame reads the sync frame header at the start of b.
+func ParseFrame(b []byte) (*Frame, error) {
+	if len(b) < 6 || b[0] != 0x0B || b[1] != 0x77 {
+		return nil, errors.New("no AC-3 sync word")
+	}
+	bsid := int(b[5] >> 3)
+	switch {
+	case bsid <= 10:
+		return parseAC3(b)
+	case bsid <= 16:
+		return parseEAC3(b)
+	}
+	return nil, fmt.Errorf("unsupported bsid %d", bsid)
+}
+
+func parseAC3(b []byte) (*Frame, error) {
+	r := &bitReader{b: b, pos: 32}
+	f := &Frame{Blocks: 6}
+	f.Fscod = r.read(2)
+	frmsizecod := r.read(6)
+	f.Bsid = r.read(5)
+	f.Bsmod = r.read(3)
+	f.Acmod = r.read(3)
+	if f.Acmod&1 != 0 && f.Acmod != 1 {
+		r.skip(2) // cmixlev
+	}
+	if f.Acmod&4 != 0 {
+		r.skip(2) // surmixlev
+	}
+	if f.Acmod == 2 {
+		r.skip(2) // dsurmod
+	}
+	f.LFE = r.flag()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if f.Fscod == 3 || frmsizecod > 37 {
+		return nil, errors.New("invalid AC-3 frame header")
+	}
+	f.SampleRate = sampleRates[f.Fscod]
+	f.BitRateCode = frmsizecod >> 1
+	rate := ac3Bitrates[f.BitRateCode]
+	switch f.Fscod {
+	case 0:
+		f.Size = rate * 4
+	case 1:
+		f.Size = (rate*320/147 + frmsizecod&1) * 2
+	case 2:
+		f.Size = rate * 6
+	}
+	return f, nil
+}
+
+func parseEAC3(b []byte) (*Frame, error) {
+	r := &bitReader{b: b, pos: 16}
+	f := &Frame{EAC3: true}
+	f.StreamType = r.read(2)
+	f.SubstreamID = r.read(3)
+	f.Size = (r.read(11) + 1) * 2
+	f.Fscod = r.read(2)
+	numblkscod := 3
+	if f.Fscod == 3 {
+		fscod2 := r.read(2)
+		if fscod2 == 3 {
+			return nil, errors.New("invalid E-AC-3 sample rate")
+		}
+		f.SampleRate = reducedRates[fscod2]
+	} else {
+		numblkscod = r.read(2)
+		f.SampleRate = sampleRates[f.Fscod]
+	}
+	f.Blocks = blocksPerFrame[numblkscod]
+	f.Acmod = r.read(3)
+	f.LFE = r.flag()
+	f.Bsid = r.read(5)
+	programs := 1
+	if f.Acmod == 0 {
+		programs = 2
+	}
+	for i := 0; i < programs; i++ {
+		r.skip(5) // dialnorm
+		if r.flag() {
+			r.skip(8) // compr
+		}
+	}
+	if f.StreamType == StreamDependent && r.flag() {
+		f.ChanMap = r.read(16)
+		f.HasChanMap = true
+	}
+	if r.flag() { // mixmdate
+		if f.Acmod > 2 {
+			r.skip(2) // dmixmod
+			if f.Acmod&1 != 0 {
+				r.skip(6) // ltrtcmixlev, lorocmixlev
+			}
+			if f.Acmod&4 != 0 {
+				r.skip(6) // ltrtsurmixlev, lorosurmixlev
+			}
+		}
+		if f.LFE && r.flag() {
+			r.skip(5) // lfemixlevcod
+		}
+		if f.StreamType == StreamIndependent {
+			for i := 0; i < programs; i++ {
+				if r.flag() {
+					r.skip(6) // pgmscl
+				}
+			}
+			if r.flag() {
+				r.skip(6) // extpgmscl
+			}
+			switch r.read(2) { // mixdef
+			case 1:
+				r.skip(5)
+			case 2:
+				r.skip(12)
+			case 3:
+				r.skip((r.read(5) + 2) * 8)
+			}
+			if f.Acmod < 2 {
+				for i := 0; i < programs; i++ {
+					if r.flag() {
+						r.skip(14) // panmean, paninfo
+					}
+				}
+			}
+			if r.flag() { // frmmixcfginfoe
+				for blk := 0; blk < f.Blocks; blk++ {
+					if f.Blocks == 1 || r.flag() {
+						r.skip(5)
+					}
+				}
+			}
+		}
+	}
+	if r.flag() { // infomdate
+		f.Bsmod = r.read(3)
+		r.skip(2) // copyrightb, origbs
+		if f.Acmod == 2 {
+			r.skip(4) // dsurmod, dheadphonmod
+		}
+		if f.Acmod >= 6 {
+			r.skip(2) // dsurexmod
+		}
+		for i := 0; i < programs; i++ {
+			if r.flag() {
+				r.skip(8) // mixlevel, roomtyp, adconvtyp
+			}
+		}
+		if f.Fscod != 3 {
+			r.skip(1) // sourcefscod
+		}
+	}
+	if f.StreamType == StreamIndependent && f.Blocks != 6 {
+		r.skip(1) // convsync
+	}
+	if f.StreamType == StreamAC3Convert && (f.Blocks == 6 || r.flag()) {
+		r.skip(6) // frmsizecod
+	}
+	if r.flag() { // addbsie
+		r.skip(6) // addbsil
+		r.skip(7)
+		f.JOC = r.flag()
+		if f.JOC {
+			f.Complexity = r.read(8)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return f, nil
+}
+
+// Substream is one independent substream of a dec3 box, or the single
+// stream of a dac3 box.
+type Substream struct {
+	Fscod     int
+	Bsid      int
+	Bsmod     int
+	Acmod     int
+	LFE       bool
+	NumDepSub int
+	ChanLoc   int
+}
+
+// Config is the decoder configuration stored in a dac3 or dec3 box.
+type Config struct {
+	EAC3 bool
+	// DataRate is the bit rate in kbit/s.
+	DataRate int
+	// BitRateCode is set for AC-3 only.
+	BitRateCode int
+	Substreams  []Substream
+	JOC         bool
+	Complexity  int
+}
+
+// FromFrames builds the configuration of a stream from the frames of one
+// access unit: a single AC-3 frame, or the independent E-AC-3 substreams
+// each followed by its dependent substreams.
+func FromFrames(frames []*Frame) (*Config, error) {
+	if len(frames) == 0 {
+		return nil, errors.New("no frames")
+	}
+	first := frames[0]
+	if !first.EAC3 {
+		return &Config{
+			DataRate:    ac3Bitrates[first.BitRateCode],
+			BitRateCode: first.BitRateCode,
+			Substreams: []Substream{{
+				Fscod: first.Fscod, Bsid: first.Bsid, Bsmod: first.Bsmod, Acmod: first.Acmod, LFE: first.LFE,
+			}},
+		}, nil
+	}
+	c := &Config{EAC3: true}
+	bits := 0
+	for _, f := range frames {
+		if !f.EAC3 {
+			return nil, errors.New("mixed AC-3 and E-AC-3 frames")
+		}
+		bits += f.Size * 8 * f.SampleRate / (f.Blocks * 256)
+		if f.StreamType != StreamDependent {
+			c.Substreams = append(c.Substreams, Substream{
+				Fscod: f.Fscod, Bsid: f.Bsid, Bsmod: f.Bsmod, Acmod: f.Acmod, LFE: f.LFE,
+			})
+			if f.JOC && len(c.Substreams) == 1 {
+				c.JOC = true
+				c.Complexity = f.Complexity
+			}
+			continue
+		}
+		if len(c.Substreams) == 0 {
+			return nil, errors.New("dependent substream without an independent one")
+		}
+		s := &c.Substreams[len(c.Substreams)-1]
+		s.NumDepSub++
+		if f.HasChanMap {
+			s.ChanLoc |= chanLocFromMap(f.ChanMap)
+		}
+	}
+	c.DataRate = bits / 1000
+	return c, nil
+}
+
+// chanLocFromMap converts a dependent substream chanmap (Table E.1.4) to
+// chan_loc flags. Lts/Rts has no chan_loc equivalent and is dropped.
+func chanLocFromMap(chanmap int) int {
+	return (chanmap>>2)&0x1FE | (chanmap>>1)&1
+}
+
+// ParseDac3 reads the payload of a dac3 box.
+func ParseDac3(p []byte) (*Config, error) {
+	r := &bitReader{b: p}
+	s := Substream{Fscod: r.read(2), Bsid: r.read(5), Bsmod: r.read(3), Acmod: r.read(3), LFE: r.flag()}
+	code := r.read(5)
+	if r.err != nil {
+		return nil, r.err
+	}
+	if code >= len(ac3Bitrates) {
+		return nil, fmt.Errorf("invalid bit_rate_code %d", code)
+	}
+	return &Config{DataRate: ac3Bitrates[code], BitRateCode: code, Substreams: []Substream{s}}, nil
+}
+
+// ParseDec3 reads the payload of a dec3 box, including the Atmos
+// extension when present.
+func ParseDec3(p []byte) (*Config, error) {
+	r := &bitReader{b: p}
+	c := &Config{EAC3: true, DataRate: r.read(13)}
+	count := r.read(3) + 1
+	for i := 0; i < count; i++ {
+		var s Substream
+		s.Fscod = r.read(2)
+		s.Bsid = r.read(5)
+		r.skip(2) // reserved, asvc
+		s.Bsmod = r.read(3)
+		s.Acmod = r.read(3)
+		s.LFE = r.flag()
+		r.skip(3)
+		s.NumDepSub = r.read(4)
+		if s.NumDepSub > 0 {
+			s.ChanLoc = r.read(9)
+		} else {
+			r.skip(1)
+		}
+		c.Substreams = append(c.Substreams, s)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(p)*8-r.pos >= 16 {
+		r.skip(7)
+		c.JOC = r.flag()
+		c.Complexity = r.read(8)
+		if !c.JOC {
+			c.Complexity = 0
+		}
+	}
+	return c, nil
+}
+
+// Box returns the type and payload of the dac3 or dec3 box for c.
+func (c *Config) Box() (string, []byte) {
+	w := &bitWriter{}
+	if !c.EAC3 {
+		s := c.Substreams[0]
+		w.write(s.Fscod, 2)
+		w.write(s.Bsid, 5)
+		w.write(s.Bsmod, 3)
+		w.write(s.Acmod, 3)
+		w.writeFlag(s.LFE)
+		w.write(c.BitRateCode, 5)
+		w.write(0, 5)
+		return "dac3", w.bytes()
+	}
+	w.write(c.DataRate, 13)
+	w.write(len(c.Substreams)-1, 3)
+	for _, s := range c.Substreams {
+		w.write(s.Fscod, 2)
+		w.write(s.Bsid, 5)
+		w.write(0, 2)
+		w.write(s.Bsmod, 3)
+		w.write(s.Acmod, 3)
+		w.writeFlag(s.LFE)
+		w.write(0, 3)
+		w.write(s.NumDepSub, 4)
+		if s.NumDepSub > 0 {
+			w.write(s.ChanLoc, 9)
+		} else {
+			w.write(0, 1)
+		}
+	}
+	if c.JOC {
+		w.write(0, 7)
+		w.write(1, 1)
+		w.write(c.Complexity, 8)
+	}
+	return "dec3", w.bytes()
+}
+
+// Channels counts the speaker channels of the first substream, LFE
+// channels separately and height channels included in main.
+func (c *Config) Channels() (main, lfe, height int) {
+	if len(c.Substreams) == 0 {
+		return 0, 0, 0
+	}
+	s := c.Substreams[0]
+	main = acmodChannels[s.Acmod&7]
+	if s.LFE {
+		lfe = 1
+	}
+	for _, pair := range []int{LocLcRc, LocLrsRrs, LocLsdRsd, LocLwRw} {
+		if s.ChanLoc&pair != 0 {
+			main += 2
+		}
+	}
+	if s.ChanLoc&LocCs != 0 {
+		main++
+	}
+	if s.ChanLoc&LocLvhRvh != 0 {
+		height += 2
+	}
+	for _, single := range []int{LocTs, LocCvh} {
+		if s.ChanLoc&single != 0 {
+			height++
+		}
+	}
+	if s.ChanLoc&LocLFE2 != 0 {
+		lfe++
+	}
+	return main + height, lfe, height
+}
+
+// Layout describes the channel bed, e.g. "5.1" or "5.1.2".
+func (c *Config) Layout() string {
+	main, lfe, height := c.Channels()
+	if height > 0 {
+		return fmt.Sprintf("%d.%d.%d", main-height, lfe, height)
+	}
+	return fmt.Sprintf("%d.%d", main, lfe)
+}
+
+// ChannelConfiguration returns the ISO/IEC 23091-3 ChannelConfiguration of
+// the bed, or 0 when no predefined layout matches.
+func (c *Config) ChannelConfiguration() int {
+	if len(c.Substreams) == 0 {
+		return 0
+	}
+	s := c.Substreams[0]
+	if s.ChanLoc != 0 {
+		switch {
+		case s.Acmod == 7 && s.LFE && s.ChanLoc == LocLrsRrs:
+			return 12
+		case s.Acmod == 7 && s.LFE && s.ChanLoc == LocLvhRvh:
+			return 14
+		}
+		return 0
+	}
+	if s.LFE {
+		if s.Acmod == 7 {
+			return 6
+		}
+		return 0
+	}
+	switch s.Acmod {
+	case 1:
+		return 1
+	case 2:
+		return 2
+	case 3:
+		return 3
+	case 4:
+		return 9
+	case 5:
+		return 4
+	case 6:
+		return 10
+	case 7:
+		return 5
+	}
+	return 0
+}
+
+// ChnlBox returns the payload of an ISO/IEC 14496-12 channel layout box
+// for c, or nil when the layout has no predefined configuration. Atmos
+// streams also declare their objects, counted by the complexity index.
+func (c *Config) ChnlBox() []byte {
+	layout := c.ChannelConfiguration()
+	if layout == 0 {
+		return nil
+	}
+	structure := byte(1)
+	if c.JOC {
+		structure |= 2
+	}
+	out := []byte{0, 0, 0, 0, structure, byte(layout)}
+	out = append(out, make([]byte, 8)...) // omittedChannelsMap
+	if c.JOC {
+		out = append(out, byte(c.Complexity))
+	}
+	return out
+}
+
+type bitReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *bitReader) read(n int) int {
+	if r.pos+n > len(r.b)*8 {
+		r.err = errTruncated
+		r.pos = len(r.b) * 8
+		return 0
+	}
+	v := 0
+	for i := 0; i < n; i++ {
+		v = v<<1 | int(r.b[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.read(1) == 1
+}
+
+func (r *bitReader) skip(n int) {
+	if r.pos+n > len(r.b)*8 {
+		r.err = errTruncated
+		r.pos = len(r.b) * 8
+		return
+	}
+	r.pos += n
+}
+
+type bitWriter struct {
+	b   []byte
+	pos int
+}
+
+func (w *bitWriter) write(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		if v>>i&1 != 0 {
+			w.b[w.pos/8] |= 1 << (7 - w.pos%8)
+		}
+		w.pos++
+	}
+}
+
+func (w *bitWriter) writeFlag(v bool) {
+	if v {
+		w.write(1, 1)
+	} else {
+		w.write(0, 1)
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	return w.b
+}
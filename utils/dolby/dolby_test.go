@@ -0,0 +1,129 @@
+package dolby
+
+import (
+	"bytes"
+	"testing"
+)
+
+// eac3Frame builds a 48 kHz, six block E-AC-3 frame header padded to size
+// bytes. Dependent frames carry chanmap; independent ones signal JOC with
+// the given complexity when it is non-zero.
+func eac3Frame(size, strmtyp, acmod int, lfe bool, chanmap, complexity int) []byte {
+	w := &bitWriter{}
+	w.write(0x0B77, 16)
+	w.write(strmtyp, 2)
+	w.write(0, 3)
+	w.write(size/2-1, 11)
+	w.write(0, 2) // fscod
+	w.write(3, 2) // numblkscod
+	w.write(acmod, 3)
+	w.writeFlag(lfe)
+	w.write(16, 5)
+	w.write(31, 5) // dialnorm
+	w.write(0, 1)  // compre
+	if strmtyp == StreamDependent {
+		w.write(1, 1)
+		w.write(chanmap, 16)
+	}
+	w.write(0, 1) // mixmdate
+	w.write(1, 1) // infomdate
+	w.write(0, 3) // bsmod
+	w.write(0, 2)
+	if acmod >= 6 {
+		w.write(0, 2)
+	}
+	w.write(0, 1) // audprodie
+	w.write(0, 1) // sourcefscod
+	if complexity > 0 {
+		w.write(1, 1)
+		w.write(1, 6)
+		w.write(1, 8)
+		w.write(complexity, 8)
+	} else {
+		w.write(0, 1)
+	}
+	out := w.bytes()
+	return append(out, make([]byte, size-len(out))...)
+}
+
+func TestParseAtmosFrame(t *testing.T) {
+	f, err := ParseFrame(eac3Frame(1536, StreamIndependent, 7, true, 0, 16))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if !f.EAC3 || f.Size != 1536 || f.SampleRate != 48000 || f.Blocks != 6 || f.Acmod != 7 || !f.LFE || !f.JOC || f.Complexity != 16 {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+	c, err := FromFrames([]*Frame{f})
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	if c.DataRate != 384 || c.Layout() != "5.1" || c.ChannelConfiguration() != 6 {
+		t.Fatalf("unexpected config %+v (%s)", c, c.Layout())
+	}
+	typ, payload := c.Box()
+	want := []byte{0x0C, 0x00, 0x20, 0x0F, 0x00, 0x01, 0x10}
+	if typ != "dec3" || !bytes.Equal(payload, want) {
+		t.Fatalf("dec3 = %s %x", typ, payload)
+	}
+	back, err := ParseDec3(payload)
+	if err != nil || !back.JOC || back.Complexity != 16 || back.DataRate != 384 || back.Substreams[0] != c.Substreams[0] {
+		t.Fatalf("round trip %+v, %v", back, err)
+	}
+	if chnl := c.ChnlBox(); len(chnl) != 15 || chnl[4] != 3 || chnl[5] != 6 || chnl[14] != 16 {
+		t.Fatalf("chnl = %x", chnl)
+	}
+}
+
+func TestDependentSubstream(t *testing.T) {
+	// 7.1: the dependent substream adds the rear surround pair.
+	chanmap := 1 << (15 - 6)
+	var frames []*Frame
+	for _, data := range [][]byte{
+		eac3Frame(768, StreamIndependent, 7, true, 0, 0),
+		eac3Frame(512, StreamDependent, 2, false, chanmap, 0),
+	} {
+		f, err := ParseFrame(data)
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		frames = append(frames, f)
+	}
+	c, err := FromFrames(frames)
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	s := c.Substreams[0]
+	if len(c.Substreams) != 1 || s.NumDepSub != 1 || s.ChanLoc != LocLrsRrs {
+		t.Fatalf("unexpected substreams %+v", c.Substreams)
+	}
+	if c.Layout() != "7.1" || c.ChannelConfiguration() != 12 || c.JOC {
+		t.Fatalf("unexpected layout %s", c.Layout())
+	}
+	_, payload := c.Box()
+	back, err := ParseDec3(payload)
+	if err != nil || back.Substreams[0] != s || back.DataRate != c.DataRate {
+		t.Fatalf("round trip %+v, %v", back, err)
+	}
+}
+
+func TestAC3Frame(t *testing.T) {
+	// 48 kHz, 640 kbit/s (frmsizecod 36), bsid 8, 5.1.
+	header := []byte{0x0B, 0x77, 0, 0, 0x24, 0x40, 0xE1, 0x00}
+	f, err := ParseFrame(header)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if f.EAC3 || f.Size != 2560 || f.Acmod != 7 || f.BitRateCode != 18 {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+	c, _ := FromFrames([]*Frame{f})
+	typ, payload := c.Box()
+	if typ != "dac3" || len(payload) != 3 {
+		t.Fatalf("dac3 = %s %x", typ, payload)
+	}
+	back, err := ParseDac3(payload)
+	if err != nil || back.DataRate != 640 || back.Substreams[0] != c.Substreams[0] {
+		t.Fatalf("round trip %+v, %v", back, err)
+	}
+}
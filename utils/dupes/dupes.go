@@ -0,0 +1,209 @@
+// Package dupes finds copies of the same recording in a library, first by
+// ISRC and then by audio fingerprint, and replaces the extra copies with
+// hardlinks.
+package dupes
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DurationTolerance is how far apart the durations of two files compared
+// by fingerprint may be.
+const DurationTolerance = 2 * time.Second
+
+// File is a library file considered for duplicates. Files are only
+// grouped with files of the same Root and extension: a root can hold an
+// .m4a next to its .flac or .opus conversion, and those are not copies of
+// each other. Rank is the playlistdedupe.ReleaseRank of the file's release
+// and Release identifies it, e.g. by album artist and album name.
+type File struct {
+	Path        string
+	Root        string
+	ISRC        string
+	Rank        int
+	Release     string
+	Size        int64
+	Duration    time.Duration
+	Fingerprint Fingerprint
+}
+
+// Group is one recording found more than once. Files[0] is the copy to
+// keep.
+type Group struct {
+	ISRC          string
+	ByFingerprint bool
+	Files         []File
+}
+
+// Sort puts the copy to keep first: the highest release rank wins, then
+// the first path.
+func (g *Group) Sort() {
+	sort.SliceStable(g.Files, func(i, j int) bool {
+		if g.Files[i].Rank != g.Files[j].Rank {
+			return g.Files[i].Rank > g.Files[j].Rank
+		}
+		return g.Files[i].Path < g.Files[j].Path
+	})
+}
+
+// kind is what two files must share to be grouped: the save root and the
+// container.
+func (f File) kind() string {
+	return f.Root + "\x00" + strings.ToLower(filepath.Ext(f.Path))
+}
+
+// SameRelease reports whether a and b come from the same release, so a
+// hardlink between them keeps the tags of the replaced file.
+func SameRelease(a, b File) bool {
+	return strings.EqualFold(strings.TrimSpace(a.Release), strings.TrimSpace(b.Release))
+}
+
+// NeedsFingerprint reports which files have to be fingerprinted: files
+// without an ISRC, and files of the same root and container whose duration
+// is close to one of them.
+func NeedsFingerprint(files []File) []bool {
+	need := make([]bool, len(files))
+	for i, f := range files {
+		if f.ISRC != "" {
+			continue
+		}
+		need[i] = true
+		for j, other := range files {
+			if j != i && other.kind() == f.kind() && closeDuration(f, other) {
+				need[j] = true
+			}
+		}
+	}
+	return need
+}
+
+// Find groups the files by ISRC, then joins files without an ISRC to the
+// files whose fingerprint matches. Files that are the same file on disk,
+// such as earlier hardlinks, stay in their group.
+func Find(files []File) []Group {
+	parent := make([]int, len(files))
+	isrc := make([]string, len(files))
+	fingerprinted := make([]bool, len(files))
+	for i := range parent {
+		parent[i] = i
+		isrc[i] = strings.ToUpper(strings.TrimSpace(files[i].ISRC))
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	// union refuses to join two groups with different ISRCs.
+	union := func(a, b int) bool {
+		ra, rb := find(a), find(b)
+		if ra == rb {
+			return true
+		}
+		if isrc[ra] != "" && isrc[rb] != "" && isrc[ra] != isrc[rb] {
+			return false
+		}
+		if isrc[ra] == "" {
+			isrc[ra] = isrc[rb]
+		}
+		parent[rb] = ra
+		return true
+	}
+
+	byISRC := make(map[string]int)
+	for i, f := range files {
+		if isrc[i] == "" {
+			continue
+		}
+		key := f.kind() + "\x00" + isrc[i]
+		if first, ok := byISRC[key]; ok {
+			union(first, i)
+		} else {
+			byISRC[key] = i
+		}
+	}
+	hasISRC := make([]bool, len(files))
+	for i := range files {
+		hasISRC[i] = isrc[i] != ""
+	}
+	for i, f := range files {
+		if hasISRC[i] || len(f.Fingerprint) == 0 {
+			continue
+		}
+		for j, other := range files {
+			if j == i || other.kind() != f.kind() || len(other.Fingerprint) == 0 || !closeDuration(f, other) {
+				continue
+			}
+			// Pairs of files without an ISRC are compared once.
+			if (!hasISRC[j] && j < i) || find(i) == find(j) {
+				continue
+			}
+			if Same(f.Fingerprint, other.Fingerprint) && union(i, j) {
+				fingerprinted[find(i)] = true
+			}
+		}
+	}
+
+	members := make(map[int][]File)
+	var roots []int
+	for i := range files {
+		r := find(i)
+		if _, ok := members[r]; !ok {
+			roots = append(roots, r)
+		}
+		members[r] = append(members[r], files[i])
+	}
+	var groups []Group
+	for _, r := range roots {
+		if len(members[r]) < 2 {
+			continue
+		}
+		g := Group{ISRC: isrc[r], ByFingerprint: fingerprinted[r], Files: members[r]}
+		g.Sort()
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Files[0].Path < groups[j].Files[0].Path })
+	return groups
+}
+
+func closeDuration(a, b File) bool {
+	if a.Duration <= 0 || b.Duration <= 0 {
+		return true
+	}
+	diff := a.Duration - b.Duration
+	return diff <= DurationTolerance && diff >= -DurationTolerance
+}
+
+// Linked reports whether two paths are already the same file.
+func Linked(a, b string) bool {
+	ia, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	ib, err := os.Stat(b)
+	return err == nil && os.SameFile(ia, ib)
+}
+
+// Hardlink replaces dup with a hardlink to keep. The link is created next
+// to dup first, so dup is left alone when linking fails, e.g. across
+// filesystems.
+func Hardlink(keep, dup string) error {
+	if Linked(keep, dup) {
+		return nil
+	}
+	tmp := filepath.Join(filepath.Dir(dup), ".dupes-"+filepath.Base(dup))
+	_ = os.Remove(tmp)
+	if err := os.Link(keep, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dup); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
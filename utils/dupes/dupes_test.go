@@ -0,0 +1,100 @@
+package dupes
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// music returns a few seconds of changing tones mixed with noise.
+func music(seed int64, seconds int) []int16 {
+	r := rand.New(rand.NewSource(seed))
+	out := make([]int16, seconds*SampleRate)
+	freq := 440.0
+	for i := range out {
+		if i%(SampleRate/4) == 0 {
+			freq = 300 + r.Float64()*1700
+		}
+		v := 8000*math.Sin(2*math.Pi*freq*float64(i)/SampleRate) + 2000*r.NormFloat64()
+		out[i] = int16(v)
+	}
+	return out
+}
+
+func TestFingerprint(t *testing.T) {
+	song := music(1, 30)
+	// The same recording, quieter, with added noise and a little offset.
+	r := rand.New(rand.NewSource(9))
+	copied := make([]int16, 0, len(song))
+	for _, s := range song[SampleRate/3:] {
+		copied = append(copied, int16(float64(s)*0.7+300*r.NormFloat64()))
+	}
+	a, b, other := Compute(song), Compute(copied), Compute(music(2, 30))
+	if ber := BitErrorRate(a, b); ber > MaxBitErrorRate {
+		t.Fatalf("same recording has bit error rate %.2f", ber)
+	}
+	if ber := BitErrorRate(a, other); ber <= MaxBitErrorRate {
+		t.Fatalf("different recordings have bit error rate %.2f", ber)
+	}
+}
+
+func TestFind(t *testing.T) {
+	fp, other := Compute(music(1, 20)), Compute(music(2, 20))
+	minute := time.Minute
+	files := []File{
+		{Path: "alac/Artist/Song - Single/01. Song.m4a", Root: "alac", ISRC: "USAAA0000001", Rank: 1, Duration: 3 * minute},
+		{Path: "alac/Artist/Album/03. Song.m4a", Root: "alac", ISRC: "usaaa0000001", Rank: 3, Duration: 3 * minute},
+		{Path: "atmos/Artist/Album/03. Song.m4a", Root: "atmos", ISRC: "USAAA0000001", Rank: 3, Duration: 3 * minute},
+		{Path: "alac/Playlist/07. Song.m4a", Root: "alac", Duration: minute, Fingerprint: fp},
+		{Path: "alac/Artist/Album/01. Song Two.m4a", Root: "alac", ISRC: "USAAA0000002", Rank: 3, Duration: minute, Fingerprint: other},
+		{Path: "alac/Other/01. Song Two.m4a", Root: "alac", Duration: minute + time.Second, Fingerprint: other},
+		{Path: "alac/Other/02. Song.m4a", Root: "alac", Duration: minute + 10*time.Second, Fingerprint: fp},
+		// A conversion next to the original is not a duplicate of it.
+		{Path: "alac/Artist/Album/03. Song.flac", Root: "alac", ISRC: "USAAA0000001", Rank: 3, Duration: 3 * minute},
+	}
+	need := NeedsFingerprint(files)
+	if !need[3] || !need[4] || need[0] || need[2] || need[7] {
+		t.Fatalf("needs fingerprint = %v", need)
+	}
+	groups := Find(files)
+	if len(groups) != 2 {
+		t.Fatalf("groups = %+v", groups)
+	}
+	g := groups[0]
+	if g.ISRC != "USAAA0000002" || !g.ByFingerprint || len(g.Files) != 2 || g.Files[0].Path != files[4].Path {
+		t.Fatalf("fingerprint group = %+v", g)
+	}
+	g = groups[1]
+	if g.ByFingerprint || len(g.Files) != 2 || g.Files[0].Path != files[1].Path {
+		t.Fatalf("ISRC group = %+v", g)
+	}
+}
+
+func TestSameRelease(t *testing.T) {
+	album := File{Release: "Artist\x00Album"}
+	if !SameRelease(album, File{Release: "artist\x00album"}) {
+		t.Error("same release not matched")
+	}
+	if SameRelease(album, File{Release: "Artist\x00Song - Single"}) {
+		t.Error("single matched the album")
+	}
+}
+
+func TestHardlink(t *testing.T) {
+	dir := t.TempDir()
+	keep, dup := filepath.Join(dir, "keep.m4a"), filepath.Join(dir, "dup.m4a")
+	os.WriteFile(keep, []byte("keep"), 0644)
+	os.WriteFile(dup, []byte("dup"), 0644)
+	if err := Hardlink(keep, dup); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(dup); string(data) != "keep" || !Linked(keep, dup) {
+		t.Fatal("dup not linked to keep")
+	}
+	if err := Hardlink(keep, dup); err != nil {
+		t.Fatal(err)
+	}
+}
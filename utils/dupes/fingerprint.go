@@ -0,0 +1,162 @@
+package dupes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SampleRate is the rate audio is decoded at for fingerprinting.
+	SampleRate = 5512
+	// FingerprintSeconds is how much of each file is fingerprinted.
+	FingerprintSeconds = 120
+	// MaxBitErrorRate is the share of differing bits below which two
+	// fingerprints are taken to be the same recording.
+	MaxBitErrorRate = 0.25
+
+	frameSize = 2048
+	frameHop  = 256
+	bands     = 33
+	minFreq   = 300.0
+	maxFreq   = 2000.0
+	// maxShift is how many frames one fingerprint may be shifted against
+	// the other when comparing, about five seconds.
+	maxShift = 5 * SampleRate / frameHop
+	// minOverlap is the fewest frames two fingerprints must share.
+	minOverlap = 10 * SampleRate / frameHop
+)
+
+// Fingerprint holds one 32-bit sub-fingerprint per frame. Each bit is the
+// sign of the change of the energy difference of two neighbouring bands
+// from one frame to the next, which survives re-encoding and gain changes.
+type Fingerprint []uint32
+
+// Decode fingerprints the first FingerprintSeconds of path, decoded to
+// mono PCM with ffmpeg.
+func Decode(ffmpegPath, path string) (Fingerprint, error) {
+	cmd := exec.Command(ffmpegPath, "-hide_banner", "-nostdin", "-v", "error",
+		"-i", path, "-map", "0:a:0", "-t", strconv.Itoa(FingerprintSeconds),
+		"-ac", "1", "-ar", strconv.Itoa(SampleRate), "-f", "s16le", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(strings.TrimSpace(strings.Split(msg, "\n")[0]))
+		}
+		return nil, err
+	}
+	samples := make([]int16, len(out)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(out[2*i:]))
+	}
+	return Compute(samples), nil
+}
+
+// Compute fingerprints mono samples at SampleRate.
+func Compute(samples []int16) Fingerprint {
+	if len(samples) < frameSize {
+		return nil
+	}
+	window := make([]float64, frameSize)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(frameSize-1))
+	}
+	// Band edges as FFT bin indexes, spaced logarithmically.
+	var edges [bands + 1]int
+	for b := range edges {
+		freq := minFreq * math.Pow(maxFreq/minFreq, float64(b)/bands)
+		edges[b] = int(freq * frameSize / SampleRate)
+	}
+
+	buf := make([]complex128, frameSize)
+	var prev [bands]float64
+	var fp Fingerprint
+	for start := 0; start+frameSize <= len(samples); start += frameHop {
+		for i := range buf {
+			buf[i] = complex(float64(samples[start+i])*window[i], 0)
+		}
+		fft(buf)
+		var energy [bands]float64
+		for b := 0; b < bands; b++ {
+			for k := edges[b]; k < edges[b+1]; k++ {
+				m := cmplx.Abs(buf[k])
+				energy[b] += m * m
+			}
+		}
+		if start > 0 {
+			var sub uint32
+			for b := 0; b < bands-1; b++ {
+				if (energy[b]-energy[b+1])-(prev[b]-prev[b+1]) > 0 {
+					sub |= 1 << b
+				}
+			}
+			fp = append(fp, sub)
+		}
+		prev = energy
+	}
+	return fp
+}
+
+// BitErrorRate compares two fingerprints at the best alignment within a
+// few seconds and returns the share of differing bits, or 1 when they
+// overlap too little to be compared.
+func BitErrorRate(a, b Fingerprint) float64 {
+	best := 1.0
+	for shift := -maxShift; shift <= maxShift; shift++ {
+		i, j := 0, shift
+		if shift < 0 {
+			i, j = -shift, 0
+		}
+		n := min(len(a)-i, len(b)-j)
+		if n < minOverlap {
+			continue
+		}
+		diff := 0
+		for k := 0; k < n; k++ {
+			diff += bits.OnesCount32(a[i+k] ^ b[j+k])
+		}
+		if rate := float64(diff) / float64(32*n); rate < best {
+			best = rate
+		}
+	}
+	return best
+}
+
+// Same reports whether two fingerprints are of the same recording.
+func Same(a, b Fingerprint) bool {
+	return BitErrorRate(a, b) <= MaxBitErrorRate
+}
+
+// fft transforms x in place. len(x) must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j |= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u, v := x[start+k], w*x[start+k+size/2]
+				x[start+k], x[start+k+size/2] = u+v, u-v
+				w *= step
+			}
+		}
+	}
+}
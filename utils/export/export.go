@@ -0,0 +1,213 @@
+package export
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const ManifestName = ".export-manifest.json"
+
+// Item is one source file and the path it should have below the target.
+type Item struct {
+	Source  string
+	Size    int64
+	ModTime int64
+	Target  string
+}
+
+// Record remembers how a target file was produced so unchanged sources can
+// be skipped on the next run.
+type Record struct {
+	Source        string `json:"source"`
+	SourceSize    int64  `json:"source_size"`
+	SourceModTime int64  `json:"source_mtime"`
+	Settings      string `json:"settings"`
+	Size          int64  `json:"size"`
+}
+
+type Options struct {
+	Dest string
+	// Budget caps the total size of exported files; 0 means unlimited.
+	Budget int64
+	// Settings identifies the transcode settings; changing it re-exports
+	// every file.
+	Settings  string
+	Transcode func(src, dst string) error
+	Progress  func(action, target string)
+}
+
+type Result struct {
+	Exported   int
+	UpToDate   int
+	Removed    int
+	OverBudget int
+	Failed     int
+	Bytes      int64
+}
+
+// Sync exports items in order until the budget is used up. Files exported
+// by an earlier run that are no longer selected, or no longer fit, are
+// deleted. Files the manifest does not know about are never touched.
+func Sync(items []Item, opts Options) (Result, error) {
+	var res Result
+	if opts.Dest == "" {
+		return res, errors.New("export destination is required")
+	}
+	if err := os.MkdirAll(opts.Dest, os.ModePerm); err != nil {
+		return res, err
+	}
+	manifest := loadManifest(opts.Dest)
+	kept := map[string]Record{}
+	progress := opts.Progress
+	if progress == nil {
+		progress = func(string, string) {}
+	}
+
+	fits := func(size int64) bool {
+		return opts.Budget <= 0 || res.Bytes+size <= opts.Budget
+	}
+	for _, item := range items {
+		if _, dup := kept[item.Target]; dup {
+			continue
+		}
+		dst := filepath.Join(opts.Dest, filepath.FromSlash(item.Target))
+		if rec, ok := manifest[item.Target]; ok && upToDate(rec, item, opts.Settings, dst) {
+			if !fits(rec.Size) {
+				res.OverBudget++
+				continue
+			}
+			kept[item.Target] = rec
+			res.Bytes += rec.Size
+			res.UpToDate++
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return res, err
+		}
+		tmp := dst + ".part" + filepath.Ext(dst)
+		if err := opts.Transcode(item.Source, tmp); err != nil {
+			os.Remove(tmp)
+			progress("failed", item.Target)
+			res.Failed++
+			if rec, ok := manifest[item.Target]; ok {
+				// Keep the previous export rather than deleting it.
+				kept[item.Target] = rec
+			}
+			continue
+		}
+		info, err := os.Stat(tmp)
+		if err != nil {
+			return res, err
+		}
+		if !fits(info.Size()) {
+			os.Remove(tmp)
+			res.OverBudget++
+			continue
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			os.Remove(tmp)
+			return res, err
+		}
+		kept[item.Target] = Record{
+			Source:        item.Source,
+			SourceSize:    item.Size,
+			SourceModTime: item.ModTime,
+			Settings:      opts.Settings,
+			Size:          info.Size(),
+		}
+		res.Bytes += info.Size()
+		res.Exported++
+		progress("exported", item.Target)
+	}
+
+	stale := make([]string, 0)
+	for target := range manifest {
+		if _, ok := kept[target]; !ok {
+			stale = append(stale, target)
+		}
+	}
+	sort.Strings(stale)
+	for _, target := range stale {
+		dst := filepath.Join(opts.Dest, filepath.FromSlash(target))
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			kept[target] = manifest[target]
+			continue
+		}
+		pruneEmptyDirs(filepath.Dir(dst), opts.Dest)
+		res.Removed++
+		progress("removed", target)
+	}
+	return res, saveManifest(opts.Dest, kept)
+}
+
+func upToDate(rec Record, item Item, settings, dst string) bool {
+	if rec.Source != item.Source || rec.SourceSize != item.Size || rec.SourceModTime != item.ModTime || rec.Settings != settings {
+		return false
+	}
+	info, err := os.Stat(dst)
+	return err == nil && info.Size() == rec.Size
+}
+
+func loadManifest(dest string) map[string]Record {
+	manifest := map[string]Record{}
+	data, err := os.ReadFile(filepath.Join(dest, ManifestName))
+	if err == nil {
+		_ = json.Unmarshal(data, &manifest)
+	}
+	return manifest
+}
+
+func saveManifest(dest string, manifest map[string]Record) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dest, ManifestName), data, 0644)
+}
+
+func pruneEmptyDirs(dir, stop string) {
+	stop = filepath.Clean(stop)
+	for dir = filepath.Clean(dir); dir != stop && strings.HasPrefix(dir, stop); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// ParseSize parses sizes such as "32G", "500MB" or "1048576". Units are
+// binary multiples.
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(v * float64(mult)), nil
+}
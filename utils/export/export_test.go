@@ -0,0 +1,73 @@
+package export
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func copyTranscode(calls *int) func(src, dst string) error {
+	return func(src, dst string) error {
+		*calls++
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(dst, data, 0644)
+	}
+}
+
+func TestSyncBudgetAndRemoval(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dest := filepath.Join(dir, "dest")
+	os.MkdirAll(src, os.ModePerm)
+	var items []Item
+	for _, name := range []string{"a", "b", "c"} {
+		path := filepath.Join(src, name)
+		os.WriteFile(path, make([]byte, 100), 0644)
+		info, _ := os.Stat(path)
+		items = append(items, Item{Source: path, Size: info.Size(), ModTime: info.ModTime().UnixNano(), Target: "x/" + name + ".mp3"})
+	}
+
+	calls := 0
+	opts := Options{Dest: dest, Budget: 250, Settings: "mp3", Transcode: copyTranscode(&calls)}
+	res, err := Sync(items, opts)
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if res.Exported != 2 || res.OverBudget != 1 || res.Bytes != 200 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	// Second run with b deselected: a is reused, b is removed and c fits.
+	res, err = Sync([]Item{items[0], items[2]}, opts)
+	if err != nil {
+		t.Fatalf("resync: %v", err)
+	}
+	if res.UpToDate != 1 || res.Exported != 1 || res.Removed != 1 || calls != 4 {
+		t.Fatalf("unexpected result %+v after %d transcodes", res, calls)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "x", "b.mp3")); !os.IsNotExist(err) {
+		t.Fatalf("expected b.mp3 to be removed")
+	}
+
+	// Changing settings re-exports everything.
+	opts.Settings = "opus"
+	if res, _ = Sync([]Item{items[0]}, opts); res.Exported != 1 || res.Removed != 1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{"": 0, "1024": 1024, "4K": 4096, "1.5M": 1572864, "32GB": 32 << 30, "2GiB": 2 << 30}
+	for input, want := range cases {
+		got, err := ParseSize(input)
+		if err != nil || got != want {
+			t.Errorf("%q: got %d, %v", input, got, err)
+		}
+	}
+	if _, err := ParseSize("lots"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,303 @@
+package flacmeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	BlockStreamInfo    byte = 0
+	BlockPadding       byte = 1
+	BlockApplication   byte = 2
+	BlockSeekTable     byte = 3
+	BlockVorbisComment byte = 4
+	BlockCueSheet      byte = 5
+	BlockPicture       byte = 6
+)
+
+// DefaultPadding is reserved after the metadata when a file has to be
+// rewritten, so later tag edits can usually be done in place.
+const DefaultPadding = 8192
+
+// MaxPadding caps the padding kept by an in-place write. Larger gaps are
+// reclaimed by rewriting the file.
+const MaxPadding = 1 << 20
+
+const maxBlockSize = 1<<24 - 1
+
+var ErrNotFLAC = errors.New("not a FLAC file")
+
+// Vendor names the tool in a VORBIS_COMMENT block added to a file that had
+// none. Existing blocks keep their own vendor string.
+const Vendor = "apple-music-downloader"
+
+// Block is a metadata block kept verbatim, such as STREAMINFO, SEEKTABLE,
+// APPLICATION or CUESHEET.
+type Block struct {
+	Type byte
+	Data []byte
+}
+
+// File holds the metadata of a FLAC file. Comment and Pictures are decoded,
+// every other block except padding is preserved as is.
+type File struct {
+	Path     string
+	Blocks   []Block
+	Comment  *VorbisComment
+	Pictures []*Picture
+
+	prefix    []byte
+	metaSize  int64
+	audioFrom int64
+}
+
+func Open(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parse(path, f)
+}
+
+func parse(path string, r io.ReadSeeker) (*File, error) {
+	file := &File{Path: path}
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, ErrNotFLAC
+	}
+	if string(magic[:3]) == "ID3" {
+		// Some tools prepend an ID3v2 tag; keep it untouched.
+		var hdr [6]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, ErrNotFLAC
+		}
+		size := int64(hdr[2]&0x7f)<<21 | int64(hdr[3]&0x7f)<<14 | int64(hdr[4]&0x7f)<<7 | int64(hdr[5]&0x7f)
+		if hdr[1]&0x10 != 0 {
+			size += 10
+		}
+		file.prefix = make([]byte, 10+size)
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, file.prefix); err != nil {
+			return nil, ErrNotFLAC
+		}
+		if _, err := io.ReadFull(r, magic[:]); err != nil {
+			return nil, ErrNotFLAC
+		}
+	}
+	if string(magic[:]) != "fLaC" {
+		return nil, ErrNotFLAC
+	}
+
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, fmt.Errorf("read block header: %w", err)
+		}
+		last := hdr[0]&0x80 != 0
+		typ := hdr[0] & 0x7f
+		size := int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3])
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("read block %d: %w", typ, err)
+		}
+		file.metaSize += int64(4 + size)
+		switch typ {
+		case BlockPadding:
+		case BlockVorbisComment:
+			vc, err := ParseVorbisComment(data)
+			if err != nil {
+				return nil, err
+			}
+			if file.Comment == nil {
+				file.Comment = vc
+			}
+		case BlockPicture:
+			pic, err := parsePicture(data)
+			if err != nil {
+				return nil, err
+			}
+			file.Pictures = append(file.Pictures, pic)
+		default:
+			file.Blocks = append(file.Blocks, Block{Type: typ, Data: data})
+		}
+		if last {
+			break
+		}
+	}
+	if len(file.Blocks) == 0 || file.Blocks[0].Type != BlockStreamInfo {
+		return nil, errors.New("missing STREAMINFO block")
+	}
+	file.audioFrom = int64(len(file.prefix)) + 4 + file.metaSize
+	if file.Comment == nil {
+		file.Comment = &VorbisComment{Vendor: Vendor}
+	}
+	return file, nil
+}
+
+// Block returns the first preserved block of the given type.
+func (f *File) Block(typ byte) *Block {
+	for i := range f.Blocks {
+		if f.Blocks[i].Type == typ {
+			return &f.Blocks[i]
+		}
+	}
+	return nil
+}
+
+// StreamInfo is the decoded STREAMINFO block.
+type StreamInfo struct {
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+	TotalSamples  uint64
+}
+
+// StreamInfo decodes the STREAMINFO block.
+func (f *File) StreamInfo() (StreamInfo, error) {
+	b := f.Block(BlockStreamInfo)
+	if b == nil || len(b.Data) < 18 {
+		return StreamInfo{}, errors.New("missing STREAMINFO block")
+	}
+	v := binary.BigEndian.Uint64(b.Data[10:18])
+	return StreamInfo{
+		SampleRate:    int(v >> 44),
+		Channels:      int(v>>41&0x7) + 1,
+		BitsPerSample: int(v>>36&0x1f) + 1,
+		TotalSamples:  v & (1<<36 - 1),
+	}, nil
+}
+
+// SetBlock replaces the first block of typ, appends it when missing, or
+// removes it when data is nil.
+func (f *File) SetBlock(typ byte, data []byte) {
+	for i := range f.Blocks {
+		if f.Blocks[i].Type != typ {
+			continue
+		}
+		if data == nil {
+			f.Blocks = append(f.Blocks[:i], f.Blocks[i+1:]...)
+		} else {
+			f.Blocks[i].Data = data
+		}
+		return
+	}
+	if data != nil {
+		f.Blocks = append(f.Blocks, Block{Type: typ, Data: data})
+	}
+}
+
+// Save writes the metadata back. It overwrites the existing metadata region
+// when the new blocks fit, adjusting the padding, and rewrites the whole
+// file with DefaultPadding otherwise.
+func (f *File) Save() error {
+	blocks, err := f.encodeBlocks()
+	if err != nil {
+		return err
+	}
+	needed := int64(0)
+	for _, b := range blocks {
+		needed += int64(4 + len(b.Data))
+	}
+
+	if needed == f.metaSize {
+		return f.writeInPlace(blocks)
+	}
+	if spare := f.metaSize - needed - 4; spare >= 0 && spare <= MaxPadding {
+		return f.writeInPlace(append(blocks, Block{Type: BlockPadding, Data: make([]byte, spare)}))
+	}
+	return f.rewrite(append(blocks, Block{Type: BlockPadding, Data: make([]byte, DefaultPadding)}))
+}
+
+func (f *File) encodeBlocks() ([]Block, error) {
+	var blocks []Block
+	blocks = append(blocks, f.Blocks...)
+	blocks = append(blocks, Block{Type: BlockVorbisComment, Data: f.Comment.Encode()})
+	for _, pic := range f.Pictures {
+		blocks = append(blocks, Block{Type: BlockPicture, Data: pic.Encode()})
+	}
+	for _, b := range blocks {
+		if len(b.Data) > maxBlockSize {
+			return nil, fmt.Errorf("metadata block %d too large", b.Type)
+		}
+	}
+	return blocks, nil
+}
+
+func encodeMetadata(prefix []byte, blocks []Block) []byte {
+	var buf bytes.Buffer
+	buf.Write(prefix)
+	buf.WriteString("fLaC")
+	for i, b := range blocks {
+		typ := b.Type
+		if i == len(blocks)-1 {
+			typ |= 0x80
+		}
+		size := len(b.Data)
+		buf.Write([]byte{typ, byte(size >> 16), byte(size >> 8), byte(size)})
+		buf.Write(b.Data)
+	}
+	return buf.Bytes()
+}
+
+func (f *File) writeInPlace(blocks []Block) error {
+	out, err := os.OpenFile(f.Path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := out.WriteAt(encodeMetadata(f.prefix, blocks), 0); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (f *File) rewrite(blocks []Block) error {
+	src, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), ".flacmeta-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	meta := encodeMetadata(f.prefix, blocks)
+	_, err = tmp.Write(meta)
+	if err == nil {
+		_, err = io.Copy(tmp, io.NewSectionReader(src, f.audioFrom, info.Size()-f.audioFrom))
+	}
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	src.Close()
+	if err := os.Rename(tmpName, f.Path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	f.metaSize = int64(len(meta)) - int64(len(f.prefix)) - 4
+	f.audioFrom = int64(len(meta))
+	return nil
+}
+
+func le32(b []byte) uint32 { return binary.LittleEndian.Uint32(b) }
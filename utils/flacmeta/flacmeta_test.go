@@ -0,0 +1,161 @@
+package flacmeta
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var audio = []byte("\xff\xf8audio-frames")
+
+func writeSample(t *testing.T, padding int) string {
+	t.Helper()
+	vc := &VorbisComment{Vendor: "test", Fields: []Field{
+		{"TITLE", "Song"},
+		{"TRACKNUMBER", "3/12"},
+		{"encoder", "Lavf60"},
+	}}
+	blocks := []Block{
+		{Type: BlockStreamInfo, Data: make([]byte, 34)},
+		{Type: BlockVorbisComment, Data: vc.Encode()},
+		{Type: BlockPadding, Data: make([]byte, padding)},
+	}
+	data := append(encodeMetadata(nil, blocks), audio...)
+	path := filepath.Join(t.TempDir(), "track.flac")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return path
+}
+
+func assertAudio(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.HasSuffix(data, audio) {
+		t.Fatalf("audio frames changed")
+	}
+}
+
+func TestSaveInPlaceUsesPadding(t *testing.T) {
+	path := writeSample(t, 256)
+	before, _ := os.Stat(path)
+	f, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	f.Comment.Set("TRACKNUMBER", "3")
+	f.Comment.Set("TRACKTOTAL", "12")
+	f.Comment.Set("ARTIST", "A", "B")
+	f.Comment.Remove("ENCODER")
+	if err := f.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if before.Size() != after.Size() {
+		t.Fatalf("expected in-place write, size %d -> %d", before.Size(), after.Size())
+	}
+	assertAudio(t, path)
+
+	f, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if got := f.Comment.Get("artist"); len(got) != 2 || got[0] != "A" || got[1] != "B" {
+		t.Fatalf("unexpected artists %q", got)
+	}
+	if f.Comment.First("TRACKNUMBER") != "3" || f.Comment.First("TRACKTOTAL") != "12" {
+		t.Fatalf("unexpected track fields %+v", f.Comment.Fields)
+	}
+	if f.Comment.First("ENCODER") != "" {
+		t.Fatalf("encoder tag not removed")
+	}
+}
+
+func TestSaveRewritesWhenPictureDoesNotFit(t *testing.T) {
+	path := writeSample(t, 16)
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewNRGBA(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	f, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	pic, err := NewPicture(img.Bytes(), PictureFrontCover)
+	if err != nil {
+		t.Fatalf("picture: %v", err)
+	}
+	f.SetCover(pic)
+	f.SetCover(pic)
+	if err := f.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	assertAudio(t, path)
+
+	f, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if len(f.Pictures) != 1 {
+		t.Fatalf("expected one picture, got %d", len(f.Pictures))
+	}
+	got := f.Pictures[0]
+	if got.MIME != "image/png" || got.Width != 40 || got.Height != 30 || got.Depth != 32 {
+		t.Fatalf("unexpected picture header %+v", got)
+	}
+	if f.metaSize < DefaultPadding {
+		t.Fatalf("expected default padding after rewrite, metadata is %d bytes", f.metaSize)
+	}
+}
+
+func TestVendor(t *testing.T) {
+	path := writeSample(t, 256)
+	f, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	f.Comment.Set("TITLE", "Other")
+	if err := f.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if f, err = Open(path); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if f.Comment.Vendor != "test" {
+		t.Fatalf("source vendor replaced with %q", f.Comment.Vendor)
+	}
+
+	data := append(encodeMetadata(nil, []Block{{Type: BlockStreamInfo, Data: make([]byte, 34)}}), audio...)
+	bare := filepath.Join(t.TempDir(), "bare.flac")
+	if err := os.WriteFile(bare, data, 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if f, err = Open(bare); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if f.Comment.Vendor != Vendor {
+		t.Fatalf("unexpected vendor %q", f.Comment.Vendor)
+	}
+}
+
+func TestStreamInfo(t *testing.T) {
+	f := &File{Blocks: []Block{{Type: BlockStreamInfo, Data: make([]byte, 34)}}}
+	// 96 kHz, 2 channels, 24 bits, 1000000 samples.
+	v := uint64(96000)<<44 | uint64(1)<<41 | uint64(23)<<36 | 1000000
+	for i := 0; i < 8; i++ {
+		f.Blocks[0].Data[10+i] = byte(v >> (56 - 8*i))
+	}
+	info, err := f.StreamInfo()
+	if err != nil {
+		t.Fatalf("stream info: %v", err)
+	}
+	if info != (StreamInfo{SampleRate: 96000, Channels: 2, BitsPerSample: 24, TotalSamples: 1000000}) {
+		t.Fatalf("unexpected stream info %+v", info)
+	}
+}
@@ -0,0 +1,141 @@
+package flacmeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// PictureFrontCover is the ID3v2 APIC picture type used for album covers.
+const PictureFrontCover uint32 = 3
+
+type Picture struct {
+	Type        uint32
+	MIME        string
+	Description string
+	Width       uint32
+	Height      uint32
+	Depth       uint32
+	Colors      uint32
+	Data        []byte
+}
+
+// NewPicture builds a PICTURE block for an encoded image, filling in the
+// MIME type, dimensions and colour depth from the image header.
+func NewPicture(data []byte, typ uint32) (*Picture, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	pic := &Picture{
+		Type:   typ,
+		MIME:   "image/" + format,
+		Width:  uint32(cfg.Width),
+		Height: uint32(cfg.Height),
+		Data:   data,
+	}
+	switch m := cfg.ColorModel.(type) {
+	case color.Palette:
+		pic.Depth = 8
+		pic.Colors = uint32(len(m))
+	default:
+		pic.Depth = colorDepth(m)
+	}
+	return pic, nil
+}
+
+func colorDepth(m color.Model) uint32 {
+	switch m {
+	case color.GrayModel:
+		return 8
+	case color.Gray16Model:
+		return 16
+	case color.RGBAModel, color.NRGBAModel:
+		return 32
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 64
+	case color.CMYKModel:
+		return 32
+	}
+	return 24
+}
+
+func parsePicture(data []byte) (*Picture, error) {
+	errInvalid := errors.New("invalid PICTURE block")
+	pos := 0
+	read32 := func() (uint32, bool) {
+		if len(data)-pos < 4 {
+			return 0, false
+		}
+		v := binary.BigEndian.Uint32(data[pos:])
+		pos += 4
+		return v, true
+	}
+	readBytes := func() ([]byte, bool) {
+		n, ok := read32()
+		if !ok || uint32(len(data)-pos) < n {
+			return nil, false
+		}
+		b := data[pos : pos+int(n)]
+		pos += int(n)
+		return b, true
+	}
+	pic := &Picture{}
+	var ok bool
+	if pic.Type, ok = read32(); !ok {
+		return nil, errInvalid
+	}
+	mime, ok := readBytes()
+	if !ok {
+		return nil, errInvalid
+	}
+	desc, ok := readBytes()
+	if !ok {
+		return nil, errInvalid
+	}
+	pic.MIME, pic.Description = string(mime), string(desc)
+	for _, dst := range []*uint32{&pic.Width, &pic.Height, &pic.Depth, &pic.Colors} {
+		if *dst, ok = read32(); !ok {
+			return nil, errInvalid
+		}
+	}
+	body, ok := readBytes()
+	if !ok {
+		return nil, errInvalid
+	}
+	pic.Data = append([]byte{}, body...)
+	return pic, nil
+}
+
+// Encode renders the PICTURE block body, which Ogg streams also carry
+// base64-encoded in METADATA_BLOCK_PICTURE.
+func (p *Picture) Encode() []byte {
+	out := make([]byte, 0, 32+len(p.MIME)+len(p.Description)+len(p.Data))
+	out = binary.BigEndian.AppendUint32(out, p.Type)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(p.MIME)))
+	out = append(out, p.MIME...)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(p.Description)))
+	out = append(out, p.Description...)
+	out = binary.BigEndian.AppendUint32(out, p.Width)
+	out = binary.BigEndian.AppendUint32(out, p.Height)
+	out = binary.BigEndian.AppendUint32(out, p.Depth)
+	out = binary.BigEndian.AppendUint32(out, p.Colors)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(p.Data)))
+	return append(out, p.Data...)
+}
+
+// SetCover replaces any existing front cover with pic.
+func (f *File) SetCover(pic *Picture) {
+	kept := f.Pictures[:0]
+	for _, p := range f.Pictures {
+		if p.Type != pic.Type {
+			kept = append(kept, p)
+		}
+	}
+	f.Pictures = append(kept, pic)
+}
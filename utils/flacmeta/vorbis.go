@@ -0,0 +1,139 @@
+package flacmeta
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Field is one NAME=value entry. Names are matched case-insensitively and
+// may repeat for multi-value tags such as ARTIST.
+type Field struct {
+	Name  string
+	Value string
+}
+
+type VorbisComment struct {
+	Vendor string
+	Fields []Field
+}
+
+// ParseVorbisComment decodes a comment block without the framing used by
+// FLAC or Ogg around it.
+func ParseVorbisComment(data []byte) (*VorbisComment, error) {
+	errInvalid := errors.New("invalid VORBIS_COMMENT block")
+	if len(data) < 8 {
+		return nil, errInvalid
+	}
+	pos := 0
+	readString := func() (string, bool) {
+		if len(data)-pos < 4 {
+			return "", false
+		}
+		n := int(le32(data[pos:]))
+		pos += 4
+		if n < 0 || len(data)-pos < n {
+			return "", false
+		}
+		s := string(data[pos : pos+n])
+		pos += n
+		return s, true
+	}
+	vendor, ok := readString()
+	if !ok || len(data)-pos < 4 {
+		return nil, errInvalid
+	}
+	count := int(le32(data[pos:]))
+	pos += 4
+	vc := &VorbisComment{Vendor: vendor}
+	for i := 0; i < count; i++ {
+		entry, ok := readString()
+		if !ok {
+			return nil, errInvalid
+		}
+		name, value, found := strings.Cut(entry, "=")
+		if !found {
+			continue
+		}
+		vc.Fields = append(vc.Fields, Field{Name: name, Value: value})
+	}
+	return vc, nil
+}
+
+// Encode renders the comment in the layout shared by FLAC and Ogg streams.
+func (vc *VorbisComment) Encode() []byte {
+	size := 8 + len(vc.Vendor)
+	for _, f := range vc.Fields {
+		size += 4 + len(f.Name) + 1 + len(f.Value)
+	}
+	out := make([]byte, 0, size)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(vc.Vendor)))
+	out = append(out, vc.Vendor...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(vc.Fields)))
+	for _, f := range vc.Fields {
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(f.Name)+1+len(f.Value)))
+		out = append(out, f.Name...)
+		out = append(out, '=')
+		out = append(out, f.Value...)
+	}
+	return out
+}
+
+// Get returns every value stored under name.
+func (vc *VorbisComment) Get(name string) []string {
+	var out []string
+	for _, f := range vc.Fields {
+		if strings.EqualFold(f.Name, name) {
+			out = append(out, f.Value)
+		}
+	}
+	return out
+}
+
+// First returns the first value stored under name, or "".
+func (vc *VorbisComment) First(name string) string {
+	for _, f := range vc.Fields {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Set replaces all values of name. Empty values are skipped, so Set with no
+// non-empty value removes the tag.
+func (vc *VorbisComment) Set(name string, values ...string) {
+	vc.Remove(name)
+	for _, v := range values {
+		if v != "" {
+			vc.Add(name, v)
+		}
+	}
+}
+
+func (vc *VorbisComment) Add(name, value string) {
+	vc.Fields = append(vc.Fields, Field{Name: strings.ToUpper(name), Value: value})
+}
+
+// Remove deletes every value of the given names and reports whether
+// anything was removed.
+func (vc *VorbisComment) Remove(names ...string) bool {
+	removed := false
+	kept := vc.Fields[:0]
+	for _, f := range vc.Fields {
+		drop := false
+		for _, name := range names {
+			if strings.EqualFold(f.Name, name) {
+				drop = true
+				break
+			}
+		}
+		if drop {
+			removed = true
+			continue
+		}
+		kept = append(kept, f)
+	}
+	vc.Fields = kept
+	return removed
+}
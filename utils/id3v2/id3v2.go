@@ -0,0 +1,219 @@
+package id3v2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultPadding is appended after the frames so players that rewrite tags
+// in place have room to do so.
+const DefaultPadding = 2048
+
+const encodingUTF8 = 3
+
+// Picture types from the APIC specification.
+const (
+	PictureOther      byte = 0
+	PictureFrontCover byte = 3
+)
+
+// Frame is a single ID3v2.4 frame with an already encoded body.
+type Frame struct {
+	ID   string
+	Body []byte
+}
+
+// Tag is an ordered list of ID3v2.4 frames.
+type Tag struct {
+	Frames []Frame
+}
+
+// SyncedLine is one timestamped lyric line for SYLT.
+type SyncedLine struct {
+	Millis uint32
+	Text   string
+}
+
+// AddText adds a text information frame such as TIT2. Multiple values are
+// stored NUL-separated as allowed by v2.4.
+func (t *Tag) AddText(id string, values ...string) {
+	var kept []string
+	for _, v := range values {
+		if v != "" {
+			kept = append(kept, v)
+		}
+	}
+	if len(kept) == 0 {
+		return
+	}
+	body := []byte{encodingUTF8}
+	body = append(body, strings.Join(kept, "\x00")...)
+	t.Frames = append(t.Frames, Frame{ID: id, Body: body})
+}
+
+// AddUserText adds a TXXX frame.
+func (t *Tag) AddUserText(description, value string) {
+	if value == "" {
+		return
+	}
+	body := []byte{encodingUTF8}
+	body = append(body, description...)
+	body = append(body, 0)
+	body = append(body, value...)
+	t.Frames = append(t.Frames, Frame{ID: "TXXX", Body: body})
+}
+
+// AddLyrics adds an unsynchronised USLT frame.
+func (t *Tag) AddLyrics(lang, text string) {
+	if text == "" {
+		return
+	}
+	body := []byte{encodingUTF8}
+	body = append(body, language(lang)...)
+	body = append(body, 0)
+	body = append(body, text...)
+	t.Frames = append(t.Frames, Frame{ID: "USLT", Body: body})
+}
+
+// AddSyncedLyrics adds a SYLT frame with millisecond timestamps.
+func (t *Tag) AddSyncedLyrics(lang string, lines []SyncedLine) {
+	if len(lines) == 0 {
+		return
+	}
+	body := []byte{encodingUTF8}
+	body = append(body, language(lang)...)
+	// Absolute milliseconds, content type 1 (lyrics), empty descriptor.
+	body = append(body, 2, 1, 0)
+	for _, line := range lines {
+		body = append(body, line.Text...)
+		body = append(body, 0)
+		body = binary.BigEndian.AppendUint32(body, line.Millis)
+	}
+	t.Frames = append(t.Frames, Frame{ID: "SYLT", Body: body})
+}
+
+// AddPicture adds an APIC frame.
+func (t *Tag) AddPicture(mime string, pictureType byte, description string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	body := []byte{encodingUTF8}
+	body = append(body, mime...)
+	body = append(body, 0, pictureType)
+	body = append(body, description...)
+	body = append(body, 0)
+	body = append(body, data...)
+	t.Frames = append(t.Frames, Frame{ID: "APIC", Body: body})
+}
+
+func language(lang string) string {
+	if len(lang) != 3 {
+		return "XXX"
+	}
+	return lang
+}
+
+// Encode renders the tag with padding bytes after the frames.
+func (t *Tag) Encode(padding int) ([]byte, error) {
+	var frames bytes.Buffer
+	for _, f := range t.Frames {
+		if len(f.ID) != 4 {
+			return nil, errors.New("invalid frame id " + f.ID)
+		}
+		if len(f.Body) >= 1<<28 {
+			return nil, errors.New("frame " + f.ID + " too large")
+		}
+		frames.WriteString(f.ID)
+		frames.Write(synchsafe(uint32(len(f.Body))))
+		frames.Write([]byte{0, 0})
+		frames.Write(f.Body)
+	}
+	size := frames.Len() + padding
+	if size >= 1<<28 {
+		return nil, errors.New("tag too large")
+	}
+	out := make([]byte, 0, 10+size)
+	out = append(out, 'I', 'D', '3', 4, 0, 0)
+	out = append(out, synchsafe(uint32(size))...)
+	out = append(out, frames.Bytes()...)
+	return append(out, make([]byte, padding)...), nil
+}
+
+func synchsafe(v uint32) []byte {
+	return []byte{byte(v>>21) & 0x7f, byte(v>>14) & 0x7f, byte(v>>7) & 0x7f, byte(v) & 0x7f}
+}
+
+// existingTagSize returns the length of an ID3v2 tag at the start of r, or 0.
+func existingTagSize(r io.ReaderAt) (int64, error) {
+	var hdr [10]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if string(hdr[:3]) != "ID3" {
+		return 0, nil
+	}
+	size := int64(hdr[6]&0x7f)<<21 | int64(hdr[7]&0x7f)<<14 | int64(hdr[8]&0x7f)<<7 | int64(hdr[9]&0x7f)
+	size += 10
+	if hdr[5]&0x10 != 0 {
+		size += 10
+	}
+	return size, nil
+}
+
+// WriteFile replaces any ID3v2 tag at the start of path with t.
+func WriteFile(path string, t *Tag) error {
+	encoded, err := t.Encode(DefaultPadding)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	skip, err := existingTagSize(src)
+	if err != nil {
+		return err
+	}
+	if skip > info.Size() {
+		return errors.New("invalid ID3v2 tag size")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".id3v2-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	_, err = tmp.Write(encoded)
+	if err == nil {
+		_, err = io.Copy(tmp, io.NewSectionReader(src, skip, info.Size()-skip))
+	}
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	src.Close()
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
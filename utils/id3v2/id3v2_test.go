@@ -0,0 +1,63 @@
+package id3v2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncodeFrames(t *testing.T) {
+	var tag Tag
+	tag.AddText("TPE1", "A", "B")
+	tag.AddSyncedLyrics("eng", []SyncedLine{{Millis: 1500, Text: "hi"}})
+	got, err := tag.Encode(4)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	want := []byte("ID3\x04\x00\x00\x00\x00\x00\x2a" +
+		"TPE1\x00\x00\x00\x04\x00\x00\x03A\x00B" +
+		"SYLT\x00\x00\x00\x0e\x00\x00\x03eng\x02\x01\x00hi\x00\x00\x00\x05\xdc" +
+		"\x00\x00\x00\x00")
+	if !bytes.Equal(got, want) {
+		t.Fatalf("unexpected tag\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestWriteFileReplacesExistingTag(t *testing.T) {
+	var old Tag
+	old.AddText("TSSE", "Lavf60")
+	oldBytes, _ := old.Encode(16)
+	audio := []byte("\xff\xfbframe")
+	path := filepath.Join(t.TempDir(), "track.mp3")
+	if err := os.WriteFile(path, append(oldBytes, audio...), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var tag Tag
+	tag.AddText("TIT2", "Song")
+	if err := WriteFile(path, &tag); err != nil {
+		t.Fatalf("write tag: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	want, _ := tag.Encode(DefaultPadding)
+	if !bytes.Equal(data, append(want, audio...)) {
+		t.Fatalf("unexpected file contents")
+	}
+}
+
+func TestParseLRC(t *testing.T) {
+	synced, plain := ParseLRC("[ar:Someone]\n[00:01.50]First\n[01:02.345][01:10.00]Second\n")
+	if len(synced) != 3 {
+		t.Fatalf("expected 3 synced lines, got %d", len(synced))
+	}
+	if synced[0].Millis != 1500 || synced[1].Millis != 62345 || synced[2].Millis != 70000 {
+		t.Fatalf("unexpected timestamps %+v", synced)
+	}
+	if plain != "First\nSecond" {
+		t.Fatalf("unexpected plain lyrics %q", plain)
+	}
+	if synced, plain := ParseLRC("just text"); synced != nil || plain != "just text" {
+		t.Fatalf("expected untimed text to pass through")
+	}
+}
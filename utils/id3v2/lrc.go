@@ -0,0 +1,67 @@
+package id3v2
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var lrcTimestamp = regexp.MustCompile(`^\[(\d+):(\d{1,2})(?:[.:](\d{1,3}))?\]`)
+
+// ParseLRC splits LRC text into timed lines for SYLT and the plain lyrics
+// for USLT. Text without timestamps is returned unchanged as plain lyrics.
+func ParseLRC(text string) ([]SyncedLine, string) {
+	var synced []SyncedLine
+	var plain []string
+	for _, raw := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		line := strings.TrimSpace(raw)
+		var stamps []uint32
+		for {
+			m := lrcTimestamp.FindStringSubmatch(line)
+			if m == nil {
+				break
+			}
+			stamps = append(stamps, lrcMillis(m[1], m[2], m[3]))
+			line = line[len(m[0]):]
+		}
+		if len(stamps) == 0 {
+			if !isLRCHeader(line) {
+				plain = append(plain, raw)
+			}
+			continue
+		}
+		line = strings.TrimSpace(line)
+		for _, ms := range stamps {
+			synced = append(synced, SyncedLine{Millis: ms, Text: line})
+		}
+		plain = append(plain, line)
+	}
+	if len(synced) == 0 {
+		return nil, text
+	}
+	return synced, strings.TrimSpace(strings.Join(plain, "\n"))
+}
+
+func lrcMillis(min, sec, frac string) uint32 {
+	m, _ := strconv.Atoi(min)
+	s, _ := strconv.Atoi(sec)
+	ms := 0
+	if frac != "" {
+		ms, _ = strconv.Atoi(frac)
+		switch len(frac) {
+		case 1:
+			ms *= 100
+		case 2:
+			ms *= 10
+		}
+	}
+	return uint32(m*60000 + s*1000 + ms)
+}
+
+// isLRCHeader reports ID tags such as [ar:Artist] or [offset:+100].
+func isLRCHeader(line string) bool {
+	if !strings.HasPrefix(line, "[") || !strings.HasSuffix(line, "]") {
+		return false
+	}
+	return strings.Contains(line, ":")
+}
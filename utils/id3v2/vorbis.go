@@ -0,0 +1,87 @@
+package id3v2
+
+import (
+	"sort"
+	"strings"
+)
+
+// vorbisFrames maps Vorbis comment names to ID3v2.4 text frames. Names
+// not listed here are written as TXXX frames.
+var vorbisFrames = map[string]string{
+	"TITLE":           "TIT2",
+	"TITLESORT":       "TSOT",
+	"ARTIST":          "TPE1",
+	"ARTISTSORT":      "TSOP",
+	"ALBUM":           "TALB",
+	"ALBUMSORT":       "TSOA",
+	"ALBUMARTIST":     "TPE2",
+	"ALBUMARTISTSORT": "TSO2",
+	"COMPOSER":        "TCOM",
+	"COMPOSERSORT":    "TSOC",
+	"GENRE":           "TCON",
+	"DATE":            "TDRC",
+	"ORIGINALDATE":    "TDOR",
+	"ISRC":            "TSRC",
+	"COPYRIGHT":       "TCOP",
+	"PUBLISHER":       "TPUB",
+	"PERFORMER":       "TPE3",
+	"ALBUMVERSION":    "TIT3",
+}
+
+// vorbisSkipped are handled separately or folded into other frames.
+var vorbisSkipped = map[string]bool{
+	"TRACKNUMBER": true,
+	"TRACKTOTAL":  true,
+	"TOTALTRACKS": true,
+	"DISCNUMBER":  true,
+	"DISCTOTAL":   true,
+	"TOTALDISCS":  true,
+	"LYRICS":      true,
+}
+
+// FromVorbis builds a tag from Vorbis-style NAME=value pairs, joining track
+// and disc numbers with their totals into TRCK and TPOS.
+func FromVorbis(comments map[string]string) *Tag {
+	upper := make(map[string]string, len(comments))
+	for k, v := range comments {
+		if v = strings.TrimSpace(v); v != "" {
+			upper[strings.ToUpper(k)] = v
+		}
+	}
+	keys := make([]string, 0, len(upper))
+	for k := range upper {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	t := &Tag{}
+	for _, k := range keys {
+		if vorbisSkipped[k] {
+			continue
+		}
+		if id, ok := vorbisFrames[k]; ok {
+			t.AddText(id, upper[k])
+			continue
+		}
+		if k == "LABEL" && upper["PUBLISHER"] == "" {
+			t.AddText("TPUB", upper[k])
+			continue
+		}
+		t.AddUserText(k, upper[k])
+	}
+	t.AddText("TRCK", numberWithTotal(upper["TRACKNUMBER"], upper["TRACKTOTAL"], upper["TOTALTRACKS"]))
+	t.AddText("TPOS", numberWithTotal(upper["DISCNUMBER"], upper["DISCTOTAL"], upper["TOTALDISCS"]))
+	return t
+}
+
+func numberWithTotal(number string, totals ...string) string {
+	if number == "" || strings.Contains(number, "/") {
+		return number
+	}
+	for _, total := range totals {
+		if total != "" {
+			return number + "/" + total
+		}
+	}
+	return number
+}
@@ -0,0 +1,238 @@
+// Package integrity checks finished downloads against what was requested
+// and keeps a SHA-256 manifest per album folder so that later corruption
+// or changes can be found.
+package integrity
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DurationTolerance is how far the decoded duration may be from the
+// catalog duration.
+const DurationTolerance = 2 * time.Second
+
+// Audio describes a decoded track. Zero fields are unknown and not
+// compared.
+type Audio struct {
+	Duration   time.Duration
+	SampleRate int
+	BitDepth   int
+}
+
+// Problems lists the ways got differs from want.
+func (want Audio) Problems(got Audio) []string {
+	var out []string
+	if want.Duration > 0 && got.Duration > 0 {
+		diff := got.Duration - want.Duration
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > DurationTolerance {
+			out = append(out, fmt.Sprintf("duration %s, expected %s", got.Duration.Round(time.Millisecond), want.Duration.Round(time.Millisecond)))
+		}
+	}
+	if want.SampleRate > 0 && got.SampleRate > 0 && want.SampleRate != got.SampleRate {
+		out = append(out, fmt.Sprintf("sample rate %d Hz, expected %d Hz", got.SampleRate, want.SampleRate))
+	}
+	if want.BitDepth > 0 && got.BitDepth > 0 && want.BitDepth != got.BitDepth {
+		out = append(out, fmt.Sprintf("bit depth %d, expected %d", got.BitDepth, want.BitDepth))
+	}
+	return out
+}
+
+// ParseQuality reads the bit depth and sample rate of a lossless {Quality}
+// value such as "24B-96.0kHz". It returns zeros for other values.
+func ParseQuality(quality string) (int, int) {
+	depth, rate, ok := strings.Cut(quality, "B-")
+	if !ok {
+		return 0, 0
+	}
+	bitDepth, err := strconv.Atoi(depth)
+	if err != nil {
+		return 0, 0
+	}
+	khz, err := strconv.ParseFloat(strings.TrimSuffix(rate, "kHz"), 64)
+	if err != nil {
+		return 0, 0
+	}
+	return bitDepth, int(khz*1000 + 0.5)
+}
+
+// Decode decodes the first audio stream of path with ffmpeg, stopping at
+// the first decoding error, and returns the decoded duration.
+func Decode(ffmpegPath, path string) (time.Duration, error) {
+	cmd := exec.Command(ffmpegPath, "-hide_banner", "-nostdin", "-nostats", "-v", "error",
+		"-xerror", "-err_detect", "explode", "-i", path,
+		"-map", "0:a:0", "-f", "null", "-progress", "pipe:1", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return 0, errors.New(strings.TrimSpace(strings.Split(msg, "\n")[0]))
+		}
+		return 0, err
+	}
+	return progressTime(out), nil
+}
+
+// progressTime returns the last out_time_us reported by ffmpeg -progress.
+func progressTime(out []byte) time.Duration {
+	var last time.Duration
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "out_time_us=")
+		if !ok {
+			continue
+		}
+		if us, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil && us > 0 {
+			last = time.Duration(us) * time.Microsecond
+		}
+	}
+	return last
+}
+
+// ManifestName is the manifest file kept in each album folder. It uses the
+// sha256sum format, so `sha256sum -c SHA256SUMS` checks it as well.
+const ManifestName = "SHA256SUMS"
+
+// Manifest maps the file names of one folder to their SHA-256 sums.
+type Manifest struct {
+	Dir  string
+	sums map[string]string
+}
+
+// LoadManifest reads the manifest of dir. A folder without one gives an
+// empty manifest.
+func LoadManifest(dir string) (*Manifest, error) {
+	m := &Manifest{Dir: dir, sums: make(map[string]string)}
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, " ")
+		if !ok || len(sum) != sha256.Size*2 {
+			return nil, fmt.Errorf("%s line %d: malformed entry", ManifestName, n+1)
+		}
+		// The second separator character marks text or binary mode.
+		name = strings.TrimPrefix(strings.TrimPrefix(name, " "), "*")
+		m.sums[name] = strings.ToLower(sum)
+	}
+	return m, nil
+}
+
+// Names returns the listed file names in order.
+func (m *Manifest) Names() []string {
+	names := make([]string, 0, len(m.sums))
+	for name := range m.sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Sum returns the recorded sum of name, or "".
+func (m *Manifest) Sum(name string) string {
+	return m.sums[name]
+}
+
+func (m *Manifest) Set(name, sum string) {
+	m.sums[name] = sum
+}
+
+func (m *Manifest) Remove(name string) {
+	delete(m.sums, name)
+}
+
+// Add hashes the file name in the manifest's folder and records it.
+func (m *Manifest) Add(name string) error {
+	sum, err := HashFile(filepath.Join(m.Dir, name))
+	if err != nil {
+		return err
+	}
+	m.sums[name] = sum
+	return nil
+}
+
+// Save writes the manifest, or removes it when it lists nothing.
+func (m *Manifest) Save() error {
+	path := filepath.Join(m.Dir, ManifestName)
+	if len(m.sums) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	var b strings.Builder
+	for _, name := range m.Names() {
+		fmt.Fprintf(&b, "%s  %s\n", m.sums[name], name)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+const (
+	StatusOK       = "ok"
+	StatusMismatch = "mismatch"
+	StatusMissing  = "missing"
+)
+
+// Result is the outcome of checking one manifest entry.
+type Result struct {
+	Name   string
+	Status string
+	Err    error
+}
+
+// Verify hashes every listed file again and compares the sums.
+func (m *Manifest) Verify() []Result {
+	var out []Result
+	for _, name := range m.Names() {
+		sum, err := HashFile(filepath.Join(m.Dir, name))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			out = append(out, Result{Name: name, Status: StatusMissing})
+		case err != nil:
+			out = append(out, Result{Name: name, Status: StatusMismatch, Err: err})
+		case sum != m.sums[name]:
+			out = append(out, Result{Name: name, Status: StatusMismatch})
+		default:
+			out = append(out, Result{Name: name, Status: StatusOK})
+		}
+	}
+	return out
+}
+
+// HashFile returns the hex SHA-256 sum of the file at path.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
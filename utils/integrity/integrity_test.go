@@ -0,0 +1,69 @@
+package integrity
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProblems(t *testing.T) {
+	want := Audio{Duration: 200 * time.Second, SampleRate: 96000, BitDepth: 24}
+	if p := want.Problems(Audio{Duration: 201 * time.Second, SampleRate: 96000, BitDepth: 24}); len(p) != 0 {
+		t.Fatalf("unexpected problems %v", p)
+	}
+	if p := want.Problems(Audio{Duration: 150 * time.Second, SampleRate: 44100, BitDepth: 16}); len(p) != 3 {
+		t.Fatalf("problems = %v", p)
+	}
+	if d, r := ParseQuality("24B-96.0kHz"); d != 24 || r != 96000 {
+		t.Fatalf("parsed %d bit %d Hz", d, r)
+	}
+	if d, r := ParseQuality("256Kbps"); d != 0 || r != 0 {
+		t.Fatal("expected zeros for a lossy quality")
+	}
+}
+
+func TestProgressTime(t *testing.T) {
+	out := []byte("out_time_us=1000000\nprogress=continue\nout_time_us=183250000\nprogress=end\n")
+	if d := progressTime(out); d != 183250*time.Millisecond {
+		t.Fatalf("duration = %s", d)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{"01. A.m4a": "a", "02. B.m4a": "b"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, _ := LoadManifest(dir)
+	for _, name := range []string{"01. A.m4a", "02. B.m4a"} {
+		if err := m.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(filepath.Join(dir, "01. A.m4a"), []byte("changed"), 0644)
+	os.Remove(filepath.Join(dir, "02. B.m4a"))
+	loaded, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := loaded.Verify()
+	if len(results) != 2 || results[0].Status != StatusMismatch || results[1].Status != StatusMissing {
+		t.Fatalf("results = %+v", results)
+	}
+
+	loaded.Remove("01. A.m4a")
+	loaded.Remove("02. B.m4a")
+	if err := loaded.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ManifestName)); !os.IsNotExist(err) {
+		t.Fatal("empty manifest not removed")
+	}
+}
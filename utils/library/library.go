@@ -0,0 +1,237 @@
+package library
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zhaarey/go-mp4tag"
+
+	"main/utils/flacmeta"
+	"main/utils/oggopus"
+)
+
+const FileName = ".library-index.json"
+
+var audioExts = map[string]bool{
+	".m4a":  true,
+	".flac": true,
+	".opus": true,
+	".ogg":  true,
+	".mp3":  true,
+	".wav":  true,
+	".ec3":  true,
+	".mka":  true,
+}
+
+// IsAudio reports whether path has one of the audio extensions the
+// library indexes.
+func IsAudio(path string) bool {
+	return audioExts[strings.ToLower(filepath.Ext(path))]
+}
+
+// Entry describes one audio file below a save root. Tags are read once and
+// cached in the root's index file until the file's size or mtime changes.
+type Entry struct {
+	Path        string `json:"-"`
+	Root        string `json:"-"`
+	Rel         string `json:"path"`
+	Size        int64  `json:"size"`
+	ModTime     int64  `json:"mtime"`
+	Format      string `json:"format"`
+	Artist      string `json:"artist,omitempty"`
+	AlbumArtist string `json:"album_artist,omitempty"`
+	Album       string `json:"album,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Genre       string `json:"genre,omitempty"`
+	Date        string `json:"date,omitempty"`
+	ISRC        string `json:"isrc,omitempty"`
+	TrackNumber int    `json:"track,omitempty"`
+	DiscNumber  int    `json:"disc,omitempty"`
+	// Playlists holds the IDs and names of the playlists the file was
+	// downloaded for.
+	Playlists []string `json:"-"`
+}
+
+// Year returns the leading year of Date, or 0.
+func (e *Entry) Year() int {
+	if len(e.Date) < 4 {
+		return 0
+	}
+	year, _ := strconv.Atoi(e.Date[:4])
+	return year
+}
+
+// Scan indexes every audio file below root, reusing cached tags for
+// unchanged files and rewriting the index file when anything changed.
+func Scan(root string) ([]Entry, error) {
+	cached := map[string]Entry{}
+	if data, err := os.ReadFile(filepath.Join(root, FileName)); err == nil {
+		var list []Entry
+		if json.Unmarshal(data, &list) == nil {
+			for _, e := range list {
+				cached[e.Rel] = e
+			}
+		}
+	}
+
+	var entries []Entry
+	changed := false
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if !audioExts[ext] || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		e, ok := cached[rel]
+		if !ok || e.Size != info.Size() || e.ModTime != info.ModTime().UnixNano() {
+			e = Entry{Rel: rel, Size: info.Size(), ModTime: info.ModTime().UnixNano(), Format: ext[1:]}
+			readTags(path, &e)
+			changed = true
+		}
+		e.Path = path
+		e.Root = root
+		entries = append(entries, e)
+		delete(cached, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if changed || len(cached) > 0 {
+		if data, err := json.MarshalIndent(entries, "", "  "); err == nil {
+			_ = os.WriteFile(filepath.Join(root, FileName), data, 0644)
+		}
+	}
+	setPlaylists(root, entries)
+	Sort(entries)
+	return entries, nil
+}
+
+// ScanRoots scans several roots, skipping empty, missing or repeated ones.
+func ScanRoots(roots []string) ([]Entry, error) {
+	seen := map[string]bool{}
+	var all []Entry
+	for _, root := range roots {
+		if root == "" || seen[root] {
+			continue
+		}
+		seen[root] = true
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			continue
+		}
+		entries, err := Scan(root)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, entries...)
+	}
+	Sort(all)
+	return all, nil
+}
+
+// Sort orders entries by album artist, album, disc, track and path.
+func Sort(entries []Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := &entries[i], &entries[j]
+		if x, y := strings.ToLower(a.albumArtist()), strings.ToLower(b.albumArtist()); x != y {
+			return x < y
+		}
+		if x, y := strings.ToLower(a.Album), strings.ToLower(b.Album); x != y {
+			return x < y
+		}
+		if a.DiscNumber != b.DiscNumber {
+			return a.DiscNumber < b.DiscNumber
+		}
+		if a.TrackNumber != b.TrackNumber {
+			return a.TrackNumber < b.TrackNumber
+		}
+		return a.Path < b.Path
+	})
+}
+
+func (e *Entry) albumArtist() string {
+	if e.AlbumArtist != "" {
+		return e.AlbumArtist
+	}
+	return e.Artist
+}
+
+func readTags(path string, e *Entry) {
+	switch e.Format {
+	case "m4a":
+		mp4, err := mp4tag.Open(path)
+		if err != nil {
+			return
+		}
+		defer mp4.Close()
+		tags, err := mp4.Read()
+		if err != nil {
+			return
+		}
+		e.Artist = tags.Artist
+		e.AlbumArtist = tags.AlbumArtist
+		e.Album = tags.Album
+		e.Title = tags.Title
+		e.Genre = tags.CustomGenre
+		e.Date = tags.Date
+		e.TrackNumber = int(tags.TrackNumber)
+		e.DiscNumber = int(tags.DiscNumber)
+		for key, value := range tags.Custom {
+			if strings.EqualFold(key, "ISRC") {
+				e.ISRC = value
+			}
+		}
+	case "flac":
+		f, err := flacmeta.Open(path)
+		if err != nil {
+			return
+		}
+		fromVorbis(f.Comment, e)
+	case "opus", "ogg":
+		vc, err := oggopus.ReadTags(path)
+		if err != nil {
+			return
+		}
+		fromVorbis(vc, e)
+	}
+}
+
+func fromVorbis(vc *flacmeta.VorbisComment, e *Entry) {
+	e.Artist = strings.Join(vc.Get("ARTIST"), ", ")
+	e.AlbumArtist = vc.First("ALBUMARTIST")
+	e.Album = vc.First("ALBUM")
+	e.Title = vc.First("TITLE")
+	e.Genre = vc.First("GENRE")
+	e.Date = vc.First("DATE")
+	e.ISRC = vc.First("ISRC")
+	e.TrackNumber = leadingInt(vc.First("TRACKNUMBER"))
+	e.DiscNumber = leadingInt(vc.First("DISCNUMBER"))
+}
+
+func leadingInt(s string) int {
+	s, _, _ = strings.Cut(strings.TrimSpace(s), "/")
+	n, _ := strconv.Atoi(s)
+	return n
+}
@@ -0,0 +1,82 @@
+package library
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const PlaylistsFileName = ".playlists.json"
+
+// Playlist is a playlist downloaded into a save root. Its tracks are saved
+// in their artist and album folders, so membership is recorded at download
+// time rather than read from the layout.
+type Playlist struct {
+	Name   string   `json:"name"`
+	Tracks []string `json:"tracks"`
+}
+
+// Playlists maps playlist IDs to the playlists recorded below one root.
+type Playlists map[string]*Playlist
+
+func LoadPlaylists(root string) Playlists {
+	p := Playlists{}
+	if data, err := os.ReadFile(filepath.Join(root, PlaylistsFileName)); err == nil {
+		_ = json.Unmarshal(data, &p)
+	}
+	return p
+}
+
+// Add records that the file at rel, relative to the root, belongs to the
+// playlist.
+func (p Playlists) Add(id, name, rel string) {
+	list, ok := p[id]
+	if !ok {
+		list = &Playlist{}
+		p[id] = list
+	}
+	if name != "" {
+		list.Name = name
+	}
+	rel = filepath.ToSlash(rel)
+	for _, track := range list.Tracks {
+		if track == rel {
+			return
+		}
+	}
+	list.Tracks = append(list.Tracks, rel)
+}
+
+func (p Playlists) Save(root string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(root, PlaylistsFileName), data, 0644)
+}
+
+// setPlaylists fills in the Playlists of entries from the root's record.
+func setPlaylists(root string, entries []Entry) {
+	byRel := map[string][]string{}
+	for id, list := range LoadPlaylists(root) {
+		for _, rel := range list.Tracks {
+			byRel[rel] = append(byRel[rel], id, list.Name)
+		}
+	}
+	for i := range entries {
+		entries[i].Playlists = byRel[entries[i].Rel]
+	}
+}
+
+// InPlaylist reports whether e was downloaded as part of the playlist with
+// the given name or ID.
+func InPlaylist(e *Entry, name string) bool {
+	name = strings.TrimSpace(name)
+	for _, p := range e.Playlists {
+		if strings.EqualFold(p, name) {
+			return true
+		}
+	}
+	return false
+}
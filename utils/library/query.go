@@ -0,0 +1,146 @@
+package library
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Query is a list of terms that must all match. Terms take the forms
+// field:value (contains), field=value (equals), year>=N / year<=N, or a bare
+// word matched against artist, album, title and path. Values may be quoted.
+type Query []term
+
+type term struct {
+	field string
+	op    string
+	value string
+}
+
+var queryFields = map[string]bool{
+	"artist":      true,
+	"albumartist": true,
+	"album":       true,
+	"title":       true,
+	"genre":       true,
+	"isrc":        true,
+	"format":      true,
+	"path":        true,
+	"playlist":    true,
+	"year":        true,
+}
+
+func ParseQuery(s string) (Query, error) {
+	var q Query
+	for _, word := range splitQuery(s) {
+		t, err := parseTerm(word)
+		if err != nil {
+			return nil, err
+		}
+		q = append(q, t)
+	}
+	return q, nil
+}
+
+func splitQuery(s string) []string {
+	var out []string
+	var cur strings.Builder
+	quoted := false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if cur.Len() > 0 {
+				out = append(out, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if cur.Len() > 0 {
+		out = append(out, cur.String())
+	}
+	return out
+}
+
+func parseTerm(word string) (term, error) {
+	for _, op := range []string{">=", "<=", "=", ":"} {
+		idx := strings.Index(word, op)
+		if idx <= 0 {
+			continue
+		}
+		field := strings.ToLower(word[:idx])
+		if !queryFields[field] {
+			return term{}, fmt.Errorf("unknown query field %q", field)
+		}
+		t := term{field: field, op: op, value: strings.ToLower(word[idx+len(op):])}
+		if op == ">=" || op == "<=" {
+			if field != "year" {
+				return term{}, fmt.Errorf("%s only applies to year", op)
+			}
+			if _, err := strconv.Atoi(t.value); err != nil {
+				return term{}, fmt.Errorf("invalid year %q", t.value)
+			}
+		}
+		return t, nil
+	}
+	return term{op: ":", value: strings.ToLower(word)}, nil
+}
+
+// Match reports whether e satisfies every term of q.
+func (q Query) Match(e *Entry) bool {
+	for _, t := range q {
+		if !t.match(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t term) match(e *Entry) bool {
+	if t.field == "year" {
+		want, _ := strconv.Atoi(t.value)
+		year := e.Year()
+		switch t.op {
+		case ">=":
+			return year >= want
+		case "<=":
+			return year <= want
+		}
+		return year == want
+	}
+	if t.field == "playlist" {
+		return InPlaylist(e, t.value)
+	}
+	for _, v := range t.values(e) {
+		v = strings.ToLower(v)
+		if t.op == "=" && v == t.value || t.op == ":" && strings.Contains(v, t.value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t term) values(e *Entry) []string {
+	switch t.field {
+	case "artist":
+		return []string{e.Artist, e.AlbumArtist}
+	case "albumartist":
+		return []string{e.albumArtist()}
+	case "album":
+		return []string{e.Album}
+	case "title":
+		return []string{e.Title}
+	case "genre":
+		return []string{e.Genre}
+	case "isrc":
+		return []string{e.ISRC}
+	case "format":
+		return []string{e.Format}
+	case "path":
+		return []string{e.Rel}
+	}
+	return []string{e.Artist, e.AlbumArtist, e.Album, e.Title, e.Rel}
+}
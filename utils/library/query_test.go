@@ -0,0 +1,41 @@
+package library
+
+import "testing"
+
+func TestQueryMatch(t *testing.T) {
+	e := &Entry{
+		Rel:         "Daft Punk/Discovery/01. One More Time.m4a",
+		Artist:      "Daft Punk",
+		AlbumArtist: "Daft Punk",
+		Album:       "Discovery",
+		Title:       "One More Time",
+		Date:        "2001-03-12",
+		Format:      "m4a",
+		Playlists:   []string{"pl.u-123", "Chill Mix"},
+	}
+	cases := map[string]bool{
+		`artist:daft`:                 true,
+		`artist="daft punk"`:          true,
+		`artist=daft`:                 false,
+		`album:discovery year>=2000`:  true,
+		`year<=1999`:                  false,
+		`"one more"`:                  true,
+		`format=flac`:                 false,
+		`playlist=discovery`:          false,
+		`playlist="chill mix"`:        true,
+		`playlist=pl.u-123`:           true,
+		`title:time path:"daft punk"`: true,
+	}
+	for input, want := range cases {
+		q, err := ParseQuery(input)
+		if err != nil {
+			t.Fatalf("parse %q: %v", input, err)
+		}
+		if got := q.Match(e); got != want {
+			t.Errorf("%q: got %v, want %v", input, got, want)
+		}
+	}
+	if _, err := ParseQuery("bitrate:320"); err == nil {
+		t.Fatalf("expected unknown field error")
+	}
+}
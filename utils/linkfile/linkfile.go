@@ -0,0 +1,130 @@
+package linkfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Mode string
+
+const (
+	Copy     Mode = "copy"
+	Hardlink Mode = "hardlink"
+	Reflink  Mode = "reflink"
+	Symlink  Mode = "symlink"
+)
+
+var ErrUnsupported = errors.New("reflink not supported on this platform")
+
+func ParseMode(value string) (Mode, error) {
+	switch Mode(strings.ToLower(strings.TrimSpace(value))) {
+	case "", Copy:
+		return Copy, nil
+	case Hardlink, "link":
+		return Hardlink, nil
+	case Reflink, "clone":
+		return Reflink, nil
+	case Symlink:
+		return Symlink, nil
+	}
+	return "", fmt.Errorf("unknown link-mode %q (expected copy, hardlink, reflink or symlink)", value)
+}
+
+// Place makes dst refer to the contents of src using mode. When the link
+// cannot be created (different filesystems, no reflink support, missing
+// privileges) it falls back to a plain copy. The mode actually used is
+// returned.
+func Place(src, dst string, mode Mode) (Mode, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return "", err
+	}
+	if same, _ := sameFile(src, dst); same {
+		return mode, nil
+	}
+	switch mode {
+	case Hardlink:
+		_ = os.Remove(dst)
+		if err := os.Link(src, dst); err == nil {
+			return Hardlink, nil
+		}
+	case Symlink:
+		_ = os.Remove(dst)
+		target, err := filepath.Abs(src)
+		if err == nil {
+			if err := os.Symlink(target, dst); err == nil {
+				return Symlink, nil
+			}
+		}
+	case Reflink:
+		if err := reflink(src, dst); err == nil {
+			return Reflink, nil
+		}
+	}
+	return Copy, copyFile(src, dst)
+}
+
+// Unshare gives path a copy of its data of its own when it is a symlink or
+// has other hard links, so an edit made in place leaves the other names
+// alone. Hard links are only detected on Unix.
+func Unshare(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink == 0 && linkCount(info) <= 1 {
+		return nil
+	}
+	target, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".unshare"
+	if err := copyFile(path, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, target.Mode().Perm()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func sameFile(a, b string) (bool, error) {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(ai, bi), nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	_ = os.Remove(dst)
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
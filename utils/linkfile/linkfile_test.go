@@ -0,0 +1,90 @@
+package linkfile
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	tests := map[string]Mode{"": Copy, " Copy ": Copy, "link": Hardlink, "clone": Reflink, "symlink": Symlink}
+	for in, want := range tests {
+		if got, err := ParseMode(in); err != nil || got != want {
+			t.Errorf("ParseMode(%q) = %q, %v", in, got, err)
+		}
+	}
+	if _, err := ParseMode("junction"); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPlace(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.m4a")
+	writeFile(t, src, "audio")
+	for _, mode := range []Mode{Copy, Hardlink, Symlink, Reflink} {
+		dst := filepath.Join(dir, string(mode), "dst.m4a")
+		used, err := Place(src, dst, mode)
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if used != mode && used != Copy {
+			t.Errorf("%s: used %s", mode, used)
+		}
+		if got := readFile(t, dst); got != "audio" {
+			t.Errorf("%s: dst holds %q", mode, got)
+		}
+		if again, err := Place(src, dst, mode); err != nil || again != used {
+			t.Errorf("%s: placing again = %s, %v", mode, again, err)
+		}
+	}
+}
+
+func TestUnshare(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "album.flac")
+	writeFile(t, src, "album")
+	plain := filepath.Join(dir, "plain.flac")
+	writeFile(t, plain, "plain")
+	if err := Unshare(plain); err != nil || readFile(t, plain) != "plain" {
+		t.Errorf("unlinked file changed: %v", err)
+	}
+
+	modes := []Mode{Symlink}
+	if runtime.GOOS != "windows" {
+		modes = append(modes, Hardlink)
+	}
+	for _, mode := range modes {
+		dst := filepath.Join(dir, string(mode)+".flac")
+		if used, err := Place(src, dst, mode); err != nil || used != mode {
+			t.Skipf("%s not available: %v", mode, err)
+		}
+		if err := Unshare(dst); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		writeFile(t, dst, "playlist")
+		if got := readFile(t, src); got != "album" {
+			t.Errorf("%s: edit reached the source, which now holds %q", mode, got)
+		}
+		if info, err := os.Lstat(dst); err != nil || info.Mode()&os.ModeSymlink != 0 {
+			t.Errorf("%s: %s is still a link", mode, dst)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package linkfile
+
+func reflink(src, dst string) error {
+	return ErrUnsupported
+}
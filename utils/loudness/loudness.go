@@ -0,0 +1,232 @@
+// Package loudness measures EBU R128 loudness with ffmpeg's ebur128 filter
+// and turns the results into ReplayGain, R128 and SoundCheck tags.
+package loudness
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ReplayGainReference is the ReplayGain 2.0 target loudness.
+	ReplayGainReference = -18.0
+	// R128Reference is the target the Opus R128_* gains are relative to.
+	R128Reference = -23.0
+
+	absoluteGate = -70.0
+)
+
+// Result holds the loudness of one track, or of an album when built with
+// Album. Momentary and ShortTerm are the 400 ms and 3 s block loudnesses
+// ffmpeg logs every 100 ms; they are kept so album values can be gated over
+// all tracks at once.
+type Result struct {
+	Integrated float64
+	Range      float64
+	TruePeak   float64
+	Momentary  []float64
+	ShortTerm  []float64
+}
+
+var (
+	frameRe   = regexp.MustCompile(`\bM:\s*(-?(?:[\d.]+|inf))\s+S:\s*(-?(?:[\d.]+|inf))`)
+	summaryRe = regexp.MustCompile(`^\s*(I|LRA|Peak):\s*(-?(?:[\d.]+|inf))`)
+)
+
+// Analyze runs ffmpeg over path and parses the ebur128 output.
+func Analyze(ffmpegPath, path string) (*Result, error) {
+	cmd := exec.Command(ffmpegPath, "-hide_banner", "-nostats", "-i", path,
+		"-map", "0:a:0", "-filter:a", "ebur128=peak=true", "-f", "null", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ebur128 failed: %v", err)
+	}
+	return Parse(stderr.String())
+}
+
+// Parse reads ffmpeg's ebur128 log: the per-frame M/S values and the final
+// summary block.
+func Parse(log string) (*Result, error) {
+	res := &Result{TruePeak: math.Inf(-1)}
+	inSummary := false
+	found := 0
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !inSummary {
+			if m := frameRe.FindStringSubmatch(line); m != nil {
+				res.Momentary = append(res.Momentary, parseValue(m[1]))
+				res.ShortTerm = append(res.ShortTerm, parseValue(m[2]))
+				continue
+			}
+			inSummary = strings.Contains(line, "Summary:")
+			continue
+		}
+		m := summaryRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		v := parseValue(m[2])
+		switch m[1] {
+		case "I":
+			res.Integrated = v
+		case "LRA":
+			res.Range = v
+		case "Peak":
+			res.TruePeak = v
+		}
+		found++
+	}
+	if found == 0 {
+		return nil, errors.New("no ebur128 summary in ffmpeg output")
+	}
+	return res, nil
+}
+
+func parseValue(s string) float64 {
+	if strings.HasSuffix(s, "inf") {
+		return math.Inf(-1)
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return math.Inf(-1)
+	}
+	return v
+}
+
+// Album combines track results as if the tracks were played back to back:
+// the blocks of all tracks are gated together and the peak is the highest
+// track peak.
+func Album(tracks []*Result) *Result {
+	res := &Result{TruePeak: math.Inf(-1)}
+	for _, t := range tracks {
+		res.Momentary = append(res.Momentary, t.Momentary...)
+		res.ShortTerm = append(res.ShortTerm, t.ShortTerm...)
+		res.TruePeak = math.Max(res.TruePeak, t.TruePeak)
+	}
+	res.Integrated = Integrated(res.Momentary)
+	res.Range = Range(res.ShortTerm)
+	return res
+}
+
+// Integrated gates momentary block loudnesses as in ITU-R BS.1770: an
+// absolute gate at -70 LUFS, then a relative gate 10 LU below the mean.
+func Integrated(blocks []float64) float64 {
+	gated := gate(blocks, absoluteGate)
+	if len(gated) == 0 {
+		return math.Inf(-1)
+	}
+	return meanLoudness(gate(gated, meanLoudness(gated)-10))
+}
+
+// Range computes the loudness range (EBU Tech 3342) from short-term block
+// loudnesses: the spread between the 10th and 95th percentile after an
+// absolute gate and a relative gate 20 LU below the mean.
+func Range(blocks []float64) float64 {
+	gated := gate(blocks, absoluteGate)
+	if len(gated) == 0 {
+		return 0
+	}
+	gated = gate(gated, meanLoudness(gated)-20)
+	sort.Float64s(gated)
+	if len(gated) < 2 {
+		return 0
+	}
+	low := gated[int(math.Round(0.10*float64(len(gated)-1)))]
+	high := gated[int(math.Round(0.95*float64(len(gated)-1)))]
+	return high - low
+}
+
+func gate(blocks []float64, threshold float64) []float64 {
+	out := make([]float64, 0, len(blocks))
+	for _, b := range blocks {
+		if b > threshold {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func meanLoudness(blocks []float64) float64 {
+	if len(blocks) == 0 {
+		return math.Inf(-1)
+	}
+	sum := 0.0
+	for _, b := range blocks {
+		sum += math.Pow(10, (b+0.691)/10)
+	}
+	return -0.691 + 10*math.Log10(sum/float64(len(blocks)))
+}
+
+// Gain is the ReplayGain 2.0 gain in dB.
+func (r *Result) Gain() float64 {
+	return ReplayGainReference - r.Integrated
+}
+
+// Peak is the true peak as a linear amplitude, 1.0 being full scale.
+func (r *Result) Peak() float64 {
+	if math.IsInf(r.TruePeak, -1) {
+		return 0
+	}
+	return math.Pow(10, r.TruePeak/20)
+}
+
+// R128Gain is the gain for R128_TRACK_GAIN/R128_ALBUM_GAIN: a Q7.8 fixed
+// point dB value relative to -23 LUFS.
+func (r *Result) R128Gain() int {
+	q := math.Round((R128Reference - r.Integrated) * 256)
+	return int(math.Max(math.MinInt16, math.Min(math.MaxInt16, q)))
+}
+
+// Valid reports whether r measured anything other than silence.
+func (r *Result) Valid() bool {
+	return r != nil && !math.IsInf(r.Integrated, 0) && !math.IsNaN(r.Integrated)
+}
+
+// ReplayGainTags returns REPLAYGAIN_* tags for track and, when not nil,
+// album.
+func ReplayGainTags(track, album *Result) map[string]string {
+	tags := map[string]string{
+		"REPLAYGAIN_TRACK_GAIN": fmt.Sprintf("%.2f dB", track.Gain()),
+		"REPLAYGAIN_TRACK_PEAK": fmt.Sprintf("%.6f", track.Peak()),
+	}
+	if album != nil {
+		tags["REPLAYGAIN_ALBUM_GAIN"] = fmt.Sprintf("%.2f dB", album.Gain())
+		tags["REPLAYGAIN_ALBUM_PEAK"] = fmt.Sprintf("%.6f", album.Peak())
+	}
+	return tags
+}
+
+// R128Tags returns the Opus R128_* gain tags.
+func R128Tags(track, album *Result) map[string]string {
+	tags := map[string]string{"R128_TRACK_GAIN": strconv.Itoa(track.R128Gain())}
+	if album != nil {
+		tags["R128_ALBUM_GAIN"] = strconv.Itoa(album.R128Gain())
+	}
+	return tags
+}
+
+// SoundCheck encodes gain and peak as an iTunNORM value.
+func SoundCheck(r *Result) string {
+	encode := func(base float64) uint32 {
+		return uint32(math.Min(65534, math.Round(math.Pow(10, -r.Gain()/10)*base)))
+	}
+	g1000, g2500 := encode(1000), encode(2500)
+	peak := uint32(math.Min(32768, math.Round(r.Peak()*32768)))
+	values := []uint32{g1000, g1000, g2500, g2500, 0, 0, peak, peak, 0, 0}
+	var b strings.Builder
+	for _, v := range values {
+		fmt.Fprintf(&b, " %08X", v)
+	}
+	return b.String()
+}
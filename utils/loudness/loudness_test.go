@@ -0,0 +1,70 @@
+package loudness
+
+import (
+	"math"
+	"testing"
+)
+
+const sampleLog = `Input #0, mov,mp4,m4a,3gp,3g2,mj2, from 'track.m4a':
+[Parsed_ebur128_0 @ 0x55d] t: 0.1        TARGET:-23 LUFS    M:-120.7 S:-120.7     I: -70.0 LUFS       LRA:   0.0 LU  FTPK: -inf dBFS  TPK: -inf dBFS
+[Parsed_ebur128_0 @ 0x55d] t: 0.5        TARGET:-23 LUFS    M: -14.2 S:-120.7     I: -14.2 LUFS       LRA:   0.0 LU  FTPK: -1.2 dBFS  TPK: -1.2 dBFS
+[Parsed_ebur128_0 @ 0x55d] t: 0.6        TARGET:-23 LUFS    M: -13.8 S: -15.0     I: -14.0 LUFS       LRA:   0.0 LU  FTPK: -0.9 dBFS  TPK: -0.9 dBFS
+[Parsed_ebur128_0 @ 0x55d] Summary:
+
+  Integrated loudness:
+    I:         -14.0 LUFS
+    Threshold: -24.0 LUFS
+
+  Loudness range:
+    LRA:         3.4 LU
+    Threshold: -34.0 LUFS
+    LRA low:   -16.0 LUFS
+    LRA high:  -12.6 LUFS
+
+  True peak:
+    Peak:       -0.9 dBFS
+`
+
+func TestParse(t *testing.T) {
+	r, err := Parse(sampleLog)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if r.Integrated != -14 || r.Range != 3.4 || r.TruePeak != -0.9 {
+		t.Fatalf("unexpected summary %+v", r)
+	}
+	if len(r.Momentary) != 3 || r.Momentary[1] != -14.2 || r.ShortTerm[2] != -15 {
+		t.Fatalf("unexpected blocks %v %v", r.Momentary, r.ShortTerm)
+	}
+	if _, err := Parse("no summary here"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestAlbumGating(t *testing.T) {
+	quiet := &Result{TruePeak: -6, Momentary: []float64{-120, -40, -40}, ShortTerm: []float64{-30, -30}}
+	loud := &Result{TruePeak: -1, Momentary: []float64{-20, -20, -20, -20}, ShortTerm: []float64{-20, -20}}
+	album := Album([]*Result{quiet, loud})
+	// The -40 blocks fall below the relative gate (about -31.7 LUFS).
+	if math.Abs(album.Integrated+20) > 1e-9 {
+		t.Fatalf("integrated = %v, want -20", album.Integrated)
+	}
+	if album.TruePeak != -1 || album.Range != 10 {
+		t.Fatalf("unexpected album %+v", album)
+	}
+}
+
+func TestTags(t *testing.T) {
+	r := &Result{Integrated: -10, TruePeak: 0}
+	rg := ReplayGainTags(r, nil)
+	if rg["REPLAYGAIN_TRACK_GAIN"] != "-8.00 dB" || rg["REPLAYGAIN_TRACK_PEAK"] != "1.000000" || len(rg) != 2 {
+		t.Fatalf("unexpected replaygain tags %v", rg)
+	}
+	if got := R128Tags(r, r)["R128_ALBUM_GAIN"]; got != "-3328" {
+		t.Fatalf("R128 gain = %s", got)
+	}
+	want := " 000018A6 000018A6 00003D9E 00003D9E 00000000 00000000 00008000 00008000 00000000 00000000"
+	if got := SoundCheck(r); got != want {
+		t.Fatalf("iTunNORM = %q", got)
+	}
+}
@@ -0,0 +1,204 @@
+package mp4meta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// node is a parsed ISO-BMFF box. Containers keep their children, leaves
+// keep the raw payload; prefix holds the bytes between the header and the
+// first child of full-box containers such as meta.
+type node struct {
+	typ      string
+	prefix   []byte
+	payload  []byte
+	children []*node
+	isParent bool
+}
+
+var containerTypes = map[string]bool{
+	"moov": true,
+	"trak": true,
+	"mdia": true,
+	"minf": true,
+	"stbl": true,
+	"edts": true,
+	"udta": true,
+	"dinf": true,
+	"mvex": true,
+	"ilst": true,
+	"moof": true,
+	"traf": true,
+	"meta": true,
+}
+
+func parseBoxes(data []byte) ([]*node, error) {
+	var out []*node
+	pos := 0
+	for pos < len(data) {
+		if len(data)-pos < 8 {
+			return nil, errors.New("truncated box header")
+		}
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		header := 8
+		switch size {
+		case 0:
+			size = len(data) - pos
+		case 1:
+			if len(data)-pos < 16 {
+				return nil, errors.New("truncated large box header")
+			}
+			size = int(binary.BigEndian.Uint64(data[pos+8:]))
+			header = 16
+		}
+		if size < header || pos+size > len(data) {
+			return nil, fmt.Errorf("invalid size for box %q", typ)
+		}
+		body := data[pos+header : pos+size]
+		n, err := parseNode(typ, body)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+		pos += size
+	}
+	return out, nil
+}
+
+func parseNode(typ string, body []byte) (*node, error) {
+	n := &node{typ: typ}
+	if !containerTypes[typ] {
+		n.payload = append([]byte{}, body...)
+		return n, nil
+	}
+	if typ == "meta" && isFullBoxMeta(body) {
+		n.prefix = append([]byte{}, body[:4]...)
+		body = body[4:]
+	}
+	children, err := parseBoxes(body)
+	if err != nil {
+		return nil, err
+	}
+	n.children = children
+	n.isParent = true
+	return n, nil
+}
+
+// isFullBoxMeta tells ISO meta boxes (version and flags before the first
+// child) apart from QuickTime ones that start with a child box directly.
+func isFullBoxMeta(body []byte) bool {
+	if len(body) < 12 {
+		return len(body) >= 4
+	}
+	return string(body[4:8]) != "hdlr"
+}
+
+func (n *node) size() int {
+	if !n.isParent {
+		return 8 + len(n.payload)
+	}
+	total := 8 + len(n.prefix)
+	for _, c := range n.children {
+		total += c.size()
+	}
+	return total
+}
+
+func (n *node) encode(buf *bytes.Buffer) {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(n.size()))
+	copy(header[4:], n.typ)
+	buf.Write(header[:])
+	if !n.isParent {
+		buf.Write(n.payload)
+		return
+	}
+	buf.Write(n.prefix)
+	for _, c := range n.children {
+		c.encode(buf)
+	}
+}
+
+func (n *node) bytes() []byte {
+	var buf bytes.Buffer
+	n.encode(&buf)
+	return buf.Bytes()
+}
+
+func (n *node) child(typ string) *node {
+	for _, c := range n.children {
+		if c.typ == typ {
+			return c
+		}
+	}
+	return nil
+}
+
+func (n *node) childrenOf(typ string) []*node {
+	var out []*node
+	for _, c := range n.children {
+		if c.typ == typ {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (n *node) path(types ...string) *node {
+	cur := n
+	for _, typ := range types {
+		if cur == nil {
+			return nil
+		}
+		cur = cur.child(typ)
+	}
+	return cur
+}
+
+func (n *node) remove(typ string) bool {
+	removed := false
+	kept := n.children[:0]
+	for _, c := range n.children {
+		if c.typ == typ {
+			removed = true
+			continue
+		}
+		kept = append(kept, c)
+	}
+	n.children = kept
+	return removed
+}
+
+func newParent(typ string, children ...*node) *node {
+	return &node{typ: typ, isParent: true, children: children}
+}
+
+func newLeaf(typ string, payload []byte) *node {
+	return &node{typ: typ, payload: payload}
+}
+
+// iTunes metadata handler: version/flags, pre_defined, "mdir", "appl",
+// two reserved words and an empty name.
+func newMdirHdlr() *node {
+	payload := make([]byte, 25)
+	copy(payload[8:12], "mdir")
+	copy(payload[12:16], "appl")
+	return newLeaf("hdlr", payload)
+}
+
+func be32(b []byte, off int) uint32 {
+	return binary.BigEndian.Uint32(b[off:])
+}
+
+func be64(b []byte, off int) uint64 {
+	return binary.BigEndian.Uint64(b[off:])
+}
+
+func put32(v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return b[:]
+}
@@ -0,0 +1,210 @@
+package mp4meta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"main/utils/dolby"
+)
+
+// PrepareDolby makes a progressive AC-3 or E-AC-3 file a plain MP4: the
+// dac3/dec3 box is rebuilt from the first access unit when it is missing,
+// a chnl box declares the channel layout and the M4A brands are replaced
+// by mp42. It returns the stream configuration.
+func PrepareDolby(path string) (*dolby.Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	boxes, err := scanTopLevel(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	var moovBox *topBox
+	for i := range boxes {
+		switch boxes[i].typ {
+		case "moof":
+			return nil, errors.New("fragmented file")
+		case "moov":
+			if moovBox == nil {
+				moovBox = &boxes[i]
+			}
+		}
+	}
+	if moovBox == nil {
+		return nil, errors.New("moov box not found")
+	}
+	moov, err := readNode(f, *moovBox)
+	if err != nil {
+		return nil, err
+	}
+	stbl := audioStbl(moov)
+	if stbl == nil {
+		return nil, errors.New("no audio track")
+	}
+	stsd := stbl.child("stsd")
+	if stsd == nil || len(stsd.payload) < 16 {
+		return nil, errors.New("invalid stsd")
+	}
+	p := stsd.payload
+	entrySize := int(be32(p, 8))
+	entryType := string(p[12:16])
+	if entryType != "ec-3" && entryType != "ac-3" {
+		return nil, fmt.Errorf("not a Dolby track (%s)", entryType)
+	}
+	if entrySize < 36 || 8+entrySize > len(p) {
+		return nil, errors.New("invalid sample entry")
+	}
+	body := p[16 : 8+entrySize]
+	fixed := 28
+	switch binary.BigEndian.Uint16(body[8:]) {
+	case 1:
+		fixed += 16
+	case 2:
+		fixed += 36
+	}
+	if len(body) < fixed {
+		return nil, errors.New("invalid sample entry")
+	}
+	children, err := parseBoxes(body[fixed:])
+	if err != nil {
+		return nil, err
+	}
+	entry := &node{typ: entryType, children: children, isParent: true}
+
+	configType := "dec3"
+	if entryType == "ac-3" {
+		configType = "dac3"
+	}
+	var cfg *dolby.Config
+	if box := entry.child(configType); box != nil {
+		if configType == "dec3" {
+			cfg, err = dolby.ParseDec3(box.payload)
+		} else {
+			cfg, err = dolby.ParseDac3(box.payload)
+		}
+	}
+	if cfg == nil {
+		if cfg, err = configFromFirstSample(f, stbl); err != nil {
+			return nil, err
+		}
+		entry.remove(configType)
+		typ, payload := cfg.Box()
+		entry.children = append([]*node{newLeaf(typ, payload)}, entry.children...)
+	}
+	entry.remove("chnl")
+	if chnl := cfg.ChnlBox(); chnl != nil {
+		entry.children = append(entry.children, newLeaf("chnl", chnl))
+	}
+
+	entry.prefix = append([]byte{}, body[:fixed]...)
+	newEntry := entry.bytes()
+	stsd.payload = append(append(append([]byte{}, p[:8]...), newEntry...), p[8+entrySize:]...)
+
+	delta := int64(moov.size()) - moovBox.size
+	if delta != 0 {
+		if err := shiftChunkOffsets(moov, boxes, moovBox, delta); err != nil {
+			return nil, err
+		}
+	}
+	write := func(w io.Writer) error {
+		for _, b := range boxes {
+			var data []byte
+			switch {
+			case b.offset == moovBox.offset:
+				data = moov.bytes()
+			case b.typ == "ftyp":
+				data = make([]byte, b.size)
+				if _, err := f.ReadAt(data, b.offset); err != nil {
+					return err
+				}
+				mp42Brands(data[b.header:])
+			default:
+				if _, err := io.Copy(w, io.NewSectionReader(f, b.offset, b.size)); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return cfg, replaceFile(f, path, write)
+}
+
+func audioStbl(moov *node) *node {
+	for _, t := range moov.childrenOf("trak") {
+		if hdlr := t.path("mdia", "hdlr"); hdlr != nil && len(hdlr.payload) >= 12 && string(hdlr.payload[8:12]) == "soun" {
+			return t.path("mdia", "minf", "stbl")
+		}
+	}
+	return nil
+}
+
+// configFromFirstSample parses the sync frames of the first sample, which
+// holds one complete access unit.
+func configFromFirstSample(f *os.File, stbl *node) (*dolby.Config, error) {
+	var offset int64
+	if stco := stbl.child("stco"); stco != nil && len(stco.payload) >= 12 && be32(stco.payload, 4) > 0 {
+		offset = int64(be32(stco.payload, 8))
+	} else if co64 := stbl.child("co64"); co64 != nil && len(co64.payload) >= 16 && be32(co64.payload, 4) > 0 {
+		offset = int64(be64(co64.payload, 8))
+	} else {
+		return nil, errors.New("no chunk offsets")
+	}
+	stsz := stbl.child("stsz")
+	if stsz == nil || len(stsz.payload) < 12 {
+		return nil, errors.New("invalid stsz")
+	}
+	size := be32(stsz.payload, 4)
+	if size == 0 {
+		if be32(stsz.payload, 8) == 0 || len(stsz.payload) < 16 {
+			return nil, errors.New("no samples")
+		}
+		size = be32(stsz.payload, 12)
+	}
+	sample := make([]byte, size)
+	if _, err := f.ReadAt(sample, offset); err != nil {
+		return nil, err
+	}
+	var frames []*dolby.Frame
+	for pos := 0; pos < len(sample); {
+		frame, err := dolby.ParseFrame(sample[pos:])
+		if err != nil {
+			if len(frames) > 0 {
+				break
+			}
+			return nil, err
+		}
+		frames = append(frames, frame)
+		if !frame.EAC3 {
+			break
+		}
+		pos += frame.Size
+	}
+	return dolby.FromFrames(frames)
+}
+
+// mp42Brands switches an ftyp payload from the M4A brand to mp42 in place.
+func mp42Brands(p []byte) {
+	if len(p) < 8 {
+		return
+	}
+	copy(p[:4], "mp42")
+	for i := 8; i+4 <= len(p); i += 4 {
+		if bytes.Equal(p[i:i+4], []byte("M4A ")) {
+			copy(p[i:i+4], "mp42")
+		}
+	}
+}
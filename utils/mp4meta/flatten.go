@@ -0,0 +1,541 @@
+package mp4meta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+type sample struct {
+	duration uint32
+	size     uint32
+	cto      int32
+}
+
+type chunk struct {
+	offset  int64
+	size    int64
+	sdi     uint32
+	samples []sample
+}
+
+type trexDefaults struct {
+	sdi      uint32
+	duration uint32
+	size     uint32
+}
+
+// flatten collects the samples of every fragment and prepares a writer that
+// emits ftyp, a progressive moov and a single mdat. Files it cannot convert
+// without losing information, such as ones with several tracks, are
+// rejected before anything is written.
+func flatten(f *os.File, boxes []topBox, moov *node) (func(w io.Writer) error, error) {
+	traks := moov.childrenOf("trak")
+	if len(traks) != 1 {
+		return nil, fmt.Errorf("flattening supports a single track, found %d", len(traks))
+	}
+	trak := traks[0]
+	trackID, err := tkhdTrackID(trak)
+	if err != nil {
+		return nil, err
+	}
+	defaults := findTrex(moov, trackID)
+	stbl := trak.path("mdia", "minf", "stbl")
+	if stbl == nil {
+		return nil, errors.New("stbl box not found")
+	}
+	groups := newSampleGroups(stbl)
+
+	var ftyp *topBox
+	var chunks []chunk
+	for i := range boxes {
+		b := boxes[i]
+		switch b.typ {
+		case "ftyp":
+			if ftyp == nil {
+				ftyp = &boxes[i]
+			}
+		case "moof":
+			moof, err := readNode(f, b)
+			if err != nil {
+				return nil, err
+			}
+			fragChunks, err := moofChunks(moof, b.offset, trackID, defaults, groups)
+			if err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, fragChunks...)
+		}
+	}
+	if len(chunks) == 0 {
+		return nil, errors.New("no samples found in fragments")
+	}
+
+	var dataSize int64
+	var mediaDuration uint64
+	for _, c := range chunks {
+		dataSize += c.size
+		for _, s := range c.samples {
+			mediaDuration += uint64(s.duration)
+		}
+	}
+	if dataSize+8 > 0xFFFFFFFF {
+		return nil, errors.New("media data too large")
+	}
+
+	stco := rebuildSampleTables(stbl, chunks)
+	groups.apply()
+	moov.remove("mvex")
+	if err := setDurations(moov, trak, mediaDuration); err != nil {
+		return nil, err
+	}
+	ensureIlst(moov)
+
+	var ftypBytes []byte
+	if ftyp != nil {
+		ftypBytes = make([]byte, ftyp.size)
+		if _, err := f.ReadAt(ftypBytes, ftyp.offset); err != nil {
+			return nil, err
+		}
+	}
+	mdatStart := int64(len(ftypBytes)) + int64(moov.size()) + 8
+	if mdatStart+dataSize > 0xFFFFFFFF {
+		return nil, errors.New("chunk offsets exceed stco range")
+	}
+	offsets := stco.payload
+	binary.BigEndian.PutUint32(offsets[4:], uint32(len(chunks)))
+	pos := mdatStart
+	for i, c := range chunks {
+		binary.BigEndian.PutUint32(offsets[8+4*i:], uint32(pos))
+		pos += c.size
+	}
+
+	return func(w io.Writer) error {
+		if _, err := w.Write(ftypBytes); err != nil {
+			return err
+		}
+		if _, err := w.Write(moov.bytes()); err != nil {
+			return err
+		}
+		var header [8]byte
+		binary.BigEndian.PutUint32(header[:4], uint32(dataSize+8))
+		copy(header[4:], "mdat")
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		for _, c := range chunks {
+			if _, err := io.Copy(w, io.NewSectionReader(f, c.offset, c.size)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+func tkhdTrackID(trak *node) (uint32, error) {
+	tkhd := trak.child("tkhd")
+	if tkhd == nil || len(tkhd.payload) < 24 {
+		return 0, errors.New("tkhd box not found")
+	}
+	if tkhd.payload[0] == 1 {
+		return be32(tkhd.payload, 20), nil
+	}
+	return be32(tkhd.payload, 12), nil
+}
+
+func findTrex(moov *node, trackID uint32) trexDefaults {
+	defaults := trexDefaults{sdi: 1}
+	mvex := moov.child("mvex")
+	if mvex == nil {
+		return defaults
+	}
+	for _, trex := range mvex.childrenOf("trex") {
+		p := trex.payload
+		if len(p) < 24 || be32(p, 4) != trackID {
+			continue
+		}
+		defaults.sdi = be32(p, 8)
+		defaults.duration = be32(p, 12)
+		defaults.size = be32(p, 16)
+	}
+	return defaults
+}
+
+func moofChunks(moof *node, moofOffset int64, trackID uint32, defaults trexDefaults, groups *sampleGroups) ([]chunk, error) {
+	var out []chunk
+	nextBase := moofOffset
+	for _, traf := range moof.childrenOf("traf") {
+		tfhd := traf.child("tfhd")
+		if tfhd == nil || len(tfhd.payload) < 8 {
+			return nil, errors.New("tfhd box not found")
+		}
+		p := tfhd.payload
+		flags := be32(p, 0) & 0xFFFFFF
+		pos := 8
+		base := nextBase
+		sdi, duration, size := defaults.sdi, defaults.duration, defaults.size
+		if flags&0x1 != 0 {
+			if len(p) < pos+8 {
+				return nil, errors.New("invalid tfhd")
+			}
+			base = int64(be64(p, pos))
+			pos += 8
+		} else if flags&0x20000 != 0 {
+			base = moofOffset
+		}
+		readField := func() (uint32, error) {
+			if len(p) < pos+4 {
+				return 0, errors.New("invalid tfhd")
+			}
+			v := be32(p, pos)
+			pos += 4
+			return v, nil
+		}
+		var err error
+		if flags&0x2 != 0 {
+			if sdi, err = readField(); err != nil {
+				return nil, err
+			}
+		}
+		if flags&0x8 != 0 {
+			if duration, err = readField(); err != nil {
+				return nil, err
+			}
+		}
+		if flags&0x10 != 0 {
+			if size, err = readField(); err != nil {
+				return nil, err
+			}
+		}
+		if be32(p, 4) != trackID {
+			continue
+		}
+		for _, c := range traf.children {
+			switch c.typ {
+			case "tfhd", "tfdt", "trun", "sbgp", "sgpd":
+			default:
+				return nil, fmt.Errorf("unsupported %s box in fragment", c.typ)
+			}
+		}
+
+		dataPos := base
+		var count uint32
+		for _, trun := range traf.childrenOf("trun") {
+			c, err := parseTrun(trun.payload, base, dataPos, duration, size)
+			if err != nil {
+				return nil, err
+			}
+			c.sdi = sdi
+			dataPos = c.offset + c.size
+			count += uint32(len(c.samples))
+			if len(c.samples) > 0 {
+				out = append(out, c)
+			}
+		}
+		if err := groups.addTraf(traf, count); err != nil {
+			return nil, err
+		}
+		nextBase = dataPos
+	}
+	return out, nil
+}
+
+func parseTrun(p []byte, base, dataPos int64, defaultDuration, defaultSize uint32) (chunk, error) {
+	if len(p) < 8 {
+		return chunk{}, errors.New("invalid trun")
+	}
+	flags := be32(p, 0) & 0xFFFFFF
+	count := int(be32(p, 4))
+	pos := 8
+	c := chunk{offset: dataPos}
+	if flags&0x1 != 0 {
+		if len(p) < pos+4 {
+			return chunk{}, errors.New("invalid trun")
+		}
+		c.offset = base + int64(int32(be32(p, pos)))
+		pos += 4
+	}
+	if flags&0x4 != 0 {
+		pos += 4
+	}
+	entry := 0
+	for _, bit := range []uint32{0x100, 0x200, 0x400, 0x800} {
+		if flags&bit != 0 {
+			entry += 4
+		}
+	}
+	if len(p) < pos+count*entry {
+		return chunk{}, errors.New("invalid trun")
+	}
+	c.samples = make([]sample, count)
+	for i := 0; i < count; i++ {
+		s := sample{duration: defaultDuration, size: defaultSize}
+		if flags&0x100 != 0 {
+			s.duration = be32(p, pos)
+			pos += 4
+		}
+		if flags&0x200 != 0 {
+			s.size = be32(p, pos)
+			pos += 4
+		}
+		if flags&0x400 != 0 {
+			pos += 4
+		}
+		if flags&0x800 != 0 {
+			s.cto = int32(be32(p, pos))
+			pos += 4
+		}
+		c.samples[i] = s
+		c.size += int64(s.size)
+	}
+	return c, nil
+}
+
+// rebuildSampleTables replaces the empty fragmented sample tables with ones
+// describing chunks and returns the stco node whose offsets are filled in
+// once the final layout is known.
+func rebuildSampleTables(stbl *node, chunks []chunk) *node {
+	var stts, stsz, stsc, ctts bytes.Buffer
+
+	var runs [][2]uint32
+	var cttsRuns [][2]int32
+	var sizes []uint32
+	uniform := true
+	hasCto := false
+	for _, c := range chunks {
+		for _, s := range c.samples {
+			if n := len(runs); n > 0 && runs[n-1][1] == s.duration {
+				runs[n-1][0]++
+			} else {
+				runs = append(runs, [2]uint32{1, s.duration})
+			}
+			if n := len(cttsRuns); n > 0 && cttsRuns[n-1][1] == s.cto {
+				cttsRuns[n-1][0]++
+			} else {
+				cttsRuns = append(cttsRuns, [2]int32{1, s.cto})
+			}
+			if s.cto != 0 {
+				hasCto = true
+			}
+			if len(sizes) > 0 && sizes[0] != s.size {
+				uniform = false
+			}
+			sizes = append(sizes, s.size)
+		}
+	}
+
+	stts.Write(put32(0))
+	stts.Write(put32(uint32(len(runs))))
+	for _, r := range runs {
+		stts.Write(put32(r[0]))
+		stts.Write(put32(r[1]))
+	}
+
+	negativeCto := false
+	for _, r := range cttsRuns {
+		if r[1] < 0 {
+			negativeCto = true
+		}
+	}
+	if negativeCto {
+		ctts.Write(put32(1 << 24))
+	} else {
+		ctts.Write(put32(0))
+	}
+	ctts.Write(put32(uint32(len(cttsRuns))))
+	for _, r := range cttsRuns {
+		ctts.Write(put32(uint32(r[0])))
+		ctts.Write(put32(uint32(r[1])))
+	}
+
+	type stscEntry struct{ first, perChunk, sdi uint32 }
+	var entries []stscEntry
+	for i, c := range chunks {
+		n := len(entries)
+		if n > 0 && entries[n-1].perChunk == uint32(len(c.samples)) && entries[n-1].sdi == c.sdi {
+			continue
+		}
+		entries = append(entries, stscEntry{uint32(i + 1), uint32(len(c.samples)), c.sdi})
+	}
+	stsc.Write(put32(0))
+	stsc.Write(put32(uint32(len(entries))))
+	for _, e := range entries {
+		stsc.Write(put32(e.first))
+		stsc.Write(put32(e.perChunk))
+		stsc.Write(put32(e.sdi))
+	}
+
+	stsz.Write(put32(0))
+	if uniform && len(sizes) > 0 {
+		stsz.Write(put32(sizes[0]))
+		stsz.Write(put32(uint32(len(sizes))))
+	} else {
+		stsz.Write(put32(0))
+		stsz.Write(put32(uint32(len(sizes))))
+		for _, s := range sizes {
+			stsz.Write(put32(s))
+		}
+	}
+
+	stco := newLeaf("stco", make([]byte, 8+4*len(chunks)))
+	children := []*node{}
+	if stsd := stbl.child("stsd"); stsd != nil {
+		children = append(children, stsd)
+	}
+	children = append(children, newLeaf("stts", stts.Bytes()))
+	if hasCto {
+		children = append(children, newLeaf("ctts", ctts.Bytes()))
+	}
+	children = append(children,
+		newLeaf("stsc", stsc.Bytes()),
+		newLeaf("stsz", stsz.Bytes()),
+		stco,
+	)
+	for _, c := range stbl.children {
+		switch c.typ {
+		case "stsd", "stts", "ctts", "stsc", "stsz", "stz2", "stco", "co64", "stss":
+			continue
+		}
+		children = append(children, c)
+	}
+	stbl.children = children
+	return stco
+}
+
+func setDurations(moov, trak *node, mediaDuration uint64) error {
+	mdhd := trak.path("mdia", "mdhd")
+	mvhd := moov.child("mvhd")
+	if mdhd == nil || mvhd == nil {
+		return errors.New("mdhd or mvhd box not found")
+	}
+	mediaTimescale, err := writeHeaderDuration(mdhd.payload, mediaDuration)
+	if err != nil {
+		return err
+	}
+	movieTimescale, err := readTimescale(mvhd.payload)
+	if err != nil {
+		return err
+	}
+	movieDuration := mediaDuration
+	if mediaTimescale > 0 {
+		movieDuration = mediaDuration * uint64(movieTimescale) / uint64(mediaTimescale)
+	}
+	if edit, ok, err := fitEditList(trak, mediaDuration, mediaTimescale, movieTimescale); err != nil {
+		return err
+	} else if ok {
+		movieDuration = edit
+	}
+	if _, err := writeHeaderDuration(mvhd.payload, movieDuration); err != nil {
+		return err
+	}
+	if tkhd := trak.child("tkhd"); tkhd != nil {
+		p := tkhd.payload
+		switch {
+		case len(p) > 0 && p[0] == 1 && len(p) >= 36:
+			binary.BigEndian.PutUint64(p[28:], movieDuration)
+		case len(p) > 0 && p[0] == 0 && len(p) >= 24:
+			binary.BigEndian.PutUint32(p[20:], clamp32(movieDuration))
+		default:
+			return errors.New("invalid tkhd box")
+		}
+	}
+	return nil
+}
+
+// fitEditList makes a single edit end with the flattened media, since
+// fragmented files usually leave its duration at zero, and returns the
+// edit's duration in the movie timescale. Edit lists with empty edits,
+// several entries or another rate are rejected.
+func fitEditList(trak *node, mediaDuration uint64, mediaTimescale, movieTimescale uint32) (uint64, bool, error) {
+	elst := trak.path("edts", "elst")
+	if elst == nil {
+		return 0, false, nil
+	}
+	p := elst.payload
+	if len(p) < 8 {
+		return 0, false, errors.New("invalid elst")
+	}
+	count := be32(p, 4)
+	if count == 0 {
+		return 0, false, nil
+	}
+	if count > 1 {
+		return 0, false, fmt.Errorf("edit lists with %d entries are not supported", count)
+	}
+	entry := 12
+	if p[0] == 1 {
+		entry = 20
+	}
+	if len(p) < 8+entry {
+		return 0, false, errors.New("invalid elst")
+	}
+	var dur uint64
+	var mediaTime int64
+	if p[0] == 1 {
+		dur, mediaTime = be64(p, 8), int64(be64(p, 16))
+	} else {
+		dur, mediaTime = uint64(be32(p, 8)), int64(int32(be32(p, 12)))
+	}
+	if mediaTime < 0 {
+		return 0, false, errors.New("empty edits are not supported")
+	}
+	if be32(p, 8+entry-4) != 0x10000 {
+		return 0, false, errors.New("edits with a rate other than 1 are not supported")
+	}
+	if uint64(mediaTime) > mediaDuration {
+		return 0, false, errors.New("edit starts after the end of the media")
+	}
+	available := mediaDuration - uint64(mediaTime)
+	if mediaTimescale > 0 {
+		available = available * uint64(movieTimescale) / uint64(mediaTimescale)
+	}
+	if dur == 0 || dur > available {
+		dur = available
+		if p[0] == 1 {
+			binary.BigEndian.PutUint64(p[8:], dur)
+		} else {
+			binary.BigEndian.PutUint32(p[8:], clamp32(dur))
+		}
+	}
+	return dur, true, nil
+}
+
+// writeHeaderDuration updates the duration of an mvhd or mdhd payload and
+// returns its timescale. Both share the same layout up to the duration.
+func writeHeaderDuration(p []byte, duration uint64) (uint32, error) {
+	if len(p) < 20 {
+		return 0, errors.New("invalid media header")
+	}
+	if p[0] == 1 {
+		if len(p) < 32 {
+			return 0, errors.New("invalid media header")
+		}
+		binary.BigEndian.PutUint64(p[24:], duration)
+		return be32(p, 20), nil
+	}
+	binary.BigEndian.PutUint32(p[16:], clamp32(duration))
+	return be32(p, 12), nil
+}
+
+func readTimescale(p []byte) (uint32, error) {
+	if len(p) < 20 {
+		return 0, errors.New("invalid movie header")
+	}
+	if p[0] == 1 {
+		if len(p) < 24 {
+			return 0, errors.New("invalid movie header")
+		}
+		return be32(p, 20), nil
+	}
+	return be32(p, 12), nil
+}
+
+func clamp32(v uint64) uint32 {
+	if v > 0xFFFFFFFF {
+		return 0xFFFFFFFF
+	}
+	return uint32(v)
+}
@@ -0,0 +1,269 @@
+package mp4meta
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// aacPriming is the encoder delay of Apple's AAC encoder, used when a file
+// signals decoder pre-roll but carries neither an edit list nor iTunSMPB.
+const aacPriming = 2112
+
+// Gapless describes the encoder delay and trailing padding of the first
+// audio track. Counts are in media timescale ticks, which for audio tracks
+// are samples.
+type Gapless struct {
+	Priming uint64
+	Padding uint64
+	Valid   uint64
+	// SampleRate is the media timescale of the track.
+	SampleRate uint32
+	// EditList reports whether an edit list skips the priming. Demuxers such
+	// as ffmpeg's apply it, so only the padding is left to trim.
+	EditList bool
+	// Codec is the sample entry type, e.g. "alac", "mp4a" or "ec-3".
+	Codec string
+}
+
+// ReadGapless reads gapless information from a progressive MP4 file: the
+// iTunSMPB item when present, otherwise the edit list, otherwise a roll
+// sample group marking an AAC track.
+func ReadGapless(path string) (Gapless, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Gapless{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Gapless{}, err
+	}
+	boxes, err := scanTopLevel(f, info.Size())
+	if err != nil {
+		return Gapless{}, err
+	}
+	var moov *node
+	for _, b := range boxes {
+		switch b.typ {
+		case "moof":
+			return Gapless{}, errors.New("fragmented file")
+		case "moov":
+			if moov == nil {
+				if moov, err = readNode(f, b); err != nil {
+					return Gapless{}, err
+				}
+			}
+		}
+	}
+	if moov == nil {
+		return Gapless{}, errors.New("moov box not found")
+	}
+	return gaplessFromMoov(moov)
+}
+
+func gaplessFromMoov(moov *node) (Gapless, error) {
+	var trak *node
+	for _, t := range moov.childrenOf("trak") {
+		if hdlr := t.path("mdia", "hdlr"); hdlr != nil && len(hdlr.payload) >= 12 && string(hdlr.payload[8:12]) == "soun" {
+			trak = t
+			break
+		}
+	}
+	if trak == nil {
+		return Gapless{}, errors.New("no audio track")
+	}
+	stbl := trak.path("mdia", "minf", "stbl")
+	if stbl == nil {
+		return Gapless{}, errors.New("stbl box not found")
+	}
+	total, err := totalDuration(stbl)
+	if err != nil {
+		return Gapless{}, err
+	}
+	mdhd := trak.path("mdia", "mdhd")
+	if mdhd == nil {
+		return Gapless{}, errors.New("mdhd box not found")
+	}
+	mediaScale, err := readTimescale(mdhd.payload)
+	if err != nil {
+		return Gapless{}, err
+	}
+
+	g := Gapless{SampleRate: mediaScale, Codec: sampleEntryType(stbl)}
+	priming, segment, hasEdit := editList(trak)
+	g.EditList = hasEdit && priming > 0
+	if smpb, ok := itunSMPB(moov); ok {
+		s, err := ParseITunSMPB(smpb)
+		if err == nil {
+			s.EditList = g.EditList
+			s.SampleRate = mediaScale
+			s.Codec = g.Codec
+			return s, nil
+		}
+	}
+
+	switch {
+	case hasEdit:
+		g.Priming = priming
+		if segment > 0 {
+			mvhd := moov.child("mvhd")
+			if mvhd == nil {
+				return Gapless{}, errors.New("mvhd box not found")
+			}
+			movieScale, err := readTimescale(mvhd.payload)
+			if err != nil {
+				return Gapless{}, err
+			}
+			if movieScale > 0 {
+				g.Valid = (segment*uint64(mediaScale) + uint64(movieScale)/2) / uint64(movieScale)
+			}
+		}
+	case hasRollGroup(stbl) && sampleEntryType(stbl) == "mp4a":
+		g.Priming = aacPriming
+	}
+	if g.Priming > total {
+		g.Priming = total
+	}
+	if g.Valid == 0 || g.Priming+g.Valid > total {
+		g.Valid = total - g.Priming
+	}
+	g.Padding = total - g.Priming - g.Valid
+	return g, nil
+}
+
+func totalDuration(stbl *node) (uint64, error) {
+	stts := stbl.child("stts")
+	if stts == nil || len(stts.payload) < 8 {
+		return 0, errors.New("invalid stts")
+	}
+	p := stts.payload
+	count := int(be32(p, 4))
+	if len(p) < 8+count*8 {
+		return 0, errors.New("invalid stts")
+	}
+	var total uint64
+	for i := 0; i < count; i++ {
+		total += uint64(be32(p, 8+i*8)) * uint64(be32(p, 12+i*8))
+	}
+	return total, nil
+}
+
+// editList returns the media time and duration of the first non-empty edit.
+func editList(trak *node) (mediaTime, segment uint64, ok bool) {
+	elst := trak.path("edts", "elst")
+	if elst == nil || len(elst.payload) < 8 {
+		return 0, 0, false
+	}
+	p := elst.payload
+	count := int(be32(p, 4))
+	entry := 12
+	if p[0] == 1 {
+		entry = 20
+	}
+	for i := 0; i < count && len(p) >= 8+(i+1)*entry; i++ {
+		off := 8 + i*entry
+		var dur uint64
+		var mt int64
+		if p[0] == 1 {
+			dur, mt = be64(p, off), int64(be64(p, off+8))
+		} else {
+			dur, mt = uint64(be32(p, off)), int64(int32(be32(p, off+4)))
+		}
+		if mt < 0 {
+			continue
+		}
+		return uint64(mt), dur, true
+	}
+	return 0, 0, false
+}
+
+func hasRollGroup(stbl *node) bool {
+	for _, sgpd := range stbl.childrenOf("sgpd") {
+		if len(sgpd.payload) >= 8 && string(sgpd.payload[4:8]) == "roll" {
+			return true
+		}
+	}
+	return false
+}
+
+func sampleEntryType(stbl *node) string {
+	stsd := stbl.child("stsd")
+	if stsd == nil || len(stsd.payload) < 16 {
+		return ""
+	}
+	return string(stsd.payload[12:16])
+}
+
+// itunSMPB finds the ----:com.apple.iTunes:iTunSMPB item.
+func itunSMPB(moov *node) (string, bool) {
+	ilst := moov.path("udta", "meta", "ilst")
+	if ilst == nil {
+		return "", false
+	}
+	for _, item := range ilst.childrenOf("----") {
+		parts, err := parseBoxes(item.payload)
+		if err != nil {
+			continue
+		}
+		var name, value string
+		for _, part := range parts {
+			if len(part.payload) < 4 {
+				continue
+			}
+			switch part.typ {
+			case "name":
+				name = string(part.payload[4:])
+			case "data":
+				if len(part.payload) >= 8 {
+					value = string(part.payload[8:])
+				}
+			}
+		}
+		if strings.EqualFold(name, "iTunSMPB") {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// ParseITunSMPB parses an iTunSMPB value: a zero word, priming, padding
+// and the valid sample count, all hexadecimal.
+func ParseITunSMPB(s string) (Gapless, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 4 {
+		return Gapless{}, fmt.Errorf("invalid iTunSMPB %q", s)
+	}
+	var vals [3]uint64
+	for i := range vals {
+		v, err := strconv.ParseUint(fields[i+1], 16, 64)
+		if err != nil {
+			return Gapless{}, fmt.Errorf("invalid iTunSMPB %q", s)
+		}
+		vals[i] = v
+	}
+	return Gapless{Priming: vals[0], Padding: vals[1], Valid: vals[2]}, nil
+}
+
+// ITunSMPB formats g the way iTunes writes it.
+func (g Gapless) ITunSMPB() string {
+	return fmt.Sprintf(" 00000000 %08X %08X %016X 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000",
+		g.Priming, g.Padding, g.Valid)
+}
+
+// TrimFilter returns an ffmpeg atrim filter that cuts decoded audio to the
+// valid samples, or "" when there is nothing to trim.
+func (g Gapless) TrimFilter() string {
+	if g.Valid == 0 || g.Priming == 0 && g.Padding == 0 {
+		return ""
+	}
+	if g.EditList {
+		if g.Padding == 0 {
+			return ""
+		}
+		return fmt.Sprintf("atrim=end_sample=%d", g.Valid)
+	}
+	return fmt.Sprintf("atrim=start_sample=%d:end_sample=%d,asetpts=PTS-STARTPTS", g.Priming, g.Priming+g.Valid)
+}
@@ -0,0 +1,247 @@
+package mp4meta
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Tag item types that Prepare strips from the ilst. "©too" is the encoder
+// tag written by the packager.
+var removedItems = []string{"\xa9too"}
+
+type topBox struct {
+	typ    string
+	offset int64
+	header int64
+	size   int64
+}
+
+// Prepare makes a downloaded track ready for tag writing: fragmented files
+// are rewritten as a single progressive moov/mdat pair, an empty
+// udta/meta/ilst is created when missing, the encoder tag is removed and
+// chunk offsets are adjusted. Files that need no change are left untouched.
+func Prepare(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	boxes, err := scanTopLevel(f, info.Size())
+	if err != nil {
+		return err
+	}
+
+	var moovBox *topBox
+	fragmented := false
+	for i := range boxes {
+		switch boxes[i].typ {
+		case "moov":
+			if moovBox == nil {
+				moovBox = &boxes[i]
+			}
+		case "moof":
+			fragmented = true
+		}
+	}
+	if moovBox == nil {
+		return errors.New("moov box not found")
+	}
+	moov, err := readNode(f, *moovBox)
+	if err != nil {
+		return err
+	}
+
+	var write func(w io.Writer) error
+	if fragmented {
+		write, err = flatten(f, boxes, moov)
+		if err != nil {
+			return err
+		}
+	} else {
+		changed := ensureIlst(moov)
+		if !changed {
+			return nil
+		}
+		write = func(w io.Writer) error {
+			return rewriteFlat(f, boxes, moovBox, moov, w)
+		}
+	}
+
+	return replaceFile(f, path, write)
+}
+
+// replaceFile writes a new version of path next to it and renames it into
+// place, closing the source f first.
+func replaceFile(f *os.File, path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".mp4meta-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+func scanTopLevel(r io.ReaderAt, fileSize int64) ([]topBox, error) {
+	var boxes []topBox
+	var offset int64
+	header := make([]byte, 16)
+	for offset < fileSize {
+		if fileSize-offset < 8 {
+			return nil, errors.New("truncated box header")
+		}
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		typ := string(header[4:8])
+		hdr := int64(8)
+		switch size {
+		case 0:
+			size = fileSize - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:]))
+			hdr = 16
+		}
+		if size < hdr || offset+size > fileSize {
+			return nil, fmt.Errorf("invalid size for box %q", typ)
+		}
+		boxes = append(boxes, topBox{typ: typ, offset: offset, header: hdr, size: size})
+		offset += size
+	}
+	return boxes, nil
+}
+
+func readNode(r io.ReaderAt, b topBox) (*node, error) {
+	body := make([]byte, b.size-b.header)
+	if _, err := r.ReadAt(body, b.offset+b.header); err != nil {
+		return nil, err
+	}
+	return parseNode(b.typ, body)
+}
+
+// ensureIlst creates moov/udta/meta/ilst when missing and drops unwanted
+// items. It reports whether moov changed.
+func ensureIlst(moov *node) bool {
+	changed := false
+	udta := moov.child("udta")
+	if udta == nil {
+		udta = newParent("udta")
+		moov.children = append(moov.children, udta)
+		changed = true
+	}
+	meta := udta.child("meta")
+	if meta == nil {
+		meta = newParent("meta", newMdirHdlr())
+		meta.prefix = make([]byte, 4)
+		udta.children = append(udta.children, meta)
+		changed = true
+	}
+	ilst := meta.child("ilst")
+	if ilst == nil {
+		ilst = newParent("ilst")
+		meta.children = append(meta.children, ilst)
+		changed = true
+	}
+	for _, typ := range removedItems {
+		if ilst.remove(typ) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// rewriteFlat writes a non-fragmented file with a modified moov, shifting
+// chunk offsets when the moov precedes the media data.
+func rewriteFlat(f *os.File, boxes []topBox, moovBox *topBox, moov *node, w io.Writer) error {
+	delta := int64(moov.size()) - moovBox.size
+	if delta != 0 {
+		if err := shiftChunkOffsets(moov, boxes, moovBox, delta); err != nil {
+			return err
+		}
+	}
+	for _, b := range boxes {
+		if b.offset == moovBox.offset {
+			if _, err := w.Write(moov.bytes()); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(f, b.offset, b.size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func shiftChunkOffsets(moov *node, boxes []topBox, moovBox *topBox, delta int64) error {
+	for _, trak := range moov.childrenOf("trak") {
+		stbl := trak.path("mdia", "minf", "stbl")
+		if stbl == nil {
+			continue
+		}
+		if stco := stbl.child("stco"); stco != nil {
+			p := stco.payload
+			if len(p) < 8 {
+				return errors.New("invalid stco")
+			}
+			count := int(be32(p, 4))
+			if len(p) < 8+count*4 {
+				return errors.New("invalid stco")
+			}
+			for i := 0; i < count; i++ {
+				off := int64(be32(p, 8+i*4))
+				if off < moovBox.offset {
+					continue
+				}
+				shifted := off + delta
+				if shifted < 0 || shifted > 0xFFFFFFFF {
+					return errors.New("chunk offset out of range for stco")
+				}
+				binary.BigEndian.PutUint32(p[8+i*4:], uint32(shifted))
+			}
+		}
+		if co64 := stbl.child("co64"); co64 != nil {
+			p := co64.payload
+			if len(p) < 8 {
+				return errors.New("invalid co64")
+			}
+			count := int(be32(p, 4))
+			if len(p) < 8+count*8 {
+				return errors.New("invalid co64")
+			}
+			for i := 0; i < count; i++ {
+				off := int64(be64(p, 8+i*8))
+				if off < moovBox.offset {
+					continue
+				}
+				binary.BigEndian.PutUint64(p[8+i*8:], uint64(off+delta))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,499 @@
+package mp4meta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zhaarey/go-mp4tag"
+)
+
+func box(typ string, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	out := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(out, uint32(8+len(body)))
+	copy(out[4:], typ)
+	return append(out, body...)
+}
+
+func u32(vals ...uint32) []byte {
+	out := make([]byte, 4*len(vals))
+	for i, v := range vals {
+		binary.BigEndian.PutUint32(out[4*i:], v)
+	}
+	return out
+}
+
+func zeros(n int) []byte { return make([]byte, n) }
+
+func mvhd(duration uint32) []byte {
+	return box("mvhd", u32(0, 0, 0, 1000, duration), zeros(80))
+}
+
+func tkhd(duration uint32) []byte {
+	return box("tkhd", u32(7, 0, 0, 1, 0, duration), zeros(60))
+}
+
+func mdhd(duration uint32) []byte {
+	return box("mdhd", u32(0, 0, 0, 44100, duration), zeros(4))
+}
+
+var (
+	ftypBox = box("ftyp", []byte("M4A "), u32(0), []byte("M4A isom"))
+	hdlrBox = box("hdlr", u32(0, 0), []byte("soun"), zeros(13))
+	stsdBox = box("stsd", u32(0, 1), box("alac", zeros(8)))
+	ilstHdl = box("hdlr", u32(0, 0), []byte("mdirappl"), zeros(9))
+)
+
+func trak(duration, mediaDuration uint32, stbl ...[]byte) []byte {
+	return box("trak",
+		tkhd(duration),
+		box("mdia", mdhd(mediaDuration), hdlrBox,
+			box("minf", box("stbl", stbl...))))
+}
+
+func emptyIlst() []byte {
+	return box("udta", box("meta", u32(0), ilstHdl, box("ilst")))
+}
+
+func fragment(payload []byte, sizes ...uint32) []byte {
+	return fragmentWith(nil, payload, sizes...)
+}
+
+// fragmentWith adds extra boxes after the trun of the fragment's traf.
+func fragmentWith(extra []byte, payload []byte, sizes ...uint32) []byte {
+	trunBody := append(u32(0x201, uint32(len(sizes)), 0), u32(sizes...)...)
+	build := func(dataOffset uint32) []byte {
+		binary.BigEndian.PutUint32(trunBody[8:], dataOffset)
+		return box("moof",
+			box("mfhd", u32(0, 1)),
+			box("traf",
+				box("tfhd", u32(0x20000, 1)),
+				box("trun", trunBody),
+				extra))
+	}
+	moof := build(0)
+	moof = build(uint32(len(moof) + 8))
+	return append(moof, box("mdat", payload)...)
+}
+
+func writeTemp(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "track.m4a")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return path
+}
+
+func assertFile(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("unexpected output\n got: %x\nwant: %x", got, want)
+	}
+}
+
+func fragmentedSample() []byte {
+	return fragmentedFile(nil,
+		fragment([]byte("abcdefgh"), 3, 5),
+		fragment([]byte("ijkl"), 4))
+}
+
+// fragmentedFile builds an init segment whose track carries edts, followed
+// by the given fragments.
+func fragmentedFile(edts []byte, fragments ...[]byte) []byte {
+	moov := box("moov",
+		mvhd(0),
+		box("trak",
+			tkhd(0),
+			edts,
+			box("mdia", mdhd(0), hdlrBox,
+				box("minf", box("stbl",
+					stsdBox,
+					box("stts", u32(0, 0)),
+					box("stsc", u32(0, 0)),
+					box("stsz", u32(0, 0, 0)),
+					box("stco", u32(0, 0)))))),
+		box("mvex", box("trex", u32(0, 1, 1, 1024, 0, 0))))
+	file := append([]byte{}, ftypBox...)
+	file = append(file, moov...)
+	for _, f := range fragments {
+		file = append(file, f...)
+	}
+	return file
+}
+
+// preparedStbl flattens data and returns the resulting sample table.
+func preparedStbl(t *testing.T, data []byte) *node {
+	t.Helper()
+	path := writeTemp(t, data)
+	if err := Prepare(path); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	out, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	boxes, err := parseBoxes(out)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	for _, b := range boxes {
+		if b.typ == "moov" {
+			return b.path("trak", "mdia", "minf", "stbl")
+		}
+	}
+	t.Fatalf("moov box not found")
+	return nil
+}
+
+func TestPrepareFlattensFragments(t *testing.T) {
+	path := writeTemp(t, fragmentedSample())
+	if err := Prepare(path); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+
+	// 3 samples of 1024 at 44.1 kHz is 69 ms in the movie timescale.
+	build := func(first, second uint32) []byte {
+		return box("moov",
+			mvhd(69),
+			trak(69, 3072,
+				stsdBox,
+				box("stts", u32(0, 1, 3, 1024)),
+				box("stsc", u32(0, 2, 1, 2, 1, 2, 1, 1)),
+				box("stsz", u32(0, 0, 3, 3, 5, 4)),
+				box("stco", u32(0, 2, first, second))),
+			emptyIlst())
+	}
+	start := uint32(len(ftypBox) + len(build(0, 0)) + 8)
+	want := append([]byte{}, ftypBox...)
+	want = append(want, build(start, start+8)...)
+	want = append(want, box("mdat", []byte("abcdefghijkl"))...)
+	assertFile(t, path, want)
+
+	if err := Prepare(path); err != nil {
+		t.Fatalf("second prepare: %v", err)
+	}
+	assertFile(t, path, want)
+}
+
+func TestPrepareMergesFragmentSampleGroups(t *testing.T) {
+	// The first fragment points its two samples at a description of its
+	// own, the second leaves its sample ungrouped.
+	roll := box("sgpd", u32(1<<24), []byte("roll"), u32(2, 1), []byte{0xFF, 0xFF})
+	sbgp := box("sbgp", u32(0), []byte("roll"), u32(1, 2, 0x10001))
+	stbl := preparedStbl(t, fragmentedFile(nil,
+		fragmentWith(append(roll, sbgp...), []byte("abcdefgh"), 3, 5),
+		fragment([]byte("ijkl"), 4)))
+
+	sgpd := stbl.child("sgpd")
+	if sgpd == nil || !bytes.Equal(sgpd.payload, roll[8:]) {
+		t.Fatalf("unexpected sgpd %+v", sgpd)
+	}
+	got := stbl.child("sbgp")
+	want := append(append(u32(0), []byte("roll")...), u32(2, 2, 1, 1, 0)...)
+	if got == nil || !bytes.Equal(got.payload, want) {
+		t.Fatalf("unexpected sbgp %+v", got)
+	}
+}
+
+func TestPrepareFitsEditList(t *testing.T) {
+	// 3072 samples at 44.1 kHz less 1000 skipped ones is 46 ms.
+	edts := box("edts", box("elst", u32(0, 1, 0, 1000, 0x10000)))
+	path := writeTemp(t, fragmentedFile(edts,
+		fragment([]byte("abcdefgh"), 3, 5),
+		fragment([]byte("ijkl"), 4)))
+	if err := Prepare(path); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if !bytes.Contains(data, box("elst", u32(0, 1, 46, 1000, 0x10000))) {
+		t.Fatalf("edit list not fitted to the media")
+	}
+	if !bytes.Contains(data, mvhd(46)) {
+		t.Fatalf("movie duration does not follow the edit")
+	}
+}
+
+// TestPrepareRealFragmentedFile flattens testdata/opus_fragmented.mp4, the
+// Opus stream of mp4ff's opus.mp4 with its encoder edit list, split into
+// two fragments that each carry the roll group the Opus mapping asks for.
+func TestPrepareRealFragmentedFile(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "opus_fragmented.mp4"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var audio []byte
+	for _, b := range mustParse(t, data) {
+		if b.typ == "mdat" {
+			audio = append(audio, b.payload...)
+		}
+	}
+	path := writeTemp(t, data)
+	if err := Prepare(path); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	out, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	var moov, mdat *node
+	for _, b := range mustParse(t, out) {
+		switch b.typ {
+		case "moov":
+			moov = b
+		case "mdat":
+			mdat = b
+		case "moof":
+			t.Fatalf("fragment left in the flattened file")
+		}
+	}
+	if moov == nil || mdat == nil || !bytes.Equal(mdat.payload, audio) {
+		t.Fatalf("audio not carried over unchanged")
+	}
+	stbl := moov.path("trak", "mdia", "minf", "stbl")
+	// Both fragments share one description; the 50 samples form one run.
+	roll := append(append(append(u32(1<<24), []byte("roll")...), u32(2, 1)...), 0xFF, 0xFC)
+	if sgpd := stbl.child("sgpd"); sgpd == nil || !bytes.Equal(sgpd.payload, roll) {
+		t.Fatalf("unexpected sgpd %+v", sgpd)
+	}
+	if sbgp := stbl.child("sbgp"); sbgp == nil || !bytes.Equal(sbgp.payload, append(append(u32(0), []byte("roll")...), u32(1, 50, 1)...)) {
+		t.Fatalf("unexpected sbgp %+v", sbgp)
+	}
+	// 50 frames of 960 samples at 48 kHz less the 312 pre-skip samples.
+	if elst := moov.path("trak", "edts", "elst"); elst == nil || !bytes.Equal(elst.payload, u32(0, 1, 993, 312, 0x10000)) {
+		t.Fatalf("unexpected elst %+v", elst)
+	}
+	if d := binary.BigEndian.Uint32(moov.child("mvhd").payload[16:]); d != 993 {
+		t.Fatalf("movie duration %d, want 993", d)
+	}
+
+	g, err := ReadGapless(path)
+	if err != nil {
+		t.Fatalf("read gapless: %v", err)
+	}
+	if g.Priming != 312 || !g.EditList || g.SampleRate != 48000 {
+		t.Fatalf("unexpected gapless info %+v", g)
+	}
+}
+
+func mustParse(t *testing.T, data []byte) []*node {
+	t.Helper()
+	boxes, err := parseBoxes(data)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	return boxes
+}
+
+func TestPrepareRejectsUnsupportedFragments(t *testing.T) {
+	twoTracks := fragmentedSample()
+	moov := bytes.Index(twoTracks, []byte("trak")) - 4
+	size := int(binary.BigEndian.Uint32(twoTracks[moov:]))
+	twoTracks = append(twoTracks[:moov+size:moov+size], twoTracks[moov:]...)
+	binary.BigEndian.PutUint32(twoTracks[len(ftypBox):], binary.BigEndian.Uint32(twoTracks[len(ftypBox):])+uint32(size))
+
+	// A version 1 tkhd too short for its 64-bit duration.
+	shortTkhd := bytes.Replace(fragmentedSample(), tkhd(0), box("tkhd", u32(1<<24|7, 0, 0, 0, 0, 1, 0, 0)), 1)
+	for _, typ := range []string{"moov", "trak"} {
+		at := bytes.Index(shortTkhd, []byte(typ)) - 4
+		binary.BigEndian.PutUint32(shortTkhd[at:], binary.BigEndian.Uint32(shortTkhd[at:])-uint32(len(tkhd(0))-40))
+	}
+
+	frags := [][]byte{fragment([]byte("abcdefgh"), 3, 5)}
+	cases := map[string][]byte{
+		"two tracks":  twoTracks,
+		"short tkhd":  shortTkhd,
+		"empty edit":  fragmentedFile(box("edts", box("elst", u32(0, 1, 10, 0xFFFFFFFF, 0x10000))), frags...),
+		"encrypted":   fragmentedFile(nil, fragmentWith(box("senc", u32(0, 0)), []byte("abcdefgh"), 3, 5)),
+		"v0 sgpd":     fragmentedFile(nil, fragmentWith(append(box("sgpd", u32(0), []byte("roll"), u32(1), []byte{0xFF, 0xFF}), box("sbgp", u32(0), []byte("roll"), u32(1, 2, 0x10001))...), []byte("abcdefgh"), 3, 5)),
+		"missing ref": fragmentedFile(nil, fragmentWith(box("sbgp", u32(0), []byte("roll"), u32(1, 2, 0x10001)), []byte("abcdefgh"), 3, 5)),
+	}
+	for name, data := range cases {
+		path := writeTemp(t, data)
+		if err := Prepare(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		assertFile(t, path, data)
+	}
+}
+
+func TestPrepareRemovesEncoderTag(t *testing.T) {
+	item := func(typ, value string) []byte {
+		return box(typ, box("data", u32(1, 0), []byte(value)))
+	}
+	build := func(offset uint32, items ...[]byte) []byte {
+		return box("moov",
+			mvhd(1),
+			trak(1, 44,
+				stsdBox,
+				box("stts", u32(0, 1, 1, 44)),
+				box("stsc", u32(0, 1, 1, 1, 1)),
+				box("stsz", u32(0, 4, 1)),
+				box("stco", u32(0, 1, offset))),
+			box("udta", box("meta", u32(0), ilstHdl, box("ilst", items...))))
+	}
+	title := item("\xa9nam", "Song")
+	tool := item("\xa9too", "Lavf60.16.100")
+
+	in := append([]byte{}, ftypBox...)
+	moov := build(0, title, tool)
+	in = append(in, build(uint32(len(ftypBox)+len(moov)+8), title, tool)...)
+	in = append(in, box("mdat", []byte("wxyz"))...)
+	path := writeTemp(t, in)
+	if err := Prepare(path); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+
+	want := append([]byte{}, ftypBox...)
+	moov = build(0, title)
+	want = append(want, build(uint32(len(ftypBox)+len(moov)+8), title)...)
+	want = append(want, box("mdat", []byte("wxyz"))...)
+	assertFile(t, path, want)
+}
+
+func TestPreparedFileAcceptsTagsAndCover(t *testing.T) {
+	path := writeTemp(t, fragmentedSample())
+	if err := Prepare(path); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	cover := []byte{0xFF, 0xD8, 0xFF, 0xE0, 1, 2, 3, 4}
+	write := func(pics ...*mp4tag.MP4Picture) {
+		mp4, err := mp4tag.Open(path)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		defer mp4.Close()
+		tags := &mp4tag.MP4Tags{Title: "Song", Pictures: pics}
+		if err := mp4.Write(tags, []string{"allpictures"}); err != nil {
+			t.Fatalf("write tags: %v", err)
+		}
+	}
+	write(&mp4tag.MP4Picture{Format: mp4tag.ImageTypeAuto, Data: cover})
+	write(&mp4tag.MP4Picture{Format: mp4tag.ImageTypeAuto, Data: cover})
+
+	mp4, err := mp4tag.Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer mp4.Close()
+	tags, err := mp4.Read()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if tags.Title != "Song" {
+		t.Fatalf("unexpected title %q", tags.Title)
+	}
+	if len(tags.Pictures) != 1 || !bytes.Equal(tags.Pictures[0].Data, cover) {
+		t.Fatalf("expected a single embedded cover, got %d", len(tags.Pictures))
+	}
+	data, _ := os.ReadFile(path)
+	if !bytes.Contains(data, []byte("abcdefghijkl")) {
+		t.Fatalf("media data lost after tagging")
+	}
+}
+
+func TestReadGapless(t *testing.T) {
+	// 10 AAC frames with a 2112 sample edit and 8000 valid samples at a
+	// 1000 Hz movie timescale (about 181 ms).
+	aac := box("stsd", u32(0, 1), box("mp4a", zeros(8)))
+	build := func(extra ...[]byte) []byte {
+		elst := box("edts", box("elst", u32(0, 1, 181, 2112, 0x10000)))
+		moov := box("moov",
+			mvhd(232),
+			box("trak",
+				tkhd(232),
+				elst,
+				box("mdia", mdhd(10240), hdlrBox,
+					box("minf", box("stbl", aac, box("stts", u32(0, 1, 10, 1024)))))),
+			bytes.Join(extra, nil))
+		return append(append([]byte{}, ftypBox...), moov...)
+	}
+
+	g, err := ReadGapless(writeTemp(t, build()))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if g.Priming != 2112 || g.Valid != 7982 || g.Padding != 146 || !g.EditList || g.SampleRate != 44100 {
+		t.Fatalf("unexpected gapless info %+v", g)
+	}
+	if got := g.TrimFilter(); got != "atrim=end_sample=7982" {
+		t.Fatalf("trim filter = %q", got)
+	}
+
+	// An iTunSMPB item wins over the rounded edit duration.
+	smpb := Gapless{Priming: 2112, Padding: 128, Valid: 8000}
+	item := box("----",
+		box("mean", u32(0), []byte("com.apple.iTunes")),
+		box("name", u32(0), []byte("iTunSMPB")),
+		box("data", u32(1, 0), []byte(smpb.ITunSMPB())))
+	udta := box("udta", box("meta", u32(0), ilstHdl, box("ilst", item)))
+	g, err = ReadGapless(writeTemp(t, build(udta)))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if g.Priming != 2112 || g.Padding != 128 || g.Valid != 8000 || !g.EditList {
+		t.Fatalf("unexpected gapless info %+v", g)
+	}
+
+	g.EditList = false
+	if got := g.TrimFilter(); got != "atrim=start_sample=2112:end_sample=10112,asetpts=PTS-STARTPTS" {
+		t.Fatalf("trim filter = %q", got)
+	}
+}
+
+func TestPrepareDolby(t *testing.T) {
+	// One 48 kHz 640 kbit/s 5.1 AC-3 frame header and no dac3 box.
+	frame := []byte{0x0B, 0x77, 0, 0, 0x24, 0x40, 0xE1, 0x00}
+	build := func(offset uint32) []byte {
+		return box("moov",
+			mvhd(32),
+			trak(32, 1536,
+				box("stsd", u32(0, 1), box("ac-3", zeros(28))),
+				box("stts", u32(0, 1, 1, 1536)),
+				box("stsc", u32(0, 1, 1, 1, 1)),
+				box("stsz", u32(0, 8, 1)),
+				box("stco", u32(0, 1, offset))))
+	}
+	in := append([]byte{}, ftypBox...)
+	in = append(in, build(uint32(len(ftypBox)+len(build(0))+8))...)
+	in = append(in, box("mdat", frame)...)
+	path := writeTemp(t, in)
+
+	cfg, err := PrepareDolby(path)
+	if err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	if cfg.EAC3 || cfg.DataRate != 640 || cfg.Layout() != "5.1" {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data[8:12]) != "mp42" || bytes.Contains(data[:len(ftypBox)], []byte("M4A ")) {
+		t.Fatalf("unexpected ftyp %q", data[:len(ftypBox)])
+	}
+	for _, typ := range []string{"dac3", "chnl"} {
+		if !bytes.Contains(data, []byte(typ)) {
+			t.Fatalf("%s box missing", typ)
+		}
+	}
+	stco := bytes.Index(data, []byte("stco"))
+	offset := binary.BigEndian.Uint32(data[stco+12:])
+	if !bytes.Equal(data[offset:offset+8], frame) {
+		t.Fatalf("chunk offset %d does not point at the frame", offset)
+	}
+
+	again, err := PrepareDolby(path)
+	if err != nil || again.DataRate != 640 {
+		t.Fatalf("second prepare: %+v, %v", again, err)
+	}
+	if second, _ := os.ReadFile(path); !bytes.Equal(second, data) {
+		t.Fatalf("second prepare changed the file")
+	}
+}
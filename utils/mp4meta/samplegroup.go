@@ -0,0 +1,274 @@
+package mp4meta
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// fragmentGroupBase is added to sbgp indices that point at the sgpd of the
+// fragment itself rather than the one in the sample table.
+const fragmentGroupBase = 0x10000
+
+// groupDescription is a parsed sgpd payload. Version 0 boxes do not carry
+// entry lengths, so only versions 1 and 2 can be split into entries.
+type groupDescription struct {
+	version       byte
+	defaultLength uint32
+	defaultIndex  uint32
+	entries       [][]byte
+}
+
+// sampleGroups merges the sample-to-group runs of every fragment into one
+// sbgp per grouping type, moving descriptions local to a fragment into the
+// sample table's sgpd.
+type sampleGroups struct {
+	stbl    *node
+	order   []string
+	runs    map[string][][2]uint32
+	params  map[string][]byte
+	descs   map[string]*groupDescription
+	changed map[string]bool
+	samples uint32
+}
+
+func newSampleGroups(stbl *node) *sampleGroups {
+	return &sampleGroups{
+		stbl:    stbl,
+		runs:    make(map[string][][2]uint32),
+		params:  make(map[string][]byte),
+		descs:   make(map[string]*groupDescription),
+		changed: make(map[string]bool),
+	}
+}
+
+// addTraf records the groups of a fragment holding count samples.
+func (g *sampleGroups) addTraf(traf *node, count uint32) error {
+	local := make(map[string]*groupDescription)
+	for _, sgpd := range traf.childrenOf("sgpd") {
+		typ, d, err := parseSgpd(sgpd.payload)
+		if err != nil {
+			return err
+		}
+		local[typ] = d
+	}
+	for _, sbgp := range traf.childrenOf("sbgp") {
+		p := sbgp.payload
+		if len(p) < 12 {
+			return errors.New("invalid sbgp")
+		}
+		typ := string(p[4:8])
+		pos := 8
+		var param []byte
+		if p[0] == 1 {
+			param = p[8:12]
+			pos = 12
+		}
+		if len(p) < pos+4 {
+			return errors.New("invalid sbgp")
+		}
+		n := int(be32(p, pos))
+		pos += 4
+		if len(p) < pos+8*n {
+			return errors.New("invalid sbgp")
+		}
+
+		if _, ok := g.runs[typ]; !ok {
+			g.order = append(g.order, typ)
+			g.params[typ] = param
+		} else if !bytes.Equal(g.params[typ], param) {
+			return fmt.Errorf("sbgp %q changes its grouping parameter between fragments", typ)
+		}
+		runs := pad(g.runs[typ], g.samples)
+		var covered uint32
+		for i := 0; i < n; i++ {
+			samples, index := be32(p, pos), be32(p, pos+4)
+			pos += 8
+			if index > fragmentGroupBase {
+				d := local[typ]
+				if d == nil || int(index-fragmentGroupBase) > len(d.entries) {
+					return fmt.Errorf("sbgp %q refers to a missing description", typ)
+				}
+				var err error
+				if index, err = g.globalIndex(typ, d, d.entries[index-fragmentGroupBase-1]); err != nil {
+					return err
+				}
+			}
+			runs = appendRun(runs, samples, index)
+			covered += samples
+		}
+		if covered > count {
+			return fmt.Errorf("sbgp %q describes more samples than its fragment", typ)
+		}
+		g.runs[typ] = runs
+	}
+	g.samples += count
+	return nil
+}
+
+// globalIndex returns the 1-based index of entry in the sample table's
+// description of typ, appending it when it is not there yet.
+func (g *sampleGroups) globalIndex(typ string, local *groupDescription, entry []byte) (uint32, error) {
+	d := g.descs[typ]
+	if d == nil {
+		for _, sgpd := range g.stbl.childrenOf("sgpd") {
+			if len(sgpd.payload) < 8 || string(sgpd.payload[4:8]) != typ {
+				continue
+			}
+			var err error
+			if _, d, err = parseSgpd(sgpd.payload); err != nil {
+				return 0, err
+			}
+		}
+		if d == nil {
+			d = &groupDescription{version: local.version, defaultLength: local.defaultLength, defaultIndex: local.defaultIndex}
+		}
+		g.descs[typ] = d
+	}
+	if d.version != local.version || d.defaultLength != local.defaultLength {
+		return 0, fmt.Errorf("sgpd %q of a fragment does not match the sample table", typ)
+	}
+	for i, e := range d.entries {
+		if bytes.Equal(e, entry) {
+			return uint32(i + 1), nil
+		}
+	}
+	d.entries = append(d.entries, entry)
+	g.changed[typ] = true
+	return uint32(len(d.entries)), nil
+}
+
+// apply replaces the sample table's sbgp boxes with the merged runs and
+// writes back the descriptions that gained entries.
+func (g *sampleGroups) apply() {
+	for _, typ := range g.order {
+		kept := g.stbl.children[:0]
+		for _, c := range g.stbl.children {
+			if c.typ == "sbgp" && len(c.payload) >= 8 && string(c.payload[4:8]) == typ {
+				continue
+			}
+			if c.typ == "sgpd" && g.changed[typ] && len(c.payload) >= 8 && string(c.payload[4:8]) == typ {
+				continue
+			}
+			kept = append(kept, c)
+		}
+		g.stbl.children = kept
+		if g.changed[typ] {
+			g.stbl.children = append(g.stbl.children, newLeaf("sgpd", g.descs[typ].encode(typ)))
+		}
+
+		runs := pad(g.runs[typ], g.samples)
+		grouped := false
+		for _, r := range runs {
+			if r[1] != 0 {
+				grouped = true
+			}
+		}
+		if !grouped {
+			continue
+		}
+		var buf bytes.Buffer
+		if param := g.params[typ]; param != nil {
+			buf.Write(put32(1 << 24))
+			buf.WriteString(typ)
+			buf.Write(param)
+		} else {
+			buf.Write(put32(0))
+			buf.WriteString(typ)
+		}
+		buf.Write(put32(uint32(len(runs))))
+		for _, r := range runs {
+			buf.Write(put32(r[0]))
+			buf.Write(put32(r[1]))
+		}
+		g.stbl.children = append(g.stbl.children, newLeaf("sbgp", buf.Bytes()))
+	}
+}
+
+// pad extends runs with ungrouped samples until it covers total samples.
+func pad(runs [][2]uint32, total uint32) [][2]uint32 {
+	var covered uint32
+	for _, r := range runs {
+		covered += r[0]
+	}
+	if covered < total {
+		runs = appendRun(runs, total-covered, 0)
+	}
+	return runs
+}
+
+func appendRun(runs [][2]uint32, samples, index uint32) [][2]uint32 {
+	if samples == 0 {
+		return runs
+	}
+	if n := len(runs); n > 0 && runs[n-1][1] == index {
+		runs[n-1][0] += samples
+		return runs
+	}
+	return append(runs, [2]uint32{samples, index})
+}
+
+func parseSgpd(p []byte) (string, *groupDescription, error) {
+	if len(p) < 8 {
+		return "", nil, errors.New("invalid sgpd")
+	}
+	typ := string(p[4:8])
+	d := &groupDescription{version: p[0]}
+	if d.version == 0 {
+		return "", nil, fmt.Errorf("sgpd %q version 0 is not supported", typ)
+	}
+	pos := 8
+	read := func() (uint32, error) {
+		if len(p) < pos+4 {
+			return 0, errors.New("invalid sgpd")
+		}
+		v := be32(p, pos)
+		pos += 4
+		return v, nil
+	}
+	var err error
+	if d.defaultLength, err = read(); err != nil {
+		return "", nil, err
+	}
+	if d.version >= 2 {
+		if d.defaultIndex, err = read(); err != nil {
+			return "", nil, err
+		}
+	}
+	n, err := read()
+	if err != nil {
+		return "", nil, err
+	}
+	for i := uint32(0); i < n; i++ {
+		length := d.defaultLength
+		if length == 0 {
+			if length, err = read(); err != nil {
+				return "", nil, err
+			}
+		}
+		if len(p) < pos+int(length) {
+			return "", nil, errors.New("invalid sgpd")
+		}
+		d.entries = append(d.entries, p[pos:pos+int(length)])
+		pos += int(length)
+	}
+	return typ, d, nil
+}
+
+func (d *groupDescription) encode(typ string) []byte {
+	var buf bytes.Buffer
+	buf.Write(put32(uint32(d.version) << 24))
+	buf.WriteString(typ)
+	buf.Write(put32(d.defaultLength))
+	if d.version >= 2 {
+		buf.Write(put32(d.defaultIndex))
+	}
+	buf.Write(put32(uint32(len(d.entries))))
+	for _, e := range d.entries {
+		if d.defaultLength == 0 {
+			buf.Write(put32(uint32(len(e))))
+		}
+		buf.Write(e)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,146 @@
+// Package multiformat describes jobs that download one release in several
+// formats, such as "alac,atmos,aac-binaural", and collects which formats
+// each track was available in.
+package multiformat
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Format is one download mode of a multi-format job.
+type Format struct {
+	Name  string
+	Atmos bool
+	AC3   bool
+	// AacType is set for the AAC formats and names the aac-type to use.
+	AacType string
+}
+
+// Codec is the codec label the download mode uses for {Codec}.
+func (f Format) Codec() string {
+	switch {
+	case f.Atmos:
+		return "ATMOS"
+	case f.AC3:
+		return "AC3"
+	case f.AacType != "":
+		return "AAC"
+	}
+	return "ALAC"
+}
+
+// Parse reads a comma separated list of formats. "lossless" is accepted as
+// an alias of "alac".
+func Parse(spec string) ([]Format, error) {
+	var out []Format
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(spec, ",") {
+		name := strings.ToLower(strings.TrimSpace(part))
+		if name == "" {
+			continue
+		}
+		f := Format{Name: name}
+		switch name {
+		case "alac", "lossless":
+			f.Name = "alac"
+		case "atmos":
+			f.Atmos = true
+		case "ac3":
+			f.AC3 = true
+		case "aac", "aac-lc", "aac-binaural", "aac-downmix":
+			f.AacType = name
+		default:
+			return nil, fmt.Errorf("unknown format %q", part)
+		}
+		if seen[f.Name] {
+			return nil, fmt.Errorf("format %q listed twice", f.Name)
+		}
+		seen[f.Name] = true
+		out = append(out, f)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no formats in %q", spec)
+	}
+	return out, nil
+}
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+	StatusError       = "error"
+)
+
+// Report records the outcome of every track in every format of a job.
+type Report struct {
+	formats []Format
+	keys    []string
+	names   map[string]string
+	status  map[string]map[string]string
+}
+
+func NewReport(formats []Format) *Report {
+	return &Report{
+		formats: formats,
+		names:   make(map[string]string),
+		status:  make(map[string]map[string]string),
+	}
+}
+
+// Set records status for the track identified by key in format. Tracks are
+// listed in the order they were first seen.
+func (r *Report) Set(key, name, format, status string) {
+	if _, ok := r.status[key]; !ok {
+		r.keys = append(r.keys, key)
+		r.names[key] = name
+		r.status[key] = make(map[string]string)
+	}
+	r.status[key][format] = status
+}
+
+// Empty reports whether no track was recorded.
+func (r *Report) Empty() bool {
+	return len(r.keys) == 0
+}
+
+// Header returns the table header: the track column and one column per
+// format.
+func (r *Report) Header() []string {
+	header := []string{"Track"}
+	for _, f := range r.formats {
+		header = append(header, f.Name)
+	}
+	return header
+}
+
+// Rows returns one row per track. Formats the track was not attempted in
+// are shown as "-".
+func (r *Report) Rows() [][]string {
+	rows := make([][]string, 0, len(r.keys))
+	for _, key := range r.keys {
+		row := []string{r.names[key]}
+		for _, f := range r.formats {
+			status := r.status[key][f.Name]
+			if status == "" {
+				status = "-"
+			}
+			row = append(row, status)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// Summary counts the tracks that ended in each status, per format.
+func (r *Report) Summary() map[string]map[string]int {
+	out := make(map[string]map[string]int)
+	for _, f := range r.formats {
+		out[f.Name] = make(map[string]int)
+		for _, key := range r.keys {
+			if status := r.status[key][f.Name]; status != "" {
+				out[f.Name][status]++
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,40 @@
+package multiformat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	formats, err := Parse("alac, Atmos,aac-binaural")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(formats) != 3 || formats[0].Codec() != "ALAC" || !formats[1].Atmos || formats[2].AacType != "aac-binaural" {
+		t.Fatalf("unexpected formats %+v", formats)
+	}
+	for _, bad := range []string{"", "alac,lossless", "flac"} {
+		if _, err := Parse(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	formats, _ := Parse("alac,atmos")
+	r := NewReport(formats)
+	r.Set("1", "01. Intro", "alac", StatusOK)
+	r.Set("2", "02. Song", "alac", StatusOK)
+	r.Set("1", "01. Intro", "atmos", StatusUnavailable)
+	got := make([]string, 0, 2)
+	for _, row := range r.Rows() {
+		got = append(got, strings.Join(row, "|"))
+	}
+	want := "01. Intro|ok|unavailable,02. Song|ok|-"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("rows = %q", got)
+	}
+	if s := r.Summary(); s["alac"][StatusOK] != 2 || s["atmos"][StatusUnavailable] != 1 {
+		t.Fatalf("summary = %v", s)
+	}
+}
@@ -0,0 +1,352 @@
+// Package naming renders the folder and file name templates of the config.
+//
+// A template is text with placeholders in braces:
+//
+//	{AlbumName}              the value of AlbumName
+//	{SongNumber|pad:3}       the value passed through functions
+//	{?Explicit: [E]}         " [E]" when Explicit is set
+//	{!Explicit:{?Clean: [C]}} text when a value is not set; bodies nest
+//	{{ and }}                literal braces
+//
+// A value counts as set unless it is empty, "0" or "false".
+package naming
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gosimple/unidecode"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Vars holds the placeholder values of one name.
+type Vars map[string]string
+
+type Template struct {
+	src   string
+	nodes []node
+}
+
+type node struct {
+	text  string
+	name  string
+	calls []call
+	// cond is '?' or '!' for a conditional, whose output is body.
+	cond byte
+	body []node
+}
+
+type call struct {
+	fn  string
+	arg int
+}
+
+// Funcs lists the template functions and whether they take a numeric
+// argument.
+var Funcs = map[string]bool{
+	"upper":         false,
+	"lower":         false,
+	"pad":           true,
+	"truncate":      true,
+	"fold-accents":  false,
+	"transliterate": false,
+	"first-artist":  false,
+}
+
+// Parse compiles src. Placeholders must be in known unless known is nil.
+func Parse(src string, known map[string]bool) (*Template, error) {
+	p := &parser{src: src, known: known}
+	nodes, err := p.parse(false)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{src: src, nodes: nodes}, nil
+}
+
+func (t *Template) String() string {
+	return t.src
+}
+
+// Render fills in the template. Placeholders without a value render empty.
+func (t *Template) Render(v Vars) string {
+	var b strings.Builder
+	render(&b, t.nodes, v)
+	return b.String()
+}
+
+// Unknown lists the placeholders of the template that are not in known.
+func (t *Template) Unknown(known map[string]bool) []string {
+	var out []string
+	seen := make(map[string]bool)
+	var walk func([]node)
+	walk = func(nodes []node) {
+		for _, n := range nodes {
+			if n.name != "" && !known[n.name] && !seen[n.name] {
+				seen[n.name] = true
+				out = append(out, n.name)
+			}
+			walk(n.body)
+		}
+	}
+	walk(t.nodes)
+	return out
+}
+
+// Uses reports whether the template refers to any of names.
+func (t *Template) Uses(names ...string) bool {
+	return uses(t.nodes, names)
+}
+
+func render(b *strings.Builder, nodes []node, v Vars) {
+	for _, n := range nodes {
+		switch {
+		case n.cond != 0:
+			if Truthy(v[n.name]) == (n.cond == '?') {
+				render(b, n.body, v)
+			}
+		case n.name != "":
+			value := v[n.name]
+			for _, c := range n.calls {
+				value = apply(c, value)
+			}
+			b.WriteString(value)
+		default:
+			b.WriteString(n.text)
+		}
+	}
+}
+
+func uses(nodes []node, names []string) bool {
+	for _, n := range nodes {
+		for _, name := range names {
+			if n.name == name {
+				return true
+			}
+		}
+		if uses(n.body, names) {
+			return true
+		}
+	}
+	return false
+}
+
+// Truthy reports whether a value counts as set in a conditional.
+func Truthy(value string) bool {
+	return value != "" && value != "0" && !strings.EqualFold(value, "false")
+}
+
+func apply(c call, value string) string {
+	switch c.fn {
+	case "upper":
+		return strings.ToUpper(value)
+	case "lower":
+		return strings.ToLower(value)
+	case "pad":
+		if _, err := strconv.Atoi(value); err != nil {
+			return value
+		}
+		for len(value) < c.arg {
+			value = "0" + value
+		}
+		return value
+	case "truncate":
+		if utf8.RuneCountInString(value) <= c.arg {
+			return value
+		}
+		return strings.TrimSpace(string([]rune(value)[:c.arg]))
+	case "fold-accents":
+		return FoldAccents(value)
+	case "transliterate":
+		return Transliterate(value)
+	case "first-artist":
+		return FirstArtist(value)
+	}
+	return value
+}
+
+var foldExtra = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O",
+	'ł': "l", 'Ł': "L", 'đ': "d", 'Đ': "D", 'ð': "d", 'Ð': "D", 'þ': "th", 'Þ': "Th",
+	'ı': "i", '‘': "'", '’': "'", '“': "\"", '”': "\"", '–': "-", '—': "-", '…': "...",
+}
+
+// FoldAccents folds Latin letters with diacritics and a few special
+// letters and punctuation marks to ASCII. It does not transliterate: other
+// scripts, such as Cyrillic or CJK, are kept as they are.
+func FoldAccents(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if repl, ok := foldExtra[r]; ok {
+			b.WriteString(repl)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return norm.NFC.String(b.String())
+}
+
+// Transliterate spells s in ASCII: accents are folded and other scripts,
+// such as Cyrillic, Greek, kana, Hangul or Han, are romanized. Characters
+// without a romanization, such as emoji, are kept.
+func Transliterate(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFC.String(s) {
+		if r <= unicode.MaxASCII {
+			b.WriteRune(r)
+			continue
+		}
+		if t := unidecode.Unidecode(string(r)); t != "" && !strings.Contains(t, "[?]") {
+			b.WriteString(t)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	// Han characters come out as space-separated syllables.
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+var artistSeparators = []string{", ", " & ", " feat. ", " ft. ", " featuring ", " x ", " with "}
+
+// FirstArtist returns the first name of a joined artist list such as
+// "A, B & C".
+func FirstArtist(s string) string {
+	cut := len(s)
+	lower := strings.ToLower(s)
+	for _, sep := range artistSeparators {
+		if i := strings.Index(lower, sep); i > 0 && i < cut {
+			cut = i
+		}
+	}
+	return strings.TrimSpace(s[:cut])
+}
+
+type parser struct {
+	src   string
+	pos   int
+	known map[string]bool
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%q column %d: %s", p.src, p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// parse reads nodes up to the end of the source, or up to the closing
+// brace of a conditional body when nested is set.
+func (p *parser) parse(nested bool) ([]node, error) {
+	var nodes []node
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, node{text: text.String()})
+			text.Reset()
+		}
+	}
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '{' && strings.HasPrefix(p.src[p.pos:], "{{"):
+			text.WriteByte('{')
+			p.pos += 2
+		case c == '}' && nested:
+			flush()
+			p.pos++
+			return nodes, nil
+		case c == '}' && strings.HasPrefix(p.src[p.pos:], "}}"):
+			text.WriteByte('}')
+			p.pos += 2
+		case c == '}':
+			return nil, p.errorf("unmatched '}' (write '}}' for a literal brace)")
+		case c == '{':
+			flush()
+			n, err := p.placeholder()
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, n)
+		default:
+			text.WriteByte(c)
+			p.pos++
+		}
+	}
+	if nested {
+		return nil, p.errorf("conditional is not closed")
+	}
+	flush()
+	return nodes, nil
+}
+
+func (p *parser) placeholder() (node, error) {
+	p.pos++ // '{'
+	var n node
+	if p.pos < len(p.src) && (p.src[p.pos] == '?' || p.src[p.pos] == '!') {
+		n.cond = p.src[p.pos]
+		p.pos++
+	}
+	name, err := p.name()
+	if err != nil {
+		return n, err
+	}
+	n.name = name
+	if n.cond != 0 {
+		if p.pos >= len(p.src) || p.src[p.pos] != ':' {
+			return n, p.errorf("expected ':' after {%c%s", n.cond, name)
+		}
+		p.pos++
+		n.body, err = p.parse(true)
+		return n, err
+	}
+	for p.pos < len(p.src) && p.src[p.pos] == '|' {
+		p.pos++
+		end := strings.IndexAny(p.src[p.pos:], "|}")
+		if end < 0 {
+			return n, p.errorf("placeholder {%s} is not closed", name)
+		}
+		fn, arg, hasArg := strings.Cut(strings.TrimSpace(p.src[p.pos:p.pos+end]), ":")
+		takesArg, ok := Funcs[fn]
+		if !ok {
+			return n, p.errorf("unknown function %q", fn)
+		}
+		c := call{fn: fn}
+		if takesArg {
+			if c.arg, err = strconv.Atoi(strings.TrimSpace(arg)); err != nil || c.arg <= 0 {
+				return n, p.errorf("%s needs a positive number, e.g. %s:3", fn, fn)
+			}
+		} else if hasArg {
+			return n, p.errorf("%s takes no argument", fn)
+		}
+		n.calls = append(n.calls, c)
+		p.pos += end
+	}
+	if p.pos >= len(p.src) || p.src[p.pos] != '}' {
+		return n, p.errorf("placeholder {%s} is not closed", name)
+	}
+	p.pos++
+	return n, nil
+}
+
+func (p *parser) name() (string, error) {
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	name := p.src[start:p.pos]
+	if name == "" {
+		return "", p.errorf("expected a placeholder name")
+	}
+	if p.known != nil && !p.known[name] {
+		p.pos = start
+		return "", p.errorf("unknown placeholder {%s}", name)
+	}
+	return name, nil
+}
@@ -0,0 +1,92 @@
+package naming
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	v := Vars{
+		"AlbumName":   "Déjà Vu",
+		"ArtistName":  "Crosby, Stills, Nash & Young",
+		"ReleaseYear": "1970",
+		"TrackNumber": "7",
+		"Explicit":    "1",
+		"Clean":       "",
+		"DiscTotal":   "1",
+	}
+	cases := map[string]string{
+		"[{ReleaseYear}] - {AlbumName}":                     "[1970] - Déjà Vu",
+		"{AlbumName}{?Explicit: [E]}{?Clean: [C]}":          "Déjà Vu [E]",
+		"{!Clean:{?Explicit:E}}":                            "E",
+		"{TrackNumber|pad:3}. {AlbumName|upper}":            "007. DÉJÀ VU",
+		"{AlbumName|fold-accents|lower}":                    "deja vu",
+		"{ArtistName|first-artist}/{ArtistName|truncate:6}": "Crosby/Crosby",
+		"{{{ReleaseYear}}} {Missing}":                       "{1970} ",
+		"{?DiscTotal:Disc }{?Missing:never}":                "Disc ",
+	}
+	for src, want := range cases {
+		tmpl, err := Parse(src, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		if got := tmpl.Render(v); got != want {
+			t.Errorf("%s = %q, want %q", src, got, want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	known := map[string]bool{"AlbumName": true, "Explicit": true}
+	for src, want := range map[string]string{
+		"{AlbumNam}":          "unknown placeholder {AlbumNam}",
+		"{AlbumName|shout}":   `unknown function "shout"`,
+		"{AlbumName|pad}":     "pad needs a positive number",
+		"{AlbumName|upper:2}": "upper takes no argument",
+		"{AlbumName":          "not closed",
+		"{?Explicit [E]}":     "expected ':'",
+		"{?Explicit: [E]":     "conditional is not closed",
+		"{AlbumName} }":       "unmatched '}'",
+	} {
+		_, err := Parse(src, known)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error %v, want %q", src, err, want)
+		}
+	}
+	tmpl, err := Parse("{AlbumName}{?Explicit: [E]}", known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tmpl.Uses("Explicit") || tmpl.Uses("Quality") {
+		t.Fatal("Uses reports wrong placeholders")
+	}
+	tmpl, err = Parse("{AlbumNam} {?Explict:{AlbumNam}} {AlbumName}", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tmpl.Unknown(known); strings.Join(got, ",") != "AlbumNam,Explict" {
+		t.Errorf("Unknown = %v", got)
+	}
+}
+
+func TestFoldAccents(t *testing.T) {
+	if got := FoldAccents("Sigur Rós – Ágætis byrjun / Кино / 坂本龍一"); got != "Sigur Ros - Agaetis byrjun / Кино / 坂本龍一" {
+		t.Errorf("FoldAccents = %q", got)
+	}
+}
+
+func TestTransliterate(t *testing.T) {
+	tests := map[string]string{
+		"Sigur Rós – Ágætis byrjun": "Sigur Ros - Agaetis byrjun",
+		"Кино":                      "Kino",
+		"Ελληνικά":                  "Ellenika",
+		"방탄소년단":                     "bangtansonyeondan",
+		"坂本龍 Live":                  "Ban Ben Long Live",
+		"Love 😀":                    "Love 😀",
+	}
+	for in, want := range tests {
+		if got := Transliterate(in); got != want {
+			t.Errorf("Transliterate(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
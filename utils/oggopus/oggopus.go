@@ -0,0 +1,229 @@
+package oggopus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"main/utils/flacmeta"
+)
+
+const maxSegments = 255
+
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+type page struct {
+	headerType byte
+	granule    uint64
+	serial     uint32
+	seq        uint32
+	segments   []byte
+	body       []byte
+}
+
+func readPage(r io.Reader) (*page, error) {
+	var hdr [27]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if string(hdr[:4]) != "OggS" || hdr[4] != 0 {
+		return nil, errors.New("invalid Ogg page")
+	}
+	p := &page{
+		headerType: hdr[5],
+		granule:    binary.LittleEndian.Uint64(hdr[6:]),
+		serial:     binary.LittleEndian.Uint32(hdr[14:]),
+		seq:        binary.LittleEndian.Uint32(hdr[18:]),
+		segments:   make([]byte, hdr[26]),
+	}
+	if _, err := io.ReadFull(r, p.segments); err != nil {
+		return nil, err
+	}
+	size := 0
+	for _, s := range p.segments {
+		size += int(s)
+	}
+	p.body = make([]byte, size)
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *page) encode() []byte {
+	out := make([]byte, 27, 27+len(p.segments)+len(p.body))
+	copy(out, "OggS")
+	out[5] = p.headerType
+	binary.LittleEndian.PutUint64(out[6:], p.granule)
+	binary.LittleEndian.PutUint32(out[14:], p.serial)
+	binary.LittleEndian.PutUint32(out[18:], p.seq)
+	out[26] = byte(len(p.segments))
+	out = append(out, p.segments...)
+	out = append(out, p.body...)
+	var crc uint32
+	for _, b := range out {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	binary.LittleEndian.PutUint32(out[22:], crc)
+	return out
+}
+
+// paginate splits a header packet into pages starting at sequence seq.
+func paginate(packet []byte, serial, seq uint32) []*page {
+	var lacing []byte
+	for n := len(packet); ; n -= 255 {
+		if n < 255 {
+			lacing = append(lacing, byte(n))
+			break
+		}
+		lacing = append(lacing, 255)
+	}
+	var pages []*page
+	for len(lacing) > 0 {
+		n := len(lacing)
+		if n > maxSegments {
+			n = maxSegments
+		}
+		size := 0
+		for _, s := range lacing[:n] {
+			size += int(s)
+		}
+		p := &page{serial: serial, seq: seq, segments: lacing[:n], body: packet[:size]}
+		if len(pages) > 0 {
+			p.headerType = 0x01
+		}
+		pages = append(pages, p)
+		lacing, packet = lacing[n:], packet[size:]
+		seq++
+	}
+	return pages
+}
+
+// headers reads the identification page and the pages carrying the comment
+// packet, which Opus requires to end on a page boundary.
+func headers(r io.Reader) (*page, []*page, []byte, error) {
+	head, err := readPage(r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !bytes.HasPrefix(head.body, []byte("OpusHead")) {
+		return nil, nil, nil, errors.New("not an Ogg Opus file")
+	}
+	var pages []*page
+	var packet []byte
+	for {
+		p, err := readPage(r)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		pages = append(pages, p)
+		packet = append(packet, p.body...)
+		if n := len(p.segments); n > 0 && p.segments[n-1] < 255 {
+			break
+		}
+	}
+	if !bytes.HasPrefix(packet, []byte("OpusTags")) {
+		return nil, nil, nil, errors.New("missing OpusTags packet")
+	}
+	return head, pages, packet, nil
+}
+
+// ReadTags returns the comment header of an Ogg Opus file.
+func ReadTags(path string) (*flacmeta.VorbisComment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, _, packet, err := headers(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	return flacmeta.ParseVorbisComment(packet[8:])
+}
+
+// WriteTags replaces the OpusTags packet and renumbers the following pages.
+func WriteTags(path string, vc *flacmeta.VorbisComment) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(src)
+	head, oldPages, _, err := headers(r)
+	if err != nil {
+		return err
+	}
+	packet := append([]byte("OpusTags"), vc.Encode()...)
+	newPages := paginate(packet, head.serial, head.seq+1)
+	shift := uint32(len(newPages)) - uint32(len(oldPages))
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".oggopus-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	w := bufio.NewWriter(tmp)
+	_, err = w.Write(head.encode())
+	for _, p := range newPages {
+		if err == nil {
+			_, err = w.Write(p.encode())
+		}
+	}
+	for err == nil {
+		var p *page
+		p, err = readPage(r)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			break
+		}
+		if p.serial == head.serial {
+			p.seq += shift
+		}
+		_, err = w.Write(p.encode())
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	src.Close()
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package oggopus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"main/utils/flacmeta"
+)
+
+func TestPageChecksum(t *testing.T) {
+	// CRC-32/POSIX without the final inversion, as used by Ogg.
+	var crc uint32
+	for _, b := range []byte("123456789") {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	if crc != 0x89a1897f {
+		t.Fatalf("unexpected checksum %08x", crc)
+	}
+}
+
+func writeStream(t *testing.T) (string, [][]byte) {
+	t.Helper()
+	const serial = 0x1234
+	head := paginate(append([]byte("OpusHead"), 1, 2, 0x38, 1, 0x80, 0xbb, 0, 0, 0, 0, 0), serial, 0)
+	head[0].headerType = 0x02
+	tags := paginate(append([]byte("OpusTags"), (&flacmeta.VorbisComment{Vendor: "Lavf"}).Encode()...), serial, 1)
+	audio := [][]byte{[]byte("frame-one"), []byte("frame-two")}
+	var buf bytes.Buffer
+	buf.Write(head[0].encode())
+	buf.Write(tags[0].encode())
+	for i, frame := range audio {
+		p := paginate(frame, serial, uint32(2+i))[0]
+		p.granule = uint64(960 * (i + 1))
+		if i == len(audio)-1 {
+			p.headerType = 0x04
+		}
+		buf.Write(p.encode())
+	}
+	path := filepath.Join(t.TempDir(), "track.opus")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return path, audio
+}
+
+func TestWriteTagsSpanningPages(t *testing.T) {
+	path, audio := writeStream(t)
+	vc := &flacmeta.VorbisComment{Vendor: "Lavf"}
+	vc.Set("TITLE", "Song")
+	vc.Set("ARTIST", "A", "B")
+	// Larger than one page (255 * 255 bytes) to force continuation pages.
+	vc.Set("METADATA_BLOCK_PICTURE", strings.Repeat("x", 70000))
+	if err := WriteTags(path, vc); err != nil {
+		t.Fatalf("write tags: %v", err)
+	}
+
+	got, err := ReadTags(path)
+	if err != nil {
+		t.Fatalf("read tags: %v", err)
+	}
+	if got.First("TITLE") != "Song" || len(got.Get("ARTIST")) != 2 || len(got.First("METADATA_BLOCK_PICTURE")) != 70000 {
+		t.Fatalf("unexpected tags %v", got.Get("TITLE"))
+	}
+
+	data, _ := os.ReadFile(path)
+	r := bytes.NewReader(data)
+	var pages []*page
+	for {
+		start := len(data) - r.Len()
+		p, err := readPage(r)
+		if err != nil {
+			break
+		}
+		raw := data[start : start+27+len(p.segments)+len(p.body)]
+		if !bytes.Equal(raw, p.encode()) {
+			t.Fatalf("page %d has a bad checksum", p.seq)
+		}
+		pages = append(pages, p)
+	}
+	for i, p := range pages {
+		if p.seq != uint32(i) {
+			t.Fatalf("page %d has sequence %d", i, p.seq)
+		}
+	}
+	last := pages[len(pages)-2:]
+	for i, frame := range audio {
+		if !bytes.Equal(last[i].body, frame) || last[i].granule != uint64(960*(i+1)) {
+			t.Fatalf("audio page %d changed", i)
+		}
+	}
+	if binary.LittleEndian.Uint32(data[14:]) != 0x1234 {
+		t.Fatalf("serial changed")
+	}
+}
@@ -0,0 +1,291 @@
+// Package pathsafe turns catalog names into file and folder names that a
+// given kind of filesystem accepts.
+package pathsafe
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"main/utils/naming"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// ExtRoom is kept free after a file name for its extension.
+	ExtRoom = 8
+	// FolderRoom is kept free after a folder within the path limit, for
+	// the names of the files saved in it.
+	FolderRoom = 64
+
+	hashLen = 8
+	minName = hashLen + 9
+)
+
+// Profile holds the naming rules of one kind of filesystem. Limits are in
+// bytes of UTF-8.
+type Profile struct {
+	Name string
+	// Forbidden characters are replaced with "_", as are control
+	// characters.
+	Forbidden string
+	// Windows rejects reserved device names such as CON or LPT1 and names
+	// ending in a dot or a space.
+	Windows bool
+	// ASCII transliterates names and replaces what is left outside ASCII,
+	// adding a hash of the name so different names stay apart.
+	ASCII bool
+	// Legacy only replaces forbidden characters, leaving spaces, dots and
+	// normalization as names had them before profiles existed.
+	Legacy bool
+	// Form is "nfc", "nfd" or empty to keep names as they are.
+	Form    string
+	MaxName int
+	// MaxPath limits the whole absolute path; 0 means no limit.
+	MaxPath int
+
+	roots    []string
+	rootRoom int
+}
+
+const windowsForbidden = `/\<>:"|?*`
+
+var profiles = map[string]Profile{
+	"legacy":  {Name: "legacy", Forbidden: windowsForbidden, Legacy: true, MaxName: 255},
+	"posix":   {Name: "posix", Forbidden: "/", Form: "nfc", MaxName: 255, MaxPath: 4095},
+	"windows": {Name: "windows", Forbidden: windowsForbidden, Windows: true, Form: "nfc", MaxName: 255, MaxPath: 259},
+	"fat32":   {Name: "fat32", Forbidden: windowsForbidden, Windows: true, Form: "nfc", MaxName: 255, MaxPath: 4095},
+	"ascii":   {Name: "ascii", Forbidden: windowsForbidden, Windows: true, ASCII: true, MaxName: 255, MaxPath: 4095},
+}
+
+// Default is the profile used when none is configured. It keeps the names
+// of earlier versions, so existing libraries are still found.
+func Default() string {
+	return "legacy"
+}
+
+// Resolve returns the profile called name, with its normalization form
+// replaced by form unless form is empty. smb and exfat share the rules of
+// fat32.
+func Resolve(name, form string) (Profile, error) {
+	key := strings.ToLower(strings.TrimSpace(name))
+	switch key {
+	case "":
+		key = Default()
+	case "exfat", "smb":
+		key = "fat32"
+	case "ascii-only":
+		key = "ascii"
+	}
+	p, ok := profiles[key]
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown filename-profile %q (expected legacy, posix, windows, smb, fat32, exfat or ascii)", name)
+	}
+	if p.Legacy && runtime.GOOS == "windows" {
+		// Longer paths failed before, so cutting them renames nothing.
+		p.MaxPath = 259
+	}
+	switch f := strings.ToLower(strings.TrimSpace(form)); f {
+	case "":
+	case "none":
+		p.Form = ""
+	case "nfc", "nfd":
+		p.Form = f
+	default:
+		return Profile{}, fmt.Errorf("unknown filename-normalization %q (expected nfc, nfd or none)", form)
+	}
+	return p, nil
+}
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true, "CONIN$": true, "CONOUT$": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// WithRoots returns p measuring a path below one of roots as if its root
+// were as long as the longest of them, so a name is cut the same way under
+// every root and sibling folders keep matching names.
+func (p Profile) WithRoots(roots ...string) Profile {
+	p.roots, p.rootRoom = nil, 0
+	for _, root := range roots {
+		if strings.TrimSpace(root) == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(root); err == nil {
+			root = abs
+		}
+		p.roots = append(p.roots, filepath.Clean(root))
+		if len(root) > p.rootRoom {
+			p.rootRoom = len(root)
+		}
+	}
+	return p
+}
+
+// Clean applies the rules of p to one path component.
+func (p Profile) Clean(name string) string {
+	return shorten(p.clean(name), p.MaxName, p.Windows)
+}
+
+// File returns name as the name of a file saved in dir, leaving ExtRoom
+// bytes for the extension.
+func (p Profile) File(dir, name string) string {
+	name = p.fit(dir, name, ExtRoom, ExtRoom)
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+// Folder returns name as the name of a folder below dir. An empty result
+// means the name had nothing usable in it.
+func (p Profile) Folder(dir, name string) string {
+	return p.fit(dir, name, 0, FolderRoom)
+}
+
+func (p Profile) fit(dir, name string, nameRoom, pathRoom int) string {
+	name = p.clean(name)
+	limit := p.MaxName - nameRoom
+	if p.MaxPath > 0 {
+		if free := p.MaxPath - p.dirLen(dir) - 1 - pathRoom; free < limit {
+			limit = free
+		}
+	}
+	if limit < minName {
+		limit = minName
+	}
+	return shorten(name, limit, p.Windows)
+}
+
+// dirLen is the length of dir counted against MaxPath, with the save root
+// it is in counted at the budget of WithRoots.
+func (p Profile) dirLen(dir string) int {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	for _, root := range p.roots {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if rel == "." {
+			return p.rootRoom
+		}
+		return p.rootRoom + 1 + len(rel)
+	}
+	return len(dir)
+}
+
+// Path applies the rules of p to every component of rel, a slash or
+// separator delimited path of a file below root, and returns it slash
+// separated. The extension of the file name is kept.
+func (p Profile) Path(root, rel string) string {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	dir := root
+	out := make([]string, 0, len(parts))
+	for i, part := range parts {
+		if i == len(parts)-1 {
+			ext := filepath.Ext(part)
+			out = append(out, p.File(dir, strings.TrimSuffix(part, ext))+ext)
+			break
+		}
+		name := p.Folder(dir, part)
+		if name == "" {
+			name = "_"
+		}
+		out = append(out, name)
+		dir = filepath.Join(dir, name)
+	}
+	return strings.Join(out, "/")
+}
+
+func (p Profile) clean(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+	original := name
+	switch {
+	case p.ASCII:
+		name = naming.Transliterate(name)
+	case p.Form == "nfc":
+		name = norm.NFC.String(name)
+	case p.Form == "nfd":
+		name = norm.NFD.String(name)
+	}
+	lost := false
+	name = strings.Map(func(r rune) rune {
+		if p.ASCII && r > unicode.MaxASCII {
+			lost = true
+			return '_'
+		}
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(p.Forbidden, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if p.Legacy {
+		if name == "." || name == ".." {
+			name = strings.Repeat("_", len(name))
+		}
+		return name
+	}
+	name = strings.TrimSpace(name)
+	if lost {
+		name += "~" + hash(original)
+	}
+	if p.Windows {
+		name = strings.TrimRight(name, ". ")
+		stem, rest, found := strings.Cut(name, ".")
+		if reservedNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+			name = stem + "_"
+			if found {
+				name += "." + rest
+			}
+		}
+	}
+	if name == "." || name == ".." {
+		name = strings.Repeat("_", len(name))
+	}
+	return name
+}
+
+// shorten cuts name to max bytes. A cut name ends in "~" and a hash of the
+// whole name, so the result stays the same from run to run and different
+// long names do not collide.
+func shorten(name string, max int, windows bool) string {
+	if len(name) <= max {
+		return name
+	}
+	keep := max - 1 - hashLen
+	cut := 0
+	for i, r := range name {
+		if i+utf8.RuneLen(r) > keep {
+			break
+		}
+		cut = i + utf8.RuneLen(r)
+	}
+	// Don't leave a base letter without the marks that follow it.
+	for cut > 0 {
+		r, _ := utf8.DecodeRuneInString(name[cut:])
+		if !unicode.Is(unicode.Mn, r) {
+			break
+		}
+		_, size := utf8.DecodeLastRuneInString(name[:cut])
+		cut -= size
+	}
+	head := strings.TrimRight(name[:cut], " ")
+	if windows {
+		head = strings.TrimRight(head, ". ")
+	}
+	return head + "~" + hash(name)
+}
+
+func hash(name string) string {
+	sum := sha1.Sum([]byte(name))
+	return hex.EncodeToString(sum[:])[:hashLen]
+}
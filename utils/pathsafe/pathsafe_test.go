@@ -0,0 +1,149 @@
+package pathsafe
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+func mustResolve(t *testing.T, name, form string) Profile {
+	t.Helper()
+	p, err := Resolve(name, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestClean(t *testing.T) {
+	tests := []struct {
+		profile, in, want string
+	}{
+		{"posix", "AC/DC: Live?", "AC_DC: Live?"},
+		{"posix", "Vol. 2...", "Vol. 2..."},
+		{"posix", "..", "__"},
+		{"windows", "AC/DC: Live?", "AC_DC_ Live_"},
+		{"windows", "Vol. 2... ", "Vol. 2"},
+		{"windows", "con", "con_"},
+		{"windows", "Aux.m4a", "Aux_.m4a"},
+		{"windows", "Console", "Console"},
+		{"windows", "a\tb\x00c", "a_b_c"},
+		{"exfat", "Sigur Rós <Live>", "Sigur Rós _Live_"},
+		{"ascii", "Sigur Rós – Ágætis byrjun", "Sigur Ros - Agaetis byrjun"},
+		{"ascii", "Кино", "Kino"},
+		{"ascii", "Love 😀", "Love _~" + hash("Love 😀")},
+		{"legacy", "AC/DC: Live? ", "AC_DC_ Live_ "},
+		{"legacy", "Jr.", "Jr."},
+		{"legacy", "con", "con"},
+	}
+	for _, tt := range tests {
+		if got := mustResolve(t, tt.profile, "").Clean(tt.in); got != tt.want {
+			t.Errorf("%s Clean(%q) = %q, want %q", tt.profile, tt.in, got, tt.want)
+		}
+	}
+	if a := mustResolve(t, "ascii", ""); a.Clean("😀") == a.Clean("😎") {
+		t.Error("ascii gave two names the same replacement")
+	}
+}
+
+func TestNormalization(t *testing.T) {
+	decomposed := norm.NFD.String("Beyoncé")
+	if got := mustResolve(t, "posix", "").Clean(decomposed); got != "Beyoncé" || !norm.NFC.IsNormalString(got) {
+		t.Errorf("nfc: got %q", got)
+	}
+	if got := mustResolve(t, "posix", "nfd").Clean("Beyoncé"); got != decomposed {
+		t.Errorf("nfd: got %q", got)
+	}
+	if got := mustResolve(t, "posix", "none").Clean(decomposed); got != decomposed {
+		t.Errorf("none: got %q", got)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	p := mustResolve(t, "posix", "")
+	long := strings.Repeat("é", 200)
+	got := p.Clean(long)
+	if len(got) > p.MaxName || !strings.Contains(got, "~") {
+		t.Fatalf("Clean kept %d bytes: %q", len(got), got)
+	}
+	if again := p.Clean(long); again != got {
+		t.Errorf("truncation not stable: %q != %q", again, got)
+	}
+	if other := p.Clean(long + "x"); other == got {
+		t.Errorf("different names truncated to the same %q", got)
+	}
+	if p.Clean(got) != got {
+		t.Errorf("Clean is not idempotent on %q", got)
+	}
+
+	w := mustResolve(t, "windows", "")
+	dir := "/" + strings.Repeat("d", 150)
+	name := w.File(dir, strings.Repeat("song ", 40))
+	if total := len(dir) + 1 + len(name) + ExtRoom; total > w.MaxPath {
+		t.Errorf("path of %d bytes exceeds %d", total, w.MaxPath)
+	}
+	folder := w.Folder(dir, strings.Repeat("album ", 30))
+	if total := len(dir) + 1 + len(folder) + FolderRoom; total > w.MaxPath {
+		t.Errorf("folder path of %d bytes exceeds %d", total, w.MaxPath)
+	}
+	if got := w.File(dir, " . "); got != "_" {
+		t.Errorf("empty file name = %q", got)
+	}
+	if got := w.Folder(dir, ""); got != "" {
+		t.Errorf("empty folder name = %q", got)
+	}
+}
+
+func TestWithRoots(t *testing.T) {
+	short, deep := "/music/alac", "/music/"+strings.Repeat("r", 80)+"/atmos"
+	w := mustResolve(t, "windows", "").WithRoots(short, deep)
+	album := strings.Repeat("アルバム", 20)
+	a := w.Folder(short+"/Artist", album)
+	b := w.Folder(deep+"/Artist", album)
+	if a != b {
+		t.Errorf("folder names differ between roots: %q != %q", a, b)
+	}
+	if total := len(deep) + len("/Artist/") + len(b) + FolderRoom; total > w.MaxPath {
+		t.Errorf("folder path of %d bytes exceeds %d", total, w.MaxPath)
+	}
+	if got := w.Folder("/elsewhere", "Album"); got != "Album" {
+		t.Errorf("folder outside the roots = %q", got)
+	}
+}
+
+func TestPath(t *testing.T) {
+	f := mustResolve(t, "fat32", "")
+	if got, want := f.Path("/mnt/usb", "AC/DC: Live?/Who Made Who?.m4a"), "AC/DC_ Live_/Who Made Who_.m4a"; filepath.ToSlash(got) != want {
+		t.Errorf("Path = %q, want %q", got, want)
+	}
+	if got := f.Path("/mnt/usb", "Artist/Album./01 Song.flac"); filepath.ToSlash(got) != "Artist/Album/01 Song.flac" {
+		t.Errorf("Path = %q", got)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	if p := mustResolve(t, "", ""); p.Name != Default() {
+		t.Errorf("default profile = %s", p.Name)
+	}
+	if p := mustResolve(t, "", ""); runtime.GOOS != "windows" && (p.MaxPath != 0 || p.Clean("a:b") != "a_b") {
+		t.Errorf("default on %s = %+v", runtime.GOOS, p)
+	}
+	decomposed := norm.NFD.String("Beyoncé")
+	if got := mustResolve(t, "", "").Clean(decomposed); got != decomposed {
+		t.Errorf("default profile normalized %q", got)
+	}
+	for _, name := range []string{"exFAT", "smb"} {
+		if p := mustResolve(t, name, ""); p.Name != "fat32" {
+			t.Errorf("%s = %s", name, p.Name)
+		}
+	}
+	if _, err := Resolve("ntfs", ""); err == nil {
+		t.Error("unknown profile accepted")
+	}
+	if _, err := Resolve("posix", "nfkc"); err == nil {
+		t.Error("unknown form accepted")
+	}
+}
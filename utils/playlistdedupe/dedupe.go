@@ -236,18 +236,25 @@ func releaseRankForTrack(track *ampapi.TrackRespData) int {
 		return releaseRankUnknown
 	}
 	album := track.Relationships.Albums.Data[0].Attributes
-	name := strings.ToLower(strings.TrimSpace(album.Name))
-	if album.IsSingle || strings.Contains(name, "single") {
+	return ReleaseRank(album.Name, album.TrackCount, album.IsSingle)
+}
+
+// ReleaseRank orders releases for picking which copy of a track to keep:
+// albums rank above EPs, EPs above singles and singles above releases that
+// cannot be classified. A trackCount of 0 means unknown.
+func ReleaseRank(albumName string, trackCount int, isSingle bool) int {
+	name := strings.ToLower(strings.TrimSpace(albumName))
+	if isSingle || strings.Contains(name, "single") {
 		return releaseRankSingle
 	}
 	if looksLikeEPName(name) {
 		return releaseRankEP
 	}
-	if album.TrackCount > 0 {
-		if album.TrackCount <= 3 {
+	if trackCount > 0 {
+		if trackCount <= 3 {
 			return releaseRankSingle
 		}
-		if album.TrackCount <= 6 {
+		if trackCount <= 6 {
 			return releaseRankEP
 		}
 		return releaseRankAlbum
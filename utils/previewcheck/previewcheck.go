@@ -0,0 +1,147 @@
+// Package previewcheck compares a downloaded track with the catalog's
+// preview clip to catch audio that decodes fine but is not the track,
+// e.g. after a wrong key or a decryptor fault.
+package previewcheck
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SampleRate is the rate both clips are decoded at.
+	SampleRate = 8000
+	// DefaultThreshold is the lowest score still taken as a match.
+	DefaultThreshold = 0.5
+	// maxTrack bounds how much of a track is decoded.
+	maxTrack = 20 * time.Minute
+	// hop is the envelope resolution, 10 ms.
+	hop = SampleRate / 100
+)
+
+// Result is where the preview was found in the track and how well it
+// matched there, from -1 to 1.
+type Result struct {
+	Offset time.Duration
+	Score  float64
+}
+
+// Check decodes the preview, which may be a URL, and the track and
+// cross-correlates them.
+func Check(ffmpegPath, previewURL, trackPath string) (Result, error) {
+	preview, err := Decode(ffmpegPath, previewURL, 0)
+	if err != nil {
+		return Result{}, errors.New("preview: " + err.Error())
+	}
+	track, err := Decode(ffmpegPath, trackPath, maxTrack)
+	if err != nil {
+		return Result{}, err
+	}
+	return Correlate(Envelope(preview), Envelope(track)), nil
+}
+
+// Decode returns the first audio stream of input as mono samples at
+// SampleRate, stopping after limit when it is set.
+func Decode(ffmpegPath, input string, limit time.Duration) ([]int16, error) {
+	args := []string{"-hide_banner", "-nostdin", "-v", "error", "-i", input, "-map", "0:a:0"}
+	if limit > 0 {
+		args = append(args, "-t", strconv.Itoa(int(limit.Seconds())))
+	}
+	args = append(args, "-ac", "1", "-ar", strconv.Itoa(SampleRate), "-f", "s16le", "-")
+	cmd := exec.Command(ffmpegPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(strings.TrimSpace(strings.Split(msg, "\n")[0]))
+		}
+		return nil, err
+	}
+	samples := make([]int16, len(out)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(out[2*i:]))
+	}
+	return samples, nil
+}
+
+// Envelope returns the change in log energy from one 10 ms frame to the
+// next. Unlike the waveform it does not depend on the phase the encoders
+// left, and unlike the energy itself it has no large offset that would
+// make any two loud clips correlate.
+func Envelope(samples []int16) []float64 {
+	frames := len(samples) / hop
+	if frames < 2 {
+		return nil
+	}
+	out := make([]float64, frames-1)
+	prev := 0.0
+	for f := 0; f < frames; f++ {
+		energy := 0.0
+		for _, s := range samples[f*hop : (f+1)*hop] {
+			energy += float64(s) * float64(s)
+		}
+		level := math.Log(energy/hop + 1)
+		if f > 0 {
+			out[f-1] = level - prev
+		}
+		prev = level
+	}
+	return out
+}
+
+// Correlate slides the preview envelope over the track envelope and
+// returns the offset with the highest normalized cross-correlation. A
+// preview longer than the track is cut to the track's length.
+func Correlate(preview, track []float64) Result {
+	m := min(len(preview), len(track))
+	if m < 2 {
+		return Result{}
+	}
+	p := make([]float64, m)
+	mean := 0.0
+	for _, v := range preview[:m] {
+		mean += v
+	}
+	mean /= float64(m)
+	norm := 0.0
+	for i, v := range preview[:m] {
+		p[i] = v - mean
+		norm += p[i] * p[i]
+	}
+	if norm == 0 {
+		return Result{}
+	}
+	norm = math.Sqrt(norm)
+
+	// Prefix sums give the mean and spread of every track window.
+	sum := make([]float64, len(track)+1)
+	sq := make([]float64, len(track)+1)
+	for i, v := range track {
+		sum[i+1] = sum[i] + v
+		sq[i+1] = sq[i] + v*v
+	}
+	best := Result{Score: -1}
+	for k := 0; k+m <= len(track); k++ {
+		s := sum[k+m] - sum[k]
+		spread := sq[k+m] - sq[k] - s*s/float64(m)
+		if spread <= 0 {
+			continue
+		}
+		// p has zero mean, so the window's mean drops out of the dot product.
+		dot := 0.0
+		for i, v := range p {
+			dot += v * track[k+i]
+		}
+		if score := dot / (norm * math.Sqrt(spread)); score > best.Score {
+			best = Result{Offset: time.Duration(k) * 10 * time.Millisecond, Score: score}
+		}
+	}
+	return best
+}
@@ -0,0 +1,43 @@
+package previewcheck
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// music returns notes of random pitch and loudness with a little noise.
+func music(seed int64, seconds int) []int16 {
+	r := rand.New(rand.NewSource(seed))
+	out := make([]int16, seconds*SampleRate)
+	freq, gain := 440.0, 0.5
+	for i := range out {
+		if i%(SampleRate/5) == 0 {
+			freq, gain = 200+r.Float64()*1500, 0.1+r.Float64()*0.9
+		}
+		out[i] = int16(gain*9000*math.Sin(2*math.Pi*freq*float64(i)/SampleRate) + 300*r.NormFloat64())
+	}
+	return out
+}
+
+func TestCorrelate(t *testing.T) {
+	track := music(1, 120)
+	// A quieter clip from 45 s to 75 s with its own noise and fades.
+	r := rand.New(rand.NewSource(7))
+	clip := track[45*SampleRate : 75*SampleRate]
+	preview := make([]int16, len(clip))
+	for i, s := range clip {
+		fade := math.Min(1, math.Min(float64(i), float64(len(clip)-i))/SampleRate)
+		preview[i] = int16(float64(s)*0.6*fade + 200*r.NormFloat64())
+	}
+
+	got := Correlate(Envelope(preview), Envelope(track))
+	if got.Score < DefaultThreshold || got.Offset < 44900*time.Millisecond || got.Offset > 45100*time.Millisecond {
+		t.Fatalf("matching preview: %+v", got)
+	}
+	other := Correlate(Envelope(preview), Envelope(music(2, 120)))
+	if other.Score >= DefaultThreshold {
+		t.Fatalf("unrelated track scored %.2f", other.Score)
+	}
+}
@@ -0,0 +1,256 @@
+// Package quality evaluates download quality policies such as
+// "atmos>hires<=96k>lossless>aac" against the variants of an HLS master
+// playlist. Steps are tried in order and the first one with a matching
+// variant wins; every skipped step records why.
+package quality
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+type Kind string
+
+const (
+	Atmos       Kind = "atmos"
+	AC3         Kind = "ac3"
+	HiRes       Kind = "hires"
+	Lossless    Kind = "lossless"
+	AAC         Kind = "aac"
+	AACBinaural Kind = "aac-binaural"
+	AACDownmix  Kind = "aac-downmix"
+	// AACLC is served outside the master playlist, so it never depends on
+	// the variants and always matches.
+	AACLC Kind = "aac-lc"
+)
+
+var kinds = map[Kind]bool{Atmos: true, AC3: true, HiRes: true, Lossless: true, AAC: true, AACBinaural: true, AACDownmix: true, AACLC: true}
+
+// losslessMaxRate is the highest sample rate that still counts as lossless
+// rather than hi-res.
+const losslessMaxRate = 48000
+
+type Step struct {
+	Kind Kind
+	// Max limits the sample rate in Hz for hires and lossless, and the
+	// bitrate in kbit/s for the other kinds. 0 means no limit.
+	Max  int
+	Root string
+}
+
+type Policy struct {
+	Steps []Step
+}
+
+// Parse reads a policy such as "atmos>hires<=96k>lossless>aac". Sample
+// rate limits accept "96k", "44.1k" or plain Hz; bitrate limits are in
+// kbit/s.
+func Parse(spec string) (*Policy, error) {
+	p := &Policy{}
+	for _, part := range strings.Split(spec, ">") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
+			return nil, fmt.Errorf("empty step in quality policy %q", spec)
+		}
+		name, limit, hasLimit := strings.Cut(part, "<=")
+		step := Step{Kind: Kind(strings.TrimSpace(name))}
+		if !kinds[step.Kind] {
+			return nil, fmt.Errorf("unknown quality %q in policy %q", name, spec)
+		}
+		if hasLimit {
+			v, err := parseLimit(step.Kind, strings.TrimSpace(limit))
+			if err != nil {
+				return nil, err
+			}
+			step.Max = v
+		}
+		p.Steps = append(p.Steps, step)
+	}
+	return p, nil
+}
+
+func parseLimit(kind Kind, s string) (int, error) {
+	kilo := strings.HasSuffix(s, "k")
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "k"), 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid limit %q for %s", s, kind)
+	}
+	if kind == HiRes || kind == Lossless {
+		if kilo || v < 1000 {
+			v *= 1000
+		}
+	}
+	return int(v), nil
+}
+
+func (p *Policy) String() string {
+	parts := make([]string, len(p.Steps))
+	for i, s := range p.Steps {
+		parts[i] = string(s.Kind)
+		if s.Max > 0 {
+			parts[i] += "<=" + strconv.Itoa(s.Max)
+		}
+	}
+	return strings.Join(parts, ">")
+}
+
+// Variant is one audio rendition of a master playlist.
+type Variant struct {
+	Kind       Kind
+	Audio      string
+	URI        string
+	SampleRate int
+	BitDepth   int
+	Bitrate    int
+}
+
+var aacGroupRe = regexp.MustCompile(`audio-stereo-\d+`)
+
+// FromMaster lists the audio variants of master with URIs resolved
+// against base.
+func FromMaster(master *m3u8.MasterPlaylist, base *url.URL) []Variant {
+	var out []Variant
+	for _, mv := range master.Variants {
+		v := Variant{Audio: mv.Audio, URI: mv.URI}
+		if base != nil {
+			if u, err := base.Parse(mv.URI); err == nil {
+				v.URI = u.String()
+			}
+		}
+		split := strings.Split(mv.Audio, "-")
+		last := func(n int) int {
+			if len(split) < n {
+				return 0
+			}
+			x, _ := strconv.Atoi(split[len(split)-n])
+			return x
+		}
+		switch {
+		case mv.Codecs == "alac":
+			v.SampleRate, v.BitDepth = last(2), last(1)
+			v.Kind = Lossless
+			if v.SampleRate > losslessMaxRate {
+				v.Kind = HiRes
+			}
+		case mv.Codecs == "ec-3" && strings.Contains(strings.ToLower(mv.Audio), "atmos"):
+			v.Kind, v.Bitrate = Atmos, last(1)
+		case mv.Codecs == "ac-3":
+			v.Kind, v.Bitrate = AC3, last(1)
+		case mv.Codecs == "mp4a.40.2":
+			v.Kind = Kind(aacGroupRe.ReplaceAllString(mv.Audio, "aac"))
+			if len(split) >= 3 {
+				v.Bitrate, _ = strconv.Atoi(split[2])
+			}
+		default:
+			continue
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// Quality formats v the way the {Quality} placeholder shows it.
+func (v *Variant) Quality() string {
+	switch v.Kind {
+	case HiRes, Lossless:
+		return fmt.Sprintf("%dB-%.1fkHz", v.BitDepth, float64(v.SampleRate)/1000)
+	case Atmos:
+		// Atmos group IDs prefix the bitrate with a 2, e.g. 2768.
+		if v.Bitrate >= 2000 {
+			return fmt.Sprintf("%dKbps", v.Bitrate-2000)
+		}
+	}
+	return fmt.Sprintf("%d Kbps", v.Bitrate)
+}
+
+// Decision is the outcome of evaluating a policy for one track.
+type Decision struct {
+	Step Step
+	// Variant is nil for AAC-LC.
+	Variant *Variant
+	Reasons []string
+}
+
+// Codec is the codec label used for {Codec} and format matching.
+func (d *Decision) Codec() string {
+	switch d.Step.Kind {
+	case Atmos:
+		return "ATMOS"
+	case AC3:
+		return "AC3"
+	case HiRes, Lossless:
+		return "ALAC"
+	}
+	return "AAC"
+}
+
+// Quality is the {Quality} value of the chosen variant.
+func (d *Decision) Quality() string {
+	if d.Variant == nil {
+		return "256Kbps"
+	}
+	return d.Variant.Quality()
+}
+
+// ErrNoMatch is returned when no step of the policy matches.
+var ErrNoMatch = errors.New("no variant matches the quality policy")
+
+// Evaluate picks the best variant of the first step that has one. The
+// decision is returned with its reasons even when nothing matched.
+func (p *Policy) Evaluate(variants []Variant) (*Decision, error) {
+	d := &Decision{}
+	for _, step := range p.Steps {
+		if step.Kind == AACLC {
+			d.Step = step
+			d.Reasons = append(d.Reasons, "aac-lc: chosen")
+			return d, nil
+		}
+		var candidates, allowed []Variant
+		for _, v := range variants {
+			if v.Kind == step.Kind {
+				candidates = append(candidates, v)
+			}
+		}
+		for _, v := range candidates {
+			if step.Max == 0 || v.limitValue() <= step.Max {
+				allowed = append(allowed, v)
+			}
+		}
+		switch {
+		case len(candidates) == 0:
+			d.Reasons = append(d.Reasons, fmt.Sprintf("%s: not available", step.Kind))
+			continue
+		case len(allowed) == 0:
+			sort.Slice(candidates, func(i, j int) bool { return candidates[i].better(candidates[j]) })
+			d.Reasons = append(d.Reasons, fmt.Sprintf("%s: %s exceeds the limit of %d", step.Kind, candidates[len(candidates)-1].Quality(), step.Max))
+			continue
+		}
+		sort.Slice(allowed, func(i, j int) bool { return allowed[i].better(allowed[j]) })
+		d.Step = step
+		d.Variant = &allowed[0]
+		d.Reasons = append(d.Reasons, fmt.Sprintf("%s: chosen %s (%s)", step.Kind, d.Variant.Quality(), d.Variant.Audio))
+		return d, nil
+	}
+	return d, ErrNoMatch
+}
+
+func (v Variant) limitValue() int {
+	if v.Kind == HiRes || v.Kind == Lossless {
+		return v.SampleRate
+	}
+	return v.Bitrate
+}
+
+func (v Variant) better(o Variant) bool {
+	if v.limitValue() != o.limitValue() {
+		return v.limitValue() > o.limitValue()
+	}
+	return v.BitDepth > o.BitDepth
+}
@@ -0,0 +1,77 @@
+package quality
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/grafov/m3u8"
+)
+
+const master = `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=300000,CODECS="mp4a.40.2",AUDIO="audio-stereo-256"
+aac/256.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1500000,CODECS="alac",AUDIO="audio-alac-stereo-44100-16"
+alac/44.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=5000000,CODECS="alac",AUDIO="audio-alac-stereo-96000-24"
+alac/96.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=9000000,CODECS="alac",AUDIO="audio-alac-stereo-192000-24"
+alac/192.m3u8
+`
+
+func variants(t *testing.T) []Variant {
+	t.Helper()
+	list, _, err := m3u8.DecodeFrom(strings.NewReader(master), true)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	base, _ := url.Parse("https://example.com/x/master.m3u8")
+	return FromMaster(list.(*m3u8.MasterPlaylist), base)
+}
+
+func TestParse(t *testing.T) {
+	p, err := Parse("atmos > hires<=96k > lossless<=44.1k > aac-lc")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got := p.String(); got != "atmos>hires<=96000>lossless<=44100>aac-lc" {
+		t.Fatalf("policy = %s", got)
+	}
+	for _, bad := range []string{"", "atmos>>aac", "flac", "hires<=fast"} {
+		if _, err := Parse(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestEvaluateFallsBack(t *testing.T) {
+	p, _ := Parse("atmos>hires<=96k>lossless>aac")
+	d, err := p.Evaluate(variants(t))
+	if err != nil {
+		t.Fatalf("evaluate: %v", err)
+	}
+	if d.Step.Kind != HiRes || d.Codec() != "ALAC" || d.Quality() != "24B-96.0kHz" {
+		t.Fatalf("unexpected decision %+v", d)
+	}
+	if d.Variant.URI != "https://example.com/x/alac/96.m3u8" {
+		t.Fatalf("uri = %s", d.Variant.URI)
+	}
+	want := []string{"atmos: not available", "hires: chosen 24B-96.0kHz (audio-alac-stereo-96000-24)"}
+	if strings.Join(d.Reasons, "|") != strings.Join(want, "|") {
+		t.Fatalf("reasons = %q", d.Reasons)
+	}
+
+	p, _ = Parse("hires<=88.2k>aac")
+	d, err = p.Evaluate(variants(t))
+	if err != nil || d.Step.Kind != AAC || d.Quality() != "256 Kbps" {
+		t.Fatalf("unexpected decision %+v, %v", d, err)
+	}
+	if d.Reasons[0] != "hires: 24B-96.0kHz exceeds the limit of 88200" {
+		t.Fatalf("reasons = %q", d.Reasons)
+	}
+
+	p, _ = Parse("atmos>ac3")
+	if d, err := p.Evaluate(variants(t)); err != ErrNoMatch || len(d.Reasons) != 2 {
+		t.Fatalf("expected no match, got %+v, %v", d, err)
+	}
+}
@@ -0,0 +1,239 @@
+// Package reorganize moves downloads to the paths the current folder and
+// file templates give them and records the moves so they can be undone.
+package reorganize
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Move renames one file. Root is the save root it lives under; empty
+// directories are removed up to it.
+type Move struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Root string `json:"root,omitempty"`
+}
+
+// Conflict is a move that was not planned because its target is taken.
+type Conflict struct {
+	Move
+	Reason string
+}
+
+// Plan drops moves that leave a file in place and sets aside the ones
+// whose target already exists or is claimed by an earlier move.
+func Plan(moves []Move) ([]Move, []Conflict) {
+	var out []Move
+	var conflicts []Conflict
+	claimed := make(map[string]bool)
+	sources := make(map[string]bool)
+	for _, m := range moves {
+		sources[key(m.From)] = true
+	}
+	for _, m := range moves {
+		if filepath.Clean(m.From) == filepath.Clean(m.To) {
+			continue
+		}
+		k := key(m.To)
+		switch {
+		case claimed[k]:
+			conflicts = append(conflicts, Conflict{m, "another file moves to the same path"})
+			continue
+		case sources[k] && !sameFile(m.From, m.To):
+			conflicts = append(conflicts, Conflict{m, "target is another file that is moved as well"})
+			continue
+		case !sources[k] && exists(m.To) && !sameFile(m.From, m.To):
+			conflicts = append(conflicts, Conflict{m, "target already exists"})
+			continue
+		}
+		claimed[k] = true
+		out = append(out, m)
+	}
+	return out, conflicts
+}
+
+// key folds case so that two targets differing only in case are treated
+// as one, as they are on case-insensitive filesystems.
+func key(p string) string {
+	return strings.ToLower(filepath.Clean(p))
+}
+
+func exists(p string) bool {
+	_, err := os.Lstat(p)
+	return err == nil
+}
+
+// sameFile reports whether a and b name the same file, which happens for
+// case-only renames on case-insensitive filesystems.
+func sameFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ai, bi)
+}
+
+// Log is the undo log of a reorganize run.
+type Log struct {
+	Created time.Time `json:"created"`
+	Moves   []Move    `json:"moves"`
+
+	file *os.File
+}
+
+// Create starts a log at path. Every move is appended to it, one JSON line
+// each, before it is made, so an interrupted run can still be undone.
+func Create(path string) (*Log, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{Created: time.Now(), file: f}
+	if err := l.append(struct {
+		Created time.Time `json:"created"`
+	}{l.Created}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) append(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the file of a log started with Create.
+func (l *Log) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Apply performs m and records it in the log. A log started with Create
+// gets m written to its file first.
+func (l *Log) Apply(m Move) error {
+	if l.file != nil {
+		if err := l.append(m); err != nil {
+			return fmt.Errorf("writing undo log: %w", err)
+		}
+	}
+	if err := rename(m.From, m.To); err != nil {
+		return err
+	}
+	l.Moves = append(l.Moves, m)
+	return nil
+}
+
+// Save writes the log as JSON to path.
+func (l *Log) Save(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Load reads a log written by Save or Create.
+func Load(path string) (*Log, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	l := new(Log)
+	if err := json.Unmarshal(data, l); err == nil {
+		return l, nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if n == 1 {
+			if err := json.Unmarshal(line, l); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+			continue
+		}
+		var m Move
+		if err := json.Unmarshal(line, &m); err != nil {
+			// The last line of an interrupted run may be cut short.
+			break
+		}
+		l.Moves = append(l.Moves, m)
+	}
+	return l, scanner.Err()
+}
+
+// Undo moves every file back, last move first, and removes the
+// directories the run left empty. Moves that were logged but never made
+// are passed over. Moves whose source is gone or whose original path is
+// taken again are reported through failed and skipped.
+func (l *Log) Undo(failed func(Move, error)) int {
+	undone := 0
+	for i := len(l.Moves) - 1; i >= 0; i-- {
+		m := l.Moves[i]
+		if exists(m.From) && !exists(m.To) {
+			continue
+		}
+		if exists(m.From) && !sameFile(m.From, m.To) {
+			failed(m, fmt.Errorf("%s already exists", m.From))
+			continue
+		}
+		if err := rename(m.To, m.From); err != nil {
+			failed(m, err)
+			continue
+		}
+		RemoveEmptyDirs(filepath.Dir(m.To), m.Root)
+		undone++
+	}
+	return undone
+}
+
+func rename(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// RemoveEmptyDirs removes dir and then each parent that is left empty,
+// stopping at root, which is never removed. Without a root only dir is
+// considered.
+func RemoveEmptyDirs(dir, root string) {
+	dir = filepath.Clean(dir)
+	root = filepath.Clean(root)
+	for {
+		if root != "." {
+			rel, err := filepath.Rel(root, dir)
+			if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+				return
+			}
+		}
+		if os.Remove(dir) != nil {
+			return
+		}
+		if root == "." {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
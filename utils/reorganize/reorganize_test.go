@@ -0,0 +1,113 @@
+package reorganize
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func touch(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(path), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	root := t.TempDir()
+	a := filepath.Join(root, "Old", "01. A.m4a")
+	b := filepath.Join(root, "Old", "02. B.m4a")
+	c := filepath.Join(root, "Old", "03. C.m4a")
+	taken := filepath.Join(root, "New", "03. C.m4a")
+	for _, p := range []string{a, b, c, taken} {
+		touch(t, p)
+	}
+	same := filepath.Join(root, "New", "A.m4a")
+	moves, conflicts := Plan([]Move{
+		{From: a, To: same},
+		{From: b, To: same},
+		{From: c, To: taken},
+		{From: a, To: a},
+	})
+	if len(moves) != 1 || moves[0].From != a {
+		t.Fatalf("moves = %+v", moves)
+	}
+	if len(conflicts) != 2 || conflicts[0].From != b || conflicts[1].From != c {
+		t.Fatalf("conflicts = %+v", conflicts)
+	}
+}
+
+func TestApplyUndo(t *testing.T) {
+	root := t.TempDir()
+	from := filepath.Join(root, "Artist", "Album", "01. Song.m4a")
+	lrc := filepath.Join(root, "Artist", "Album", "01. Song.lrc")
+	touch(t, from)
+	touch(t, lrc)
+	to := filepath.Join(root, "Artist", "2020 - Album", "01 Song.m4a")
+	toLrc := filepath.Join(root, "Artist", "2020 - Album", "01 Song.lrc")
+
+	l := &Log{}
+	for _, m := range []Move{{From: from, To: to, Root: root}, {From: lrc, To: toLrc, Root: root}} {
+		if err := l.Apply(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	RemoveEmptyDirs(filepath.Dir(from), root)
+	if exists(filepath.Dir(from)) || !exists(filepath.Join(root, "Artist")) {
+		t.Fatal("expected only the old album folder to be removed")
+	}
+
+	logPath := filepath.Join(root, "undo.json")
+	if err := l.Save(logPath); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := loaded.Undo(func(m Move, err error) { t.Errorf("undo %s: %v", m.To, err) })
+	if n != 2 || !exists(from) || !exists(lrc) || exists(filepath.Dir(to)) {
+		t.Fatalf("undo restored %d moves", n)
+	}
+	if !exists(root) {
+		t.Fatal("root removed")
+	}
+}
+
+func TestCreateInterrupted(t *testing.T) {
+	root := t.TempDir()
+	moved := filepath.Join(root, "Old", "01. A.m4a")
+	left := filepath.Join(root, "Old", "02. B.m4a")
+	touch(t, moved)
+	touch(t, left)
+
+	logPath := filepath.Join(root, "undo.jsonl")
+	l, err := Create(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Apply(Move{From: moved, To: filepath.Join(root, "New", "A.m4a"), Root: root}); err != nil {
+		t.Fatal(err)
+	}
+	// Logged, then interrupted before the file was moved.
+	if err := l.append(Move{From: left, To: filepath.Join(root, "New", "B.m4a"), Root: root}); err != nil {
+		t.Fatal(err)
+	}
+	l.file.WriteString(`{"from":"cut`)
+	l.Close()
+
+	loaded, err := Load(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Moves) != 2 || loaded.Created.IsZero() {
+		t.Fatalf("loaded %+v", loaded)
+	}
+	n := loaded.Undo(func(m Move, err error) { t.Errorf("undo %s: %v", m.To, err) })
+	if n != 1 || !exists(moved) || !exists(left) || exists(filepath.Join(root, "New")) {
+		t.Fatalf("undo restored %d moves", n)
+	}
+}
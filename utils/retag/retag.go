@@ -0,0 +1,186 @@
+// Package retag compares the tags of existing downloads with the tags the
+// current metadata policy would write for them.
+package retag
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zhaarey/go-mp4tag"
+)
+
+// Change is one tag whose value differs. An empty Old means the tag is
+// added, an empty New that it is removed.
+type Change struct {
+	Key string
+	Old string
+	New string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Key, show(c.Old), show(c.New))
+}
+
+func show(v string) string {
+	if v == "" {
+		return "(none)"
+	}
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	if r := []rune(v); len(r) > 60 {
+		v = string(r[:57]) + "..."
+	}
+	return strconv.Quote(v)
+}
+
+// Diff lists the tags to change so that current matches desired. Tags
+// missing from desired are only removed when managed reports them as
+// owned by the metadata policy; everything else is left alone.
+func Diff(current, desired map[string]string, managed func(key string) bool) []Change {
+	var out []Change
+	for key, value := range desired {
+		if current[key] != value {
+			out = append(out, Change{Key: key, Old: current[key], New: value})
+		}
+	}
+	for key, value := range current {
+		if _, ok := desired[key]; !ok && value != "" && managed(key) {
+			out = append(out, Change{Key: key, Old: value})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// TrackRef identifies a track within an album.
+type TrackRef struct {
+	ISRC  string
+	Disc  int
+	Track int
+}
+
+// Match returns the index of want in tracks: by ISRC when it is unique in
+// the album, otherwise by disc and track number. It returns -1 when no
+// track matches.
+func Match(tracks []TrackRef, want TrackRef) int {
+	if want.ISRC != "" {
+		found := -1
+		for i, t := range tracks {
+			if !strings.EqualFold(t.ISRC, want.ISRC) {
+				continue
+			}
+			if found >= 0 {
+				found = -1
+				break
+			}
+			found = i
+		}
+		if found >= 0 {
+			return found
+		}
+	}
+	if want.Track == 0 {
+		return -1
+	}
+	disc := want.Disc
+	if disc == 0 {
+		disc = 1
+	}
+	for i, t := range tracks {
+		if t.Track == want.Track && (t.Disc == disc || t.Disc == 0) {
+			return i
+		}
+	}
+	return -1
+}
+
+// MP4Fields flattens the tags go-mp4tag writes into a map keyed by the
+// names its Write method accepts for deletion; custom items are keyed as
+// "custom:NAME". Zero values are left out, as go-mp4tag does not write
+// them. Pictures are not included.
+func MP4Fields(t *mp4tag.MP4Tags) map[string]string {
+	out := make(map[string]string)
+	set := func(key, value string) {
+		if value != "" {
+			out[key] = value
+		}
+	}
+	num := func(key string, n int64) {
+		if n > 0 {
+			out[key] = strconv.FormatInt(n, 10)
+		}
+	}
+	set("album", t.Album)
+	set("albumsort", t.AlbumSort)
+	set("albumartist", t.AlbumArtist)
+	set("albumartistsort", t.AlbumArtistSort)
+	set("artist", t.Artist)
+	set("artistsort", t.ArtistSort)
+	set("composer", t.Composer)
+	set("composersort", t.ComposerSort)
+	set("copyright", t.Copyright)
+	set("customgenre", t.CustomGenre)
+	set("date", t.Date)
+	set("lyrics", t.Lyrics)
+	set("publisher", t.Publisher)
+	set("title", t.Title)
+	set("titlesort", t.TitleSort)
+	num("discnumber", int64(t.DiscNumber))
+	num("disctotal", int64(t.DiscTotal))
+	num("tracknumber", int64(t.TrackNumber))
+	num("tracktotal", int64(t.TrackTotal))
+	num("itunesalbumid", int64(t.ItunesAlbumID))
+	num("itunesartistid", int64(t.ItunesArtistID))
+	switch t.ItunesAdvisory {
+	case mp4tag.ItunesAdvisoryExplicit:
+		out["itunesadvisory"] = "explicit"
+	case mp4tag.ItunesAdvisoryClean:
+		out["itunesadvisory"] = "clean"
+	}
+	for key, value := range t.Custom {
+		set("custom:"+strings.ToUpper(key), value)
+	}
+	return out
+}
+
+// FFprobeTags returns the format tags ffprobe reports for an m4a carrying
+// t, which is what FLAC metadata is built from after conversion.
+func FFprobeTags(t *mp4tag.MP4Tags) map[string]string {
+	out := make(map[string]string)
+	set := func(key, value string) {
+		if value != "" {
+			out[key] = value
+		}
+	}
+	fraction := func(n, total int16) string {
+		switch {
+		case n <= 0:
+			return ""
+		case total > 0:
+			return fmt.Sprintf("%d/%d", n, total)
+		}
+		return strconv.Itoa(int(n))
+	}
+	set("title", t.Title)
+	set("sort_name", t.TitleSort)
+	set("artist", t.Artist)
+	set("sort_artist", t.ArtistSort)
+	set("album", t.Album)
+	set("sort_album", t.AlbumSort)
+	set("album_artist", t.AlbumArtist)
+	set("sort_album_artist", t.AlbumArtistSort)
+	set("composer", t.Composer)
+	set("sort_composer", t.ComposerSort)
+	set("genre", t.CustomGenre)
+	set("date", t.Date)
+	set("copyright", t.Copyright)
+	set("publisher", t.Publisher)
+	set("lyrics", t.Lyrics)
+	set("track", fraction(t.TrackNumber, t.TrackTotal))
+	set("disc", fraction(t.DiscNumber, t.DiscTotal))
+	for key, value := range t.Custom {
+		set(strings.ToLower(key), value)
+	}
+	return out
+}
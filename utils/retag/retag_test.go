@@ -0,0 +1,62 @@
+package retag
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zhaarey/go-mp4tag"
+)
+
+func TestDiff(t *testing.T) {
+	current := map[string]string{"title": "Song", "artist": "A & B", "custom:ENCODER": "x", "custom:LABEL": "Old"}
+	desired := map[string]string{"title": "Song", "artist": "A, B", "album": "Album"}
+	managed := func(key string) bool { return key == "custom:LABEL" }
+	var got []string
+	for _, c := range Diff(current, desired, managed) {
+		got = append(got, c.String())
+	}
+	want := []string{
+		`album: (none) -> "Album"`,
+		`artist: "A & B" -> "A, B"`,
+		`custom:LABEL: "Old" -> (none)`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("diff = %q", got)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tracks := []TrackRef{
+		{ISRC: "USAAA0000001", Disc: 1, Track: 1},
+		{ISRC: "USAAA0000002", Disc: 1, Track: 2},
+		{ISRC: "USAAA0000002", Disc: 2, Track: 1},
+	}
+	if i := Match(tracks, TrackRef{ISRC: "usaaa0000001"}); i != 0 {
+		t.Fatalf("isrc match = %d", i)
+	}
+	// A repeated ISRC falls back to the track position.
+	if i := Match(tracks, TrackRef{ISRC: "USAAA0000002", Disc: 2, Track: 1}); i != 2 {
+		t.Fatalf("position match = %d", i)
+	}
+	if i := Match(tracks, TrackRef{Track: 3}); i != -1 {
+		t.Fatalf("expected no match, got %d", i)
+	}
+}
+
+func TestFields(t *testing.T) {
+	tags := &mp4tag.MP4Tags{
+		Title:          "Song",
+		TrackNumber:    3,
+		TrackTotal:     12,
+		ItunesAdvisory: mp4tag.ItunesAdvisoryExplicit,
+		Custom:         map[string]string{"Isrc": "USAAA0000001"},
+	}
+	f := MP4Fields(tags)
+	if f["title"] != "Song" || f["tracknumber"] != "3" || f["itunesadvisory"] != "explicit" || f["custom:ISRC"] != "USAAA0000001" || f["discnumber"] != "" {
+		t.Fatalf("fields = %v", f)
+	}
+	p := FFprobeTags(tags)
+	if p["track"] != "3/12" || p["isrc"] != "USAAA0000001" {
+		t.Fatalf("ffprobe tags = %v", p)
+	}
+}
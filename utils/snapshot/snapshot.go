@@ -0,0 +1,233 @@
+// Package snapshot records what the catalog said about an album when it
+// was downloaded, so that remasters, reissues and added bonus tracks can
+// be found later.
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileName is the snapshot kept in each album folder.
+const FileName = ".album-snapshot.json"
+
+// Track is the catalog state of one track. File is the name of the
+// downloaded file in the album folder, or empty when the track was not
+// downloaded.
+type Track struct {
+	ID          string   `json:"id"`
+	Disc        int      `json:"disc"`
+	Number      int      `json:"track"`
+	Name        string   `json:"name"`
+	ISRC        string   `json:"isrc,omitempty"`
+	DurationMS  int      `json:"duration_ms"`
+	AudioTraits []string `json:"audio_traits,omitempty"`
+	Variants    []string `json:"variants,omitempty"`
+	Quality     string   `json:"quality,omitempty"`
+	File        string   `json:"file,omitempty"`
+}
+
+type Album struct {
+	ID                 string    `json:"id"`
+	Storefront         string    `json:"storefront"`
+	Artist             string    `json:"artist"`
+	Name               string    `json:"name"`
+	Codec              string    `json:"codec"`
+	TrackCount         int       `json:"track_count"`
+	AppleDigitalMaster bool      `json:"apple_digital_master"`
+	Updated            time.Time `json:"updated"`
+	Tracks             []Track   `json:"tracks"`
+}
+
+func Load(dir string) (*Album, error) {
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	if err != nil {
+		return nil, err
+	}
+	var a Album
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, fmt.Errorf("%s: %v", FileName, err)
+	}
+	return &a, nil
+}
+
+func (a *Album) Save(dir string) error {
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, FileName), append(data, '\n'), 0644)
+}
+
+// Find returns the folders below root that hold a snapshot.
+func Find(root string) ([]string, error) {
+	var dirs []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && d.Name() == FileName {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+		return nil
+	})
+	sort.Strings(dirs)
+	return dirs, err
+}
+
+// Merge combines the snapshot of a new download with the previous one.
+// Tracks that were not downloaded this time keep their old entry when
+// they have a file, since that file still reflects the old state. Old
+// tracks the catalog no longer lists are kept while they have a file.
+func Merge(old, cur *Album) *Album {
+	if old == nil {
+		return cur
+	}
+	byID := make(map[string]Track, len(old.Tracks))
+	for _, t := range old.Tracks {
+		byID[t.ID] = t
+	}
+	merged := *cur
+	merged.Tracks = nil
+	listed := make(map[string]bool, len(cur.Tracks))
+	for _, t := range cur.Tracks {
+		listed[t.ID] = true
+		if prev, ok := byID[t.ID]; ok && t.File == "" && prev.File != "" {
+			t = prev
+		}
+		merged.Tracks = append(merged.Tracks, t)
+	}
+	for _, t := range old.Tracks {
+		if !listed[t.ID] && t.File != "" {
+			merged.Tracks = append(merged.Tracks, t)
+		}
+	}
+	return &merged
+}
+
+const (
+	Added        = "new track"
+	Removed      = "removed track"
+	Changed      = "changed track"
+	AlbumChanged = "album changed"
+)
+
+// Change is one difference between a snapshot and the current catalog.
+// Position is the 1-based position of the track in the current album, or 0
+// for removed tracks and album-wide changes.
+type Change struct {
+	Kind     string
+	Position int
+	Detail   string
+	// File is the downloaded file of a changed or removed track.
+	File string
+}
+
+// Diff compares the snapshot old with the current catalog state cur.
+// Tracks are paired by ID, then by disc and track number, so a track whose
+// audio was swapped under a new ID shows up as changed.
+func Diff(old, cur *Album) []Change {
+	var changes []Change
+	if old.TrackCount != cur.TrackCount {
+		changes = append(changes, Change{Kind: AlbumChanged, Detail: fmt.Sprintf("track count %d -> %d", old.TrackCount, cur.TrackCount)})
+	}
+	if old.AppleDigitalMaster != cur.AppleDigitalMaster {
+		changes = append(changes, Change{Kind: AlbumChanged, Detail: fmt.Sprintf("Apple Digital Master %t -> %t", old.AppleDigitalMaster, cur.AppleDigitalMaster)})
+	}
+
+	used := make([]bool, len(old.Tracks))
+	match := func(ok func(Track) bool) int {
+		for i, t := range old.Tracks {
+			if !used[i] && ok(t) {
+				used[i] = true
+				return i
+			}
+		}
+		return -1
+	}
+	pairs := make([]int, len(cur.Tracks))
+	for i, t := range cur.Tracks {
+		pairs[i] = match(func(o Track) bool { return o.ID == t.ID })
+	}
+	for i, t := range cur.Tracks {
+		if pairs[i] < 0 {
+			pairs[i] = match(func(o Track) bool { return o.Disc == t.Disc && o.Number == t.Number })
+		}
+	}
+
+	for i, t := range cur.Tracks {
+		if pairs[i] < 0 {
+			changes = append(changes, Change{Kind: Added, Position: i + 1, Detail: t.Name})
+			continue
+		}
+		o := old.Tracks[pairs[i]]
+		if diff := trackDiff(o, t); len(diff) > 0 {
+			changes = append(changes, Change{Kind: Changed, Position: i + 1, Detail: t.Name + ": " + strings.Join(diff, ", "), File: o.File})
+		}
+	}
+	for i, o := range old.Tracks {
+		if !used[i] {
+			changes = append(changes, Change{Kind: Removed, Detail: o.Name, File: o.File})
+		}
+	}
+	return changes
+}
+
+func trackDiff(o, t Track) []string {
+	var out []string
+	if o.ID != t.ID {
+		out = append(out, fmt.Sprintf("ID %s -> %s", o.ID, t.ID))
+	}
+	if !strings.EqualFold(o.ISRC, t.ISRC) {
+		out = append(out, fmt.Sprintf("ISRC %s -> %s", o.ISRC, t.ISRC))
+	}
+	if d := t.DurationMS - o.DurationMS; d > 1000 || d < -1000 {
+		out = append(out, fmt.Sprintf("duration %s -> %s", ms(o.DurationMS), ms(t.DurationMS)))
+	}
+	if !sameSet(o.AudioTraits, t.AudioTraits) {
+		out = append(out, fmt.Sprintf("audio traits [%s] -> [%s]", strings.Join(o.AudioTraits, " "), strings.Join(t.AudioTraits, " ")))
+	}
+	// Variants are unknown when the master playlist could not be read.
+	if len(o.Variants) > 0 && len(t.Variants) > 0 && !sameSet(o.Variants, t.Variants) {
+		out = append(out, "variants changed")
+	}
+	return out
+}
+
+// Downloads returns the positions worth downloading again: new tracks
+// and changed tracks that had been downloaded.
+func Downloads(changes []Change) []int {
+	var out []int
+	for _, c := range changes {
+		if c.Kind == Added || (c.Kind == Changed && c.File != "") {
+			out = append(out, c.Position)
+		}
+	}
+	return out
+}
+
+func ms(v int) string {
+	return (time.Duration(v) * time.Millisecond).Round(time.Second).String()
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	x := append([]string{}, a...)
+	y := append([]string{}, b...)
+	sort.Strings(x)
+	sort.Strings(y)
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
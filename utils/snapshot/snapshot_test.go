@@ -0,0 +1,54 @@
+package snapshot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	old := &Album{TrackCount: 3, Tracks: []Track{
+		{ID: "1", Disc: 1, Number: 1, Name: "One", ISRC: "USAAA0000001", DurationMS: 200000, AudioTraits: []string{"lossless"}, File: "01. One.m4a"},
+		{ID: "2", Disc: 1, Number: 2, Name: "Two", ISRC: "USAAA0000002", DurationMS: 180000, File: "02. Two.m4a"},
+		{ID: "3", Disc: 1, Number: 3, Name: "Three", ISRC: "USAAA0000003", DurationMS: 240000},
+	}}
+	cur := &Album{TrackCount: 4, AppleDigitalMaster: true, Tracks: []Track{
+		{ID: "1", Disc: 1, Number: 1, Name: "One", ISRC: "USAAA0000001", DurationMS: 200400, AudioTraits: []string{"lossless", "hi-res-lossless"}},
+		{ID: "9", Disc: 1, Number: 2, Name: "Two", ISRC: "USAAA0000092", DurationMS: 185000},
+		{ID: "3", Disc: 1, Number: 3, Name: "Three", ISRC: "usaaa0000003", DurationMS: 240000},
+		{ID: "4", Disc: 1, Number: 4, Name: "Bonus", ISRC: "USAAA0000004", DurationMS: 150000},
+	}}
+	changes := Diff(old, cur)
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.Kind+"|"+c.Detail)
+	}
+	want := []string{
+		"album changed|track count 3 -> 4",
+		"album changed|Apple Digital Master false -> true",
+		"changed track|One: audio traits [lossless] -> [lossless hi-res-lossless]",
+		"changed track|Two: ID 2 -> 9, ISRC USAAA0000002 -> USAAA0000092, duration 3m0s -> 3m5s",
+		"new track|Bonus",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("changes:\n%s", strings.Join(got, "\n"))
+	}
+	if d := Downloads(changes); len(d) != 3 || d[0] != 1 || d[1] != 2 || d[2] != 4 {
+		t.Fatalf("downloads = %v", d)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	old := &Album{Tracks: []Track{
+		{ID: "1", DurationMS: 1000, File: "01. One.m4a"},
+		{ID: "2", DurationMS: 2000},
+		{ID: "5", File: "05. Gone.m4a"},
+	}}
+	cur := &Album{Tracks: []Track{
+		{ID: "1", DurationMS: 1500},
+		{ID: "2", DurationMS: 2500, File: "02. Two.m4a"},
+	}}
+	m := Merge(old, cur)
+	if len(m.Tracks) != 3 || m.Tracks[0].DurationMS != 1000 || m.Tracks[1].File != "02. Two.m4a" || m.Tracks[2].ID != "5" {
+		t.Fatalf("merged = %+v", m.Tracks)
+	}
+}
@@ -7,6 +7,21 @@ type MetadataCustomTagRule struct {
 	SourceFormats []string `yaml:"source-formats"`
 }
 
+// ConvertProfile is one conversion target. A downloaded track is converted
+// for every profile whose formats match its source format.
+type ConvertProfile struct {
+	Name          string   `yaml:"name"`
+	Codec         string   `yaml:"codec"`
+	Bitrate       string   `yaml:"bitrate"`
+	Quality       string   `yaml:"quality"`
+	MaxSampleRate int      `yaml:"max-sample-rate"`
+	MaxBitDepth   int      `yaml:"max-bit-depth"`
+	Formats       []string `yaml:"formats"`
+	SaveFolder    string   `yaml:"save-folder"`
+	FileFormat    string   `yaml:"file-format"`
+	ExtraArgs     string   `yaml:"extra-args"`
+}
+
 type ConfigSet struct {
 	Storefront                 string                  `yaml:"storefront"`
 	MediaUserToken             string                  `yaml:"media-user-token"`
@@ -21,15 +36,34 @@ type ConfigSet struct {
 	EmbedCover                 bool                    `yaml:"embed-cover"`
 	SaveCoverFile              bool                    `yaml:"save-cover-file"`
 	SaveArtistCover            bool                    `yaml:"save-artist-cover"`
+	SaveArtistBanner           bool                    `yaml:"save-artist-banner"`
+	SaveMotionTallArtwork      bool                    `yaml:"save-motion-tall-artwork"`
+	SavePlaylistArtwork        bool                    `yaml:"save-playlist-artwork"`
+	ArtworkProfiles            []string                `yaml:"artwork-profiles"`
 	CoverSize                  string                  `yaml:"cover-size"`
 	CoverFormat                string                  `yaml:"cover-format"`
+	EmbedCoverSize             string                  `yaml:"embed-cover-size"`
+	CoverJPEGQuality           int                     `yaml:"cover-jpeg-quality"`
+	CoverProgressive           bool                    `yaml:"cover-progressive"`
+	CoverStripEXIF             bool                    `yaml:"cover-strip-exif"`
+	CoverCacheFolder           string                  `yaml:"cover-cache-folder"`
+	CoverCacheHardlink         bool                    `yaml:"cover-cache-hardlink"`
+	LinkMode                   string                  `yaml:"link-mode"`
+	LinkPlaylistTracks         bool                    `yaml:"link-playlist-tracks"`
 	AlacSaveFolder             string                  `yaml:"alac-save-folder"`
 	AtmosSaveFolder            string                  `yaml:"atmos-save-folder"`
+	Ac3SaveFolder              string                  `yaml:"ac3-save-folder"`
 	AacSaveFolder              string                  `yaml:"aac-save-folder"`
+	AacVariantFolders          map[string]string       `yaml:"aac-variant-folders"`
 	AlbumFolderFormat          string                  `yaml:"album-folder-format"`
 	PlaylistFolderFormat       string                  `yaml:"playlist-folder-format"`
 	ArtistFolderFormat         string                  `yaml:"artist-folder-format"`
 	SongFileFormat             string                  `yaml:"song-file-format"`
+	AlbumFolderFormats         map[string]string       `yaml:"album-folder-formats"`
+	SongFileFormats            map[string]string       `yaml:"song-file-formats"`
+	AllowUnknownPlaceholders   bool                    `yaml:"allow-unknown-placeholders"`
+	FilenameProfile            string                  `yaml:"filename-profile"`
+	FilenameNormalization      string                  `yaml:"filename-normalization"`
 	ExplicitChoice             string                  `yaml:"explicit-choice"`
 	CleanChoice                string                  `yaml:"clean-choice"`
 	AppleMasterChoice          string                  `yaml:"apple-master-choice"`
@@ -41,6 +75,10 @@ type ConfigSet struct {
 	AacType                    string                  `yaml:"aac-type"`
 	AlacMax                    int                     `yaml:"alac-max"`
 	AtmosMax                   int                     `yaml:"atmos-max"`
+	Ac3Max                     int                     `yaml:"ac3-max"`
+	QualityPolicy              string                  `yaml:"quality-policy"`
+	QualityPolicyRoots         map[string]string       `yaml:"quality-policy-roots"`
+	DownloadFormats            string                  `yaml:"download-formats"`
 	LimitMax                   int                     `yaml:"limit-max"`
 	UseSongInfoForPlaylist     bool                    `yaml:"use-songinfo-for-playlist"`
 	DlAlbumcoverForPlaylist    bool                    `yaml:"dl-albumcover-for-playlist"`
@@ -56,6 +94,15 @@ type ConfigSet struct {
 	ConvertExtraArgs           string                  `yaml:"convert-extra-args"`
 	ConvertWarnLossyToLossless bool                    `yaml:"convert-warn-lossy-to-lossless"`
 	ConvertSkipLossyToLossless bool                    `yaml:"convert-skip-lossy-to-lossless"`
+	ConvertProfiles            []ConvertProfile        `yaml:"convert-profiles"`
+	LoudnessAnalysis           bool                    `yaml:"loudness-analysis"`
+	AlbumImage                 string                  `yaml:"album-image"`
+	AlbumImageRemoveTracks     bool                    `yaml:"album-image-remove-tracks"`
+	VerifyDownloads            bool                    `yaml:"verify-downloads"`
+	ChecksumManifest           bool                    `yaml:"checksum-manifest"`
+	PreviewCheck               string                  `yaml:"preview-check"`
+	PreviewCheckThreshold      float64                 `yaml:"preview-check-threshold"`
+	AlbumSnapshot              bool                    `yaml:"album-snapshot"`
 	MetadataTagsM4a            []string                `yaml:"metadata-tags-m4a"`
 	MetadataTagsFlac           []string                `yaml:"metadata-tags-flac"`
 	MetadataAtmosPrefix        *bool                   `yaml:"metadata-atmos-prefix"`
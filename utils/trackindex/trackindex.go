@@ -0,0 +1,99 @@
+package trackindex
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const FileName = ".track-index.json"
+
+// flushEvery bounds how many new entries are held before the file is
+// written, so an interrupted run loses at most that many.
+const flushEvery = 50
+
+// Index remembers where each downloaded track lives below a save root so
+// later playlist or station downloads can link to it instead of fetching
+// the same audio again. Paths are stored relative to the root.
+type Index struct {
+	root    string
+	mu      sync.Mutex
+	entries map[string]string
+	pending int
+}
+
+func Load(root string) *Index {
+	idx := &Index{root: root, entries: make(map[string]string)}
+	data, err := os.ReadFile(filepath.Join(root, FileName))
+	if err == nil {
+		_ = json.Unmarshal(data, &idx.entries)
+	}
+	return idx
+}
+
+func Key(trackID, codec string) string {
+	return strings.ToUpper(strings.TrimSpace(codec)) + ":" + strings.TrimSpace(trackID)
+}
+
+// Lookup returns the absolute path recorded for key if the file still
+// exists.
+func (i *Index) Lookup(key string) (string, bool) {
+	i.mu.Lock()
+	rel, ok := i.entries[key]
+	i.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+	path := filepath.Join(i.root, filepath.FromSlash(rel))
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// Record remembers path for key. The file is written every flushEvery new
+// entries and by Flush.
+func (i *Index) Record(key, path string) error {
+	rel, err := filepath.Rel(i.root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.entries[key] == filepath.ToSlash(rel) {
+		return nil
+	}
+	i.entries[key] = filepath.ToSlash(rel)
+	i.pending++
+	if i.pending < flushEvery {
+		return nil
+	}
+	return i.save()
+}
+
+// Flush writes entries recorded since the last write.
+func (i *Index) Flush() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.pending == 0 {
+		return nil
+	}
+	return i.save()
+}
+
+func (i *Index) save() error {
+	data, err := json.MarshalIndent(i.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(i.root, os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(i.root, FileName), data, 0644); err != nil {
+		return err
+	}
+	i.pending = 0
+	return nil
+}
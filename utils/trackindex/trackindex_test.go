@@ -0,0 +1,67 @@
+package trackindex
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	if got := Key(" 123 ", "alac"); got != "ALAC:123" {
+		t.Errorf("Key = %q", got)
+	}
+}
+
+func TestRecordLookup(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "Artist", "Album", "01. Song.m4a")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("audio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := Load(root)
+	key := Key("123", "ALAC")
+	if err := idx.Record(key, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Record("X:1", filepath.Join(filepath.Dir(root), "elsewhere.m4a")); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := idx.Lookup(key); !ok || got != path {
+		t.Errorf("Lookup = %q, %v", got, ok)
+	}
+	if _, ok := idx.Lookup("X:1"); ok {
+		t.Error("path outside the root was recorded")
+	}
+	if _, err := os.Stat(filepath.Join(root, FileName)); !os.IsNotExist(err) {
+		t.Errorf("index written before Flush: %v", err)
+	}
+	if err := idx.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := Load(root).Lookup(key); !ok || got != path {
+		t.Errorf("reloaded Lookup = %q, %v", got, ok)
+	}
+
+	os.Remove(path)
+	if _, ok := idx.Lookup(key); ok {
+		t.Error("Lookup returned a removed file")
+	}
+}
+
+func TestRecordFlushesInBatches(t *testing.T) {
+	root := t.TempDir()
+	idx := Load(root)
+	for i := 0; i < flushEvery; i++ {
+		if err := idx.Record(Key(strconv.Itoa(i), "AAC"), filepath.Join(root, "song.m4a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, FileName)); err != nil {
+		t.Errorf("index not written after %d entries: %v", flushEvery, err)
+	}
+}